@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The admin socket: how the CLI talks to the running agent.
+//
+// A Unix socket in the state directory, owned by the service account and
+// mode 0600, so only that account and root can use it — the same people who
+// could read the device key anyway. Each connection carries one JSON request
+// line and gets one JSON response line back.
+//
+// Commands:
+//
+//	status        connection, server, sessions, in-flight update, recent errors
+//	reconnect     drop the control connection and dial again at once
+//	reload        re-read the device key and the service's settings.json (host,
+//	              update source, update policy), then reconnect with them
+//	dropSession   detach the agent from a session; a tmux session keeps running
+
+const (
+	adminSocketName = "agent.sock"
+	adminTimeout    = 5 * time.Second
+	maxRecentErrors = 10
+)
+
+type adminRequest struct {
+	Command   string `json:"command"`
+	SessionID string `json:"sessionId,omitempty"`
+}
+
+type adminResponse struct {
+	Error string `json:"error,omitempty"`
+	// Message, when set, is printed in place of "ok".
+	Message string       `json:"message,omitempty"`
+	Status  *adminStatus `json:"status,omitempty"`
+}
+
+type adminStatus struct {
+	PID        int             `json:"pid"`
+	Version    string          `json:"version"`
+	Connection connectionState `json:"connection"`
+	Sessions   []SessionInfo   `json:"sessions"`
+	// Update is the release an in-flight update is installing ("latest"
+	// when unpinned); empty when none is.
+	Update       string       `json:"update,omitempty"`
+	RecentErrors []agentError `json:"recentErrors,omitempty"`
+}
+
+// agentError is one of the recent failures the admin socket reports.
+type agentError struct {
+	Time    int64  `json:"time"`
+	Context string `json:"context"`
+	Error   string `json:"error"`
+}
+
+var (
+	recentErrorsMu sync.Mutex
+	recentErrors   []agentError
+)
+
+// recordAgentError keeps a failure for `status` to show. Only the last few
+// are kept, in memory: they matter while the agent is running, and the log
+// has the rest.
+func recordAgentError(context string, err error) {
+	if err == nil {
+		return
+	}
+	recentErrorsMu.Lock()
+	defer recentErrorsMu.Unlock()
+	recentErrors = append(recentErrors, agentError{Time: time.Now().Unix(), Context: context, Error: err.Error()})
+	if len(recentErrors) > maxRecentErrors {
+		recentErrors = recentErrors[len(recentErrors)-maxRecentErrors:]
+	}
+}
+
+func snapshotRecentErrors() []agentError {
+	recentErrorsMu.Lock()
+	defer recentErrorsMu.Unlock()
+	return append([]agentError(nil), recentErrors...)
+}
+
+// serveAdminSocket listens on the admin socket until the returned stop is
+// called.
+func serveAdminSocket(ctl *agentControl) (func(), error) {
+	path, err := agentStatePath(adminSocketName)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	// A socket left by an agent that did not exit cleanly would make Listen
+	// fail. The single-instance lock has already established that no other
+	// agent is running, so whatever is there is stale.
+	_ = os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveAdminConn(conn, ctl)
+		}
+	}()
+	return func() {
+		_ = ln.Close()
+		_ = os.Remove(path)
+	}, nil
+}
+
+func serveAdminConn(conn net.Conn, ctl *agentControl) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(adminTimeout))
+
+	var req adminRequest
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &req)
+	}
+	var resp adminResponse
+	if err != nil {
+		resp.Error = fmt.Sprintf("malformed request: %v", err)
+	} else if err := handleAdminRequest(ctl, req, &resp); err != nil {
+		resp.Error = err.Error()
+	}
+	_ = json.NewEncoder(conn).Encode(resp)
+}
+
+func handleAdminRequest(ctl *agentControl, req adminRequest, resp *adminResponse) error {
+	switch req.Command {
+	case "status":
+		status := adminStatus{
+			PID:          os.Getpid(),
+			Version:      getAgentVersion(),
+			Connection:   currentConnectionState(),
+			Sessions:     ctl.sessions.inventory(),
+			RecentErrors: snapshotRecentErrors(),
+		}
+		if updateInProgress.Load() {
+			status.Update = "latest"
+			if target, _ := updateTarget.Load().(string); target != "" {
+				status.Update = target
+			}
+		}
+		resp.Status = &status
+	case "reconnect":
+		log.Printf("reconnecting at the admin socket's request")
+		ctl.reconnect()
+	case "reload":
+		settings, err := loadServiceSettings()
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			log.Printf("reloading the device key and reconnecting at the admin socket's request")
+			ctl.reload(nil)
+			resp.Message = "Re-read the device key. This agent has no " + serviceSettingsFile + " (it was not\n" +
+				"installed with `up`), so its other settings change only on a restart."
+		case err != nil:
+			return fmt.Errorf("nothing reloaded: %w", err)
+		default:
+			log.Printf("reloading the device key and settings and reconnecting at the admin socket's request")
+			ctl.reload(&settings)
+			resp.Message = "Re-read the device key and " + serviceSettingsFile + "; reconnecting with them."
+		}
+	case "dropSession":
+		if req.SessionID == "" {
+			return errors.New("dropSession needs a sessionId")
+		}
+		session := ctl.sessions.get(req.SessionID)
+		if session == nil || session.current() == nil {
+			return fmt.Errorf("this agent is not attached to session %s", req.SessionID)
+		}
+		// Ending the PTY sends the server the same "sessionExited" a
+		// detach would, and the next attach starts afresh.
+		log.Printf("dropping session %s at the admin socket's request", req.SessionID)
+		session.finish()
+	default:
+		return fmt.Errorf("unknown command %q", req.Command)
+	}
+	return nil
+}
+
+// runAdminCommand is `spectre-agent admin`: one request, with the answer
+// printed.
+func runAdminCommand(req adminRequest) error {
+	resp, err := queryAdmin(req)
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("no running agent found; is it running, and are you its user (or root)?")
+	}
+	if err != nil {
+		return fmt.Errorf("could not reach the agent: %w", err)
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	if resp.Status != nil {
+		data, _ := json.MarshalIndent(resp.Status, "", "  ")
+		fmt.Println(string(data))
+		return nil
+	}
+	if resp.Message != "" {
+		fmt.Println(resp.Message)
+		return nil
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+// adminSocketPaths lists where a running agent's socket may be: this user's
+// state directory, then the installed service's.
+func adminSocketPaths() []string {
+	candidates := []string{}
+	if path, err := agentStatePath(adminSocketName); err == nil {
+		candidates = append(candidates, path)
+	}
+	for _, home := range serviceHomes() {
+		candidates = append(candidates, filepath.Join(home, ".spectre-agent", adminSocketName))
+	}
+
+	seen := map[string]bool{}
+	paths := []string{}
+	for _, path := range candidates {
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// queryAdmin sends one request to the running agent. It reports an error
+// wrapping os.ErrNotExist when no agent is listening anywhere.
+func queryAdmin(req adminRequest) (adminResponse, error) {
+	var firstErr error
+	for _, path := range adminSocketPaths() {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		resp, err := queryAdminAt(path, req)
+		if err == nil {
+			return resp, nil
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if firstErr == nil {
+		firstErr = fmt.Errorf("no admin socket found: %w", os.ErrNotExist)
+	}
+	return adminResponse{}, firstErr
+}
+
+func queryAdminAt(path string, req adminRequest) (adminResponse, error) {
+	conn, err := net.DialTimeout("unix", path, adminTimeout)
+	if err != nil {
+		return adminResponse{}, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(adminTimeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return adminResponse{}, err
+	}
+	var resp adminResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return adminResponse{}, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func startAdminSocket(t *testing.T) *agentControl {
+	t.Helper()
+	t.Setenv("SPECTRE_AGENT_HOME", t.TempDir())
+	ctl := newAgentControl()
+	stop, err := serveAdminSocket(ctl)
+	if err != nil {
+		t.Fatalf("serveAdminSocket: %v", err)
+	}
+	t.Cleanup(stop)
+	return ctl
+}
+
+// addFakeSession registers a live session whose PTY is a pipe, so no shell or
+// tmux session is started on the machine running the tests.
+func addFakeSession(t *testing.T, ctl *agentControl, id string) *ptySession {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	t.Cleanup(func() { r.Close(); w.Close() })
+	session := newPtySession(id)
+	session.ptm = w
+	ctl.sessions.mu.Lock()
+	ctl.sessions.sessions[id] = session
+	ctl.sessions.mu.Unlock()
+	return session
+}
+
+func TestAdminSocketReportsStatus(t *testing.T) {
+	ctl := startAdminSocket(t)
+	addFakeSession(t, ctl, "11111111-2222-3333-4444-555555555555")
+	recordAgentError("update", errors.New("checksum mismatch"))
+
+	path, _ := agentStatePath(adminSocketName)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat socket: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Fatalf("socket mode = %o, want 600", perm)
+	}
+
+	resp, err := queryAdmin(adminRequest{Command: "status"})
+	if err != nil {
+		t.Fatalf("queryAdmin: %v", err)
+	}
+	if resp.Error != "" || resp.Status == nil {
+		t.Fatalf("status response = %+v", resp)
+	}
+	if resp.Status.PID != os.Getpid() {
+		t.Errorf("pid = %d, want %d", resp.Status.PID, os.Getpid())
+	}
+	found := false
+	for _, s := range resp.Status.Sessions {
+		if s.ID == "11111111-2222-3333-4444-555555555555" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("sessions = %+v, want the live session", resp.Status.Sessions)
+	}
+	errs := resp.Status.RecentErrors
+	if len(errs) == 0 || errs[len(errs)-1].Error != "checksum mismatch" {
+		t.Errorf("recent errors = %+v", errs)
+	}
+}
+
+func TestAdminSocketReconnectDropsTheLinkAndSkipsTheWait(t *testing.T) {
+	ctl := startAdminSocket(t)
+	closed := make(chan struct{})
+	conn := newSafeConn(dialTestServer(t, func(ws *websocket.Conn) {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	go func() {
+		_, _, _ = conn.conn.ReadMessage()
+		close(closed)
+	}()
+	ctl.setConn(conn)
+
+	if resp, err := queryAdmin(adminRequest{Command: "reload"}); err != nil || resp.Error != "" {
+		t.Fatalf("reload: %v %+v", err, resp)
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the control connection was not closed")
+	}
+	if !ctl.sleep(time.Minute) {
+		t.Fatal("the backoff wait was not cut short")
+	}
+	if reload, settings := ctl.takeReload(); !reload || settings != nil {
+		t.Fatalf("takeReload = %v, %+v; want a reload of the device key alone", reload, settings)
+	}
+	if reload, _ := ctl.takeReload(); reload {
+		t.Fatal("reload was reported twice")
+	}
+}
+
+// The host, update source and policy come from settings.json, as `up` wrote
+// it; the host `up` was given there, not the provisioning one in device info.
+func TestReloadAppliesTheServiceSettings(t *testing.T) {
+	ctl := startAdminSocket(t)
+	ctl.updater = newAutoUpdater(ctl, updatePolicy{})
+	oldSource, oldHost := agentUpdateSource()
+	t.Cleanup(func() { setAgentUpdateSource(oldSource, oldHost) })
+
+	policy := updatePolicy{channel: channelBeta, interval: 6 * time.Hour}
+	if err := saveServiceSettings(buildExecArgs("wss://new.example.com", updateSourceServer, policy)); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := queryAdmin(adminRequest{Command: "reload"}); err != nil || resp.Error != "" {
+		t.Fatalf("reload: %v %+v", err, resp)
+	}
+	reload, settings := ctl.takeReload()
+	if !reload || settings == nil {
+		t.Fatalf("takeReload = %v, %+v", reload, settings)
+	}
+
+	if host := applySettings(ctl, "wss://old.example.com", *settings); host != "wss://new.example.com" {
+		t.Errorf("host = %s", host)
+	}
+	if source, host := agentUpdateSource(); source != updateSourceServer || host != "wss://new.example.com" {
+		t.Errorf("update source = %s from %s", source, host)
+	}
+	select {
+	case got := <-ctl.updater.reloaded:
+		if got != policy {
+			t.Errorf("policy = %+v, want %+v", got, policy)
+		}
+	default:
+		t.Error("the updater was not handed the new policy")
+	}
+}
+
+// A settings.json that does not parse changes nothing, the key included.
+func TestReloadRefusesBrokenServiceSettings(t *testing.T) {
+	ctl := startAdminSocket(t)
+	if err := saveServiceSettings([]string{"run", "--update-channel=nightly", "--host=wss://new.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := queryAdmin(adminRequest{Command: "reload"})
+	if err != nil || !strings.Contains(resp.Error, "nothing reloaded") {
+		t.Fatalf("reload: %v %+v", err, resp)
+	}
+	if reload, _ := ctl.takeReload(); reload {
+		t.Fatal("a reload was requested")
+	}
+}
+
+// The device key is re-read from device info; the host there, from
+// provisioning, is not.
+func TestReloadReadsTheDeviceKey(t *testing.T) {
+	t.Setenv("SPECTRE_AGENT_HOME", t.TempDir())
+	running, err := ensureDeviceInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	running.DeviceKey, running.Host = "dk_old", "wss://old.example.com"
+
+	onDisk := running
+	onDisk.DeviceKey, onDisk.Host = "dk_new", "wss://new.example.com"
+	if err := saveDeviceInfo(onDisk); err != nil {
+		t.Fatal(err)
+	}
+	reloadDeviceKey(&running)
+	if running.DeviceKey != "dk_new" || running.Host != "wss://old.example.com" {
+		t.Fatalf("after reload: %+v", running)
+	}
+}
+
+func TestAdminSocketDropsASession(t *testing.T) {
+	ctl := startAdminSocket(t)
+	session := addFakeSession(t, ctl, "spectre-drop")
+
+	resp, err := queryAdmin(adminRequest{Command: "dropSession", SessionID: "spectre-drop"})
+	if err != nil || resp.Error != "" {
+		t.Fatalf("dropSession: %v %+v", err, resp)
+	}
+	if session.current() != nil {
+		t.Fatal("the session's PTY is still open")
+	}
+	if ctl.sessions.get("spectre-drop") == nil {
+		t.Fatal("the session was removed; dropping only detaches")
+	}
+}
+
+func TestAdminSocketRejectsBadRequests(t *testing.T) {
+	startAdminSocket(t)
+	for _, req := range []adminRequest{
+		{Command: "dropSession"},
+		{Command: "dropSession", SessionID: "no-such-session"},
+		{Command: "selfDestruct"},
+	} {
+		resp, err := queryAdmin(req)
+		if err != nil {
+			t.Fatalf("%+v: %v", req, err)
+		}
+		if resp.Error == "" {
+			t.Errorf("%+v succeeded, want an error", req)
+		}
+	}
+}
+
+func TestQueryAdminWithoutAnAgent(t *testing.T) {
+	t.Setenv("SPECTRE_AGENT_HOME", t.TempDir())
+	original := defaultServiceAgentHome
+	defaultServiceAgentHome = t.TempDir()
+	defer func() { defaultServiceAgentHome = original }()
+
+	if _, err := queryAdmin(adminRequest{Command: "status"}); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("err = %v, want os.ErrNotExist", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// agentControl is what the admin socket can reach inside the running agent:
+// the sessions, the live control connection, the reconnect loop's waits, and
+// the automatic updater a reload hands a new policy.
+type agentControl struct {
+	sessions *ptyManager
+	// updater is nil when the agent runs no update policy, as in tests.
+	updater *autoUpdater
+
+	mu   sync.Mutex
+	conn *safeConn
+	// wake cuts a backoff wait short. It holds at most one pending wake-up,
+	// so asking while connected makes the wait after the drop a no-op.
+	wake chan struct{}
+	// reloading is a reload the reconnect loop has yet to take, with the
+	// service's settings when it has any.
+	reloading bool
+	settings  *runSettings
+}
+
+func newAgentControl() *agentControl {
+	return &agentControl{sessions: newPtyManager(), wake: make(chan struct{}, 1)}
+}
+
+func (c *agentControl) setConn(conn *safeConn) {
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+}
+
+// currentConn is the live control connection, nil between connections.
+func (c *agentControl) currentConn() *safeConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// reload has the loop re-read the device key and, when settings is not nil,
+// switch to those settings, then reconnect.
+func (c *agentControl) reload(settings *runSettings) {
+	c.mu.Lock()
+	c.reloading, c.settings = true, settings
+	c.mu.Unlock()
+	c.reconnect()
+}
+
+// reconnect drops the control connection, if there is one, and has the loop
+// dial again without waiting out its backoff.
+func (c *agentControl) reconnect() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	if conn := c.currentConn(); conn != nil {
+		_ = conn.close()
+	}
+}
+
+// sleep waits d, or less if a reconnect is asked for. It reports whether it
+// was woken.
+func (c *agentControl) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return false
+	case <-c.wake:
+		return true
+	}
+}
+
+// takeReload reports whether a reload was asked for since the last call, and
+// the settings it brought.
+func (c *agentControl) takeReload() (bool, *runSettings) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reloading, settings := c.reloading, c.settings
+	c.reloading, c.settings = false, nil
+	return reloading, settings
+}
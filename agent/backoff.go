@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Reconnect pacing.
+//
+// Full jitter: each wait is drawn uniformly between zero and an exponentially
+// growing ceiling. Without it, every agent behind a restarted server retries
+// on the same schedule and the server takes the whole fleet's reconnects in a
+// handful of synchronized waves.
+//
+// A connection that stayed up for stablePeriod resets the ceiling, so a host
+// that was healthy for a week does not come back from a blip on a 30-second
+// wait because of a bad patch long ago.
+const (
+	backoffBase  = time.Second
+	backoffMax   = 30 * time.Second
+	stablePeriod = time.Minute
+	// A rejected credential is not going to start working in a second.
+	// Retrying at all is for the case where the server itself is at fault —
+	// a restored database, say — but it must not hammer it while it is.
+	authRejectedRetry = 15 * time.Minute
+)
+
+type reconnectBackoff struct {
+	attempt int
+	// random returns a value in [0, 1). A field so tests can pin it.
+	random func() float64
+}
+
+func newReconnectBackoff() *reconnectBackoff {
+	return &reconnectBackoff{random: rand.Float64}
+}
+
+// next returns how long to wait before the next attempt.
+func (b *reconnectBackoff) next() time.Duration {
+	ceiling := backoffMax
+	if b.attempt < 16 { // beyond this the shift would only overflow
+		if c := backoffBase << b.attempt; c < backoffMax {
+			ceiling = c
+		}
+	}
+	b.attempt++
+	return time.Duration(b.random() * float64(ceiling))
+}
+
+func (b *reconnectBackoff) reset() {
+	b.attempt = 0
+}
+
+// authRejectedError is a handshake the server refused outright because of the
+// credential, as opposed to one that never reached it.
+type authRejectedError struct {
+	status int
+	detail string
+}
+
+func (e *authRejectedError) Error() string {
+	return fmt.Sprintf("the control server rejected this machine's credential (HTTP %d)%s", e.status, e.detail)
+}
+
+// asAuthRejected classifies a failed dial by its HTTP response.
+func asAuthRejected(resp *http.Response) *authRejectedError {
+	if resp == nil {
+		return nil
+	}
+	if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+		return nil
+	}
+	return &authRejectedError{status: resp.StatusCode}
+}
+
+func isAuthRejected(err error) bool {
+	var rejected *authRejectedError
+	return errors.As(err, &rejected)
+}
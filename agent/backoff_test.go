@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReconnectBackoffCeilingGrowsAndResets(t *testing.T) {
+	b := newReconnectBackoff()
+	b.random = func() float64 { return 0.999999 } // just under each ceiling
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second}
+	for i, ceiling := range want {
+		got := b.next()
+		if got > ceiling || got < ceiling*99/100 {
+			t.Fatalf("attempt %d waited %v, want just under %v", i, got, ceiling)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if got := b.next(); got > backoffMax {
+			t.Fatalf("waited %v, beyond the %v cap", got, backoffMax)
+		}
+	}
+
+	b.reset()
+	if got := b.next(); got > backoffBase {
+		t.Fatalf("after a reset the first wait was %v, want at most %v", got, backoffBase)
+	}
+}
+
+// The point of jitter: two agents with the same history do not retry in step.
+func TestReconnectBackoffIsJittered(t *testing.T) {
+	b := newReconnectBackoff()
+	b.random = func() float64 { return 0 }
+	if got := b.next(); got != 0 {
+		t.Fatalf("full jitter allows an immediate retry, got %v", got)
+	}
+}
+
+func TestAsAuthRejected(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		err := asAuthRejected(&http.Response{StatusCode: status})
+		if err == nil || !isAuthRejected(fmt.Errorf("wrapped: %w", err)) {
+			t.Errorf("HTTP %d not treated as a rejected credential", status)
+		}
+	}
+	for _, resp := range []*http.Response{nil, {StatusCode: http.StatusBadGateway}} {
+		if asAuthRejected(resp) != nil {
+			t.Errorf("%+v treated as a rejected credential", resp)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/sidhantpanda/spectre/agent/protocol"
+)
+
+// Protocol negotiation.
+//
+// The hello an agent sends carries the protocol version it speaks and the
+// features it can offer on this host. The server's hello reply names the
+// features it wants switched on, and only those are served for the life of
+// the connection. A request for anything else is answered with an error
+// rather than acted on, so a fleet of mixed agent versions behaves the same
+// way whichever server build it talks to.
+//
+// A server from before negotiation replies with a bare hello. It gets
+// protocol 1: everything it could already ask for keeps working, including
+// the legacy "reset" alias, and it never asks for anything newer.
+
+// localCapabilities lists what this agent can offer on this host. Features
+// that depend on the host are left out where they could not work, so the
+// server does not offer the UI a button that can only fail.
+func localCapabilities() []string {
+	caps := []string{
+		protocol.FeatureDocker, protocol.FeatureLogs, protocol.FeaturePower, protocol.FeatureUpdate,
+		protocol.FeatureOutputReplay, protocol.FeatureEvents,
+	}
+	if isTmuxAvailable() {
+		caps = append(caps, protocol.FeatureTmux)
+	}
+	if runtime.GOOS == "linux" {
+		caps = append(caps, protocol.FeatureProcesses)
+	}
+	if requireSystemd() == nil {
+		caps = append(caps, protocol.FeatureSystemd)
+	}
+	sort.Strings(caps)
+	return caps
+}
+
+// negotiated is what one connection agreed on in its handshake.
+type negotiated struct {
+	protocol int
+	features map[string]bool
+}
+
+// negotiate settles the connection's protocol from the server's hello.
+func negotiate(offered []string, ack ControlMessage) negotiated {
+	n := negotiated{protocol: protocol.LegacyVersion, features: map[string]bool{}}
+	if ack.ProtocolVersion == 0 {
+		for _, f := range offered {
+			n.features[f] = true
+		}
+		// Except acknowledging events, which such a server never does: the
+		// agent would hold every event for an ack that cannot come.
+		delete(n.features, protocol.FeatureEvents)
+		return n
+	}
+
+	n.protocol = ack.ProtocolVersion
+	if n.protocol > protocol.Version {
+		n.protocol = protocol.Version
+	}
+	available := map[string]bool{}
+	for _, f := range offered {
+		available[f] = true
+	}
+	for _, f := range ack.Features {
+		// A feature the server names but this agent never offered is
+		// ignored: the server is newer, and will not rely on it.
+		if available[f] {
+			n.features[f] = true
+		}
+	}
+	return n
+}
+
+// allows reports whether a request may be served on this connection, and the
+// feature it needs when it may not.
+func (n negotiated) allows(msgType string) (bool, string) {
+	if msgType == "reset" {
+		return n.protocol == protocol.LegacyVersion, ""
+	}
+	feature, optional := protocol.Features[msgType]
+	if !optional || n.features[feature] {
+		return true, ""
+	}
+	return false, feature
+}
+
+func (n negotiated) String() string {
+	if len(n.features) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(n.features))
+	for f := range n.features {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func logNegotiation(n negotiated) {
+	if n.protocol == protocol.LegacyVersion {
+		log.Printf("control server predates protocol negotiation; using protocol %d", n.protocol)
+		return
+	}
+	log.Printf("negotiated protocol %d with features: %s", n.protocol, n)
+}
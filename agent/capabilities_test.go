@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sidhantpanda/spectre/agent/protocol"
+)
+
+func TestNegotiateWithLegacyServer(t *testing.T) {
+	n := negotiate([]string{protocol.FeatureDocker, protocol.FeatureUpdate}, ControlMessage{Type: "hello"})
+	if n.protocol != protocol.LegacyVersion {
+		t.Fatalf("protocol = %d, want %d", n.protocol, protocol.LegacyVersion)
+	}
+	for _, msgType := range []string{"dockerInfo", "update", "reset", "keystroke"} {
+		if ok, _ := n.allows(msgType); !ok {
+			t.Errorf("a legacy server should still get %q", msgType)
+		}
+	}
+	if legacy := negotiate([]string{protocol.FeatureEvents}, ControlMessage{Type: "hello"}); legacy.features[protocol.FeatureEvents] {
+		t.Error("events were left waiting on acks a legacy server never sends")
+	}
+}
+
+func TestNegotiateEnablesOnlyWhatBothSidesChose(t *testing.T) {
+	ack := ControlMessage{Type: "hello", ProtocolVersion: protocol.Version + 3, Features: []string{protocol.FeatureDocker, "tunnels"}}
+	n := negotiate([]string{protocol.FeatureDocker, protocol.FeatureSystemd}, ack)
+
+	if n.protocol != protocol.Version {
+		t.Errorf("protocol = %d, want this agent's %d", n.protocol, protocol.Version)
+	}
+	if want := map[string]bool{protocol.FeatureDocker: true}; !reflect.DeepEqual(n.features, want) {
+		t.Errorf("features = %v, want %v", n.features, want)
+	}
+	if ok, _ := n.allows("dockerInfo"); !ok {
+		t.Error("dockerInfo refused although docker was negotiated")
+	}
+	if ok, feature := n.allows("unitAction"); ok || feature != protocol.FeatureSystemd {
+		t.Errorf("unitAction: allowed=%v feature=%q, want refused for systemd", ok, feature)
+	}
+	if ok, _ := n.allows("listSessions"); !ok {
+		t.Error("core requests must not depend on negotiation")
+	}
+	if ok, feature := n.allows("reset"); ok || feature != "" {
+		t.Error("the legacy reset alias should be gone once a protocol is negotiated")
+	}
+}
+
+func TestEveryOptionalFeatureIsOffered(t *testing.T) {
+	known := map[string]bool{protocol.FeatureTmux: true}
+	for _, f := range protocol.Features {
+		known[f] = true
+	}
+	for _, f := range localCapabilities() {
+		if !known[f] {
+			t.Errorf("capability %q gates no request", f)
+		}
+	}
+}
@@ -1,67 +1,105 @@
 package main
 
 import (
-	"fmt"
+	"os"
 
 	"github.com/spf13/cobra"
 )
 
 func newRunCommand() *cobra.Command {
-	var host, authKey string
+	var host, authKey, updateSource string
+	var policy updatePolicyFlags
 	cmd := &cobra.Command{
-		Use:          "run",
-		Short:        "Run the agent in the foreground",
+		Use:   "run",
+		Short: "Run the agent in the foreground",
+		Long: "Runs the agent in the foreground.\n\n" +
+			"On its first start an unenrolled agent looks for a provisioning file\n" +
+			"(/etc/spectre-agent/provision.json, or spectre-agent.json in cloud-init's\n" +
+			"NoCloud seed directory), enrolls with its auth key and deletes it. --host\n" +
+			"may then be left out: the server from the file is remembered.",
 		Example:      "  spectre-agent run --host wss://spectre.example.com --authkey sk_...",
 		SilenceUsage: true,
 		Args:         cobra.NoArgs,
 		RunE: func(_ *cobra.Command, _ []string) error {
-			return runAgent(host, resolveAuthKey(authKey))
+			p, err := policy.policy()
+			if err != nil {
+				return err
+			}
+			return runAgent(host, resolveAuthKey(authKey), updateSource, p)
 		},
 	}
 	cmd.Flags().StringVar(&host, "host", "", hostFlagDoc)
 	cmd.Flags().StringVar(&authKey, "authkey", "", authKeyFlagDoc)
+	cmd.Flags().StringVar(&updateSource, "update-source", "", updateSourceFlagDoc)
+	addUpdatePolicyFlags(cmd, &policy)
 	return cmd
 }
 
 func newUpCommand() *cobra.Command {
-	var host, authKey string
+	var host, authKey, updateSource, updateToken string
+	var policy updatePolicyFlags
+	var hardening string
+	var userMode bool
 	cmd := &cobra.Command{
 		Use:   "up",
 		Short: "Enroll this machine and install it as a service",
-		Long: "Enrolls this machine with the control server and installs a systemd or\n" +
-			"launchd service so it reconnects on boot.\n\n" +
+		Long: "Enrolls this machine with the control server and installs a service so\n" +
+			"it reconnects on boot: systemd, OpenRC, runit, s6 or SysV init on Linux,\n" +
+			"whichever the machine runs, and launchd on macOS.\n\n" +
 			"With --authkey, enrollment is non-interactive. Without one, the agent\n" +
-			"prints a code to approve in the Spectre web UI.",
+			"prints a code to approve in the Spectre web UI. A provisioning file\n" +
+			"(/etc/spectre-agent/provision.json) supplies both --host and the auth key.\n\n" +
+			"On systemd the unit is sandboxed; --hardening strict confines it further,\n" +
+			"at the cost of sudo and a writable filesystem in its terminals.\n\n" +
+			"With --user, no root is needed: the agent is installed as a systemd user\n" +
+			"service for this account, with its state under ~/.local/state.",
 		Example: "  sudo spectre-agent up --host wss://spectre.example.com --authkey sk_...\n" +
-			"  sudo spectre-agent up --host wss://spectre.example.com",
+			"  sudo spectre-agent up --host wss://spectre.example.com\n" +
+			"  sudo spectre-agent up --host wss://spectre.example.com --update-interval 6h --update-window 02:00-05:00\n" +
+			"  sudo spectre-agent up --host wss://spectre.example.com --hardening strict\n" +
+			"  spectre-agent up --user --host wss://spectre.example.com --authkey sk_...",
 		SilenceUsage: true,
 		Args:         cobra.NoArgs,
 		RunE: func(_ *cobra.Command, _ []string) error {
-			if host == "" {
-				return fmt.Errorf("--host is required (e.g. --host wss://spectre.example.com)")
+			p, err := policy.policy()
+			if err != nil {
+				return err
+			}
+			level, err := parseHardeningLevel(hardening)
+			if err != nil {
+				return err
 			}
-			return serviceUp(host, resolveAuthKey(authKey))
+			if updateToken == "" {
+				updateToken = os.Getenv("SPECTRE_UPDATE_TOKEN")
+			}
+			return serviceUp(host, resolveAuthKey(authKey), updateSource, updateToken, p, level, userMode)
 		},
 	}
 	cmd.Flags().StringVar(&host, "host", "", hostFlagDoc)
 	cmd.Flags().StringVar(&authKey, "authkey", "", authKeyFlagDoc)
+	cmd.Flags().StringVar(&updateSource, "update-source", "", updateSourceFlagDoc)
+	cmd.Flags().StringVar(&updateToken, "update-token", "", updateTokenFlagDoc)
+	cmd.Flags().StringVar(&hardening, "hardening", string(defaultHardening), hardeningFlagDoc)
+	cmd.Flags().BoolVar(&userMode, "user", false, "Install for this account only, as a systemd user service; needs no root")
+	addUpdatePolicyFlags(cmd, &policy)
 	return cmd
 }
 
 func newDownCommand() *cobra.Command {
-	var purge bool
+	var purge, userMode bool
 	cmd := &cobra.Command{
 		Use:          "down",
 		Short:        "Stop and remove the spectre-agent service",
 		Long:         "Stops the service and removes it.\nUse --purge to also delete this machine's device key.",
-		Example:      "  sudo spectre-agent down\n  sudo spectre-agent down --purge",
+		Example:      "  sudo spectre-agent down\n  sudo spectre-agent down --purge\n  spectre-agent down --user",
 		SilenceUsage: true,
 		Args:         cobra.NoArgs,
 		RunE: func(_ *cobra.Command, _ []string) error {
-			return serviceDown(purge)
+			return serviceDown(purge, userMode)
 		},
 	}
 	cmd.Flags().BoolVar(&purge, "purge", false, "Also delete the device key and enrollment state")
+	cmd.Flags().BoolVar(&userMode, "user", false, "Remove this account's own service, installed with up --user")
 	return cmd
 }
 
@@ -69,23 +107,37 @@ func newUpdateCommand() *cobra.Command {
 	var opts updateOptions
 	cmd := &cobra.Command{
 		Use:   "update",
-		Short: "Update the agent to the latest GitHub release",
+		Short: "Update the agent to the latest release",
 		Long: "Downloads the newest release for this machine's OS and architecture,\n" +
 			"replaces this binary with it, and restarts the service if one is installed.\n\n" +
+			"Releases come from GitHub unless --source names the control server or a\n" +
+			"mirror. Without it, the running agent's source is used.\n\n" +
 			"Enrollment is left alone: the machine keeps its device key and needs no\n" +
 			"new auth key. Updating a system-wide install needs root.",
 		Example: "  sudo spectre-agent update\n" +
 			"  spectre-agent update --check\n" +
-			"  sudo spectre-agent update --tag v1.2.3",
+			"  sudo spectre-agent update --tag v1.2.3\n" +
+			"  sudo spectre-agent update --source server",
 		SilenceUsage: true,
 		Args:         cobra.NoArgs,
 		RunE: func(_ *cobra.Command, _ []string) error {
+			// The running agent knows which server it uses and where it was
+			// told to update from; a machine that cannot reach GitHub should
+			// not need either spelled out again.
+			if running, info := checkRunning(); running && info != nil {
+				if opts.source == "" {
+					opts.source = info.UpdateSource
+				}
+				opts.host = info.Host
+				opts.binary = info.Binary
+			}
 			return runUpdate(opts)
 		},
 	}
 	cmd.Flags().BoolVar(&opts.checkOnly, "check", false, "Only report whether an update is available")
 	cmd.Flags().StringVar(&opts.tag, "tag", "", "Release to install, e.g. v1.2.3. Defaults to the latest")
 	cmd.Flags().BoolVar(&opts.force, "force", false, "Reinstall even if already on that version")
+	cmd.Flags().StringVar(&opts.source, "source", "", updateSourceFlagDoc)
 	return cmd
 }
 
@@ -101,3 +153,86 @@ func newStatusCommand() *cobra.Command {
 		},
 	}
 }
+
+func newDoctorCommand() *cobra.Command {
+	var host string
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Check why this machine might not reach the control server",
+		Long: "Runs the checks behind a machine that will not show up on the dashboard:\n" +
+			"DNS, TCP, TLS and the WebSocket upgrade to the server, clock skew, whether\n" +
+			"the service account can read the device key, tmux, and whether the service\n" +
+			"can update its own binary. Each failure comes with a suggested fix.\n\n" +
+			"Without --host it checks the server the running agent uses. Run it with\n" +
+			"sudo to check the installed service's files.",
+		Example:      "  sudo spectre-agent doctor\n  spectre-agent doctor --host wss://spectre.example.com",
+		SilenceUsage: true,
+		Args:         cobra.NoArgs,
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return runDoctor(host)
+		},
+	}
+	cmd.Flags().StringVar(&host, "host", "", hostFlagDoc)
+	return cmd
+}
+
+func newAdminCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "admin",
+		Short: "Query or steer the running agent over its admin socket",
+		Long: "Talks to the running agent through the Unix socket in its state directory.\n" +
+			"The socket belongs to the account the agent runs as, so a system-wide\n" +
+			"install needs sudo.",
+		Example: "  sudo spectre-agent admin status\n" +
+			"  sudo spectre-agent admin reconnect\n" +
+			"  sudo spectre-agent admin drop-session <id>",
+		SilenceUsage: true,
+	}
+	simple := func(use, short, command string) *cobra.Command {
+		return &cobra.Command{
+			Use:          use,
+			Short:        short,
+			SilenceUsage: true,
+			Args:         cobra.NoArgs,
+			RunE: func(_ *cobra.Command, _ []string) error {
+				return runAdminCommand(adminRequest{Command: command})
+			},
+		}
+	}
+	cmd.AddCommand(
+		simple("status", "Print the running agent's state as JSON", "status"),
+		simple("reconnect", "Drop the control connection and reconnect now", "reconnect"),
+		simple("reload", "Re-read the device key and the service's settings.json, then reconnect", "reload"),
+		&cobra.Command{
+			Use:          "drop-session <id>",
+			Short:        "Detach the agent from a session; a tmux session keeps running",
+			SilenceUsage: true,
+			Args:         cobra.ExactArgs(1),
+			RunE: func(_ *cobra.Command, args []string) error {
+				return runAdminCommand(adminRequest{Command: "dropSession", SessionID: args[0]})
+			},
+		},
+	)
+	return cmd
+}
+
+func newDevServerCommand() *cobra.Command {
+	var listen string
+	cmd := &cobra.Command{
+		Use:   "dev-server",
+		Short: "Run a minimal control server for developing the agent",
+		Long: "Runs a control server with just enough of the real one for an agent to\n" +
+			"connect: the register socket and the approval endpoints. Enrollment is\n" +
+			"approved automatically and any credential is accepted, so never expose it.\n\n" +
+			"The terminal it runs in acts as the web UI: open and attach sessions, type\n" +
+			"into them, and send info and update requests. Type :help once it is up.",
+		Example:      "  spectre-agent dev-server\n  spectre-agent dev-server --listen 127.0.0.1:9000",
+		SilenceUsage: true,
+		Args:         cobra.NoArgs,
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return runDevServer(listen)
+		},
+	}
+	cmd.Flags().StringVar(&listen, "listen", "127.0.0.1:8090", "Address to listen on")
+	return cmd
+}
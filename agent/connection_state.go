@@ -0,0 +1,143 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// The running agent's view of its control connection, kept in the state
+// directory so `status` — a separate process — can report whether the agent
+// is actually connected and how the link has behaved lately. The file is
+// rewritten only when the link comes up or goes down; how far away the server
+// is changes with every pong, so that is kept in memory and served over the
+// admin socket.
+
+const (
+	connectionStateFile   = "connection.json"
+	connectionHistoryFile = "connection-history.json"
+	// Enough to see a pattern of drops, small enough to rewrite on each one.
+	maxConnectionHistory = 20
+)
+
+// connectionEvent is one line of the connection history.
+type connectionEvent struct {
+	Time int64 `json:"time"`
+	// Event is connected, disconnected, failed or rejected.
+	Event  string `json:"event"`
+	Server string `json:"server,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Seconds is how long a connection lasted, on disconnected.
+	Seconds int64 `json:"seconds,omitempty"`
+	// Count folds repeats of the same failure into one entry, so an outage
+	// spent retrying does not push everything else out of the history.
+	Count int `json:"count,omitempty"`
+}
+
+type connectionState struct {
+	// PID ties the record to the process that wrote it; a record left behind
+	// by an agent that has since exited is not reported as current.
+	PID       int    `json:"pid"`
+	Connected bool   `json:"connected"`
+	Server    string `json:"server,omitempty"`
+	// Since is when the current connection came up, or the last one ended.
+	Since int64 `json:"since,omitempty"`
+	// RTTMillis is the latest ping round trip. Only the admin socket
+	// reports it; the file never has it.
+	RTTMillis float64 `json:"rttMillis,omitempty"`
+	LastError string  `json:"lastError,omitempty"`
+}
+
+var (
+	connStateMu sync.Mutex
+	connState   connectionState
+)
+
+func recordConnected(server string) {
+	updateConnectionState(func(s *connectionState) {
+		*s = connectionState{Connected: true, Server: server, Since: time.Now().Unix()}
+	})
+	appendConnectionHistory(connectionEvent{Event: "connected", Server: server})
+}
+
+func recordLatency(rtt time.Duration) {
+	connStateMu.Lock()
+	defer connStateMu.Unlock()
+	connState.RTTMillis = float64(rtt.Microseconds()) / 1000
+}
+
+func recordDisconnected(err error) {
+	var event connectionEvent
+	updateConnectionState(func(s *connectionState) {
+		event = connectionEvent{Event: "disconnected", Server: s.Server, Seconds: time.Now().Unix() - s.Since}
+		s.Connected = false
+		s.Since = time.Now().Unix()
+		s.RTTMillis = 0
+		if err != nil {
+			s.LastError = err.Error()
+			event.Reason = err.Error()
+		}
+	})
+	appendConnectionHistory(event)
+}
+
+// recordConnectFailure notes an attempt that never got as far as a handshake.
+// event is "failed", or "rejected" when the server refused the credential.
+func recordConnectFailure(event string, err error) {
+	reason := ""
+	if err != nil {
+		reason = err.Error()
+		updateConnectionState(func(s *connectionState) { s.LastError = reason })
+	}
+	appendConnectionHistory(connectionEvent{Event: event, Reason: reason})
+}
+
+func appendConnectionHistory(event connectionEvent) {
+	event.Time = time.Now().Unix()
+	history := loadConnectionHistory()
+	if n := len(history); n > 0 && history[n-1].Event == event.Event && history[n-1].Reason == event.Reason &&
+		(event.Event == "failed" || event.Event == "rejected") {
+		last := &history[n-1]
+		last.Time = event.Time
+		if last.Count == 0 {
+			last.Count = 1
+		}
+		last.Count++
+	} else {
+		history = append(history, event)
+	}
+	if len(history) > maxConnectionHistory {
+		history = history[len(history)-maxConnectionHistory:]
+	}
+	if err := writeStateJSON(connectionHistoryFile, history); err != nil {
+		log.Printf("warning: could not record connection history: %v", err)
+	}
+}
+
+func loadConnectionHistory() []connectionEvent {
+	var history []connectionEvent
+	readStateJSON(connectionHistoryFile, &history)
+	return history
+}
+
+// currentConnectionState is this process's own view, for the admin socket.
+func currentConnectionState() connectionState {
+	connStateMu.Lock()
+	defer connStateMu.Unlock()
+	state := connState
+	state.PID = os.Getpid()
+	return state
+}
+
+func updateConnectionState(change func(*connectionState)) {
+	connStateMu.Lock()
+	defer connStateMu.Unlock()
+	change(&connState)
+	connState.PID = os.Getpid()
+	onDisk := connState
+	onDisk.RTTMillis = 0
+	if err := writeStateJSON(connectionStateFile, onDisk); err != nil {
+		log.Printf("warning: could not record connection state: %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConnectionHistoryFoldsRepeatedFailures(t *testing.T) {
+	t.Setenv("SPECTRE_AGENT_HOME", t.TempDir())
+
+	recordConnected("wss://spectre.example.com/api/agents/register")
+	recordDisconnected(errors.New("read: i/o timeout"))
+	refused := errors.New("dial tcp: connection refused")
+	for i := 0; i < 3; i++ {
+		recordConnectFailure("failed", refused)
+	}
+
+	history := loadConnectionHistory()
+	if len(history) != 3 {
+		t.Fatalf("expected connected, disconnected and one folded failure, got %+v", history)
+	}
+	if history[1].Event != "disconnected" || history[1].Reason != "read: i/o timeout" {
+		t.Errorf("unexpected disconnect entry %+v", history[1])
+	}
+	if history[2].Event != "failed" || history[2].Count != 3 {
+		t.Errorf("repeated failures not folded: %+v", history[2])
+	}
+}
+
+func TestConnectionHistoryIsBounded(t *testing.T) {
+	t.Setenv("SPECTRE_AGENT_HOME", t.TempDir())
+	for i := 0; i < maxConnectionHistory+5; i++ {
+		recordConnected("wss://spectre.example.com")
+		recordDisconnected(nil)
+	}
+	if got := len(loadConnectionHistory()); got != maxConnectionHistory {
+		t.Fatalf("history holds %d entries, want %d", got, maxConnectionHistory)
+	}
+}
+
+// Latency changes with every pong; it is served from memory, and the state
+// file is left alone.
+func TestLatencyIsKeptInMemory(t *testing.T) {
+	t.Setenv("SPECTRE_AGENT_HOME", t.TempDir())
+	recordConnected("wss://spectre.example.com")
+	if err := removeStateFile(connectionStateFile); err != nil {
+		t.Fatal(err)
+	}
+
+	recordLatency(12500 * time.Microsecond)
+	if got := currentConnectionState().RTTMillis; got != 12.5 {
+		t.Fatalf("latency = %v ms, want 12.5", got)
+	}
+	var onDisk connectionState
+	if readStateJSON(connectionStateFile, &onDisk) {
+		t.Fatalf("a pong rewrote %s: %+v", connectionStateFile, onDisk)
+	}
+
+	recordDisconnected(nil)
+	if !readStateJSON(connectionStateFile, &onDisk) || onDisk.Connected || onDisk.RTTMillis != 0 {
+		t.Fatalf("after a disconnect: %+v", onDisk)
+	}
+}
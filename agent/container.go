@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Container runtimes the agent can report on.
+//
+// Docker is not the only engine on the hosts Spectre reaches: plenty run
+// Podman, and Kubernetes-adjacent boxes often have only containerd. Each
+// backend answers the same question — what is running, and on which ports —
+// and every one that is present on the host contributes to a single list, so a
+// machine running both Docker and Podman shows both sets of containers.
+
+type containerRuntime interface {
+	// name is what each reported container is tagged with.
+	name() string
+	// available reports whether the runtime is installed and reachable. It
+	// must be cheap: it runs on every dockerInfo request.
+	available() bool
+	listContainers() ([]DockerContainer, error)
+}
+
+// Order matters only for presentation; every available runtime is queried.
+// A var so tests can substitute fakes for the real engines.
+var containerRuntimes = []containerRuntime{
+	dockerRuntime{},
+	podmanRuntime{},
+	nerdctlRuntime{},
+}
+
+// listContainers gathers running containers from every runtime on the host.
+//
+// One runtime failing does not hide the others' containers; its error is
+// reported alongside whatever the rest returned. Only when no runtime is
+// installed at all is that itself the error, so the dashboard can say so
+// instead of showing an empty list that looks like "nothing running".
+func listContainers() ([]DockerContainer, error) {
+	containers := make([]DockerContainer, 0)
+	var failures []string
+	found := false
+
+	for _, rt := range containerRuntimes {
+		if !rt.available() {
+			continue
+		}
+		found = true
+		list, err := rt.listContainers()
+		for i := range list {
+			list[i].Runtime = rt.name()
+		}
+		containers = append(containers, list...)
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+
+	if !found {
+		return containers, fmt.Errorf("no container runtime found (looked for docker, podman and nerdctl)")
+	}
+	if len(failures) > 0 {
+		return containers, fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	return containers, nil
+}
+
+// splitPorts turns the comma-separated port summary the docker and nerdctl
+// CLIs print into one entry per mapping.
+func splitPorts(raw string) []string {
+	var ports []string
+	for _, rawPort := range strings.Split(raw, ",") {
+		port := strings.TrimSpace(rawPort)
+		if port != "" {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
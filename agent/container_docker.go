@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// dockerRuntime lists containers with `docker ps`, which avoids adding
+// dependencies or needing the Docker daemon SDK.
+type dockerRuntime struct{}
+
+func (dockerRuntime) name() string { return "docker" }
+
+func (dockerRuntime) available() bool {
+	_, err := exec.LookPath("docker")
+	return err == nil
+}
+
+func (dockerRuntime) listContainers() ([]DockerContainer, error) {
+	return psJSONLines("docker")
+}
+
+// psJSONLines runs `<cli> ps --format '{{json .}}'` and parses the result.
+// nerdctl deliberately mirrors the docker CLI, so both share this.
+func psJSONLines(cli string) ([]DockerContainer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, cli, "ps", "--format", "{{json .}}")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		detail := strings.TrimSpace(stderr.String())
+		if detail == "" {
+			detail = err.Error()
+		}
+		return nil, fmt.Errorf("%s ps failed: %s", cli, detail)
+	}
+
+	return parsePSJSONLines(stdout.Bytes())
+}
+
+// parsePSJSONLines reads one JSON object per line, as `docker ps` and
+// `nerdctl ps` print them. Kept apart from the exec call so it can be tested
+// on machines with neither installed.
+func parsePSJSONLines(out []byte) ([]DockerContainer, error) {
+	containers := make([]DockerContainer, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var row struct {
+			Names string `json:"Names"`
+			Ports string `json:"Ports"`
+		}
+		if err := json.Unmarshal(line, &row); err != nil {
+			// Ignore malformed rows so one bad line does not break the response.
+			continue
+		}
+		containers = append(containers, DockerContainer{
+			Name:  row.Names,
+			Ports: splitPorts(row.Ports),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return containers, err
+	}
+
+	return containers, nil
+}
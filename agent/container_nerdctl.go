@@ -0,0 +1,19 @@
+package main
+
+import "os/exec"
+
+// nerdctlRuntime covers containerd hosts. containerd itself has no friendly
+// listing command; nerdctl is its docker-compatible CLI and reads the same
+// namespaces a containerd-based engine writes to.
+type nerdctlRuntime struct{}
+
+func (nerdctlRuntime) name() string { return "containerd" }
+
+func (nerdctlRuntime) available() bool {
+	_, err := exec.LookPath("nerdctl")
+	return err == nil
+}
+
+func (nerdctlRuntime) listContainers() ([]DockerContainer, error) {
+	return psJSONLines("nerdctl")
+}
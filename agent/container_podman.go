@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// podmanRuntime talks to Podman's REST API socket rather than its CLI.
+//
+// Podman is daemonless, so each user has their own set of containers: root's
+// live behind /run/podman, and a rootless user's behind their runtime
+// directory. The service usually runs as an ordinary account, so both are
+// asked, and whichever sockets exist and answer contribute.
+type podmanRuntime struct{}
+
+const podmanRootfulSocket = "/run/podman/podman.sock"
+
+func (podmanRuntime) name() string { return "podman" }
+
+func (podmanRuntime) available() bool {
+	return len(podmanSockets()) > 0
+}
+
+func (podmanRuntime) listContainers() ([]DockerContainer, error) {
+	containers := make([]DockerContainer, 0)
+	var failures []string
+	for _, socket := range podmanSockets() {
+		list, err := listPodmanContainers(socket)
+		if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		containers = append(containers, list...)
+	}
+	if len(failures) > 0 {
+		return containers, fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	return containers, nil
+}
+
+// podmanSockets returns the API sockets present on this host: the rootful
+// one, and the rootless one belonging to whoever the agent runs as.
+func podmanSockets() []string {
+	candidates := []string{podmanRootfulSocket}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		candidates = append(candidates, filepath.Join(dir, "podman", "podman.sock"))
+	}
+	// A system service has no XDG_RUNTIME_DIR, but a lingering user's runtime
+	// directory is still where it always is.
+	candidates = append(candidates, filepath.Join("/run/user", strconv.Itoa(os.Getuid()), "podman", "podman.sock"))
+
+	seen := map[string]bool{}
+	var sockets []string
+	for _, path := range candidates {
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			sockets = append(sockets, path)
+		}
+	}
+	return sockets
+}
+
+func listPodmanContainers(socket string) ([]DockerContainer, error) {
+	client := &http.Client{
+		Timeout: 3 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	// The host part is ignored; the transport always dials the socket.
+	resp, err := client.Get("http://podman/v4.0.0/libpod/containers/json")
+	if err != nil {
+		return nil, fmt.Errorf("podman (%s): %w", socket, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, fmt.Errorf("podman (%s): %w", socket, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("podman (%s) returned %s", socket, resp.Status)
+	}
+	return parsePodmanContainers(body)
+}
+
+// parsePodmanContainers reads the libpod containers/json response. Ports are
+// rendered the way `docker ps` prints them, so the dashboard shows one format
+// whichever engine a container came from.
+func parsePodmanContainers(body []byte) ([]DockerContainer, error) {
+	var rows []struct {
+		Names []string `json:"Names"`
+		Ports []struct {
+			HostIP        string `json:"host_ip"`
+			ContainerPort uint16 `json:"container_port"`
+			HostPort      uint16 `json:"host_port"`
+			Protocol      string `json:"protocol"`
+		} `json:"Ports"`
+	}
+	if err := json.Unmarshal(body, &rows); err != nil {
+		return nil, fmt.Errorf("parse podman response: %w", err)
+	}
+
+	containers := make([]DockerContainer, 0, len(rows))
+	for _, row := range rows {
+		container := DockerContainer{Name: strings.Join(row.Names, ",")}
+		for _, p := range row.Ports {
+			protocol := p.Protocol
+			if protocol == "" {
+				protocol = "tcp"
+			}
+			if p.HostPort == 0 {
+				container.Ports = append(container.Ports, fmt.Sprintf("%d/%s", p.ContainerPort, protocol))
+				continue
+			}
+			hostIP := p.HostIP
+			if hostIP == "" {
+				hostIP = "0.0.0.0"
+			}
+			container.Ports = append(container.Ports,
+				fmt.Sprintf("%s:%d->%d/%s", hostIP, p.HostPort, p.ContainerPort, protocol))
+		}
+		containers = append(containers, container)
+	}
+	return containers, nil
+}
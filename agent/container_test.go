@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParsePSJSONLines(t *testing.T) {
+	out := `{"Names":"web","Ports":"0.0.0.0:8080->80/tcp, :::8080->80/tcp"}
+not json
+{"Names":"worker","Ports":""}
+`
+	containers, err := parsePSJSONLines([]byte(out))
+	if err != nil {
+		t.Fatalf("parsePSJSONLines: %v", err)
+	}
+	if len(containers) != 2 {
+		t.Fatalf("expected 2 containers, got %+v", containers)
+	}
+	if containers[0].Name != "web" || len(containers[0].Ports) != 2 {
+		t.Errorf("unexpected first container %+v", containers[0])
+	}
+	if containers[1].Ports != nil {
+		t.Errorf("a container with no ports should report none, got %v", containers[1].Ports)
+	}
+}
+
+func TestParsePodmanContainersRendersPortsLikeDocker(t *testing.T) {
+	body := `[
+		{"Names":["db"],"Ports":[{"host_ip":"","container_port":5432,"host_port":15432,"protocol":"tcp"}]},
+		{"Names":["cache"],"Ports":[{"container_port":6379}]}
+	]`
+	containers, err := parsePodmanContainers([]byte(body))
+	if err != nil {
+		t.Fatalf("parsePodmanContainers: %v", err)
+	}
+	if len(containers) != 2 {
+		t.Fatalf("expected 2 containers, got %+v", containers)
+	}
+	if got := containers[0].Ports; len(got) != 1 || got[0] != "0.0.0.0:15432->5432/tcp" {
+		t.Errorf("published port rendered as %v", got)
+	}
+	if got := containers[1].Ports; len(got) != 1 || got[0] != "6379/tcp" {
+		t.Errorf("unpublished port rendered as %v", got)
+	}
+}
+
+type fakeRuntime struct {
+	id         string
+	installed  bool
+	containers []DockerContainer
+	err        error
+}
+
+func (f fakeRuntime) name() string    { return f.id }
+func (f fakeRuntime) available() bool { return f.installed }
+func (f fakeRuntime) listContainers() ([]DockerContainer, error) {
+	return append([]DockerContainer(nil), f.containers...), f.err
+}
+
+func withContainerRuntimes(t *testing.T, runtimes ...containerRuntime) {
+	t.Helper()
+	original := containerRuntimes
+	containerRuntimes = runtimes
+	t.Cleanup(func() { containerRuntimes = original })
+}
+
+// A host running both Docker and Podman shows both, each tagged with where it
+// came from, and one engine failing does not hide the other's containers.
+func TestListContainersMergesRuntimesAndTagsEach(t *testing.T) {
+	withContainerRuntimes(t,
+		fakeRuntime{id: "docker", installed: true, containers: []DockerContainer{{Name: "a"}}},
+		fakeRuntime{id: "podman", installed: true, err: errors.New("podman: socket refused")},
+		fakeRuntime{id: "containerd", installed: true, containers: []DockerContainer{{Name: "b"}}},
+		fakeRuntime{id: "absent", installed: false, containers: []DockerContainer{{Name: "ghost"}}},
+	)
+
+	containers, err := listContainers()
+	if err == nil || !strings.Contains(err.Error(), "socket refused") {
+		t.Fatalf("expected the podman failure to be reported, got %v", err)
+	}
+	if len(containers) != 2 {
+		t.Fatalf("expected containers from docker and containerd only, got %+v", containers)
+	}
+	if containers[0].Runtime != "docker" || containers[1].Runtime != "containerd" {
+		t.Fatalf("containers not tagged with their runtime: %+v", containers)
+	}
+}
+
+func TestListContainersWithNoRuntimeSaysSo(t *testing.T) {
+	withContainerRuntimes(t, fakeRuntime{id: "docker"})
+
+	containers, err := listContainers()
+	if err == nil || !strings.Contains(err.Error(), "no container runtime") {
+		t.Fatalf("expected a missing-runtime error, got %v", err)
+	}
+	if containers == nil {
+		t.Fatal("expected an empty list, not nil, so the payload still carries one")
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"github.com/sidhantpanda/spectre/agent/protocol"
 )
 
 // connectToControlServer maintains the agent's outbound connection to the
@@ -22,12 +24,10 @@ import (
 //   - an auth key, exchanged for a device key on first connect
 //   - interactive approval, where a human approves this machine in the web UI
 //
-// The ptyManager persists across reconnects so tmux sessions survive drops.
-func connectToControlServer(host, authKey string, deviceInfo *DeviceInfo, fingerprint map[string]any) {
-	if isPlaintext(host) && !isLoopback(host) {
-		log.Printf("WARNING: connecting over plaintext to a non-local host. Terminal I/O and the")
-		log.Printf("WARNING: device key are exposed to the network. Use wss:// in production.")
-	}
+// The ptyManager, in ctl, persists across reconnects so tmux sessions survive
+// drops.
+func connectToControlServer(ctl *agentControl, host, authKey string, deviceInfo *DeviceInfo, fingerprint map[string]any) {
+	warnIfPlaintext(host)
 
 	if deviceInfo.DeviceKey == "" && authKey == "" {
 		key, err := enrollInteractively(host, deviceInfo.DeviceID)
@@ -41,8 +41,7 @@ func connectToControlServer(host, authKey string, deviceInfo *DeviceInfo, finger
 		}
 	}
 
-	sessions := newPtyManager()
-	backoff := time.Second
+	backoff := newReconnectBackoff()
 
 	for {
 		credential := deviceInfo.DeviceKey
@@ -50,19 +49,84 @@ func connectToControlServer(host, authKey string, deviceInfo *DeviceInfo, finger
 			credential = authKey
 		}
 
-		if err := runConnection(host, credential, deviceInfo, fingerprint, sessions); err != nil {
+		started := time.Now()
+		established, err := runConnection(ctl, host, credential, deviceInfo, fingerprint)
+		if err != nil {
 			log.Printf("control server connection ended: %v", err)
+			recordAgentError("connection", err)
+		}
+
+		var wait time.Duration
+		if isAuthRejected(err) {
+			recordConnectFailure("rejected", err)
+			log.Printf("this machine's credential was refused; if it was removed from the dashboard, re-enroll with 'spectre-agent up'")
+			wait = authRejectedRetry
+		} else {
+			if !established {
+				recordConnectFailure("failed", err)
+			} else if time.Since(started) >= stablePeriod {
+				backoff.reset()
+			}
+			wait = backoff.next()
 		}
+		// An admin-requested reconnect skips the wait and starts the
+		// backoff over: someone is watching, and just fixed something.
+		if ctl.sleep(wait) {
+			backoff.reset()
+		}
+		if reload, settings := ctl.takeReload(); reload {
+			reloadDeviceKey(deviceInfo)
+			if settings != nil {
+				host = applySettings(ctl, host, *settings)
+			}
+		}
+	}
+}
+
+func warnIfPlaintext(host string) {
+	if isPlaintext(host) && !isLoopback(host) {
+		log.Printf("WARNING: connecting over plaintext to a non-local host. Terminal I/O and the")
+		log.Printf("WARNING: device key are exposed to the network. Use wss:// in production.")
+	}
+}
 
-		backoff = nextBackoff(backoff)
-		time.Sleep(backoff)
+// applySettings puts reloaded service settings into effect: the host for the
+// connection about to be dialled, and the update source and policy from now
+// on. It returns the host.
+func applySettings(ctl *agentControl, host string, settings runSettings) string {
+	if settings.host != host {
+		log.Printf("control server changed from %s to %s", host, settings.host)
+		warnIfPlaintext(settings.host)
+	}
+	setAgentUpdateSource(settings.updateSource, settings.host)
+	if ctl.updater != nil {
+		ctl.updater.setPolicy(settings.policy)
 	}
+	return settings.host
 }
 
-func runConnection(host, credential string, deviceInfo *DeviceInfo, fingerprint map[string]any, sessions *ptyManager) error {
+// reloadDeviceKey picks up a device key written since the agent started, by a
+// re-enrollment or by hand. An unreadable file keeps the key already in use.
+// Labels come from provisioning and are not re-read.
+func reloadDeviceKey(deviceInfo *DeviceInfo) {
+	info, err := ensureDeviceInfo()
+	if err != nil {
+		log.Printf("warning: could not reload device info: %v", err)
+		return
+	}
+	if info.DeviceKey != deviceInfo.DeviceKey {
+		log.Printf("device key changed on disk; using the new one")
+	}
+	deviceInfo.DeviceKey = info.DeviceKey
+}
+
+// runConnection dials, handshakes and serves one connection until it ends. It
+// reports whether the handshake completed, which is what separates a link
+// that dropped from one that never came up.
+func runConnection(ctl *agentControl, host, credential string, deviceInfo *DeviceInfo, fingerprint map[string]any) (bool, error) {
 	wsURL, err := normalizeServerURL(host, "ws", "/api/agents/register")
 	if err != nil {
-		return fmt.Errorf("invalid control server host: %w", err)
+		return false, fmt.Errorf("invalid control server host: %w", err)
 	}
 
 	// The credential goes in a header, never the URL.
@@ -71,25 +135,36 @@ func runConnection(host, credential string, deviceInfo *DeviceInfo, fingerprint
 
 	rawConn, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
 	if err != nil {
-		return fmt.Errorf("failed to connect to %s: %w%s", wsURL, err, responseDetail(resp))
+		if rejected := asAuthRejected(resp); rejected != nil {
+			rejected.detail = responseDetail(resp)
+			return false, rejected
+		}
+		return false, fmt.Errorf("failed to connect to %s: %w%s", wsURL, err, responseDetail(resp))
 	}
 	log.Printf("connected to control server at %s", wsURL)
 
+	capabilities := localCapabilities()
 	hello := AgentMessage{
-		Type:         "hello",
-		AgentID:      deviceInfo.DeviceID,
-		AgentVersion: getAgentVersion(),
-		Fingerprint:  fingerprint,
+		Type:            "hello",
+		AgentID:         deviceInfo.DeviceID,
+		AgentVersion:    getAgentVersion(),
+		Fingerprint:     fingerprint,
+		ProtocolVersion: protocol.Version,
+		Capabilities:    capabilities,
 	}
 	if err := rawConn.WriteJSON(hello); err != nil {
 		rawConn.Close()
-		return fmt.Errorf("handshake failed: %w", err)
+		return false, fmt.Errorf("handshake failed: %w", err)
 	}
 
+	// Until pings start, this is the only thing stopping a server that
+	// accepted the upgrade and then went silent from hanging the agent.
+	_ = rawConn.SetReadDeadline(time.Now().Add(handshakeWait))
+
 	var ack ControlMessage
 	if err := rawConn.ReadJSON(&ack); err != nil {
 		rawConn.Close()
-		return fmt.Errorf("no handshake response: %w", err)
+		return false, fmt.Errorf("no handshake response: %w", err)
 	}
 
 	// Connecting with an auth key enrols the machine; the server hands back a
@@ -103,19 +178,27 @@ func runConnection(host, credential string, deviceInfo *DeviceInfo, fingerprint
 		}
 		if err := rawConn.ReadJSON(&ack); err != nil {
 			rawConn.Close()
-			return fmt.Errorf("no handshake response after enrollment: %w", err)
+			return false, fmt.Errorf("no handshake response after enrollment: %w", err)
 		}
 	}
 
 	if ack.Type != "hello" {
 		rawConn.Close()
-		return fmt.Errorf("unexpected handshake response %q", ack.Type)
+		return false, fmt.Errorf("unexpected handshake response %q", ack.Type)
 	}
 
 	conn := newSafeConn(rawConn)
 	defer conn.close()
+	sessions := ctl.sessions
+	ctl.setConn(conn)
+	defer ctl.setConn(nil)
+	conn.onPong = recordLatency
+	conn.protocol = negotiate(capabilities, ack)
+	logNegotiation(conn.protocol)
+	recordConnected(wsURL)
 
-	errCh := make(chan error, 3)
+	// The first error ends the connection; see endConnection.
+	errCh := make(chan error, 1)
 	startPTY := func(session *ptySession) {
 		go readFromPTY(conn, session, sessions, errCh)
 	}
@@ -134,14 +217,44 @@ func runConnection(host, credential string, deviceInfo *DeviceInfo, fingerprint
 
 	// Tell the server what is attachable as soon as the link is up, so the UI
 	// can show the picker without waiting for a round trip.
-	if err := sendSessions(conn, sessions); err != nil {
-		return fmt.Errorf("failed to send session list: %w", err)
+	if err := sendSessions(conn, sessions, ""); err != nil {
+		return true, fmt.Errorf("failed to send session list: %w", err)
 	}
 
-	go readFromControl(conn, sessions, errCh, startPTY)
+	// Events that could not be delivered on an earlier connection, or by an
+	// earlier process, go before anything this one reports.
+	if err := pendingEvents.drain(conn); err != nil {
+		return true, fmt.Errorf("failed to send queued events: %w", err)
+	}
+
+	// A reboot the server asked for shows up here, as the first handshake on
+	// the new boot.
+	reportCompletedPowerAction(conn)
+	// Likewise an update: this handshake is what confirms it, or, on a
+	// binary that was rolled back to, what reports that.
+	confirmPendingUpdate(conn, getAgentVersion())
+
+	go readFromControl(conn, ctl, errCh, startPTY)
 	go sendHeartbeats(conn, errCh)
+	go conn.keepAlive(pingInterval, errCh)
 
-	return <-errCh
+	err = <-errCh
+	recordDisconnected(err)
+	// Follows stream to this connection only; the server asks again for
+	// whatever it still wants once the next one is up.
+	stopAllLogFollowers()
+	return true, err
+}
+
+// endConnection reports the error that ends a connection. Only the first is
+// waited for; the read loop, the heartbeat, the keepalive and every PTY
+// reader all notice a dead link, and the rest give up rather than block on a
+// channel nobody reads any more.
+func endConnection(errCh chan<- error, err error) {
+	select {
+	case errCh <- err:
+	default:
+	}
 }
 
 // responseDetail summarizes a failed handshake response without echoing the
@@ -157,11 +270,3 @@ func responseDetail(resp *http.Response) string {
 	}
 	return fmt.Sprintf(" (HTTP %s: %s)", resp.Status, body)
 }
-
-func nextBackoff(current time.Duration) time.Duration {
-	next := current * 2
-	if next > 30*time.Second {
-		return 30 * time.Second
-	}
-	return next
-}
@@ -5,162 +5,216 @@ import (
 	"fmt"
 	"log"
 	"time"
+
+	"github.com/sidhantpanda/spectre/agent/protocol"
 )
 
-func sendSessions(conn *safeConn, sessions *ptyManager) error {
-	return conn.writeJSON(AgentMessage{
+// sendSessions sends the session inventory, as the reply to requestID when it
+// answers a "listSessions" and unprompted (requestID empty) otherwise.
+func sendSessions(conn *safeConn, sessions *ptyManager, requestID string) error {
+	return conn.reply(requestID, AgentMessage{
 		Type:          "sessions",
 		Sessions:      sessions.inventory(),
 		TmuxAvailable: isTmuxAvailable(),
 	})
 }
 
-func readFromControl(conn *safeConn, sessions *ptyManager, errCh chan<- error, restartPTY func(*ptySession)) {
+func readFromControl(conn *safeConn, ctl *agentControl, errCh chan<- error, restartPTY func(*ptySession)) {
 	for {
 		var msg ControlMessage
 		if err := conn.readJSON(&msg); err != nil {
-			errCh <- err
+			endConnection(errCh, err)
+			return
+		}
+		if err := handleControlMessage(conn, ctl, msg, restartPTY); err != nil {
+			endConnection(errCh, err)
 			return
 		}
+	}
+}
 
-		sessionID := msg.SessionID
+// handleControlMessage serves one request. An error means the connection is
+// no longer usable; a request that merely failed is answered and returns nil.
+func handleControlMessage(conn *safeConn, ctl *agentControl, msg ControlMessage, restartPTY func(*ptySession)) error {
+	sessions := ctl.sessions
+	sessionID := msg.SessionID
+	requestID := msg.RequestID
 
-		switch msg.Type {
-		case "keystroke":
-			if sessionID == "" {
-				log.Printf("ignoring keystroke with no session id")
-				continue
-			}
-			session := sessions.get(sessionID)
-			if session == nil {
-				log.Printf("ignoring keystroke for unknown session %s", sessionID)
-				continue
-			}
-			ptm := session.current()
-			if ptm == nil {
-				log.Printf("ignoring keystroke for inactive session %s", sessionID)
-				continue
-			}
-			if _, err := ptm.Write([]byte(msg.Data)); err != nil {
-				errCh <- fmt.Errorf("write to pty failed: %w", err)
-				return
-			}
-		case "listSessions":
-			if err := sendSessions(conn, sessions); err != nil {
-				errCh <- err
-				return
-			}
-		case "createSession":
-			// The server normally mints the name so it can tell the UI which
-			// session it just opened; falling back keeps the agent usable on
-			// its own.
-			if sessionID == "" {
-				sessionID = newSessionID()
-			}
-			session, created := sessions.reset(sessionID, msg.Cols, msg.Rows)
-			if created {
-				restartPTY(session)
-			}
-			if err := conn.writeJSON(AgentMessage{Type: "sessionOpened", SessionID: sessionID}); err != nil {
-				errCh <- err
-				return
-			}
-			if err := sendSessions(conn, sessions); err != nil {
-				errCh <- err
-				return
-			}
-		case "killSession":
-			if sessionID == "" {
-				continue
-			}
-			if session := sessions.remove(sessionID); session != nil {
-				session.close() // closes the PTY and kills the tmux session
-			} else {
-				// Not attached in this process — it is a session that outlived
-				// an agent restart, or one the user started themselves.
-				killTmuxSession(sessionID)
-			}
-			if err := conn.writeJSON(AgentMessage{Type: "sessionClosed", SessionID: sessionID}); err != nil {
-				errCh <- err
-				return
-			}
-			if err := sendSessions(conn, sessions); err != nil {
-				errCh <- err
-				return
-			}
-		// "reset" is what pre-multi-session servers send; it means the same
-		// thing as attachSession, so both are handled here.
-		case "resize":
-			if sessionID == "" {
-				continue
-			}
-			session := sessions.get(sessionID)
-			if session == nil {
-				log.Printf("ignoring resize for unknown session %s", sessionID)
-				continue
-			}
-			session.resize(msg.Cols, msg.Rows)
-		case "attachSession", "reset":
-			if sessionID == "" {
-				log.Printf("ignoring attach with no session id")
-				continue
-			}
-			session, created := sessions.reset(sessionID, msg.Cols, msg.Rows)
-			if created {
-				restartPTY(session)
-			} else {
-				content := captureTmuxPane(sessionID)
-				if content != "" {
-					if err := conn.writeJSON(AgentMessage{Type: "output", Data: content, SessionID: sessionID}); err != nil {
-						errCh <- err
-						return
-					}
-				}
-				ptm := session.current()
-				if ptm != nil {
-					_, _ = ptm.Write([]byte{0x0c}) // Ctrl+L: redraw the terminal
+	if allowed, feature := conn.protocol.allows(msg.Type); !allowed {
+		if feature == "" {
+			return conn.refuse(msg, protocol.CodeUnknownType, "protocol %d has no %q request", conn.protocol.protocol, msg.Type)
+		}
+		return conn.refuse(msg, protocol.CodeNotEnabled, "%s was not enabled for this connection", feature)
+	}
+
+	switch msg.Type {
+	case "keystroke":
+		if sessionID == "" {
+			return conn.refuse(msg, protocol.CodeBadRequest, "keystroke with no session id")
+		}
+		session := sessions.get(sessionID)
+		if session == nil {
+			return conn.refuse(msg, protocol.CodeNotFound, "no session %s", sessionID)
+		}
+		ptm := session.current()
+		if ptm == nil {
+			return conn.refuse(msg, protocol.CodeNotFound, "session %s is not running", sessionID)
+		}
+		if _, err := ptm.Write([]byte(msg.Data)); err != nil {
+			return fmt.Errorf("write to pty failed: %w", err)
+		}
+	case "listSessions":
+		return sendSessions(conn, sessions, requestID)
+	case "createSession":
+		// The server normally mints the name so it can tell the UI which
+		// session it just opened; falling back keeps the agent usable on
+		// its own.
+		if sessionID == "" {
+			sessionID = newSessionID()
+		}
+		session, created := sessions.reset(sessionID, msg.Cols, msg.Rows)
+		if created {
+			restartPTY(session)
+		}
+		if err := conn.reply(requestID, AgentMessage{Type: "sessionOpened", SessionID: sessionID}); err != nil {
+			return err
+		}
+		return sendSessions(conn, sessions, "")
+	case "killSession":
+		if sessionID == "" {
+			return conn.refuse(msg, protocol.CodeBadRequest, "killSession with no session id")
+		}
+		if session := sessions.remove(sessionID); session != nil {
+			session.close() // closes the PTY and kills the tmux session
+		} else {
+			// Not attached in this process — it is a session that outlived
+			// an agent restart, or one the user started themselves.
+			killTmuxSession(sessionID)
+		}
+		if err := conn.sendEvent(requestID, AgentMessage{Type: "sessionClosed", SessionID: sessionID}); err != nil {
+			return err
+		}
+		return sendSessions(conn, sessions, "")
+	case "resize":
+		if sessionID == "" {
+			return conn.refuse(msg, protocol.CodeBadRequest, "resize with no session id")
+		}
+		session := sessions.get(sessionID)
+		if session == nil {
+			return conn.refuse(msg, protocol.CodeNotFound, "no session %s", sessionID)
+		}
+		session.resize(msg.Cols, msg.Rows)
+	// "reset" is what pre-multi-session servers send; it means the same
+	// thing as attachSession, so both are handled here. Only a protocol 1
+	// server gets this far with it.
+	case "attachSession", "reset":
+		if sessionID == "" {
+			return conn.refuse(msg, protocol.CodeBadRequest, "attach with no session id")
+		}
+		session, created := sessions.reset(sessionID, msg.Cols, msg.Rows)
+		if created {
+			restartPTY(session)
+		} else {
+			content := captureTmuxPane(sessionID)
+			if content != "" {
+				if err := conn.writeJSON(AgentMessage{Type: "output", Data: content, SessionID: sessionID}); err != nil {
+					return err
 				}
 			}
-		case "dockerInfo":
-			containers, err := listDockerContainers()
-			payload := AgentMessage{
-				Type:       "dockerInfo",
-				Containers: containers,
-			}
-			if err != nil {
-				payload.Error = err.Error()
-			}
-			if err := conn.writeJSON(payload); err != nil {
-				errCh <- err
-				return
-			}
-		case "systemInfo":
-			info, err := collectSystemInfo()
-			payload := AgentMessage{
-				Type:       "systemInfo",
-				SystemInfo: &info,
-			}
-			if err != nil {
-				payload.Error = err.Error()
-			}
-			if err := conn.writeJSON(payload); err != nil {
-				errCh <- err
-				return
-			}
-		case "update":
-			handleRemoteUpdate(conn, msg.Version)
-		case "networkInfo":
-			info := collectNetworkInfo()
-			payload := AgentMessage{
-				Type:        "networkInfo",
-				NetworkInfo: &info,
-			}
-			if err := conn.writeJSON(payload); err != nil {
-				errCh <- err
-				return
+			ptm := session.current()
+			if ptm != nil {
+				_, _ = ptm.Write([]byte{0x0c}) // Ctrl+L: redraw the terminal
 			}
 		}
+	case "replay":
+		session := sessions.get(sessionID)
+		if session == nil {
+			return conn.refuse(msg, protocol.CodeNotFound, "no session %s", sessionID)
+		}
+		return replayOutput(conn, session, msg.Seq)
+	case "ackOutput":
+		if session := sessions.get(sessionID); session != nil {
+			session.output.ack(msg.Seq)
+		}
+	case "ackEvent":
+		pendingEvents.ack(msg.EventID)
+	case "dockerInfo":
+		containers, err := listContainers()
+		payload := AgentMessage{
+			Type:       "dockerInfo",
+			Containers: containers,
+		}
+		if err != nil {
+			payload.Error = err.Error()
+		}
+		return conn.reply(requestID, payload)
+	case "systemInfo":
+		info, err := collectSystemInfo()
+		payload := AgentMessage{
+			Type:       "systemInfo",
+			SystemInfo: &info,
+		}
+		if err != nil {
+			payload.Error = err.Error()
+		}
+		return conn.reply(requestID, payload)
+	case "processes":
+		handleProcesses(conn, requestID)
+	case "signalProcess":
+		payload := AgentMessage{
+			Type:   "signalProcess",
+			PID:    msg.PID,
+			Signal: msg.Signal,
+		}
+		if err := signalProcess(msg.PID, msg.Signal); err != nil {
+			payload.Error = err.Error()
+		} else {
+			log.Printf("sent %s to pid %d at the control server's request", msg.Signal, msg.PID)
+		}
+		return conn.reply(requestID, payload)
+	case "systemdUnits":
+		units, err := listSystemdUnits()
+		payload := AgentMessage{
+			Type:  "systemdUnits",
+			Units: units,
+		}
+		if err != nil {
+			payload.Error = err.Error()
+		}
+		return conn.reply(requestID, payload)
+	case "unitStatus":
+		status, err := systemdUnitStatus(msg.Unit, msg.Lines)
+		payload := AgentMessage{
+			Type: "unitStatus",
+			Unit: msg.Unit,
+		}
+		if err != nil {
+			payload.Error = err.Error()
+		} else {
+			payload.UnitStatus = &status
+		}
+		return conn.reply(requestID, payload)
+	case "unitAction":
+		handleUnitAction(conn, requestID, msg.Unit, msg.Action)
+	case "queryLogs":
+		handleLogQuery(conn, requestID, msg.Query)
+	case "stopLogs":
+		stopLogFollower(msg.FollowID)
+	case "power":
+		handlePowerMessage(conn, ctl, requestID, msg.Action, msg.Delay, msg.Message)
+	case "update":
+		handleRemoteUpdate(conn, requestID, msg.Version)
+	case "networkInfo":
+		info := collectNetworkInfo()
+		payload := AgentMessage{
+			Type:        "networkInfo",
+			NetworkInfo: &info,
+		}
+		return conn.reply(requestID, payload)
+	default:
+		return conn.refuse(msg, protocol.CodeUnknownType, "unknown request type %q", msg.Type)
 	}
+	return nil
 }
 
 func readFromPTY(conn *safeConn, session *ptySession, sessions *ptyManager, errCh chan<- error) {
@@ -175,9 +229,8 @@ func readFromPTY(conn *safeConn, session *ptySession, sessions *ptyManager, errC
 		}
 		n, err := reader.Read(buf)
 		if n > 0 {
-			payload := AgentMessage{Type: "output", Data: string(buf[:n]), SessionID: session.sessionID}
-			if err := conn.writeJSON(payload); err != nil {
-				errCh <- err
+			if err := sendOutput(conn, session, string(buf[:n])); err != nil {
+				endConnection(errCh, err)
 				return
 			}
 		}
@@ -196,11 +249,11 @@ func readFromPTY(conn *safeConn, session *ptySession, sessions *ptyManager, errC
 			//
 			// The tmux session itself is left alone — see ptySession.finish.
 			session.finish()
-			_ = conn.writeJSON(AgentMessage{
+			_ = conn.sendEvent("", AgentMessage{
 				Type:      "sessionExited",
 				SessionID: session.sessionID,
 			})
-			_ = sendSessions(conn, sessions)
+			_ = sendSessions(conn, sessions, "")
 			return
 		}
 	}
@@ -211,7 +264,7 @@ func sendHeartbeats(conn *safeConn, errCh chan<- error) {
 	defer ticker.Stop()
 	for range ticker.C {
 		if err := conn.writeJSON(AgentMessage{Type: "heartbeat"}); err != nil {
-			errCh <- err
+			endConnection(errCh, err)
 			return
 		}
 	}
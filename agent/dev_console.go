@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/sidhantpanda/spectre/agent/protocol"
+)
+
+// The dev server's console: the terminal it runs in stands in for the web UI.
+//
+// Lines starting with ':' are commands; anything else is typed into the
+// attached session followed by Enter. ":raw" hands the terminal over to the
+// session completely, for programs that need every key, until Ctrl+] gives it
+// back.
+
+const devConsoleHelp = `Commands:
+  :sessions            list sessions
+  :new                 open a new session and attach to it
+  :attach <id>         attach to a session
+  :kill <id>           kill a session
+  :raw                 pass every key to the attached session; Ctrl+] to return
+  :info                request system, network and container info
+  :processes           request the process table
+  :units               request the systemd unit list
+  :update [version]    ask the agent to update itself
+  :drop                disconnect the agent; it reconnects on its own
+  :help                show this
+  :quit                stop the dev server
+Anything else is typed into the attached session.`
+
+// rawEscape (Ctrl+]) leaves raw mode, as it leaves telnet.
+const rawEscape = 0x1d
+
+func runDevServer(listen string) error {
+	srv := newDevServer()
+	console := &devConsole{srv: srv, out: os.Stdout}
+	srv.onMessage = console.show
+	srv.onConnect = func(hello protocol.AgentHello, enrolled bool) {
+		how := ""
+		if enrolled {
+			how = ", enrolled with a new device key"
+		}
+		console.printf("agent %s connected (version %s, protocol %d%s)\n",
+			hello.AgentID, hello.AgentVersion, hello.ProtocolVersion, how)
+	}
+
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	go func() { _ = http.Serve(ln, srv.handler()) }()
+
+	host := "ws://" + ln.Addr().String()
+	fmt.Printf("Development control server listening on %s\n", host)
+	fmt.Printf("Connect an agent with:\n\n    spectre-agent run --host %s --authkey dev\n\n", host)
+	fmt.Println("Every enrollment is approved automatically. Type :help for commands.")
+
+	return console.run(bufio.NewReader(os.Stdin))
+}
+
+type devConsole struct {
+	srv *devServer
+	out io.Writer
+	// mu keeps agent output and command feedback from interleaving mid-line.
+	mu       sync.Mutex
+	attached string
+}
+
+func (c *devConsole) printf(format string, args ...any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(c.out, format, args...)
+}
+
+func (c *devConsole) session() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.attached
+}
+
+func (c *devConsole) attach(id string) {
+	c.mu.Lock()
+	c.attached = id
+	c.mu.Unlock()
+}
+
+func (c *devConsole) run(in *bufio.Reader) error {
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if !strings.HasPrefix(line, ":") {
+			c.typeLine(line)
+			continue
+		}
+		fields := strings.Fields(line[1:])
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" {
+			return nil
+		}
+		if err := c.command(fields[0], fields[1:], in); err != nil {
+			c.printf("%v\n", err)
+		}
+	}
+}
+
+func (c *devConsole) typeLine(line string) {
+	id := c.session()
+	if id == "" {
+		c.printf("no session attached; use :new or :attach <id>\n")
+		return
+	}
+	if err := c.srv.send(protocol.Keystroke{SessionID: id, Data: line + "\r"}); err != nil {
+		c.printf("%v\n", err)
+	}
+}
+
+func (c *devConsole) command(name string, args []string, in *bufio.Reader) error {
+	srv := c.srv
+	switch name {
+	case "help":
+		c.printf("%s\n", devConsoleHelp)
+	case "sessions":
+		return srv.send(protocol.ListSessions{Request: srv.nextRequest()})
+	case "new":
+		id := newSessionID()
+		cols, rows := terminalSize()
+		c.attach(id)
+		return srv.send(protocol.CreateSession{Request: srv.nextRequest(), SessionID: id, Cols: cols, Rows: rows})
+	case "attach":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: :attach <id>")
+		}
+		cols, rows := terminalSize()
+		c.attach(args[0])
+		return srv.send(protocol.AttachSession{Request: srv.nextRequest(), SessionID: args[0], Cols: cols, Rows: rows})
+	case "kill":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: :kill <id>")
+		}
+		if c.session() == args[0] {
+			c.attach("")
+		}
+		return srv.send(protocol.KillSession{Request: srv.nextRequest(), SessionID: args[0]})
+	case "raw":
+		return c.raw(in)
+	case "info":
+		for _, m := range []protocol.Message{
+			protocol.SystemInfoRequest{Request: srv.nextRequest()},
+			protocol.NetworkInfoRequest{Request: srv.nextRequest()},
+			protocol.DockerInfoRequest{Request: srv.nextRequest()},
+		} {
+			if err := srv.send(m); err != nil {
+				return err
+			}
+		}
+	case "processes":
+		return srv.send(protocol.ProcessesRequest{Request: srv.nextRequest()})
+	case "units":
+		return srv.send(protocol.SystemdUnitsRequest{Request: srv.nextRequest()})
+	case "update":
+		version := ""
+		if len(args) > 0 {
+			version = args[0]
+		}
+		return srv.send(protocol.Update{Request: srv.nextRequest(), Version: version})
+	case "drop":
+		srv.closeAgent()
+	default:
+		return fmt.Errorf("unknown command :%s (try :help)", name)
+	}
+	return nil
+}
+
+// raw forwards keys as they are pressed, with the local terminal out of the
+// way, until Ctrl+].
+func (c *devConsole) raw(in *bufio.Reader) error {
+	id := c.session()
+	if id == "" {
+		return fmt.Errorf("no session attached; use :new or :attach <id>")
+	}
+	restore, err := makeRawTerminal()
+	if err != nil {
+		return err
+	}
+	defer restore()
+	c.printf("raw mode: every key goes to %s; Ctrl+] to return\r\n", id)
+
+	buf := make([]byte, 1024)
+	for {
+		n, err := in.Read(buf)
+		if err != nil {
+			return err
+		}
+		data := buf[:n]
+		escaped := false
+		if i := strings.IndexByte(string(data), rawEscape); i >= 0 {
+			data, escaped = data[:i], true
+		}
+		if len(data) > 0 {
+			if err := c.srv.send(protocol.Keystroke{SessionID: id, Data: string(data)}); err != nil {
+				return err
+			}
+		}
+		if escaped {
+			c.printf("\r\nback to line mode\r\n")
+			return nil
+		}
+	}
+}
+
+// show prints what the agent sent.
+func (c *devConsole) show(m protocol.Message) {
+	switch m := m.(type) {
+	case protocol.Heartbeat:
+	case protocol.Output:
+		if m.SessionID == c.session() {
+			c.printf("%s", m.Data)
+		}
+	case protocol.Sessions:
+		var b strings.Builder
+		fmt.Fprintf(&b, "sessions (tmux available: %v):\n", m.TmuxAvailable)
+		for _, s := range m.Sessions {
+			state := "detached"
+			if s.Attached {
+				state = "attached"
+			}
+			fmt.Fprintf(&b, "  %-44s %s, live %v, managed %v\n", s.ID, state, s.Live, s.Managed)
+		}
+		c.printf("%s", b.String())
+	case protocol.SessionOpened:
+		c.printf("[session %s opened]\n", m.SessionID)
+	case protocol.SessionClosed:
+		c.printf("[session %s closed]\n", m.SessionID)
+	case protocol.SessionExited:
+		c.printf("[session %s exited]\n", m.SessionID)
+	case protocol.Failure:
+		c.printf("[%s %s failed (%s): %s]\n", m.MessageType(), m.RequestID, m.Code, m.Error)
+	default:
+		data, _ := json.MarshalIndent(m, "", "  ")
+		c.printf("[%s]\n%s\n", m.MessageType(), data)
+	}
+}
+
+// terminalSize asks stty for the console's size, for the session to match.
+// Zero, when it is not a terminal, lets the agent pick.
+func terminalSize() (uint16, uint16) {
+	cmd := exec.Command("stty", "size")
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, 0
+	}
+	var rows, cols int
+	if _, err := fmt.Sscan(string(out), &rows, &cols); err != nil {
+		return 0, 0
+	}
+	return uint16(cols), uint16(rows)
+}
+
+// makeRawTerminal switches the console to raw mode with stty, which keeps the
+// agent free of a terminal library it otherwise has no use for.
+func makeRawTerminal() (func(), error) {
+	save := exec.Command("stty", "-g")
+	save.Stdin = os.Stdin
+	state, err := save.Output()
+	if err != nil {
+		return nil, fmt.Errorf("raw mode needs a terminal: %w", err)
+	}
+	raw := exec.Command("stty", "raw", "-echo")
+	raw.Stdin = os.Stdin
+	if err := raw.Run(); err != nil {
+		return nil, fmt.Errorf("raw mode: %w", err)
+	}
+	return func() {
+		restore := exec.Command("stty", strings.TrimSpace(string(state)))
+		restore.Stdin = os.Stdin
+		_ = restore.Run()
+	}, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/sidhantpanda/spectre/agent/protocol"
+)
+
+// A control server small enough to embed, for developing the agent.
+//
+// It implements what an agent talks to — the register socket and the two
+// approval endpoints — and nothing else: no database, no web UI, no
+// accounts. Every enrollment is approved on the spot, any credential is
+// accepted, and device keys live only as long as the process. It is for a
+// laptop and for tests, never for a network anyone else can reach.
+
+// devApprovalLifetime is how long an approval request stays answerable.
+const devApprovalLifetime = 10 * time.Minute
+
+type devServer struct {
+	mu sync.Mutex
+	// deviceKeys are the keys this process issued. A connection presenting
+	// anything else is treated as enrolling with an auth key.
+	deviceKeys map[string]bool
+	// approvals maps poll tokens to the device key each will be given.
+	approvals map[string]string
+	agent     *devAgent
+	requests  int
+
+	// onMessage sees every message an agent sends, and onConnect every
+	// connection as its handshake completes.
+	onMessage func(protocol.Message)
+	onConnect func(hello protocol.AgentHello, enrolled bool)
+}
+
+// devAgent is the connected agent. Only the newest connection is kept, as the
+// real server keeps one per device.
+type devAgent struct {
+	conn  *websocket.Conn
+	mu    sync.Mutex
+	hello protocol.AgentHello
+}
+
+func newDevServer() *devServer {
+	return &devServer{
+		deviceKeys: map[string]bool{},
+		approvals:  map[string]string{},
+		onMessage:  func(protocol.Message) {},
+		onConnect:  func(protocol.AgentHello, bool) {},
+	}
+}
+
+func (s *devServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/agents/register", s.serveAgent)
+	mux.HandleFunc("/api/devices/approval-request", s.serveApprovalRequest)
+	mux.HandleFunc("/api/devices/approval-poll", s.serveApprovalPoll)
+	return mux
+}
+
+func (s *devServer) serveApprovalRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req approvalRequest
+	_ = json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req)
+
+	token := generateDeviceID()
+	s.mu.Lock()
+	s.approvals[token] = s.issueDeviceKeyLocked()
+	s.mu.Unlock()
+	log.Printf("dev-server: approved %s (%s) without asking", req.Hostname, req.DeviceID)
+
+	writeDevJSON(w, approvalResponse{
+		UserCode:  "DEV-" + strings.ToUpper(token[:6]),
+		PollToken: token,
+		ExpiresAt: time.Now().Add(devApprovalLifetime).UnixMilli(),
+	})
+}
+
+func (s *devServer) serveApprovalPoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req pollRequest
+	_ = json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req)
+
+	s.mu.Lock()
+	key, ok := s.approvals[req.PollToken]
+	delete(s.approvals, req.PollToken)
+	s.mu.Unlock()
+	if !ok {
+		writeDevJSON(w, pollResponse{Status: "expired"})
+		return
+	}
+	writeDevJSON(w, pollResponse{Status: "approved", DeviceKey: key})
+}
+
+func (s *devServer) serveAgent(w http.ResponseWriter, r *http.Request) {
+	credential := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if credential == "" {
+		http.Error(w, "missing credential", http.StatusUnauthorized)
+		return
+	}
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	agent, err := s.handshake(conn, credential)
+	if err != nil {
+		log.Printf("dev-server: handshake with %s failed: %v", r.RemoteAddr, err)
+		return
+	}
+	defer func() {
+		s.mu.Lock()
+		if s.agent == agent {
+			s.agent = nil
+		}
+		s.mu.Unlock()
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		msg, err := protocol.DecodeAgent(data)
+		if err != nil {
+			log.Printf("dev-server: %v", err)
+			continue
+		}
+		// The events feature is granted with the rest, so queued events have
+		// to be acknowledged as the real server does, or the agent's queue
+		// only ever grows.
+		var event protocol.Event
+		if json.Unmarshal(data, &event) == nil && event.EventID != "" {
+			if err := agent.send(protocol.AckEvent{EventID: event.EventID}); err != nil {
+				log.Printf("dev-server: ack %s: %v", event.EventID, err)
+			}
+		}
+		s.onMessage(msg)
+	}
+}
+
+// handshake does what the real server does with a hello: enrol the machine if
+// it came with something other than a device key, then agree a protocol. The
+// dev server enables every feature the agent offers.
+func (s *devServer) handshake(conn *websocket.Conn, credential string) (*devAgent, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(handshakeWait))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	msg, err := protocol.DecodeAgent(data)
+	if err != nil {
+		return nil, err
+	}
+	hello, ok := msg.(protocol.AgentHello)
+	if !ok {
+		return nil, fmt.Errorf("expected hello, got %q", msg.MessageType())
+	}
+
+	agent := &devAgent{conn: conn, hello: hello}
+	s.mu.Lock()
+	enrolled := !s.deviceKeys[credential]
+	key := ""
+	if enrolled {
+		key = s.issueDeviceKeyLocked()
+	}
+	previous := s.agent
+	s.agent = agent
+	s.mu.Unlock()
+	if previous != nil {
+		_ = previous.conn.Close()
+	}
+
+	if enrolled {
+		if err := agent.send(protocol.Enrolled{DeviceKey: key}); err != nil {
+			return nil, err
+		}
+	}
+	reply := protocol.ServerHello{}
+	if hello.ProtocolVersion > 0 {
+		reply.ProtocolVersion = min(hello.ProtocolVersion, protocol.Version)
+		reply.Features = hello.Capabilities
+	}
+	if err := agent.send(reply); err != nil {
+		return nil, err
+	}
+	s.onConnect(hello, enrolled)
+	return agent, nil
+}
+
+func (s *devServer) issueDeviceKeyLocked() string {
+	key := "dk_dev_" + generateDeviceID()
+	s.deviceKeys[key] = true
+	return key
+}
+
+func (a *devAgent) send(m protocol.Message) error {
+	data, err := protocol.Encode(m)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+var errNoDevAgent = errors.New("no agent is connected")
+
+// send delivers a message to the connected agent.
+func (s *devServer) send(m protocol.Message) error {
+	s.mu.Lock()
+	agent := s.agent
+	s.mu.Unlock()
+	if agent == nil {
+		return errNoDevAgent
+	}
+	return agent.send(m)
+}
+
+// nextRequest mints a request id, so replies can be matched up.
+func (s *devServer) nextRequest() protocol.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	return protocol.Request{RequestID: fmt.Sprintf("dev-%d", s.requests)}
+}
+
+// closeAgent drops the connected agent, which will reconnect on its own.
+func (s *devServer) closeAgent() {
+	s.mu.Lock()
+	agent := s.agent
+	s.agent = nil
+	s.mu.Unlock()
+	if agent != nil {
+		_ = agent.conn.Close()
+	}
+}
+
+func writeDevJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
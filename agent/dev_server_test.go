@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sidhantpanda/spectre/agent/protocol"
+)
+
+// The agent's real connection code, against the dev server: enrolment,
+// negotiation and a request answered end to end.
+func TestAgentAgainstDevServer(t *testing.T) {
+	t.Setenv("SPECTRE_AGENT_HOME", t.TempDir())
+
+	srv := newDevServer()
+	messages := make(chan protocol.Message, 64)
+	connected := make(chan bool, 1)
+	srv.onMessage = func(m protocol.Message) { messages <- m }
+	srv.onConnect = func(_ protocol.AgentHello, enrolled bool) { connected <- enrolled }
+	ts := httptest.NewServer(srv.handler())
+	defer ts.Close()
+	defer srv.closeAgent()
+
+	device := &DeviceInfo{DeviceID: "dev-test"}
+	done := make(chan error, 1)
+	go func() {
+		_, err := runConnection(newAgentControl(), ts.URL, "sk_anything", device, map[string]any{"hostname": "dev"})
+		done <- err
+	}()
+
+	select {
+	case enrolled := <-connected:
+		if !enrolled {
+			t.Fatal("an unknown credential should have been enrolled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent never connected")
+	}
+
+	req := srv.nextRequest()
+	if err := srv.send(protocol.NetworkInfoRequest{Request: req}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case m := <-messages:
+			reply, ok := m.(protocol.NetworkInfoReply)
+			if !ok {
+				continue
+			}
+			if reply.RequestID != req.RequestID || reply.NetworkInfo == nil {
+				t.Fatalf("unexpected reply %+v", reply)
+			}
+			srv.closeAgent()
+			<-done
+			if device.DeviceKey == "" || !srv.deviceKeys[device.DeviceKey] {
+				t.Fatalf("agent did not keep the issued device key (got %q)", device.DeviceKey)
+			}
+			return
+		case <-deadline:
+			t.Fatal("no networkInfo reply")
+		}
+	}
+}
+
+func TestDevServerApprovesEnrollment(t *testing.T) {
+	srv := newDevServer()
+	ts := httptest.NewServer(srv.handler())
+	defer ts.Close()
+
+	var approval approvalResponse
+	if err := postJSON(ts.URL+"/api/devices/approval-request", approvalRequest{Hostname: "h", DeviceID: "d"}, &approval); err != nil {
+		t.Fatal(err)
+	}
+	var poll pollResponse
+	if err := postJSON(ts.URL+"/api/devices/approval-poll", pollRequest{PollToken: approval.PollToken}, &poll); err != nil {
+		t.Fatal(err)
+	}
+	if poll.Status != "approved" || !srv.deviceKeys[poll.DeviceKey] {
+		t.Fatalf("poll = %+v", poll)
+	}
+
+	// Each approval is handed out once.
+	body, _ := json.Marshal(pollRequest{PollToken: approval.PollToken})
+	resp, err := http.Post(ts.URL+"/api/devices/approval-poll", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var again pollResponse
+	_ = json.NewDecoder(resp.Body).Decode(&again)
+	if again.Status != "expired" {
+		t.Fatalf("second poll = %+v", again)
+	}
+}
+
+// The dev server grants the events feature, so it has to acknowledge what the
+// agent queues; otherwise every event is kept and resent on each reconnect.
+func TestDevServerAcknowledgesQueuedEvents(t *testing.T) {
+	t.Setenv("SPECTRE_AGENT_HOME", t.TempDir())
+	pendingEvents.push(AgentMessage{Type: "sessionExited", SessionID: "s1", EventID: newEventID()})
+	pendingEvents.push(AgentMessage{Type: "sessionClosed", SessionID: "s2", EventID: newEventID()})
+
+	srv := newDevServer()
+	ts := httptest.NewServer(srv.handler())
+	defer ts.Close()
+	defer srv.closeAgent()
+
+	device := &DeviceInfo{DeviceID: "dev-test"}
+	done := make(chan error, 1)
+	go func() {
+		_, err := runConnection(newAgentControl(), ts.URL, "sk_anything", device, map[string]any{"hostname": "dev"})
+		done <- err
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(loadPendingEvents()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("events still queued: %+v", loadPendingEvents())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	srv.closeAgent()
+	<-done
+}
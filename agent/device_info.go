@@ -13,18 +13,17 @@ import (
 type DeviceInfo struct {
 	DeviceID  string `json:"deviceId"`
 	DeviceKey string `json:"deviceKey,omitempty"`
+	// Host and Labels come from a provisioning file. Host is the server to
+	// use when `run` is not given one; labels are reported in every hello.
+	Host   string            `json:"host,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// UpdateToken is sent to a mirror update source in place of the device
+	// key, which no mirror gets.
+	UpdateToken string `json:"updateToken,omitempty"`
 }
 
 func deviceInfoPath() (string, error) {
-	home := os.Getenv("SPECTRE_AGENT_HOME")
-	if home == "" {
-		var err error
-		home, err = os.UserHomeDir()
-		if err != nil {
-			return "", err
-		}
-	}
-	return filepath.Join(home, ".spectre-agent", "device-info.json"), nil
+	return agentStatePath("device-info.json")
 }
 
 // loadDeviceInfo reads this machine's identity without creating one, and says
@@ -42,7 +41,7 @@ func loadDeviceInfo() (DeviceInfo, string, bool) {
 	}
 	// The installed service keeps its key in its own state directory, which is
 	// not where an interactive `status` would look.
-	for _, home := range []string{serviceAgentHome(), defaultServiceAgentHome} {
+	for _, home := range serviceHomes() {
 		candidates = append(candidates, filepath.Join(home, ".spectre-agent", "device-info.json"))
 	}
 
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// `spectre-agent doctor`: the checklist we used to walk by hand when a machine
+// would not show up on the dashboard.
+//
+// The network checks follow the path a connection takes — name, socket,
+// certificate, upgrade — and stop at the first one that fails, since
+// everything after it would fail for the same reason. The local checks are
+// the things that let a connected agent actually work: a readable device key,
+// tmux, and a binary the service can replace.
+//
+// Doctor never presents the device key to the server. Connecting with it
+// would supersede the running agent's own connection.
+
+const (
+	doctorTimeout = 10 * time.Second
+	// certExpiryWarning is how close to expiry a certificate gets a warning.
+	certExpiryWarning = 14 * 24 * time.Hour
+	clockSkewWarning  = 30 * time.Second
+	clockSkewFailure  = 5 * time.Minute
+)
+
+// doctorRootCAs is a seam for tests, which serve a self-signed certificate.
+// Nil means the system roots, as the agent itself uses.
+var doctorRootCAs *x509.CertPool
+
+type doctorStatus string
+
+const (
+	doctorPass doctorStatus = "PASS"
+	doctorWarn doctorStatus = "WARN"
+	doctorFail doctorStatus = "FAIL"
+	doctorSkip doctorStatus = "SKIP"
+)
+
+type doctorCheck struct {
+	name   string
+	status doctorStatus
+	detail string
+	fix    string
+}
+
+func runDoctor(host string) error {
+	if host == "" {
+		if running, info := checkRunning(); running && info.Host != "" {
+			host = info.Host
+		}
+	}
+
+	fmt.Printf("spectre-agent %s doctor\n\n", getAgentVersion())
+	checks := append(networkChecks(host), localChecks()...)
+
+	failed := 0
+	for _, c := range checks {
+		printDoctorCheck(c)
+		if c.status == doctorFail {
+			failed++
+		}
+	}
+	fmt.Println()
+	if failed > 0 {
+		return fmt.Errorf("%d check(s) failed", failed)
+	}
+	fmt.Println("No problems found.")
+	return nil
+}
+
+func printDoctorCheck(c doctorCheck) {
+	lines := strings.Split(c.detail, "\n")
+	fmt.Printf("  %s  %-14s %s\n", c.status, c.name, lines[0])
+	for _, line := range lines[1:] {
+		fmt.Printf("  %20s %s\n", "", line)
+	}
+	if c.fix != "" && c.status != doctorPass {
+		fmt.Printf("  %20s fix: %s\n", "", c.fix)
+	}
+}
+
+// networkChecks walks the connection path to host, skipping what lies beyond
+// the first failure.
+func networkChecks(host string) []doctorCheck {
+	names := []string{"DNS", "TCP", "TLS", "WebSocket", "Clock"}
+	skipRest := func(checks []doctorCheck) []doctorCheck {
+		for _, name := range names[len(checks)-1:] {
+			checks = append(checks, doctorCheck{name: name, status: doctorSkip, detail: "skipped"})
+		}
+		return checks
+	}
+
+	wsURL, err := normalizeServerURL(host, "ws", "/api/agents/register")
+	if err != nil {
+		return skipRest([]doctorCheck{{
+			name: "Server URL", status: doctorFail, detail: err.Error(),
+			fix: "pass --host, e.g. --host wss://spectre.example.com",
+		}})
+	}
+	checks := []doctorCheck{{name: "Server URL", status: doctorPass, detail: wsURL}}
+	u, _ := url.Parse(wsURL)
+	secure := u.Scheme == "wss"
+	hostname := u.Hostname()
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if secure {
+			port = "443"
+		}
+	}
+	tlsConfig := &tls.Config{ServerName: hostname, RootCAs: doctorRootCAs}
+
+	steps := []func() doctorCheck{
+		func() doctorCheck { return checkDNS(hostname) },
+		func() doctorCheck { return checkTCP(net.JoinHostPort(hostname, port)) },
+		func() doctorCheck { return checkTLS(net.JoinHostPort(hostname, port), secure, hostname, tlsConfig) },
+		func() doctorCheck { return checkUpgrade(wsURL, tlsConfig) },
+		func() doctorCheck { return checkClock(host, tlsConfig) },
+	}
+	for _, step := range steps {
+		c := step()
+		checks = append(checks, c)
+		if c.status == doctorFail {
+			return skipRest(checks)
+		}
+	}
+	return checks
+}
+
+func checkDNS(hostname string) doctorCheck {
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, hostname)
+	if err != nil {
+		return doctorCheck{
+			name: "DNS", status: doctorFail, detail: err.Error(),
+			fix: "check the hostname, and that /etc/resolv.conf points at a working resolver",
+		}
+	}
+	return doctorCheck{name: "DNS", status: doctorPass, detail: hostname + " → " + strings.Join(addrs, ", ")}
+}
+
+func checkTCP(addr string) doctorCheck {
+	started := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, doctorTimeout)
+	if err != nil {
+		return doctorCheck{
+			name: "TCP", status: doctorFail, detail: err.Error(),
+			fix: "check that the server is up and that no firewall blocks outbound connections to " + addr,
+		}
+	}
+	conn.Close()
+	return doctorCheck{name: "TCP", status: doctorPass, detail: fmt.Sprintf("connected to %s in %s", addr, time.Since(started).Round(time.Millisecond))}
+}
+
+func checkTLS(addr string, secure bool, hostname string, config *tls.Config) doctorCheck {
+	if !secure {
+		if isLoopback(hostname) {
+			return doctorCheck{name: "TLS", status: doctorPass, detail: "plaintext, to this machine"}
+		}
+		return doctorCheck{
+			name: "TLS", status: doctorWarn, detail: "plaintext: terminal I/O and the device key cross the network unencrypted",
+			fix: "serve the control server over HTTPS and connect with wss://",
+		}
+	}
+
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: doctorTimeout}, Config: config}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return doctorCheck{
+			name: "TLS", status: doctorFail, detail: err.Error(),
+			fix: "the certificate must be valid for " + hostname + " and served with its intermediates; check the proxy's certificate configuration",
+		}
+	}
+	defer conn.Close()
+
+	chain := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	var lines []string
+	for _, cert := range chain {
+		lines = append(lines, fmt.Sprintf("%s (issued by %s), expires %s",
+			certName(cert), cert.Issuer.CommonName, cert.NotAfter.Format("2006-01-02")))
+	}
+	c := doctorCheck{name: "TLS", status: doctorPass, detail: strings.Join(lines, "\n")}
+	if left := time.Until(chain[0].NotAfter); left < certExpiryWarning {
+		c.status = doctorWarn
+		c.fix = fmt.Sprintf("the certificate expires in %d day(s); renew it", int(left.Hours()/24))
+	}
+	return c
+}
+
+func certName(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return cert.Subject.String()
+}
+
+// checkUpgrade asks for a WebSocket without a credential. The server refuses
+// it with a 401 — but only after recognising it as an upgrade on the register
+// path, which is the part a misconfigured proxy gets wrong.
+func checkUpgrade(wsURL string, config *tls.Config) doctorCheck {
+	dialer := websocket.Dialer{HandshakeTimeout: doctorTimeout, TLSClientConfig: config}
+	conn, resp, err := dialer.Dial(wsURL, nil)
+	if err == nil {
+		conn.Close()
+		return doctorCheck{name: "WebSocket", status: doctorPass, detail: "upgrade accepted"}
+	}
+	if rejected := asAuthRejected(resp); rejected != nil {
+		return doctorCheck{name: "WebSocket", status: doctorPass, detail: "the server answered the upgrade and asked for a credential"}
+	}
+	return doctorCheck{
+		name: "WebSocket", status: doctorFail, detail: fmt.Sprintf("%v%s", err, responseDetail(resp)),
+		fix: "a proxy in front of the server must pass WebSocket upgrades (the Upgrade and Connection headers) through on /api/agents/register",
+	}
+}
+
+// checkClock compares this machine's clock with the Date the server sends.
+// Certificates are checked against the local clock, and a wrong one puts
+// scheduled power actions and every log timestamp at the wrong time.
+func checkClock(host string, config *tls.Config) doctorCheck {
+	statusURL, err := normalizeServerURL(host, "http", "/api/auth/status")
+	if err != nil {
+		return doctorCheck{name: "Clock", status: doctorSkip, detail: err.Error()}
+	}
+	client := &http.Client{Timeout: doctorTimeout, Transport: &http.Transport{TLSClientConfig: config}}
+	sent := time.Now()
+	resp, err := client.Get(statusURL)
+	if err != nil {
+		return doctorCheck{name: "Clock", status: doctorSkip, detail: "could not ask the server: " + err.Error()}
+	}
+	resp.Body.Close()
+	received := time.Now()
+	serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return doctorCheck{name: "Clock", status: doctorSkip, detail: "the server sent no Date header"}
+	}
+
+	// The server stamped its Date somewhere in the round trip; the midpoint is
+	// the best guess of when. Date only has whole seconds anyway.
+	local := sent.Add(received.Sub(sent) / 2)
+	skew := local.Sub(serverTime).Round(time.Second)
+	if skew < 0 {
+		skew = -skew
+	}
+	c := doctorCheck{name: "Clock", status: doctorPass, detail: fmt.Sprintf("within %s of the server", max(skew, time.Second))}
+	switch {
+	case skew >= clockSkewFailure:
+		c.status = doctorFail
+	case skew >= clockSkewWarning:
+		c.status = doctorWarn
+	default:
+		return c
+	}
+	c.detail = fmt.Sprintf("this machine's clock is %s off the server's", skew)
+	c.fix = "enable time synchronisation, e.g. timedatectl set-ntp true"
+	return c
+}
+
+func localChecks() []doctorCheck {
+	return []doctorCheck{checkDeviceKey(), checkTmux(), checkSelfUpdate()}
+}
+
+// checkDeviceKey confirms the machine is enrolled and that the service
+// account — not just whoever runs doctor — can read its key.
+func checkDeviceKey() doctorCheck {
+	info, path, found := loadDeviceInfo()
+	if !found {
+		return doctorCheck{
+			name: "Device key", status: doctorFail, detail: "no device identity found",
+			fix: "enrol this machine: sudo spectre-agent up --host <server>",
+		}
+	}
+	if info.DeviceKey == "" {
+		return doctorCheck{
+			name: "Device key", status: doctorFail, detail: path + " holds no device key; this machine is not enrolled",
+			fix: "enrol this machine: sudo spectre-agent up --host <server>",
+		}
+	}
+	uid, gid, hasAccount := serviceAccountIDsFn()
+	if !hasAccount {
+		return doctorCheck{name: "Device key", status: doctorPass, detail: path + " (the service runs as root)"}
+	}
+	account, _ := resolveServiceAccount()
+	dir := filepath.Dir(path)
+	if !accessibleBy(dir, uid, gid, 0o1) || !accessibleBy(path, uid, gid, 0o4) {
+		return doctorCheck{
+			name: "Device key", status: doctorFail, detail: path + " is not readable by " + account,
+			fix: fmt.Sprintf("sudo chown -R %s %s", account, dir),
+		}
+	}
+	return doctorCheck{name: "Device key", status: doctorPass, detail: path + ", readable by " + account}
+}
+
+// checkTmux starts a throwaway tmux server on a socket of its own, so
+// nothing of the user's is touched.
+func checkTmux() doctorCheck {
+	if !isTmuxAvailable() {
+		return doctorCheck{
+			name: "tmux", status: doctorWarn, detail: "not installed: sessions are plain shells and end when the agent restarts",
+			fix: "install tmux with the system package manager",
+		}
+	}
+	version, _ := exec.Command(tmuxPath, "-V").Output()
+	socket := fmt.Sprintf("spectre-doctor-%d", os.Getpid())
+	out, err := exec.Command(tmuxPath, "-L", socket, "-f", "/dev/null", "new-session", "-d", "true").CombinedOutput()
+	_ = exec.Command(tmuxPath, "-L", socket, "kill-server").Run()
+	if err != nil {
+		return doctorCheck{
+			name: "tmux", status: doctorFail, detail: fmt.Sprintf("%s could not start a session: %v %s", tmuxPath, err, strings.TrimSpace(string(out))),
+			fix: "run tmux by hand as the service account to see why",
+		}
+	}
+	return doctorCheck{name: "tmux", status: doctorPass, detail: strings.TrimSpace(string(version))}
+}
+
+// checkSelfUpdate applies resolveServiceBinary's test without its remedy:
+// can the service account replace the binary it runs?
+func checkSelfUpdate() doctorCheck {
+	exe, err := currentExecutablePath()
+	if err != nil {
+		return doctorCheck{name: "Self-update", status: doctorFail, detail: err.Error()}
+	}
+	uid, gid, hasAccount := serviceAccountIDsFn()
+	if !hasAccount {
+		return doctorCheck{name: "Self-update", status: doctorPass, detail: exe + " (the service runs as root)"}
+	}
+	account, _ := resolveServiceAccount()
+	if !serviceCanReplace(exe, uid, gid) {
+		return doctorCheck{
+			name: "Self-update", status: doctorFail,
+			detail: fmt.Sprintf("%s is not writable by %s, so updates from the dashboard will fail", filepath.Dir(exe), account),
+			fix:    "run sudo spectre-agent up again; it moves the binary to " + serviceBinaryPath(),
+		}
+	}
+	return doctorCheck{name: "Self-update", status: doctorPass, detail: exe + ", replaceable by " + account}
+}
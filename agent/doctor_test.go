@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/x509"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDoctorPassesAgainstAHealthyServer(t *testing.T) {
+	srv := httptest.NewTLSServer(newDevServer().handler())
+	defer srv.Close()
+
+	doctorRootCAs = x509.NewCertPool()
+	doctorRootCAs.AddCert(srv.Certificate())
+	defer func() { doctorRootCAs = nil }()
+
+	checks := networkChecks(srv.URL)
+	want := []string{"Server URL", "DNS", "TCP", "TLS", "WebSocket", "Clock"}
+	if len(checks) != len(want) {
+		t.Fatalf("got %d checks, want %d: %+v", len(checks), len(want), checks)
+	}
+	for i, c := range checks {
+		if c.name != want[i] {
+			t.Errorf("check %d is %q, want %q", i, c.name, want[i])
+		}
+		if c.status != doctorPass {
+			t.Errorf("%s: %s %s", c.name, c.status, c.detail)
+		}
+	}
+	if !strings.Contains(checks[0].detail, "wss://") {
+		t.Errorf("an https host should be checked over wss, got %s", checks[0].detail)
+	}
+}
+
+func TestDoctorSkipsWhatLiesBeyondAFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close() // nothing listens there now
+
+	checks := networkChecks("ws://" + addr)
+	statuses := map[string]doctorStatus{}
+	for _, c := range checks {
+		statuses[c.name] = c.status
+	}
+	if statuses["DNS"] != doctorPass || statuses["TCP"] != doctorFail {
+		t.Fatalf("statuses = %v, want DNS to pass and TCP to fail", statuses)
+	}
+	for _, name := range []string{"TLS", "WebSocket", "Clock"} {
+		if statuses[name] != doctorSkip {
+			t.Errorf("%s = %s, want it skipped after the TCP failure", name, statuses[name])
+		}
+	}
+	for _, c := range checks {
+		if c.status == doctorFail && c.fix == "" {
+			t.Errorf("%s failed without a fix", c.name)
+		}
+	}
+}
+
+func TestDoctorFlagsAnUnreplaceableBinary(t *testing.T) {
+	t.Setenv("SPECTRE_AGENT_HOME", t.TempDir())
+	original := serviceAccountIDsFn
+	// An account that owns nothing, so no directory the binary sits in is
+	// writable to it.
+	serviceAccountIDsFn = func() (int, int, bool) { return 65533, 65533, true }
+	defer func() { serviceAccountIDsFn = original }()
+
+	if c := checkSelfUpdate(); c.status != doctorFail || c.fix == "" {
+		t.Fatalf("checkSelfUpdate = %+v, want a failure with a fix", c)
+	}
+}
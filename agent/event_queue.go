@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/sidhantpanda/spectre/agent/protocol"
+)
+
+// Events that must reach the server.
+//
+// Most of what the agent sends is state the server can simply ask for again:
+// a session list, system info, a page of logs. A few messages are things that
+// happened — a session ended or was closed, an update moved on — and a server
+// that misses one keeps a wrong picture until something else corrects it.
+// Those go through this queue rather than straight onto the socket.
+//
+// Each event gets an id and is written to the state directory before it is
+// sent, so neither a dropped link nor a restart loses it. After every
+// handshake whatever is still queued goes out first, oldest first, ahead of
+// anything new. A server that enabled the "events" feature acknowledges each
+// one with "ackEvent", and only then is it let go; until it is, every new
+// connection sends it again and the server drops the repeats by id. A server
+// from before acknowledgements gets each event once it can be written, which
+// still covers the common case of a link that was already down.
+
+const (
+	pendingEventsFile = "events.json"
+
+	// maxPendingEvents bounds the queue through a long outage. Past it the
+	// oldest go: a session that ended days ago matters less than today's.
+	maxPendingEvents = 256
+)
+
+type eventQueue struct {
+	// mu guards the file.
+	mu sync.Mutex
+	// sendMu keeps events on the wire in queue order. It is separate from mu
+	// so an ack is never stuck behind a slow write.
+	sendMu sync.Mutex
+	// conn and sent are what has gone out on the current connection, so a
+	// drain does not repeat events still waiting for their ack.
+	conn *safeConn
+	sent map[string]bool
+}
+
+var pendingEvents = &eventQueue{}
+
+var errNotConnected = errors.New("not connected to the control server")
+
+// sendEvent is reply for a message the server must not miss: it is queued
+// under a fresh event id and then sent along with anything queued before it.
+// The error is the send's; the event is kept either way. On a nil conn,
+// between connections, it is only queued, for the next handshake to send.
+func (c *safeConn) sendEvent(requestID string, msg AgentMessage) error {
+	msg = addressed(requestID, msg)
+	msg.EventID = newEventID()
+	pendingEvents.push(msg)
+	if c == nil {
+		return errNotConnected
+	}
+	return pendingEvents.drain(c)
+}
+
+// push appends an event to the queue.
+func (q *eventQueue) push(msg AgentMessage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	events := loadPendingEvents()
+	events = append(events, msg)
+	if over := len(events) - maxPendingEvents; over > 0 {
+		log.Printf("event queue full; dropping the %d oldest", over)
+		events = events[over:]
+	}
+	if err := writeStateJSON(pendingEventsFile, events); err != nil {
+		log.Printf("warning: could not queue %s: %v", msg.Type, err)
+	}
+}
+
+// drain sends, in order, every queued event not yet sent on conn.
+func (q *eventQueue) drain(conn *safeConn) error {
+	q.sendMu.Lock()
+	defer q.sendMu.Unlock()
+	if q.conn != conn {
+		q.conn, q.sent = conn, map[string]bool{}
+	}
+
+	q.mu.Lock()
+	events := loadPendingEvents()
+	q.mu.Unlock()
+
+	var err error
+	written := map[string]bool{}
+	for _, e := range events {
+		if q.sent[e.EventID] {
+			continue
+		}
+		if err = conn.writeJSON(e); err != nil {
+			break
+		}
+		q.sent[e.EventID] = true
+		written[e.EventID] = true
+	}
+
+	// Nothing will acknowledge these, so written is as delivered as they get.
+	if !conn.protocol.features[protocol.FeatureEvents] && len(written) > 0 {
+		q.remove(written)
+	}
+	return err
+}
+
+// ack lets go of an event the server has confirmed.
+func (q *eventQueue) ack(eventID string) {
+	q.remove(map[string]bool{eventID: true})
+}
+
+func (q *eventQueue) remove(ids map[string]bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	events := loadPendingEvents()
+	kept := events[:0]
+	for _, e := range events {
+		if !ids[e.EventID] {
+			kept = append(kept, e)
+		}
+	}
+	if len(kept) == len(events) {
+		return
+	}
+	var err error
+	if len(kept) == 0 {
+		err = removeStateFile(pendingEventsFile)
+	} else {
+		err = writeStateJSON(pendingEventsFile, kept)
+	}
+	if err != nil {
+		log.Printf("warning: could not update the event queue: %v", err)
+	}
+}
+
+func loadPendingEvents() []AgentMessage {
+	var events []AgentMessage
+	readStateJSON(pendingEventsFile, &events)
+	return events
+}
+
+// newEventID only has to be unique among one machine's events.
+func newEventID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
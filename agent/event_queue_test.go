@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sidhantpanda/spectre/agent/protocol"
+)
+
+// eventRecorder is a recorder on a connection that enabled acknowledgements.
+func eventRecorder(t *testing.T) (*safeConn, <-chan AgentMessage) {
+	t.Helper()
+	conn, replies := replyRecorder(t)
+	conn.protocol.features[protocol.FeatureEvents] = true
+	return conn, replies
+}
+
+func assertNoMoreEvents(t *testing.T, replies <-chan AgentMessage) {
+	t.Helper()
+	select {
+	case msg := <-replies:
+		t.Fatalf("unexpected %+v", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestEventsOutliveTheLinkAndArriveInOrder(t *testing.T) {
+	t.Setenv("SPECTRE_AGENT_HOME", t.TempDir())
+
+	down, _ := eventRecorder(t)
+	_ = down.close()
+	if err := down.sendEvent("", AgentMessage{Type: "sessionExited", SessionID: "s1"}); err == nil {
+		t.Fatal("a send on a closed link succeeded")
+	}
+	_ = down.sendEvent("k1", AgentMessage{Type: "sessionClosed", SessionID: "s2"})
+
+	conn, replies := eventRecorder(t)
+	if err := pendingEvents.drain(conn); err != nil {
+		t.Fatal(err)
+	}
+	exited, closed := nextReply(t, replies), nextReply(t, replies)
+	if exited.Type != "sessionExited" || closed.Type != "sessionClosed" || closed.RequestID != "k1" {
+		t.Fatalf("delivered %+v then %+v", exited, closed)
+	}
+	if exited.EventID == "" || exited.EventID == closed.EventID {
+		t.Fatalf("event ids %q and %q", exited.EventID, closed.EventID)
+	}
+
+	// Not again on this connection, but again on the next until acknowledged.
+	_ = pendingEvents.drain(conn)
+	assertNoMoreEvents(t, replies)
+	if err := handleControlMessage(conn, newAgentControl(), ControlMessage{Type: "ackEvent", EventID: exited.EventID}, nil); err != nil {
+		t.Fatal(err)
+	}
+	next, replies := eventRecorder(t)
+	_ = pendingEvents.drain(next)
+	if again := nextReply(t, replies); again.EventID != closed.EventID {
+		t.Fatalf("resent %+v, want only the unacknowledged event", again)
+	}
+	assertNoMoreEvents(t, replies)
+
+	pendingEvents.ack(closed.EventID)
+	if events := loadPendingEvents(); len(events) != 0 {
+		t.Fatalf("queue holds %+v after every ack", events)
+	}
+}
+
+// A server that never acknowledges gets each event once.
+func TestEventsWithoutAcknowledgementsAreSentOnce(t *testing.T) {
+	t.Setenv("SPECTRE_AGENT_HOME", t.TempDir())
+	conn, replies := replyRecorder(t)
+
+	if err := conn.sendEvent("", AgentMessage{Type: "sessionExited", SessionID: "s1"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := nextReply(t, replies); msg.Type != "sessionExited" {
+		t.Fatalf("sent %+v", msg)
+	}
+	if events := loadPendingEvents(); len(events) != 0 {
+		t.Fatalf("queue holds %+v", events)
+	}
+}
+
+func TestEventQueueDropsTheOldestWhenFull(t *testing.T) {
+	t.Setenv("SPECTRE_AGENT_HOME", t.TempDir())
+	for i := 0; i < maxPendingEvents+10; i++ {
+		pendingEvents.push(AgentMessage{Type: "sessionExited", EventID: newEventID(), Seq: uint64(i)})
+	}
+	events := loadPendingEvents()
+	if len(events) != maxPendingEvents || events[0].Seq != 10 {
+		t.Fatalf("kept %d events starting at %d", len(events), events[0].Seq)
+	}
+}
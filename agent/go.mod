@@ -1,4 +1,4 @@
-module spectre-agent
+module github.com/sidhantpanda/spectre/agent
 
 go 1.21
 
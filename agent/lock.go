@@ -3,72 +3,161 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"syscall"
 )
 
-// AgentInstanceInfo is written to a lock file readable by anyone on the host,
-// so it carries only non-sensitive identifiers. Credentials live in the device
-// info file, which is not world-readable.
+// One agent per state directory.
+//
+// The lock is an advisory flock on agent.lock, held for the life of the
+// process. The kernel drops it when the process exits, however it exits, so
+// there is nothing stale to clean up, and two agents starting at once cannot
+// both get it. The file itself stays empty and is never removed: unlinking a
+// locked file would let the next agent lock a fresh inode while another still
+// holds the old one.
+//
+// What `status` reports — PID, agent id, server — is kept apart from the lock,
+// in instance.json. A reader cannot take the lock to check it without
+// briefly blocking the agent from starting, and a non-root `status` could not
+// open a 0600 lock file anyway. The PID is checked together with the process
+// start time, so a recycled PID is not mistaken for the agent.
+
+const (
+	lockFileName     = "agent.lock"
+	instanceFileName = "instance.json"
+)
+
+// AgentInstanceInfo describes the running agent. It carries only identifiers;
+// credentials live in the device info file.
 type AgentInstanceInfo struct {
-	PID          int    `json:"pid"`
-	AgentID      string `json:"agentId"`
-	Host         string `json:"host,omitempty"`
-	lockFilePath string
+	PID int `json:"pid"`
+	// StartTime is when the process started, as processStartTime reports it.
+	StartTime string `json:"startTime,omitempty"`
+	AgentID   string `json:"agentId"`
+	Host      string `json:"host,omitempty"`
+	// UpdateSource is where the agent fetches updates from, so `update` run
+	// by hand uses the same place.
+	UpdateSource string `json:"updateSource,omitempty"`
+	// Binary is the file the agent runs from, which `update` has to replace
+	// and which need not be the one on PATH: a per-user install may run a
+	// copy of its own.
+	Binary string `json:"binary,omitempty"`
 }
 
-func lockFilePath() string {
-	return filepath.Join(os.TempDir(), "spectre-agent.lock")
+// instanceLock is a held lock; release gives it up.
+type instanceLock struct {
+	file *os.File
 }
 
-// ensureSingleInstance attempts to acquire a simple lock so only one agent runs per machine.
-// Returns true when lock is acquired, or false with info about the running agent.
-func ensureSingleInstance(info AgentInstanceInfo) (bool, *AgentInstanceInfo, error) {
-	path := lockFilePath()
-	info.lockFilePath = path
+// ensureSingleInstance takes the lock and records info. When another agent
+// holds the lock it returns a nil lock and, if it can tell, who that is.
+func ensureSingleInstance(info AgentInstanceInfo) (*instanceLock, *AgentInstanceInfo, error) {
+	path, err := agentStatePath(lockFileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			// The holder may not have written its record yet, if it started
+			// a moment ago; then all that is known is that it exists.
+			var running AgentInstanceInfo
+			if readStateJSON(instanceFileName, &running) {
+				return nil, &running, nil
+			}
+			return nil, nil, nil
+		}
+		return nil, nil, fmt.Errorf("lock %s: %w", path, err)
+	}
 
-	existing, err := readExistingInstance(path)
-	if err == nil && processRunning(existing.PID) {
-		return false, existing, nil
+	if started, err := processStartTime(info.PID); err == nil {
+		info.StartTime = started
+	}
+	if err := writeStateJSON(instanceFileName, info); err != nil {
+		file.Close()
+		return nil, nil, err
 	}
+	return &instanceLock{file: file}, nil, nil
+}
 
-	if err := writeInstance(path, info); err != nil {
-		return false, nil, err
+// release removes the instance record and gives up the lock.
+func (l *instanceLock) release() error {
+	err := removeStateFile(instanceFileName)
+	_ = syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
 	}
-	return true, nil, nil
+	return err
 }
 
-func readExistingInstance(path string) (*AgentInstanceInfo, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
+// readRunningInstance finds the running agent's record: this user's state
+// directory first, then the installed service's. The service's state
+// directory is 0700, so another account cannot read its record; when no
+// record was found, the error names one that could not be read, and an agent
+// may be running after all.
+func readRunningInstance() (*AgentInstanceInfo, bool, error) {
+	candidates := []string{}
+	if path, err := agentStatePath(instanceFileName); err == nil {
+		candidates = append(candidates, path)
 	}
-	var info AgentInstanceInfo
-	if err := json.Unmarshal(data, &info); err != nil {
-		return nil, err
+	for _, home := range serviceHomes() {
+		candidates = append(candidates, filepath.Join(home, ".spectre-agent", instanceFileName))
 	}
-	info.lockFilePath = path
-	return &info, nil
-}
 
-func writeInstance(path string, info AgentInstanceInfo) error {
-	data, err := json.MarshalIndent(info, "", "  ")
-	if err != nil {
-		return err
+	seen := map[string]bool{}
+	var unreadable error
+	for _, path := range candidates {
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if errors.Is(err, os.ErrPermission) && unreadable == nil {
+				unreadable = err
+			}
+			continue
+		}
+		var info AgentInstanceInfo
+		if json.Unmarshal(data, &info) != nil {
+			continue
+		}
+		if instanceAlive(&info) {
+			return &info, true, nil
+		}
 	}
-	// Best-effort overwrite if stale; if another process races we will fail.
-	return os.WriteFile(path, data, 0o644)
+	return nil, false, unreadable
 }
 
-func releaseSingleton(pid int) error {
-	path := lockFilePath()
-	info, err := readExistingInstance(path)
-	if err != nil {
-		// Nothing to release.
-		return nil
+// instanceAlive reports whether the process a record names is still the one
+// that wrote it.
+func instanceAlive(info *AgentInstanceInfo) bool {
+	if !processRunning(info.PID) {
+		return false
 	}
-	if info.PID != pid {
-		return errors.New("lock owned by another process")
+	if info.StartTime == "" {
+		return true
 	}
-	return os.Remove(path)
+	started, err := processStartTime(info.PID)
+	if err != nil {
+		// Not knowing (a hardened /proc, no ps) is not evidence of a
+		// recycled PID; fall back to the PID alone.
+		return true
+	}
+	return started == info.StartTime
+}
+
+// legacyLockFilePath is where agents before the flock kept their lock, in
+// world-writable /tmp.
+func legacyLockFilePath() string {
+	return filepath.Join(os.TempDir(), "spectre-agent.lock")
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSingleInstanceLock(t *testing.T) {
+	t.Setenv("SPECTRE_AGENT_HOME", t.TempDir())
+	me := AgentInstanceInfo{PID: os.Getpid(), AgentID: "agent-1", Host: "wss://example.test"}
+
+	lock, running, err := ensureSingleInstance(me)
+	if err != nil || lock == nil {
+		t.Fatalf("first ensureSingleInstance = %v, %v, %v", lock, running, err)
+	}
+
+	// flock locks belong to the open file, so a second open in this same
+	// process contends just as another agent would.
+	second, running, err := ensureSingleInstance(AgentInstanceInfo{PID: os.Getpid() + 1})
+	if err != nil {
+		t.Fatalf("second ensureSingleInstance: %v", err)
+	}
+	if second != nil {
+		t.Fatal("a second agent got the lock")
+	}
+	if running == nil || running.PID != me.PID || running.Host != me.Host {
+		t.Fatalf("running = %+v, want the first agent", running)
+	}
+
+	if ok, info := checkRunning(); !ok || info.AgentID != "agent-1" {
+		t.Fatalf("checkRunning = %v, %+v", ok, info)
+	}
+
+	if err := lock.release(); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if ok, _ := checkRunning(); ok {
+		t.Fatal("checkRunning still reports an agent after release")
+	}
+	again, _, err := ensureSingleInstance(me)
+	if err != nil || again == nil {
+		t.Fatalf("lock not available after release: %v", err)
+	}
+	again.release()
+}
+
+// A record whose PID now belongs to some other process must not pass for a
+// running agent.
+func TestInstanceAliveRejectsARecycledPID(t *testing.T) {
+	started, err := processStartTime(os.Getpid())
+	if err != nil {
+		t.Skipf("no process start time here: %v", err)
+	}
+	if !instanceAlive(&AgentInstanceInfo{PID: os.Getpid(), StartTime: started}) {
+		t.Fatal("this process was not recognised")
+	}
+	if instanceAlive(&AgentInstanceInfo{PID: os.Getpid(), StartTime: started + "0"}) {
+		t.Fatal("a different start time was accepted")
+	}
+}
+
+// Another account cannot read a service's 0700 state directory; status must
+// not take that for an agent that is not running.
+func TestRunningInstanceInAnUnreadableStateDir(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read any state directory")
+	}
+	home := t.TempDir()
+	t.Setenv("SPECTRE_AGENT_HOME", home)
+	if err := writeStateJSON(instanceFileName, AgentInstanceInfo{PID: os.Getpid(), AgentID: "agent-1"}); err != nil {
+		t.Fatal(err)
+	}
+	stateDir := filepath.Join(home, ".spectre-agent")
+	if err := os.Chmod(stateDir, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(stateDir, 0o700) })
+
+	if _, running, err := readRunningInstance(); running || !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("readRunningInstance = %v, %v; want permission denied", running, err)
+	}
+}
@@ -2,6 +2,12 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 )
 
@@ -15,3 +21,37 @@ func processRunning(pid int) bool {
 	}
 	return errors.Is(err, syscall.EPERM)
 }
+
+// processStartTime identifies when pid started, in whatever form the platform
+// gives. Only equality matters: a PID reused by another process has a
+// different start time.
+func processStartTime(pid int) (string, error) {
+	if runtime.GOOS == "linux" {
+		data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+		if err != nil {
+			return "", err
+		}
+		// The command name, in parentheses, may itself contain spaces and
+		// parentheses; fields are counted from the last ')'. starttime is
+		// field 22, the 20th after the name.
+		stat := string(data)
+		i := strings.LastIndexByte(stat, ')')
+		if i < 0 {
+			return "", fmt.Errorf("unexpected /proc/%d/stat", pid)
+		}
+		fields := strings.Fields(stat[i+1:])
+		if len(fields) < 20 {
+			return "", fmt.Errorf("unexpected /proc/%d/stat", pid)
+		}
+		return fields[19], nil
+	}
+	out, err := exec.Command("ps", "-o", "lstart=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return "", err
+	}
+	started := strings.TrimSpace(string(out))
+	if started == "" {
+		return "", fmt.Errorf("no process %d", pid)
+	}
+	return started, nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Plain log files, for whatever does not log to the journal.
+//
+// Only files under an allowed directory can be read: /var/log by default, or
+// the colon-separated list in SPECTRE_LOG_PATHS. The check is made on the
+// fully resolved path, so a symlink planted under /var/log cannot be used to
+// read a key file somewhere else.
+
+const (
+	defaultLogRoot = "/var/log"
+	// How much of a file's end is scanned for a tail page.
+	logTailWindow = 1 << 20
+	// How often a followed file is checked for growth or rotation.
+	logFollowInterval = time.Second
+)
+
+func allowedLogRoots() []string {
+	raw := os.Getenv("SPECTRE_LOG_PATHS")
+	if raw == "" {
+		return []string{defaultLogRoot}
+	}
+	var roots []string
+	for _, root := range strings.Split(raw, ":") {
+		if root = strings.TrimSpace(root); root != "" {
+			roots = append(roots, root)
+		}
+	}
+	return roots
+}
+
+// resolveLogPath returns the real path of a log file, provided it lies under
+// one of the allowed roots.
+func resolveLogPath(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("no log file path given")
+	}
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("log file path must be absolute: %q", path)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("open %s: %w", path, err)
+	}
+	for _, root := range allowedLogRoots() {
+		realRoot, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(realRoot, resolved)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("%s is outside the allowed log paths (%s)", path, strings.Join(allowedLogRoots(), ", "))
+}
+
+// queryLogFile reads one page of a log file: its tail when no offset is
+// given, otherwise forward from that offset.
+func queryLogFile(q LogQuery, filter logFilter) (LogPage, error) {
+	path, err := resolveLogPath(q.Path)
+	if err != nil {
+		return LogPage{}, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return LogPage{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return LogPage{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return LogPage{}, fmt.Errorf("%s is not a regular file", q.Path)
+	}
+
+	if q.Offset == nil {
+		return tailLogFile(f, info.Size(), q.Limit, filter)
+	}
+	start := *q.Offset
+	if start < 0 || start > info.Size() {
+		// Truncated or rotated since the last page: start over, as tail -F would.
+		start = 0
+	}
+	return readLogLines(f, start, q.Limit, filter)
+}
+
+// readLogLines pages forward from start. Only complete lines are returned, so
+// a line still being written is picked up whole by the next page.
+func readLogLines(f *os.File, start int64, limit int, filter logFilter) (LogPage, error) {
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return LogPage{}, err
+	}
+	b := newPageBuilder(limit)
+	reader := bufio.NewReader(f)
+	offset := start
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// A partial final line is left for the next read.
+			break
+		}
+		record := LogRecord{Message: strings.TrimRight(line, "\r\n"), Offset: offset}
+		if filter.match(record.Message) && !b.add(record) {
+			b.page.HasMore = true
+			break
+		}
+		offset += int64(len(line))
+	}
+	b.page.Offset = offset
+	return b.page, nil
+}
+
+// tailLogFile returns the last matching lines of a file, scanning at most
+// logTailWindow bytes back from its end.
+func tailLogFile(f *os.File, size int64, limit int, filter logFilter) (LogPage, error) {
+	start := size - logTailWindow
+	if start < 0 {
+		start = 0
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return LogPage{}, err
+	}
+	data, err := io.ReadAll(io.LimitReader(f, size-start))
+	if err != nil {
+		return LogPage{}, err
+	}
+
+	// Drop the partial line the window starts in, and the one still being
+	// written at the end.
+	if start > 0 {
+		if i := strings.IndexByte(string(data), '\n'); i >= 0 {
+			start += int64(i + 1)
+			data = data[i+1:]
+		}
+	}
+	end := len(data)
+	if i := strings.LastIndexByte(string(data), '\n'); i >= 0 {
+		end = i + 1
+	} else {
+		end = 0
+	}
+
+	var matches []LogRecord
+	offset := start
+	for _, line := range strings.SplitAfter(string(data[:end]), "\n") {
+		if line == "" {
+			continue
+		}
+		message := strings.TrimRight(line, "\r\n")
+		if filter.match(message) {
+			matches = append(matches, LogRecord{Message: message, Offset: offset})
+		}
+		offset += int64(len(line))
+	}
+
+	b := newPageBuilder(limit)
+	// Fill from the newest backwards so the page holds the last lines, then
+	// put them back in file order.
+	for i := len(matches) - 1; i >= 0; i-- {
+		if !b.add(matches[i]) {
+			break
+		}
+	}
+	records := b.page.Records
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return LogPage{Records: records, Offset: start + int64(end)}, nil
+}
+
+// followLogFile streams lines appended to a file, surviving rotation the way
+// `tail -F` does: when the path comes to name a different file, or the file
+// shrinks, reading restarts from the beginning of whatever is there now.
+func followLogFile(ctx context.Context, send func(AgentMessage) error, q LogQuery, filter logFilter, offset int64) error {
+	path, err := resolveLogPath(q.Path)
+	if err != nil {
+		return err
+	}
+	ino := fileInode(path)
+
+	ticker := time.NewTicker(logFollowInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			continue // mid-rotation; the new file has not appeared yet
+		}
+		if current := fileInode(path); current != ino || info.Size() < offset {
+			ino = current
+			offset = 0
+		}
+		if info.Size() == offset {
+			continue
+		}
+
+		for {
+			f, err := os.Open(path)
+			if err != nil {
+				break
+			}
+			page, err := readLogLines(f, offset, maxLogLimit, filter)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			offset = page.Offset
+			if len(page.Records) > 0 {
+				page.FollowID = q.FollowID
+				if err := send(AgentMessage{Type: "logs", Logs: &page}); err != nil {
+					return err
+				}
+			}
+			if !page.HasMore {
+				break
+			}
+		}
+	}
+}
+
+func fileInode(path string) uint64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
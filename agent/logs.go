@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log queries: the systemd journal and plain log files, returned as records
+// rather than as terminal text.
+//
+// A page is bounded twice: by record count, and by size, because the server
+// drops any agent message over 256 KB and one runaway log line must not make a
+// whole page disappear.
+
+const (
+	defaultLogLimit = 200
+	maxLogLimit     = 1000
+	// Well under the server's 256 KB message cap, leaving room for the
+	// envelope and JSON escaping.
+	maxLogPageBytes   = 160 << 10
+	maxLogRecordBytes = 8 << 10
+	maxLogFollowers   = 8
+	logQueryTimeout   = 30 * time.Second
+)
+
+var syslogPriorities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3, "warning": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// logFilter is the part of a query applied to each record in turn.
+type logFilter struct {
+	grep *regexp.Regexp
+}
+
+func (f logFilter) match(message string) bool {
+	return f.grep == nil || f.grep.MatchString(message)
+}
+
+// pageBuilder collects records until the page is full by count or by size.
+type pageBuilder struct {
+	limit int
+	bytes int
+	page  LogPage
+}
+
+func newPageBuilder(limit int) *pageBuilder {
+	if limit <= 0 {
+		limit = defaultLogLimit
+	}
+	if limit > maxLogLimit {
+		limit = maxLogLimit
+	}
+	return &pageBuilder{limit: limit, page: LogPage{Records: make([]LogRecord, 0)}}
+}
+
+// add appends a record, reporting false once the page has no room for it.
+func (b *pageBuilder) add(r LogRecord) bool {
+	if len(r.Message) > maxLogRecordBytes {
+		r.Message = r.Message[:maxLogRecordBytes] + "…"
+	}
+	size := len(r.Message) + len(r.Cursor) + len(r.Unit) + 64
+	if len(b.page.Records) >= b.limit || (len(b.page.Records) > 0 && b.bytes+size > maxLogPageBytes) {
+		return false
+	}
+	b.bytes += size
+	b.page.Records = append(b.page.Records, r)
+	return true
+}
+
+func parseLogQuery(q LogQuery) (logFilter, error) {
+	var f logFilter
+	if q.Grep != "" {
+		re, err := regexp.Compile(q.Grep)
+		if err != nil {
+			return f, fmt.Errorf("invalid grep pattern: %w", err)
+		}
+		f.grep = re
+	}
+	return f, nil
+}
+
+// queryLogs reads the first page of a "queryLogs" request. For a follow it
+// also returns the function that streams on from where that page ended,
+// handing each message it produces to send.
+func queryLogs(q LogQuery) (LogPage, func(send func(AgentMessage) error), error) {
+	filter, err := parseLogQuery(q)
+	if err != nil {
+		return LogPage{}, nil, err
+	}
+	if q.Follow && q.FollowID == "" {
+		return LogPage{}, nil, fmt.Errorf("follow needs a followId to stop it by")
+	}
+
+	var page LogPage
+	switch q.Source {
+	case "", "journal":
+		page, err = queryJournal(q, filter)
+	case "file":
+		page, err = queryLogFile(q, filter)
+	default:
+		return LogPage{}, nil, fmt.Errorf("unknown log source %q (use journal or file)", q.Source)
+	}
+	if err != nil {
+		return LogPage{}, nil, err
+	}
+	if !q.Follow {
+		return page, nil, nil
+	}
+
+	ctx, err := registerLogFollower(q.FollowID)
+	if err != nil {
+		return LogPage{}, nil, err
+	}
+	page.FollowID = q.FollowID
+	follow := func(send func(AgentMessage) error) {
+		go runLogFollower(ctx, send, q, filter, page)
+	}
+	return page, follow, nil
+}
+
+// handleLogQuery services a "queryLogs" message. Grepping a large journal can
+// take a while, so the query runs off the read loop and replies when done.
+func handleLogQuery(conn *safeConn, requestID string, q *LogQuery) {
+	if q == nil {
+		q = &LogQuery{}
+	}
+	go func() {
+		page, follow, err := queryLogs(*q)
+		payload := AgentMessage{Type: "logs", Logs: &page}
+		if err != nil {
+			payload.Error = err.Error()
+			payload.Logs = &LogPage{Records: []LogRecord{}, FollowID: q.FollowID}
+		}
+		if err := conn.reply(requestID, payload); err != nil {
+			if follow != nil {
+				stopLogFollower(q.FollowID)
+			}
+			return
+		}
+		// Started only once the first page is on the wire, so nothing the
+		// follow finds can overtake it.
+		// Every page of the follow answers the same request.
+		if follow != nil {
+			follow(func(msg AgentMessage) error { return conn.reply(requestID, msg) })
+		}
+	}()
+}
+
+// journalArgs builds the journalctl filters shared by paging and following.
+func journalArgs(q LogQuery) ([]string, error) {
+	args := []string{"--no-pager", "-o", "json"}
+	if q.Unit != "" {
+		unit, err := normalizeUnitName(q.Unit)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-u", unit)
+	}
+	if q.Priority != "" {
+		p := strings.ToLower(strings.TrimSpace(q.Priority))
+		if _, ok := syslogPriorities[p]; !ok {
+			if n, err := strconv.Atoi(p); err != nil || n < 0 || n > 7 {
+				return nil, fmt.Errorf("invalid priority %q", q.Priority)
+			}
+		}
+		args = append(args, "-p", p)
+	}
+	for _, bound := range []struct{ flag, value string }{{"--since", q.Since}, {"--until", q.Until}} {
+		if bound.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, bound.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s time %q: want RFC 3339", strings.TrimPrefix(bound.flag, "--"), bound.value)
+		}
+		// journalctl reads this format in local time.
+		args = append(args, bound.flag, t.Local().Format("2006-01-02 15:04:05"))
+	}
+	return args, nil
+}
+
+func requireJournal() error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("the systemd journal is not available on %s", runtime.GOOS)
+	}
+	if _, err := exec.LookPath("journalctl"); err != nil {
+		return fmt.Errorf("journalctl not found; this host has no systemd journal")
+	}
+	return nil
+}
+
+// queryJournal reads one page of the journal.
+//
+// With a cursor or a start time it pages forward from there. With neither it
+// returns the newest matching records, read newest-first so a grep does not
+// have to scan the whole journal to find the last few matches.
+func queryJournal(q LogQuery, filter logFilter) (LogPage, error) {
+	if err := requireJournal(); err != nil {
+		return LogPage{}, err
+	}
+	args, err := journalArgs(q)
+	if err != nil {
+		return LogPage{}, err
+	}
+	latest := q.Cursor == "" && q.Since == ""
+	if latest {
+		args = append(args, "-r")
+	} else if q.Cursor != "" {
+		args = append(args, "--after-cursor", q.Cursor)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), logQueryTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "journalctl", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return LogPage{}, err
+	}
+	if err := cmd.Start(); err != nil {
+		return LogPage{}, fmt.Errorf("start journalctl: %w", err)
+	}
+	// Stopping early is the normal case: the page filled before the journal
+	// ran out, and the rest of it is not wanted.
+	defer func() {
+		cancel()
+		_ = cmd.Wait()
+	}()
+
+	b := newPageBuilder(q.Limit)
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64<<10), 4<<20)
+	for scanner.Scan() {
+		record, ok := parseJournalEntry(scanner.Bytes())
+		if !ok || !filter.match(record.Message) {
+			continue
+		}
+		if !b.add(record) {
+			b.page.HasMore = true
+			break
+		}
+	}
+
+	page := b.page
+	if latest {
+		// Read newest-first, returned oldest-first like every other page.
+		for i, j := 0, len(page.Records)-1; i < j; i, j = i+1, j-1 {
+			page.Records[i], page.Records[j] = page.Records[j], page.Records[i]
+		}
+		// Older entries being left out is not "more" in the paging sense:
+		// the next page continues forward from the newest record.
+		page.HasMore = false
+	}
+	if n := len(page.Records); n > 0 {
+		page.Cursor = page.Records[n-1].Cursor
+	} else {
+		page.Cursor = q.Cursor
+	}
+	return page, nil
+}
+
+// parseJournalEntry reads one line of `journalctl -o json`.
+func parseJournalEntry(line []byte) (LogRecord, bool) {
+	var entry struct {
+		Cursor     string          `json:"__CURSOR"`
+		Realtime   string          `json:"__REALTIME_TIMESTAMP"`
+		Priority   string          `json:"PRIORITY"`
+		Unit       string          `json:"_SYSTEMD_UNIT"`
+		Identifier string          `json:"SYSLOG_IDENTIFIER"`
+		Message    json.RawMessage `json:"MESSAGE"`
+	}
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return LogRecord{}, false
+	}
+	usec, _ := strconv.ParseInt(entry.Realtime, 10, 64)
+	priority, err := strconv.Atoi(entry.Priority)
+	if err != nil {
+		priority = 6 // journald's own default for entries without one
+	}
+	unit := entry.Unit
+	if unit == "" {
+		unit = entry.Identifier
+	}
+	return LogRecord{
+		Time:     usec / 1000,
+		Unit:     unit,
+		Priority: &priority,
+		Message:  journalMessage(entry.Message),
+		Cursor:   entry.Cursor,
+	}, true
+}
+
+// journalMessage decodes MESSAGE, which journald emits as an array of bytes
+// instead of a string whenever the message is not valid UTF-8.
+func journalMessage(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var b []byte
+	var ints []int
+	if json.Unmarshal(raw, &ints) == nil {
+		for _, v := range ints {
+			b = append(b, byte(v))
+		}
+		return strings.ToValidUTF8(string(b), "�")
+	}
+	return ""
+}
+
+// Followers stream new records for as long as the connection lasts. Each is
+// keyed by the FollowID the server chose, so a "stopLogs" can end it.
+var (
+	logFollowersMu sync.Mutex
+	logFollowers   = map[string]context.CancelFunc{}
+)
+
+// registerLogFollower claims a FollowID, so a "stopLogs" can find it.
+func registerLogFollower(id string) (context.Context, error) {
+	logFollowersMu.Lock()
+	defer logFollowersMu.Unlock()
+	if _, exists := logFollowers[id]; exists {
+		return nil, fmt.Errorf("already following %q", id)
+	}
+	if len(logFollowers) >= maxLogFollowers {
+		return nil, fmt.Errorf("too many log follows in progress (limit %d)", maxLogFollowers)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	logFollowers[id] = cancel
+	return ctx, nil
+}
+
+func runLogFollower(ctx context.Context, send func(AgentMessage) error, q LogQuery, filter logFilter, first LogPage) {
+	defer stopLogFollower(q.FollowID)
+	var err error
+	if q.Source == "file" {
+		err = followLogFile(ctx, send, q, filter, first.Offset)
+	} else {
+		err = followJournal(ctx, send, q, filter, first.Cursor)
+	}
+	if err != nil && ctx.Err() == nil {
+		log.Printf("log follow %s ended: %v", q.FollowID, err)
+		_ = send(AgentMessage{
+			Type: "logs", Error: err.Error(), Logs: &LogPage{Records: []LogRecord{}, FollowID: q.FollowID},
+		})
+	}
+}
+
+// stopLogFollower ends a follow. Stopping one that already ended is fine.
+func stopLogFollower(id string) {
+	logFollowersMu.Lock()
+	cancel, ok := logFollowers[id]
+	delete(logFollowers, id)
+	logFollowersMu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+// stopAllLogFollowers ends every follow when the connection they stream to
+// goes away; the server re-requests whatever it still wants on reconnect.
+func stopAllLogFollowers() {
+	logFollowersMu.Lock()
+	ids := make([]string, 0, len(logFollowers))
+	for id := range logFollowers {
+		ids = append(ids, id)
+	}
+	logFollowersMu.Unlock()
+	for _, id := range ids {
+		stopLogFollower(id)
+	}
+}
+
+// followJournal streams `journalctl -f` from just after the first page.
+func followJournal(ctx context.Context, send func(AgentMessage) error, q LogQuery, filter logFilter, cursor string) error {
+	args, err := journalArgs(q)
+	if err != nil {
+		return err
+	}
+	args = append(args, "-f")
+	if cursor != "" {
+		args = append(args, "--after-cursor", cursor)
+	} else {
+		args = append(args, "-n", "0")
+	}
+
+	// Cancelled on the way out, whatever the reason: when a send fails,
+	// nothing reads the pipe any more, and journalctl would block on it and
+	// never exit for the Wait below.
+	ctx, cancel := context.WithCancel(ctx)
+	cmd := exec.CommandContext(ctx, "journalctl", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return fmt.Errorf("start journalctl: %w", err)
+	}
+	defer func() { _ = cmd.Wait() }()
+	defer cancel()
+
+	return streamLogRecords(ctx, send, q.FollowID, stdout, func(line []byte) (LogRecord, bool) {
+		record, ok := parseJournalEntry(line)
+		return record, ok && filter.match(record.Message)
+	})
+}
+
+// streamLogRecords sends records as they arrive, batching whatever turns up
+// within a short window so a burst is one message rather than hundreds.
+func streamLogRecords(ctx context.Context, send func(AgentMessage) error, followID string, r io.Reader, parse func([]byte) (LogRecord, bool)) error {
+	lines := make(chan LogRecord, 256)
+	scanErr := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64<<10), 4<<20)
+		for scanner.Scan() {
+			if record, ok := parse(scanner.Bytes()); ok {
+				select {
+				case lines <- record:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		scanErr <- scanner.Err()
+		close(lines)
+	}()
+
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	b := newPageBuilder(maxLogLimit)
+	flush := func() error {
+		if len(b.page.Records) == 0 {
+			return nil
+		}
+		page := b.page
+		page.FollowID = followID
+		page.Cursor = page.Records[len(page.Records)-1].Cursor
+		b = newPageBuilder(maxLogLimit)
+		return send(AgentMessage{Type: "logs", Logs: &page})
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case record, ok := <-lines:
+			if !ok {
+				if err := flush(); err != nil {
+					return err
+				}
+				return <-scanErr
+			}
+			if !b.add(record) {
+				if err := flush(); err != nil {
+					return err
+				}
+				b.add(record)
+			}
+		case <-ticker.C:
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
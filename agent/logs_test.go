@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseJournalEntry(t *testing.T) {
+	line := `{"__CURSOR":"s=abc;i=1","__REALTIME_TIMESTAMP":"1792000000123456","PRIORITY":"3",` +
+		`"_SYSTEMD_UNIT":"nginx.service","MESSAGE":"upstream timed out"}`
+	record, ok := parseJournalEntry([]byte(line))
+	if !ok {
+		t.Fatal("failed to parse a journal entry")
+	}
+	if record.Time != 1792000000123 || record.Priority == nil || *record.Priority != 3 || record.Unit != "nginx.service" {
+		t.Errorf("unexpected record %+v", record)
+	}
+	if record.Message != "upstream timed out" || record.Cursor != "s=abc;i=1" {
+		t.Errorf("unexpected message or cursor %+v", record)
+	}
+}
+
+// journald emits MESSAGE as a byte array when it is not valid UTF-8.
+func TestParseJournalEntryDecodesBinaryMessages(t *testing.T) {
+	line := `{"__CURSOR":"c","MESSAGE":[104,105,255],"SYSLOG_IDENTIFIER":"kernel"}`
+	record, ok := parseJournalEntry([]byte(line))
+	if !ok {
+		t.Fatal("failed to parse a journal entry")
+	}
+	if !strings.HasPrefix(record.Message, "hi") || record.Unit != "kernel" {
+		t.Errorf("unexpected record %+v", record)
+	}
+	if record.Priority == nil || *record.Priority != 6 {
+		t.Errorf("missing priority should default to info, got %v", record.Priority)
+	}
+}
+
+// emerg is level 0, and the most severe record of all must not arrive looking
+// like one with no level.
+func TestJournalEntryKeepsEmergencyPriority(t *testing.T) {
+	record, ok := parseJournalEntry([]byte(`{"__CURSOR":"c","PRIORITY":"0","MESSAGE":"kernel panic"}`))
+	if !ok {
+		t.Fatal("failed to parse a journal entry")
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"priority":0`) {
+		t.Errorf("priority 0 was dropped: %s", data)
+	}
+	if data, _ := json.Marshal(LogRecord{Message: "a file line"}); strings.Contains(string(data), "priority") {
+		t.Errorf("a file line claims a priority: %s", data)
+	}
+}
+
+// A follow whose send fails must stop journalctl too. Otherwise nothing reads
+// its pipe, it blocks writing, and the follow never returns.
+func TestFollowJournalStopsWhenSendFails(t *testing.T) {
+	bin := t.TempDir()
+	script := "#!/bin/sh\nwhile :; do echo '{\"__CURSOR\":\"c\",\"MESSAGE\":\"spam\"}'; done\n"
+	if err := os.WriteFile(filepath.Join(bin, "journalctl"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- followJournal(context.Background(), func(AgentMessage) error {
+			return errors.New("connection closed")
+		}, LogQuery{FollowID: "f1"}, logFilter{}, "c")
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("a failed send was not reported")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("followJournal did not return after its send failed")
+	}
+}
+
+func TestJournalArgsValidatesFilters(t *testing.T) {
+	args, err := journalArgs(LogQuery{Unit: "nginx", Priority: "err", Since: "2026-10-01T00:00:00Z"})
+	if err != nil {
+		t.Fatalf("journalArgs: %v", err)
+	}
+	joined := strings.Join(args, " ")
+	for _, want := range []string{"-u nginx.service", "-p err", "--since "} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("args %q missing %q", joined, want)
+		}
+	}
+
+	for _, bad := range []LogQuery{{Priority: "9"}, {Priority: "loud"}, {Since: "yesterday"}, {Unit: "--all"}} {
+		if _, err := journalArgs(bad); err == nil {
+			t.Errorf("journalArgs(%+v) should be rejected", bad)
+		}
+	}
+}
+
+func TestPageBuilderCapsPageSize(t *testing.T) {
+	b := newPageBuilder(maxLogLimit)
+	big := strings.Repeat("x", maxLogRecordBytes*2)
+	added := 0
+	for b.add(LogRecord{Message: big}) {
+		added++
+	}
+	if added == 0 || added >= maxLogLimit {
+		t.Fatalf("expected the byte cap to stop the page early, added %d", added)
+	}
+	if got := len(b.page.Records[0].Message); got > maxLogRecordBytes+len("…") {
+		t.Errorf("oversized record was not truncated: %d bytes", got)
+	}
+}
+
+// withLogRoot allows reading logs from a temporary directory only.
+func withLogRoot(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	t.Setenv("SPECTRE_LOG_PATHS", root)
+	return root
+}
+
+func TestResolveLogPathStaysInsideAllowedRoots(t *testing.T) {
+	root := withLogRoot(t)
+	inside := filepath.Join(root, "app.log")
+	if err := os.WriteFile(inside, []byte("ok\n"), 0o644); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	if _, err := resolveLogPath(inside); err != nil {
+		t.Errorf("file under the allowed root rejected: %v", err)
+	}
+
+	secret := filepath.Join(t.TempDir(), "device-info.json")
+	if err := os.WriteFile(secret, []byte("dk_secret"), 0o600); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	// A symlink inside the root must not lead outside it.
+	link := filepath.Join(root, "sneaky.log")
+	if err := os.Symlink(secret, link); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	for _, path := range []string{secret, link, filepath.Join(root, "..", filepath.Base(root)+"x"), "relative.log"} {
+		if _, err := resolveLogPath(path); err == nil {
+			t.Errorf("resolveLogPath(%q) should be refused", path)
+		}
+	}
+}
+
+func TestQueryLogFilePagesForwardAndTails(t *testing.T) {
+	root := withLogRoot(t)
+	path := filepath.Join(root, "app.log")
+	// The last line is still being written and must not be returned yet.
+	content := "one\nerror two\nthree\nerror four\nfive\npartial"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+
+	tail, err := queryLogFile(LogQuery{Path: path, Limit: 2}, logFilter{})
+	if err != nil {
+		t.Fatalf("tail: %v", err)
+	}
+	if len(tail.Records) != 2 || tail.Records[0].Message != "error four" || tail.Records[1].Message != "five" {
+		t.Fatalf("unexpected tail %+v", tail.Records)
+	}
+	if want := int64(strings.LastIndex(content, "\n") + 1); tail.Offset != want {
+		t.Errorf("tail offset = %d, want %d", tail.Offset, want)
+	}
+
+	filter, _ := parseLogQuery(LogQuery{Grep: "^error"})
+	zero := int64(0)
+	first, err := queryLogFile(LogQuery{Path: path, Offset: &zero, Limit: 1}, filter)
+	if err != nil {
+		t.Fatalf("page: %v", err)
+	}
+	if len(first.Records) != 1 || first.Records[0].Message != "error two" || !first.HasMore {
+		t.Fatalf("unexpected first page %+v", first)
+	}
+	second, err := queryLogFile(LogQuery{Path: path, Offset: &first.Offset, Limit: 5}, filter)
+	if err != nil {
+		t.Fatalf("page: %v", err)
+	}
+	if len(second.Records) != 1 || second.Records[0].Message != "error four" || second.HasMore {
+		t.Fatalf("unexpected second page %+v", second)
+	}
+}
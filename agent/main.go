@@ -34,7 +34,8 @@ func resolveAuthKey(flagValue string) string {
 }
 
 func newRootCommand() *cobra.Command {
-	var host, authKey string
+	var host, authKey, updateSource string
+	var policy updatePolicyFlags
 	cmd := &cobra.Command{
 		Use:   "spectre-agent",
 		Short: "Connect this machine to a Spectre control server",
@@ -45,13 +46,20 @@ func newRootCommand() *cobra.Command {
 		SilenceUsage: true,
 		Args:         cobra.NoArgs,
 		RunE: func(_ *cobra.Command, _ []string) error {
-			return runAgent(host, resolveAuthKey(authKey))
+			p, err := policy.policy()
+			if err != nil {
+				return err
+			}
+			return runAgent(host, resolveAuthKey(authKey), updateSource, p)
 		},
 	}
 	cmd.Flags().StringVar(&host, "host", "", hostFlagDoc)
 	cmd.Flags().StringVar(&authKey, "authkey", "", authKeyFlagDoc)
+	cmd.Flags().StringVar(&updateSource, "update-source", "", updateSourceFlagDoc)
+	addUpdatePolicyFlags(cmd, &policy)
 
-	cmd.AddCommand(newRunCommand(), newUpCommand(), newDownCommand(), newUpdateCommand(), newStatusCommand())
+	cmd.AddCommand(newRunCommand(), newUpCommand(), newDownCommand(), newUpdateCommand(), newStatusCommand(),
+		newDoctorCommand(), newAdminCommand(), newDevServerCommand())
 	return cmd
 }
 
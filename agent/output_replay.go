@@ -0,0 +1,110 @@
+package main
+
+import "sync"
+
+// Output replay across reconnects.
+//
+// Every chunk a session's PTY produces is numbered and kept in a bounded
+// buffer before it is sent. If the link drops mid-command, the server knows
+// the last sequence number it received and asks for everything after it with
+// a "replay" message; chunks it has acknowledged with "ackOutput" are let go
+// early. When the buffer has already discarded part of what was asked for,
+// the reply says so with an "outputGap" rather than leaving a silent hole.
+
+// Enough for several screens of busy output per session, small enough that a
+// machine with dozens of sessions does not notice.
+const maxReplayBytes = 256 << 10
+
+type outputChunk struct {
+	seq  uint64
+	data string
+}
+
+type outputLog struct {
+	mu     sync.Mutex
+	last   uint64
+	chunks []outputChunk
+	bytes  int
+	// sendMu keeps chunks on the wire in sequence order: a replay and the
+	// live reader must not interleave. It is separate from mu so an ack is
+	// never stuck behind a slow write.
+	sendMu sync.Mutex
+}
+
+// record numbers a chunk and keeps it, evicting the oldest past the limit.
+func (l *outputLog) record(data string) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.last++
+	l.chunks = append(l.chunks, outputChunk{seq: l.last, data: data})
+	l.bytes += len(data)
+	for l.bytes > maxReplayBytes && len(l.chunks) > 1 {
+		l.bytes -= len(l.chunks[0].data)
+		l.chunks = l.chunks[1:]
+	}
+	return l.last
+}
+
+// since returns the chunks after seq, and the first sequence number still held
+// when some of what was asked for has already been discarded (0 when none has).
+func (l *outputLog) since(seq uint64) ([]outputChunk, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var gapFrom uint64
+	if len(l.chunks) > 0 && l.chunks[0].seq > seq+1 {
+		gapFrom = l.chunks[0].seq
+	} else if len(l.chunks) == 0 && l.last > seq {
+		gapFrom = l.last + 1
+	}
+	var out []outputChunk
+	for _, c := range l.chunks {
+		if c.seq > seq {
+			out = append(out, c)
+		}
+	}
+	return out, gapFrom
+}
+
+// ack releases chunks the server has confirmed it has.
+func (l *outputLog) ack(seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := 0
+	for i < len(l.chunks) && l.chunks[i].seq <= seq {
+		l.bytes -= len(l.chunks[i].data)
+		i++
+	}
+	l.chunks = l.chunks[i:]
+}
+
+func (l *outputLog) lastSeq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.last
+}
+
+// sendOutput records a chunk of PTY output and sends it.
+func sendOutput(conn *safeConn, session *ptySession, data string) error {
+	session.output.sendMu.Lock()
+	defer session.output.sendMu.Unlock()
+	seq := session.output.record(data)
+	return conn.writeJSON(AgentMessage{Type: "output", Data: data, SessionID: session.sessionID, Seq: seq})
+}
+
+// replayOutput resends what the server missed after seq.
+func replayOutput(conn *safeConn, session *ptySession, seq uint64) error {
+	session.output.sendMu.Lock()
+	defer session.output.sendMu.Unlock()
+	chunks, gapFrom := session.output.since(seq)
+	if gapFrom != 0 {
+		if err := conn.writeJSON(AgentMessage{Type: "outputGap", SessionID: session.sessionID, Seq: gapFrom}); err != nil {
+			return err
+		}
+	}
+	for _, c := range chunks {
+		if err := conn.writeJSON(AgentMessage{Type: "output", Data: c.data, SessionID: session.sessionID, Seq: c.seq}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOutputLogReplaysWhatWasMissed(t *testing.T) {
+	var l outputLog
+	for _, chunk := range []string{"a", "b", "c", "d"} {
+		l.record(chunk)
+	}
+
+	chunks, gapFrom := l.since(2)
+	if gapFrom != 0 {
+		t.Errorf("nothing was discarded, but a gap from %d was reported", gapFrom)
+	}
+	if len(chunks) != 2 || chunks[0].seq != 3 || chunks[1].data != "d" {
+		t.Fatalf("unexpected replay %+v", chunks)
+	}
+	if chunks, _ := l.since(4); len(chunks) != 0 {
+		t.Errorf("an up-to-date server was sent %+v", chunks)
+	}
+}
+
+// The buffer is bounded; asking for more than it still holds must say so
+// rather than quietly skipping the discarded output.
+func TestOutputLogReportsAGapOnceTheBufferWraps(t *testing.T) {
+	var l outputLog
+	big := strings.Repeat("x", maxReplayBytes/2+1)
+	l.record(big) // seq 1, evicted below
+	l.record(big) // seq 2
+	l.record("tail")
+
+	chunks, gapFrom := l.since(0)
+	if gapFrom != 2 {
+		t.Fatalf("gapFrom = %d, want 2", gapFrom)
+	}
+	if len(chunks) != 2 || chunks[0].seq != 2 {
+		t.Fatalf("unexpected replay %+v", chunks)
+	}
+	if l.bytes > maxReplayBytes {
+		t.Errorf("buffer holds %d bytes, over the %d limit", l.bytes, maxReplayBytes)
+	}
+}
+
+func TestOutputLogAckReleasesChunks(t *testing.T) {
+	var l outputLog
+	for _, chunk := range []string{"one", "two", "three"} {
+		l.record(chunk)
+	}
+	l.ack(2)
+	if len(l.chunks) != 1 || l.bytes != len("three") {
+		t.Fatalf("ack left %+v (%d bytes)", l.chunks, l.bytes)
+	}
+	// Sequence numbers carry on from where they were.
+	if seq := l.record("four"); seq != 4 {
+		t.Errorf("next seq = %d, want 4", seq)
+	}
+	if _, gapFrom := l.since(2); gapFrom != 0 {
+		t.Errorf("acknowledged output reported as a gap from %d", gapFrom)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Power actions: reboot and poweroff from the dashboard, optionally delayed.
+//
+// The sequence is built around the connection going away on purpose:
+//
+//  1. acknowledge with powerStatus "scheduled", saying when
+//  2. warn every live session and, with a message, every logged-in user
+//  3. just before acting, send "shuttingDown" so the server can show the
+//     machine as rebooting rather than lost
+//  4. after boot, the next handshake reports "completed"
+//
+// The last step needs to survive the reboot, so the pending action is written
+// to the state directory along with the boot it was requested in. A record
+// from the current boot that no timer in this process is counting down was
+// left by an agent that restarted before acting; it is reported as failed and
+// dropped, rather than kept until some unrelated reboot reads as "completed".
+//
+// The link may have been re-established by the time the timer fires, so what
+// is sent then goes on the connection live at that moment, through the event
+// queue: between connections it waits for the next handshake.
+
+const (
+	powerStateFile = "power-pending.json"
+	maxPowerDelay  = 24 * time.Hour
+)
+
+type pendingPower struct {
+	Action      string `json:"action"`
+	RequestedAt int64  `json:"requestedAt"`
+	BootID      string `json:"bootId"`
+	// RequestID lets the report after boot answer the request that asked.
+	RequestID string `json:"requestId,omitempty"`
+}
+
+var (
+	powerMu    sync.Mutex
+	powerTimer *time.Timer
+	powerState pendingPower
+)
+
+// Injectable for tests; the real one really does reboot the machine.
+var runPowerCommand = executePowerAction
+
+// handlePowerMessage services a "power" message: reboot, poweroff or cancel.
+func handlePowerMessage(conn *safeConn, ctl *agentControl, requestID, action string, delaySeconds int, message string) {
+	reply := func(state string, at time.Time, err error) {
+		payload := AgentMessage{Type: "powerStatus", Action: action, State: state}
+		if !at.IsZero() {
+			payload.At = at.Unix()
+		}
+		if err != nil {
+			payload.Error = err.Error()
+		}
+		_ = conn.reply(requestID, payload)
+	}
+
+	if action == "cancel" {
+		if err := cancelPowerAction(); err != nil {
+			reply("failed", time.Time{}, err)
+			return
+		}
+		log.Printf("pending power action cancelled at the control server's request")
+		reply("cancelled", time.Time{}, nil)
+		if message != "" {
+			broadcastWall(message)
+		}
+		return
+	}
+
+	delay := time.Duration(delaySeconds) * time.Second
+	at, err := schedulePowerAction(action, requestID, delay, func() {
+		// The last thing the server hears before the socket drops.
+		_ = ctl.currentConn().sendEvent(requestID, AgentMessage{Type: "powerStatus", Action: action, State: "shuttingDown"})
+		time.Sleep(500 * time.Millisecond)
+		if err := runPowerCommand(action); err != nil {
+			log.Printf("%s failed: %v", action, err)
+			recordAgentError(action, err)
+			clearPowerAction()
+			_ = ctl.currentConn().sendEvent(requestID, AgentMessage{Type: "powerStatus", Action: action, State: "failed", Error: err.Error()})
+		}
+	})
+	if err != nil {
+		reply("failed", time.Time{}, err)
+		return
+	}
+
+	log.Printf("%s scheduled for %s at the control server's request", action, at.Format(time.RFC3339))
+	reply("scheduled", at, nil)
+	warnSessions(conn, ctl.sessions, powerWarning(action, delay, message))
+	if message != "" {
+		broadcastWall(powerWarning(action, delay, message))
+	}
+}
+
+// schedulePowerAction arms the timer and records the action on disk. Only one
+// may be pending: a second request has to cancel the first explicitly.
+func schedulePowerAction(action, requestID string, delay time.Duration, fire func()) (time.Time, error) {
+	if action != "reboot" && action != "poweroff" {
+		return time.Time{}, fmt.Errorf("unsupported power action %q (use reboot, poweroff or cancel)", action)
+	}
+	if delay < 0 || delay > maxPowerDelay {
+		return time.Time{}, fmt.Errorf("delay must be between 0 and %s", maxPowerDelay)
+	}
+
+	powerMu.Lock()
+	defer powerMu.Unlock()
+	if powerTimer != nil {
+		return time.Time{}, fmt.Errorf("a %s is already scheduled; cancel it first", powerState.Action)
+	}
+
+	powerState = pendingPower{Action: action, RequestedAt: time.Now().Unix(), BootID: currentBootID(), RequestID: requestID}
+	if err := writeStateJSON(powerStateFile, powerState); err != nil {
+		// Not fatal: the action still happens, only the post-boot report is lost.
+		log.Printf("warning: could not record the pending %s: %v", action, err)
+	}
+	powerTimer = time.AfterFunc(delay, fire)
+	return time.Now().Add(delay), nil
+}
+
+func cancelPowerAction() error {
+	powerMu.Lock()
+	defer powerMu.Unlock()
+	if powerTimer == nil {
+		return fmt.Errorf("no power action is scheduled")
+	}
+	if !powerTimer.Stop() {
+		return fmt.Errorf("too late to cancel: the %s is already under way", powerState.Action)
+	}
+	powerTimer = nil
+	powerState = pendingPower{}
+	return removeStateFile(powerStateFile)
+}
+
+// clearPowerAction forgets an action that failed, so it is not reported as
+// completed on the next handshake.
+func clearPowerAction() {
+	powerMu.Lock()
+	defer powerMu.Unlock()
+	powerTimer = nil
+	powerState = pendingPower{}
+	_ = removeStateFile(powerStateFile)
+}
+
+// reportCompletedPowerAction tells the server that a reboot it asked for has
+// happened. It runs after every handshake; a record from the current boot
+// that this process is still counting down means this is just a reconnect,
+// and is left for later. One nothing is counting down any more was lost with
+// the process that scheduled it.
+func reportCompletedPowerAction(conn *safeConn) {
+	var pending pendingPower
+	if !readStateJSON(powerStateFile, &pending) {
+		return
+	}
+	powerMu.Lock()
+	armed := powerTimer != nil
+	powerMu.Unlock()
+	if armed || pending.BootID == "" {
+		return
+	}
+	if pending.BootID == currentBootID() {
+		log.Printf("dropping the %s scheduled before the agent restarted", pending.Action)
+		_ = conn.sendEvent(pending.RequestID, AgentMessage{
+			Type: "powerStatus", Action: pending.Action, State: "failed", At: pending.RequestedAt,
+			Error: "the agent restarted before the " + pending.Action + " was due; request it again",
+		})
+		_ = removeStateFile(powerStateFile)
+		return
+	}
+
+	if err := conn.reply(pending.RequestID, AgentMessage{
+		Type: "powerStatus", Action: pending.Action, State: "completed", At: pending.RequestedAt,
+	}); err != nil {
+		return // try again on the next handshake
+	}
+	log.Printf("reported the completed %s", pending.Action)
+	_ = removeStateFile(powerStateFile)
+}
+
+func powerWarning(action string, delay time.Duration, message string) string {
+	verb := "reboot"
+	if action == "poweroff" {
+		verb = "shut down"
+	}
+	when := "now"
+	if delay > 0 {
+		when = "in " + delay.Round(time.Second).String()
+	}
+	warning := fmt.Sprintf("This machine will %s %s.", verb, when)
+	if message != "" {
+		warning += " " + message
+	}
+	return warning
+}
+
+// warnSessions shows the warning in every terminal the dashboard has open. It
+// goes out as output, not input: typing it into the PTY would run it. It is
+// numbered in the session's output like anything the PTY prints, so it takes
+// its place in a replay and does not throw off the server's count.
+func warnSessions(conn *safeConn, sessions *ptyManager, warning string) {
+	banner := "\r\n\x1b[1;33m*** " + warning + " ***\x1b[0m\r\n"
+	for _, s := range sessions.activeSessions() {
+		_ = sendOutput(conn, s, banner)
+	}
+}
+
+// broadcastWall reaches users logged in some other way, over SSH or a console.
+func broadcastWall(message string) {
+	if _, err := exec.LookPath("wall"); err != nil {
+		return
+	}
+	cmd := exec.Command("wall")
+	cmd.Stdin = strings.NewReader(message + "\n")
+	_ = cmd.Run()
+}
+
+// executePowerAction asks the init system to reboot or power off.
+// --no-ask-password makes a missing privilege fail at once instead of waiting
+// on a polkit prompt nobody can answer.
+func executePowerAction(action string) error {
+	var name string
+	var args []string
+	switch {
+	case runtime.GOOS == "linux" && hasCommand("systemctl"):
+		name, args = "systemctl", []string{"--no-ask-password", action}
+	case action == "reboot":
+		name, args = "shutdown", []string{"-r", "now"}
+	default:
+		name, args = "shutdown", []string{"-h", "now"}
+	}
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		detail := strings.TrimSpace(string(out))
+		if detail == "" {
+			detail = err.Error()
+		}
+		return fmt.Errorf("%s %s: %s", name, strings.Join(args, " "), detail)
+	}
+	return nil
+}
+
+func hasCommand(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// currentBootID identifies this boot, so a record written before a reboot can
+// be told apart from one written since.
+func currentBootID() string {
+	switch runtime.GOOS {
+	case "linux":
+		if id := readFileTrim("/proc/sys/kernel/random/boot_id"); id != "" {
+			return id
+		}
+		if bt := readBootTime(); bt > 0 {
+			return fmt.Sprintf("btime-%d", bt)
+		}
+	case "darwin":
+		return runSimpleCommand("sysctl", "-n", "kern.boottime")
+	}
+	return ""
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSchedulePowerActionRecordsAndCancels(t *testing.T) {
+	t.Setenv("SPECTRE_AGENT_HOME", t.TempDir())
+	t.Cleanup(clearPowerAction)
+
+	fired := make(chan struct{}, 1)
+	if _, err := schedulePowerAction("reboot", "", time.Hour, func() { fired <- struct{}{} }); err != nil {
+		t.Fatalf("schedulePowerAction: %v", err)
+	}
+
+	var pending pendingPower
+	if !readStateJSON(powerStateFile, &pending) || pending.Action != "reboot" {
+		t.Fatalf("pending reboot was not recorded: %+v", pending)
+	}
+	if pending.BootID != currentBootID() {
+		t.Errorf("recorded boot %q, running in %q", pending.BootID, currentBootID())
+	}
+
+	// One at a time: a second request must not silently replace the first.
+	if _, err := schedulePowerAction("poweroff", "", 0, func() {}); err == nil {
+		t.Fatal("a second power action was scheduled over the first")
+	}
+
+	if err := cancelPowerAction(); err != nil {
+		t.Fatalf("cancelPowerAction: %v", err)
+	}
+	if readStateJSON(powerStateFile, &pending) {
+		t.Error("cancelled action is still recorded, and would be reported as completed after the next boot")
+	}
+	select {
+	case <-fired:
+		t.Fatal("cancelled action fired")
+	default:
+	}
+	if err := cancelPowerAction(); err == nil {
+		t.Error("cancelling with nothing scheduled should say so")
+	}
+}
+
+func TestSchedulePowerActionValidates(t *testing.T) {
+	t.Setenv("SPECTRE_AGENT_HOME", t.TempDir())
+	t.Cleanup(clearPowerAction)
+
+	if _, err := schedulePowerAction("halt-and-catch-fire", "", 0, func() {}); err == nil {
+		t.Error("unknown action accepted")
+	}
+	if _, err := schedulePowerAction("reboot", "", -time.Second, func() {}); err == nil {
+		t.Error("negative delay accepted")
+	}
+	if _, err := schedulePowerAction("reboot", "", maxPowerDelay+time.Second, func() {}); err == nil {
+		t.Error("delay beyond the maximum accepted")
+	}
+}
+
+func TestPowerWarning(t *testing.T) {
+	got := powerWarning("poweroff", 5*time.Minute, "Disk swap.")
+	if !strings.Contains(got, "shut down in 5m0s") || !strings.HasSuffix(got, "Disk swap.") {
+		t.Errorf("unexpected warning %q", got)
+	}
+	if got := powerWarning("reboot", 0, ""); got != "This machine will reboot now." {
+		t.Errorf("unexpected warning %q", got)
+	}
+}
+
+// The link may be re-established between scheduling and acting; the reports
+// from the timer go on the connection live by then, not the dead one.
+func TestPowerReportsGoOnTheLiveConnection(t *testing.T) {
+	t.Setenv("SPECTRE_AGENT_HOME", t.TempDir())
+	t.Cleanup(clearPowerAction)
+	old := runPowerCommand
+	runPowerCommand = func(string) error { return errors.New("not on a test machine") }
+	t.Cleanup(func() { runPowerCommand = old })
+
+	first, firstReplies := replyRecorder(t)
+	ctl := newAgentControl()
+	ctl.setConn(first)
+	handlePowerMessage(first, ctl, "p1", "reboot", 1, "")
+	if msg := nextReply(t, firstReplies); msg.State != "scheduled" || msg.RequestID != "p1" {
+		t.Fatalf("report = %+v", msg)
+	}
+
+	_ = first.close()
+	second, replies := replyRecorder(t)
+	ctl.setConn(second)
+	if msg := nextReply(t, replies); msg.State != "shuttingDown" || msg.RequestID != "p1" {
+		t.Fatalf("report = %+v", msg)
+	}
+	if msg := nextReply(t, replies); msg.State != "failed" || msg.RequestID != "p1" || msg.Error == "" {
+		t.Fatalf("report = %+v", msg)
+	}
+}
+
+func TestReportCompletedPowerAction(t *testing.T) {
+	t.Setenv("SPECTRE_AGENT_HOME", t.TempDir())
+	if currentBootID() == "" {
+		t.Skip("no boot id on this machine")
+	}
+	conn, replies := replyRecorder(t)
+
+	// Recorded in an earlier boot: the reboot happened.
+	_ = writeStateJSON(powerStateFile, pendingPower{Action: "reboot", BootID: "an-earlier-boot", RequestID: "p1"})
+	reportCompletedPowerAction(conn)
+	if msg := nextReply(t, replies); msg.State != "completed" || msg.RequestID != "p1" {
+		t.Fatalf("report = %+v", msg)
+	}
+
+	// Recorded in this boot, with nothing counting down: the agent restarted
+	// before the reboot, which is never coming. A later reboot for some other
+	// reason must not be taken for it.
+	_ = writeStateJSON(powerStateFile, pendingPower{Action: "reboot", BootID: currentBootID(), RequestID: "p2"})
+	reportCompletedPowerAction(conn)
+	if msg := nextReply(t, replies); msg.State != "failed" || msg.RequestID != "p2" || !strings.Contains(msg.Error, "restarted") {
+		t.Fatalf("report = %+v", msg)
+	}
+	var pending pendingPower
+	if readStateJSON(powerStateFile, &pending) {
+		t.Fatalf("the lost reboot is still recorded: %+v", pending)
+	}
+}
+
+// The warning is session output like any other: numbered after what the PTY
+// already sent, and kept for a replay.
+func TestPowerWarningIsSequencedOutput(t *testing.T) {
+	conn, replies := replyRecorder(t)
+	ctl := newAgentControl()
+	session := addFakeSession(t, ctl, "spectre-warned")
+	session.output.record("$ ")
+
+	warnSessions(conn, ctl.sessions, "Rebooting in 1 minute")
+	got := nextReply(t, replies)
+	if got.Type != "output" || got.SessionID != "spectre-warned" || got.Seq != 2 || !strings.Contains(got.Data, "Rebooting") {
+		t.Fatalf("warning sent as %+v", got)
+	}
+	if chunks, _ := session.output.since(1); len(chunks) != 1 || chunks[0].data != got.Data {
+		t.Fatalf("warning not kept for a replay: %+v", chunks)
+	}
+}
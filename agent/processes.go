@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// The process table, read straight from /proc.
+//
+// Shelling out to `ps` would be simpler, but its columns and flags differ
+// between procps, busybox and BSD, and a struggling box is exactly where
+// spawning extra processes hurts. /proc is the same everywhere on Linux.
+
+// A var so tests can point it at a fixture tree.
+var procRoot = "/proc"
+
+const (
+	// USER_HZ is 100 on every Linux architecture the agent is built for.
+	clockTicksPerSecond = 100
+	cpuSampleWindow     = 250 * time.Millisecond
+
+	// A reply is capped like a page of logs: well under the server's 256 KB
+	// message cap, leaving room for the envelope and JSON escaping.
+	maxProcesses           = 1000
+	maxProcessesBytes      = 160 << 10
+	maxProcessCmdlineBytes = 1 << 10
+)
+
+// procStat is the part of /proc/<pid>/stat the process table uses.
+type procStat struct {
+	comm      string
+	state     string
+	ppid      int
+	cpuTicks  uint64 // utime + stime
+	startTick uint64 // since boot
+	rssPages  uint64
+}
+
+// handleProcesses services a "processes" message. The CPU sample takes a
+// quarter of a second, so it runs off the read loop, like a unit action, and
+// keystrokes are not held up behind it.
+func handleProcesses(conn *safeConn, requestID string) {
+	go func() {
+		processes, err := listProcesses()
+		processes, truncated := capProcesses(processes)
+		payload := AgentMessage{
+			Type:      "processes",
+			Processes: processes,
+			Truncated: truncated,
+		}
+		if err != nil {
+			payload.Error = err.Error()
+		}
+		_ = conn.reply(requestID, payload)
+	}()
+}
+
+func listProcesses() ([]ProcessInfo, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("process listing is not supported on %s", runtime.GOOS)
+	}
+
+	before := readCPUTicks()
+	time.Sleep(cpuSampleWindow)
+
+	bootTime := readBootTime()
+	pageSize := uint64(os.Getpagesize())
+	users := map[uint32]string{}
+
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", procRoot, err)
+	}
+
+	processes := make([]ProcessInfo, 0, len(entries))
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		dir := filepath.Join(procRoot, entry.Name())
+		data, err := os.ReadFile(filepath.Join(dir, "stat"))
+		if err != nil {
+			continue // exited since the directory was listed
+		}
+		stat, err := parseProcStat(string(data))
+		if err != nil {
+			continue
+		}
+
+		info := ProcessInfo{
+			PID:      pid,
+			PPID:     stat.ppid,
+			User:     processOwner(dir, users),
+			Command:  readCmdline(dir, stat.comm),
+			RSSBytes: stat.rssPages * pageSize,
+			State:    stat.state,
+		}
+		if bootTime > 0 {
+			info.StartTime = bootTime + int64(stat.startTick/clockTicksPerSecond)
+		}
+		if prev, ok := before[pid]; ok && stat.cpuTicks >= prev {
+			elapsed := float64(stat.cpuTicks-prev) / clockTicksPerSecond
+			info.CPUPercent = elapsed / cpuSampleWindow.Seconds() * 100
+		}
+		processes = append(processes, info)
+	}
+
+	sort.Slice(processes, func(i, j int) bool { return processes[i].PID < processes[j].PID })
+	return processes, nil
+}
+
+// capProcesses fits a process table into one reply. A table that is too big
+// keeps what one is mostly looked at for, taking in turn the next busiest
+// process and the next biggest, and reports that it is partial. Either way it
+// comes back in pid order.
+func capProcesses(processes []ProcessInfo) ([]ProcessInfo, bool) {
+	size := func(p ProcessInfo) int { return len(p.Command) + len(p.User) + 128 }
+	total := 0
+	for i := range processes {
+		if len(processes[i].Command) > maxProcessCmdlineBytes {
+			processes[i].Command = truncateUTF8(processes[i].Command, maxProcessCmdlineBytes) + "…"
+		}
+		total += size(processes[i])
+	}
+	if len(processes) <= maxProcesses && total <= maxProcessesBytes {
+		return processes, false
+	}
+
+	byCPU := slices.Clone(processes)
+	sort.SliceStable(byCPU, func(i, j int) bool { return byCPU[i].CPUPercent > byCPU[j].CPUPercent })
+	byRSS := slices.Clone(processes)
+	sort.SliceStable(byRSS, func(i, j int) bool { return byRSS[i].RSSBytes > byRSS[j].RSSBytes })
+
+	kept := make([]ProcessInfo, 0, maxProcesses)
+	taken := map[int]bool{}
+	bytes := 0
+	for i := 0; i < len(processes) && len(kept) < maxProcesses; i++ {
+		for _, p := range []ProcessInfo{byCPU[i], byRSS[i]} {
+			if taken[p.PID] || len(kept) >= maxProcesses || bytes+size(p) > maxProcessesBytes {
+				continue
+			}
+			taken[p.PID] = true
+			kept = append(kept, p)
+			bytes += size(p)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].PID < kept[j].PID })
+	return kept, true
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a character, which
+// JSON encoding would otherwise turn into a replacement character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// readCPUTicks takes the first half of the CPU sample.
+func readCPUTicks() map[int]uint64 {
+	ticks := map[int]uint64{}
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return ticks
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(procRoot, entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		if stat, err := parseProcStat(string(data)); err == nil {
+			ticks[pid] = stat.cpuTicks
+		}
+	}
+	return ticks
+}
+
+// parseProcStat reads /proc/<pid>/stat. The command name is in parentheses
+// and may itself contain spaces or parentheses, so the fields are located
+// from the *last* closing parenthesis rather than by splitting the line.
+func parseProcStat(line string) (procStat, error) {
+	open := strings.IndexByte(line, '(')
+	end := strings.LastIndexByte(line, ')')
+	if open < 0 || end < open {
+		return procStat{}, fmt.Errorf("malformed stat line")
+	}
+	// fields[0] is the state, which is field 3 in proc(5)'s numbering.
+	fields := strings.Fields(line[end+1:])
+	if len(fields) < 22 {
+		return procStat{}, fmt.Errorf("short stat line")
+	}
+
+	field := func(n int) uint64 {
+		v, _ := strconv.ParseUint(fields[n-3], 10, 64)
+		return v
+	}
+	ppid, _ := strconv.Atoi(fields[4-3])
+	return procStat{
+		comm:      line[open+1 : end],
+		state:     fields[0],
+		ppid:      ppid,
+		cpuTicks:  field(14) + field(15),
+		startTick: field(22),
+		rssPages:  field(24),
+	}, nil
+}
+
+// readCmdline returns the full command line, or the bracketed command name
+// for kernel threads and zombies, which have none — the same thing ps shows.
+func readCmdline(dir, comm string) string {
+	data, err := os.ReadFile(filepath.Join(dir, "cmdline"))
+	if err != nil || len(data) == 0 {
+		return "[" + comm + "]"
+	}
+	return strings.TrimSpace(strings.ReplaceAll(string(data), "\x00", " "))
+}
+
+// processOwner resolves the owning user's name, caching lookups because a
+// process table is mostly a handful of users repeated.
+func processOwner(dir string, cache map[uint32]string) string {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return ""
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	if name, ok := cache[stat.Uid]; ok {
+		return name
+	}
+	name := strconv.FormatUint(uint64(stat.Uid), 10)
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+	cache[stat.Uid] = name
+	return name
+}
+
+// readBootTime returns the boot time from /proc/stat, which start times are
+// measured from.
+func readBootTime() int64 {
+	data, err := os.ReadFile(filepath.Join(procRoot, "stat"))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "btime ") {
+			v, _ := strconv.ParseInt(strings.TrimSpace(line[len("btime "):]), 10, 64)
+			return v
+		}
+	}
+	return 0
+}
+
+// Signals the dashboard may send. Deliberately a short list: these are the
+// ones an operator reaches for, and anything more exotic can go through a
+// terminal.
+var processSignals = map[string]syscall.Signal{
+	"TERM": syscall.SIGTERM,
+	"KILL": syscall.SIGKILL,
+	"HUP":  syscall.SIGHUP,
+	"STOP": syscall.SIGSTOP,
+	"CONT": syscall.SIGCONT,
+}
+
+// parseSignalName accepts "TERM", "term" or "SIGTERM".
+func parseSignalName(name string) (syscall.Signal, error) {
+	key := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG")
+	sig, ok := processSignals[key]
+	if !ok {
+		return 0, fmt.Errorf("unsupported signal %q (use TERM, KILL, HUP, STOP or CONT)", name)
+	}
+	return sig, nil
+}
+
+// signalProcess sends a signal to one process.
+//
+// The kernel enforces the real permission check: the agent can only signal
+// what its service account could. What this adds is refusing pids that mean
+// something other than "one process" — 0 and negatives address whole process
+// groups, and -1 is every process the caller may signal — and pid 1, which no
+// dashboard click should be able to take down.
+func signalProcess(pid int, signalName string) error {
+	sig, err := parseSignalName(signalName)
+	if err != nil {
+		return err
+	}
+	if pid <= 1 {
+		return fmt.Errorf("refusing to signal pid %d", pid)
+	}
+	if err := syscall.Kill(pid, sig); err != nil {
+		return fmt.Errorf("signal %d: %w", pid, err)
+	}
+	return nil
+}
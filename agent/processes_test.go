@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"unicode/utf8"
+)
+
+// A command name may contain spaces and parentheses; a naive split on spaces
+// shifts every field after it.
+func TestParseProcStatHandlesAwkwardCommandNames(t *testing.T) {
+	line := "4242 (tmux: server (1)) S 1 4242 4242 0 -1 4194560 1000 0 0 0 150 50 0 0 20 0 1 0 98765 123456789 2048 18446744073709551615"
+
+	stat, err := parseProcStat(line)
+	if err != nil {
+		t.Fatalf("parseProcStat: %v", err)
+	}
+	if stat.comm != "tmux: server (1)" {
+		t.Errorf("comm = %q", stat.comm)
+	}
+	if stat.state != "S" || stat.ppid != 1 {
+		t.Errorf("state/ppid = %q/%d", stat.state, stat.ppid)
+	}
+	if stat.cpuTicks != 200 {
+		t.Errorf("cpuTicks = %d, want utime+stime = 200", stat.cpuTicks)
+	}
+	if stat.startTick != 98765 || stat.rssPages != 2048 {
+		t.Errorf("startTick/rssPages = %d/%d", stat.startTick, stat.rssPages)
+	}
+
+	if _, err := parseProcStat("4242 no parens here"); err == nil {
+		t.Error("expected an error for a malformed line")
+	}
+}
+
+func TestReadCmdlineFallsBackToTheCommandName(t *testing.T) {
+	dir := t.TempDir()
+	if got := readCmdline(dir, "kworker/0:1"); got != "[kworker/0:1]" {
+		t.Errorf("kernel thread rendered as %q", got)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cmdline"), []byte("sleep\x00100\x00"), 0o644); err != nil {
+		t.Fatalf("seed cmdline: %v", err)
+	}
+	if got := readCmdline(dir, "sleep"); got != "sleep 100" {
+		t.Errorf("cmdline rendered as %q", got)
+	}
+}
+
+func TestParseSignalName(t *testing.T) {
+	for _, name := range []string{"TERM", "term", "SIGTERM", " sigterm "} {
+		if sig, err := parseSignalName(name); err != nil || sig != syscall.SIGTERM {
+			t.Errorf("parseSignalName(%q) = %v, %v", name, sig, err)
+		}
+	}
+	if _, err := parseSignalName("SEGV"); err == nil {
+		t.Error("signals outside the allowed list must be refused")
+	}
+}
+
+// 0 and negative pids address process groups, and -1 every process the agent
+// may signal; none of them is "one process".
+func TestSignalProcessRefusesGroupAndInitPids(t *testing.T) {
+	for _, pid := range []int{-1, 0, 1} {
+		err := signalProcess(pid, "TERM")
+		if err == nil || !strings.Contains(err.Error(), "refusing") {
+			t.Errorf("signalProcess(%d) = %v, want a refusal", pid, err)
+		}
+	}
+}
+
+// A busy build host can run thousands of processes with long command lines,
+// and the server drops any agent message over 256 KB. The reply keeps the
+// busiest and the biggest, and says it is partial.
+func TestProcessTableIsCappedToOneMessage(t *testing.T) {
+	var table []ProcessInfo
+	for pid := 2; pid < 6000; pid++ {
+		table = append(table, ProcessInfo{
+			PID: pid, PPID: 1, User: "builder", State: "S",
+			Command: fmt.Sprintf("/usr/bin/java -jar worker-%d.jar %s", pid, strings.Repeat("-Dprop=value ", 40)),
+		})
+	}
+	table[100].CPUPercent = 97.5
+	table[4000].RSSBytes = 8 << 30
+	table[5000].Command = "/usr/bin/node " + strings.Repeat("x", 64<<10)
+
+	kept, truncated := capProcesses(table)
+	if !truncated || len(kept) == 0 || len(kept) >= len(table) {
+		t.Fatalf("kept %d of %d, truncated=%v", len(kept), len(table), truncated)
+	}
+	data, _ := json.Marshal(AgentMessage{Type: "processes", Processes: kept, Truncated: true})
+	if len(data) > 256<<10 {
+		t.Fatalf("reply is %d bytes, over the server's cap", len(data))
+	}
+	var busiest, biggest bool
+	for i, p := range kept {
+		busiest = busiest || p.PID == table[100].PID
+		biggest = biggest || p.PID == table[4000].PID
+		if i > 0 && kept[i-1].PID >= p.PID {
+			t.Fatalf("not in pid order at %d", i)
+		}
+		if len(p.Command) > maxProcessCmdlineBytes+len("…") {
+			t.Fatalf("pid %d has a %d-byte command line", p.PID, len(p.Command))
+		}
+	}
+	if !busiest || !biggest {
+		t.Fatalf("dropped the busiest (%v) or the biggest (%v) process", busiest, biggest)
+	}
+
+	small := table[:10]
+	if kept, truncated := capProcesses(small); truncated || len(kept) != len(small) {
+		t.Fatalf("a small table was cut: %d, %v", len(kept), truncated)
+	}
+}
+
+// A long command line is cut between characters, not through one.
+func TestLongCommandLinesAreCutOnACharacterBoundary(t *testing.T) {
+	// Two bytes of ASCII put a three-byte "日" across the byte limit.
+	command := "xx" + strings.Repeat("日", maxProcessCmdlineBytes)
+	kept, _ := capProcesses([]ProcessInfo{{PID: 2, Command: command}})
+	got := kept[0].Command
+	if !utf8.ValidString(got) || !strings.HasSuffix(got, "…") {
+		t.Fatalf("command line cut to %q", got)
+	}
+	if len(got) > maxProcessCmdlineBytes+len("…") {
+		t.Fatalf("a %d-byte command line", len(got))
+	}
+}
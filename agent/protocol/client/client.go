@@ -0,0 +1,161 @@
+// Package client connects to a Spectre control server the way an agent does,
+// speaking the protocol package's typed messages. It is for automation and
+// test harnesses: a fake agent in a test, or a tool that needs to see exactly
+// what a server sends.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/sidhantpanda/spectre/agent/protocol"
+)
+
+// RegisterPath is where a control server accepts agents.
+const RegisterPath = "/api/agents/register"
+
+// Options configures Dial.
+type Options struct {
+	// URL is the agent endpoint, e.g. wss://spectre.example.com/api/agents/register.
+	URL string
+	// Credential is a device key, or an auth key to enroll with.
+	Credential string
+	// Hello is sent to open the connection. ProtocolVersion defaults to
+	// protocol.Version.
+	Hello protocol.AgentHello
+	// Dialer defaults to websocket.DefaultDialer.
+	Dialer *websocket.Dialer
+	// HandshakeTimeout bounds the hello exchange. Defaults to 30 seconds.
+	HandshakeTimeout time.Duration
+}
+
+// Conn is an established agent connection. Send may be called from several
+// goroutines; Receive from one at a time.
+type Conn struct {
+	ws *websocket.Conn
+	mu sync.Mutex
+
+	// Hello is the server's answer to the handshake: the protocol version
+	// and features it enabled.
+	Hello protocol.ServerHello
+	// DeviceKey is the credential the server issued, when the connection
+	// enrolled with an auth key. Empty otherwise.
+	DeviceKey string
+}
+
+// Dial connects, sends the hello, and waits for the server's, taking in an
+// enrollment on the way.
+func Dial(ctx context.Context, opts Options) (*Conn, error) {
+	dialer := opts.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	timeout := opts.HandshakeTimeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	hello := opts.Hello
+	if hello.ProtocolVersion == 0 {
+		hello.ProtocolVersion = protocol.Version
+	}
+
+	header := http.Header{}
+	if opts.Credential != "" {
+		header.Set("Authorization", "Bearer "+opts.Credential)
+	}
+	ws, resp, err := dialer.DialContext(ctx, opts.URL, header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("dial %s: %w (HTTP %s)", opts.URL, err, resp.Status)
+		}
+		return nil, fmt.Errorf("dial %s: %w", opts.URL, err)
+	}
+
+	c := &Conn{ws: ws}
+	if err := c.handshake(hello, timeout); err != nil {
+		ws.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Conn) handshake(hello protocol.AgentHello, timeout time.Duration) error {
+	if err := c.Send(hello); err != nil {
+		return fmt.Errorf("send hello: %w", err)
+	}
+	_ = c.ws.SetReadDeadline(time.Now().Add(timeout))
+	defer func() { _ = c.ws.SetReadDeadline(time.Time{}) }()
+
+	for {
+		msg, err := c.Receive()
+		if err != nil {
+			return fmt.Errorf("handshake: %w", err)
+		}
+		switch m := msg.(type) {
+		case protocol.Enrolled:
+			c.DeviceKey = m.DeviceKey
+		case protocol.ServerHello:
+			c.Hello = m
+			return nil
+		default:
+			return fmt.Errorf("handshake: unexpected %q", msg.MessageType())
+		}
+	}
+}
+
+// Enabled reports whether the server switched a feature on. A server that
+// predates negotiation enables everything, as it always has.
+func (c *Conn) Enabled(feature string) bool {
+	if c.Hello.ProtocolVersion == 0 {
+		return true
+	}
+	for _, f := range c.Hello.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Send validates and writes one message.
+func (c *Conn) Send(m protocol.Message) error {
+	data, err := protocol.Encode(m)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+// Receive reads the next message from the server. An error wrapping
+// protocol.ErrUnknownType or protocol.ErrInvalid concerns that message only;
+// the connection is still usable. Any other error ends it.
+func (c *Conn) Receive() (protocol.Message, error) {
+	_, data, err := c.ws.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	return protocol.DecodeControl(data)
+}
+
+// Close ends the connection.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	_ = c.ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.mu.Unlock()
+	return c.ws.Close()
+}
+
+// IsMessageError reports whether err from Receive concerned a single message
+// rather than the connection.
+func IsMessageError(err error) bool {
+	return errors.Is(err, protocol.ErrUnknownType) || errors.Is(err, protocol.ErrInvalid)
+}
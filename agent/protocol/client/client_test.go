@@ -0,0 +1,128 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/sidhantpanda/spectre/agent/protocol"
+)
+
+// fakeServer plays the control server's side of one connection.
+func fakeServer(t *testing.T, serve func(*websocket.Conn)) string {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer auth-key" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(conn)
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + RegisterPath
+}
+
+func send(t *testing.T, conn *websocket.Conn, m protocol.Message) {
+	t.Helper()
+	data, err := protocol.Encode(m)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_ = conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func TestDialEnrollsAndNegotiates(t *testing.T) {
+	got := make(chan protocol.Message, 2)
+	url := fakeServer(t, func(conn *websocket.Conn) {
+		for i := 0; i < 2; i++ {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			m, err := protocol.DecodeAgent(data)
+			if err != nil {
+				t.Errorf("server could not decode %s: %v", data, err)
+				return
+			}
+			got <- m
+			if i == 0 {
+				send(t, conn, protocol.Enrolled{DeviceKey: "device-key"})
+				send(t, conn, protocol.ServerHello{ProtocolVersion: protocol.Version, Features: []string{protocol.FeatureDocker}})
+				send(t, conn, protocol.DockerInfoRequest{Request: protocol.Request{RequestID: "r1"}})
+			}
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, Options{URL: url, Credential: "auth-key", Hello: protocol.AgentHello{AgentID: "a1"}})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+
+	if hello := (<-got).(protocol.AgentHello); hello.ProtocolVersion != protocol.Version {
+		t.Errorf("hello sent protocol %d, want %d", hello.ProtocolVersion, protocol.Version)
+	}
+	if c.DeviceKey != "device-key" {
+		t.Errorf("DeviceKey = %q", c.DeviceKey)
+	}
+	if !c.Enabled(protocol.FeatureDocker) || c.Enabled(protocol.FeatureSystemd) {
+		t.Errorf("features = %v", c.Hello.Features)
+	}
+
+	msg, err := c.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, ok := msg.(protocol.DockerInfoRequest)
+	if !ok {
+		t.Fatalf("received %#v", msg)
+	}
+	reply := protocol.DockerInfoReply{Reply: protocol.Reply{RequestID: req.RequestID}, Containers: []protocol.DockerContainer{{Name: "web"}}}
+	if err := c.Send(reply); err != nil {
+		t.Fatal(err)
+	}
+	if answer := (<-got).(protocol.DockerInfoReply); answer.RequestID != "r1" || len(answer.Containers) != 1 {
+		t.Errorf("server received %+v", answer)
+	}
+}
+
+func TestDialReportsRejection(t *testing.T) {
+	url := fakeServer(t, func(*websocket.Conn) {})
+	_, err := Dial(context.Background(), Options{URL: url, Credential: "wrong", Hello: protocol.AgentHello{AgentID: "a1"}})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("err = %v, want the HTTP status", err)
+	}
+}
+
+func TestSendValidates(t *testing.T) {
+	url := fakeServer(t, func(conn *websocket.Conn) {
+		_, _, _ = conn.ReadMessage()
+		send(t, conn, protocol.ServerHello{})
+		_, _, _ = conn.ReadMessage()
+	})
+	c, err := Dial(context.Background(), Options{URL: url, Credential: "auth-key", Hello: protocol.AgentHello{AgentID: "a1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !c.Enabled(protocol.FeaturePower) {
+		t.Error("a server that did not negotiate should leave everything enabled")
+	}
+	if err := c.Send(protocol.Output{Data: "no session"}); !IsMessageError(err) {
+		t.Fatalf("err = %v, want a validation error", err)
+	}
+}
@@ -0,0 +1,267 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrUnknownType is wrapped by Decode errors for a type this package
+	// does not know in that direction.
+	ErrUnknownType = errors.New("unknown message type")
+	// ErrInvalid is wrapped by errors for a message missing a required
+	// field or carrying a malformed one.
+	ErrInvalid = errors.New("invalid message")
+)
+
+// Encode validates m and renders it as it goes on the wire.
+func Encode(m Message) ([]byte, error) {
+	if err := Validate(m); err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	typeField, _ := json.Marshal(m.MessageType())
+	var b bytes.Buffer
+	b.WriteString(`{"type":`)
+	b.Write(typeField)
+	if !bytes.Equal(body, []byte("{}")) {
+		b.WriteByte(',')
+		b.Write(body[1:])
+	} else {
+		b.WriteByte('}')
+	}
+	return b.Bytes(), nil
+}
+
+// DecodeControl reads a server-to-agent message.
+func DecodeControl(data []byte) (Message, error) {
+	return decode(data, controlDecoders, false)
+}
+
+// DecodeAgent reads an agent-to-server message.
+func DecodeAgent(data []byte) (Message, error) {
+	return decode(data, agentDecoders, true)
+}
+
+func decode(data []byte, decoders map[string]func([]byte) (Message, error), agent bool) (Message, error) {
+	var head struct {
+		Type  string `json:"type"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if head.Type == "" {
+		return nil, fmt.Errorf("%w: no type", ErrInvalid)
+	}
+	decoder, ok := decoders[head.Type]
+	if !ok {
+		// An agent answers a request it could not serve with the request's
+		// own type, which need not be a type agents otherwise send.
+		if agent && head.Error != "" {
+			f := Failure{Type: head.Type}
+			if err := json.Unmarshal(data, &f.Reply); err != nil {
+				return nil, fmt.Errorf("%w: %s: %v", ErrInvalid, head.Type, err)
+			}
+			return f, nil
+		}
+		return nil, fmt.Errorf("%w %q", ErrUnknownType, head.Type)
+	}
+	m, err := decoder(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalid, head.Type, err)
+	}
+	if err := Validate(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func decodeAs[T Message](data []byte) (Message, error) {
+	var m T
+	err := json.Unmarshal(data, &m)
+	return m, err
+}
+
+var controlDecoders = map[string]func([]byte) (Message, error){
+	"hello":         decodeAs[ServerHello],
+	"enrolled":      decodeAs[Enrolled],
+	"keystroke":     decodeAs[Keystroke],
+	"listSessions":  decodeAs[ListSessions],
+	"createSession": decodeAs[CreateSession],
+	"attachSession": decodeAs[AttachSession],
+	"resize":        decodeAs[Resize],
+	"killSession":   decodeAs[KillSession],
+	"replay":        decodeAs[Replay],
+	"ackOutput":     decodeAs[AckOutput],
+	"ackEvent":      decodeAs[AckEvent],
+	"dockerInfo":    decodeAs[DockerInfoRequest],
+	"systemInfo":    decodeAs[SystemInfoRequest],
+	"networkInfo":   decodeAs[NetworkInfoRequest],
+	"processes":     decodeAs[ProcessesRequest],
+	"systemdUnits":  decodeAs[SystemdUnitsRequest],
+	"signalProcess": decodeAs[SignalProcessRequest],
+	"unitStatus":    decodeAs[UnitStatusRequest],
+	"unitAction":    decodeAs[UnitActionRequest],
+	"queryLogs":     decodeAs[QueryLogs],
+	"stopLogs":      decodeAs[StopLogs],
+	"power":         decodeAs[Power],
+	"update":        decodeAs[Update],
+}
+
+var agentDecoders = map[string]func([]byte) (Message, error){
+	"hello":         decodeAs[AgentHello],
+	"output":        decodeAs[Output],
+	"outputGap":     decodeAs[OutputGap],
+	"heartbeat":     decodeAs[Heartbeat],
+	"sessions":      decodeAs[Sessions],
+	"sessionOpened": decodeAs[SessionOpened],
+	"sessionClosed": decodeAs[SessionClosed],
+	"sessionExited": decodeAs[SessionExited],
+	"dockerInfo":    decodeAs[DockerInfoReply],
+	"systemInfo":    decodeAs[SystemInfoReply],
+	"networkInfo":   decodeAs[NetworkInfoReply],
+	"processes":     decodeAs[ProcessesReply],
+	"signalProcess": decodeAs[SignalProcessReply],
+	"systemdUnits":  decodeAs[SystemdUnitsReply],
+	"unitStatus":    decodeAs[UnitStatusReply],
+	"unitAction":    decodeAs[UnitActionReply],
+	"logs":          decodeAs[Logs],
+	"powerStatus":   decodeAs[PowerStatus],
+	"updateStatus":  decodeAs[UpdateStatus],
+}
+
+// Validate checks the fields a message cannot do without. It covers shape
+// only: whether a unit exists or a signal may be sent is for the agent to say.
+func Validate(m Message) error {
+	v, ok := m.(interface{ validate() string })
+	if !ok {
+		return nil
+	}
+	if problem := v.validate(); problem != "" {
+		return fmt.Errorf("%w: %s: %s", ErrInvalid, m.MessageType(), problem)
+	}
+	return nil
+}
+
+func requireSession(id string) string {
+	if id == "" {
+		return "sessionId is required"
+	}
+	return ""
+}
+
+func (m Enrolled) validate() string {
+	if m.DeviceKey == "" {
+		return "deviceKey is required"
+	}
+	return ""
+}
+
+func (m AckEvent) validate() string {
+	if m.EventID == "" {
+		return "eventId is required"
+	}
+	return ""
+}
+
+func (m Keystroke) validate() string     { return requireSession(m.SessionID) }
+func (m AttachSession) validate() string { return requireSession(m.SessionID) }
+func (m KillSession) validate() string   { return requireSession(m.SessionID) }
+func (m Replay) validate() string        { return requireSession(m.SessionID) }
+func (m AckOutput) validate() string     { return requireSession(m.SessionID) }
+func (m Output) validate() string        { return requireSession(m.SessionID) }
+func (m OutputGap) validate() string     { return requireSession(m.SessionID) }
+
+func (m Resize) validate() string {
+	if m.Cols == 0 || m.Rows == 0 {
+		return "cols and rows must both be set"
+	}
+	return requireSession(m.SessionID)
+}
+
+func (m SignalProcessRequest) validate() string {
+	if m.PID <= 0 {
+		return "pid must be positive"
+	}
+	if m.Signal == "" {
+		return "signal is required"
+	}
+	return ""
+}
+
+func (m UnitStatusRequest) validate() string {
+	if m.Unit == "" {
+		return "unit is required"
+	}
+	if m.Lines < 0 {
+		return "lines cannot be negative"
+	}
+	return ""
+}
+
+func (m UnitActionRequest) validate() string {
+	if m.Unit == "" {
+		return "unit is required"
+	}
+	switch m.Action {
+	case "start", "stop", "restart", "enable", "disable":
+		return ""
+	}
+	return fmt.Sprintf("unsupported action %q", m.Action)
+}
+
+func (m QueryLogs) validate() string {
+	if m.Query == nil {
+		return "query is required"
+	}
+	if m.Query.Follow && m.Query.FollowID == "" {
+		return "a follow needs a followId"
+	}
+	return ""
+}
+
+func (m StopLogs) validate() string {
+	if m.FollowID == "" {
+		return "followId is required"
+	}
+	return ""
+}
+
+func (m Power) validate() string {
+	switch m.Action {
+	case "reboot", "poweroff", "cancel":
+	default:
+		return fmt.Sprintf("unsupported action %q", m.Action)
+	}
+	if m.Delay < 0 {
+		return "delay cannot be negative"
+	}
+	return ""
+}
+
+func (m AgentHello) validate() string {
+	if m.AgentID == "" {
+		return "agentId is required"
+	}
+	return ""
+}
+
+func (m PowerStatus) validate() string {
+	if m.State == "" {
+		return "state is required"
+	}
+	return ""
+}
+
+func (m UpdateStatus) validate() string {
+	if m.State == "" {
+		return "state is required"
+	}
+	return ""
+}
@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeAddsTheType(t *testing.T) {
+	data, err := Encode(Keystroke{Request: Request{RequestID: "r1"}, SessionID: "s1", Data: "ls\r"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"type":"keystroke","requestId":"r1","sessionId":"s1","data":"ls\r"}`; string(data) != want {
+		t.Fatalf("got %s\nwant %s", data, want)
+	}
+	data, err = Encode(Heartbeat{})
+	if err != nil || string(data) != `{"type":"heartbeat"}` {
+		t.Fatalf("got %s, %v", data, err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	offset := int64(42)
+	controls := []Message{
+		ServerHello{ProtocolVersion: Version, Features: []string{FeatureDocker}},
+		Resize{SessionID: "s1", Cols: 80, Rows: 24},
+		QueryLogs{Request: Request{RequestID: "r2"}, Query: &LogQuery{Source: "file", Path: "/var/log/syslog", Offset: &offset}},
+		Power{Action: "reboot", Delay: 60, Message: "kernel update"},
+		AckEvent{EventID: "e1"},
+	}
+	for _, m := range controls {
+		data, err := Encode(m)
+		if err != nil {
+			t.Fatalf("encode %T: %v", m, err)
+		}
+		got, err := DecodeControl(data)
+		if err != nil {
+			t.Fatalf("decode %s: %v", data, err)
+		}
+		if !reflect.DeepEqual(got, m) {
+			t.Errorf("round trip changed %T:\n got %+v\nwant %+v", m, got, m)
+		}
+	}
+
+	agents := []Message{
+		AgentHello{AgentID: "a1", ProtocolVersion: Version, Capabilities: []string{FeatureLogs}},
+		Output{SessionID: "s1", Data: "hello", Seq: 7},
+		SessionExited{Event: Event{EventID: "e2"}, SessionID: "s1"},
+		PowerStatus{Reply: Reply{RequestID: "r3"}, Action: "reboot", State: "scheduled", At: 1700000000},
+	}
+	for _, m := range agents {
+		data, err := Encode(m)
+		if err != nil {
+			t.Fatalf("encode %T: %v", m, err)
+		}
+		got, err := DecodeAgent(data)
+		if err != nil {
+			t.Fatalf("decode %s: %v", data, err)
+		}
+		if !reflect.DeepEqual(got, m) {
+			t.Errorf("round trip changed %T:\n got %+v\nwant %+v", m, got, m)
+		}
+	}
+}
+
+// The envelopes and the typed messages must agree on the wire.
+func TestTypedMessagesMatchTheEnvelope(t *testing.T) {
+	data, err := Encode(UnitActionRequest{Request: Request{RequestID: "r4"}, Unit: "nginx.service", Action: "restart"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env ControlMessage
+	if err := json.Unmarshal(data, &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.Type != "unitAction" || env.RequestID != "r4" || env.Unit != "nginx.service" || env.Action != "restart" {
+		t.Fatalf("envelope read %+v", env)
+	}
+
+	reply, _ := json.Marshal(AgentMessage{Type: "unitAction", RequestID: "r4", Unit: "nginx.service", Action: "restart", Error: "access denied", Code: CodeFailed})
+	m, err := DecodeAgent(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := m.(UnitActionReply)
+	if !ok || got.RequestID != "r4" {
+		t.Fatalf("decoded %#v", m)
+	}
+	var protoErr *Error
+	if err := got.Err(got.MessageType()); !errors.As(err, &protoErr) || protoErr.Code != CodeFailed {
+		t.Fatalf("Err() = %v", err)
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	cases := map[string]error{
+		`{"type":"frobnicate"}`:                        ErrUnknownType,
+		`{"type":"reset","sessionId":"s1"}`:            ErrUnknownType,
+		`{"data":"no type"}`:                           ErrInvalid,
+		`not json`:                                     ErrInvalid,
+		`{"type":"keystroke","data":"ls"}`:             ErrInvalid,
+		`{"type":"power","action":"halt"}`:             ErrInvalid,
+		`{"type":"queryLogs","query":{"follow":true}}`: ErrInvalid,
+	}
+	for input, want := range cases {
+		if _, err := DecodeControl([]byte(input)); !errors.Is(err, want) {
+			t.Errorf("%s: got %v, want %v", input, err, want)
+		}
+	}
+}
+
+func TestAgentFailuresForRequestsWithoutReplies(t *testing.T) {
+	m, err := DecodeAgent([]byte(`{"type":"keystroke","requestId":"r5","error":"no session s1","code":"notFound"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, ok := m.(Failure)
+	if !ok || f.MessageType() != "keystroke" || f.Code != CodeNotFound || f.RequestID != "r5" {
+		t.Fatalf("decoded %#v", m)
+	}
+}
@@ -0,0 +1,338 @@
+package protocol
+
+// Typed messages, one struct per message type.
+//
+// Where both directions use the same type name, the server's message is
+// XxxRequest and the agent's answer XxxReply. Everything else is named after
+// its type. Each struct carries only the fields its type uses; the "type"
+// field itself is added by Encode and implied by the struct.
+
+// Message is one typed message, in either direction.
+type Message interface {
+	MessageType() string
+}
+
+// Request is embedded in every server-to-agent message. RequestID, when set,
+// is echoed on everything the agent sends in answer.
+type Request struct {
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// Reply is embedded in every agent-to-server message that answers a request.
+type Reply struct {
+	RequestID string `json:"requestId,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Code      string `json:"code,omitempty"`
+}
+
+// Err returns the reply's failure, or nil when it succeeded.
+func (r Reply) Err(msgType string) error {
+	if r.Error == "" {
+		return nil
+	}
+	return &Error{Type: msgType, Code: r.Code, Message: r.Error}
+}
+
+// Server to agent.
+
+// ServerHello answers the agent's hello. ProtocolVersion and Features are
+// absent from servers that predate negotiation.
+type ServerHello struct {
+	ProtocolVersion int      `json:"protocolVersion,omitempty"`
+	Features        []string `json:"features,omitempty"`
+}
+
+// Enrolled hands an agent that connected with an auth key its device key.
+type Enrolled struct {
+	DeviceKey string `json:"deviceKey"`
+}
+
+type Keystroke struct {
+	Request
+	SessionID string `json:"sessionId"`
+	Data      string `json:"data"`
+}
+
+type ListSessions struct{ Request }
+
+type CreateSession struct {
+	Request
+	SessionID string `json:"sessionId,omitempty"`
+	Cols      uint16 `json:"cols,omitempty"`
+	Rows      uint16 `json:"rows,omitempty"`
+}
+
+type AttachSession struct {
+	Request
+	SessionID string `json:"sessionId"`
+	Cols      uint16 `json:"cols,omitempty"`
+	Rows      uint16 `json:"rows,omitempty"`
+}
+
+type Resize struct {
+	Request
+	SessionID string `json:"sessionId"`
+	Cols      uint16 `json:"cols"`
+	Rows      uint16 `json:"rows"`
+}
+
+type KillSession struct {
+	Request
+	SessionID string `json:"sessionId"`
+}
+
+// Replay asks for a session's output after Seq.
+type Replay struct {
+	Request
+	SessionID string `json:"sessionId"`
+	Seq       uint64 `json:"seq"`
+}
+
+// AckOutput releases a session's buffered output up to Seq.
+type AckOutput struct {
+	Request
+	SessionID string `json:"sessionId"`
+	Seq       uint64 `json:"seq"`
+}
+
+// AckEvent tells the agent a queued event arrived, so it can let it go.
+type AckEvent struct {
+	Request
+	EventID string `json:"eventId"`
+}
+
+type DockerInfoRequest struct{ Request }
+type SystemInfoRequest struct{ Request }
+type NetworkInfoRequest struct{ Request }
+type ProcessesRequest struct{ Request }
+type SystemdUnitsRequest struct{ Request }
+
+type SignalProcessRequest struct {
+	Request
+	PID    int    `json:"pid"`
+	Signal string `json:"signal"`
+}
+
+type UnitStatusRequest struct {
+	Request
+	Unit  string `json:"unit"`
+	Lines int    `json:"lines,omitempty"`
+}
+
+type UnitActionRequest struct {
+	Request
+	Unit   string `json:"unit"`
+	Action string `json:"action"`
+}
+
+type QueryLogs struct {
+	Request
+	Query *LogQuery `json:"query"`
+}
+
+type StopLogs struct {
+	Request
+	FollowID string `json:"followId"`
+}
+
+// Power reboots or powers off after Delay seconds, or cancels a pending one.
+type Power struct {
+	Request
+	Action  string `json:"action"`
+	Delay   int    `json:"delay,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Update installs Version, or the latest release when it is empty.
+type Update struct {
+	Request
+	Version string `json:"version,omitempty"`
+}
+
+func (ServerHello) MessageType() string          { return "hello" }
+func (Enrolled) MessageType() string             { return "enrolled" }
+func (Keystroke) MessageType() string            { return "keystroke" }
+func (ListSessions) MessageType() string         { return "listSessions" }
+func (CreateSession) MessageType() string        { return "createSession" }
+func (AttachSession) MessageType() string        { return "attachSession" }
+func (Resize) MessageType() string               { return "resize" }
+func (KillSession) MessageType() string          { return "killSession" }
+func (Replay) MessageType() string               { return "replay" }
+func (AckOutput) MessageType() string            { return "ackOutput" }
+func (AckEvent) MessageType() string             { return "ackEvent" }
+func (DockerInfoRequest) MessageType() string    { return "dockerInfo" }
+func (SystemInfoRequest) MessageType() string    { return "systemInfo" }
+func (NetworkInfoRequest) MessageType() string   { return "networkInfo" }
+func (ProcessesRequest) MessageType() string     { return "processes" }
+func (SystemdUnitsRequest) MessageType() string  { return "systemdUnits" }
+func (SignalProcessRequest) MessageType() string { return "signalProcess" }
+func (UnitStatusRequest) MessageType() string    { return "unitStatus" }
+func (UnitActionRequest) MessageType() string    { return "unitAction" }
+func (QueryLogs) MessageType() string            { return "queryLogs" }
+func (StopLogs) MessageType() string             { return "stopLogs" }
+func (Power) MessageType() string                { return "power" }
+func (Update) MessageType() string               { return "update" }
+
+// Agent to server.
+
+// Event is embedded in the messages the agent sends through its event queue.
+// They can arrive more than once, after a reconnect, and EventID is what
+// tells a repeat from a new event.
+type Event struct {
+	EventID string `json:"eventId,omitempty"`
+}
+
+// AgentHello opens every connection.
+type AgentHello struct {
+	AgentID         string         `json:"agentId"`
+	AgentVersion    string         `json:"agentVersion,omitempty"`
+	Fingerprint     map[string]any `json:"fingerprint,omitempty"`
+	ProtocolVersion int            `json:"protocolVersion,omitempty"`
+	Capabilities    []string       `json:"capabilities,omitempty"`
+}
+
+// Output is a chunk of a session's terminal output. Seq is zero on redraws,
+// which are not replayed.
+type Output struct {
+	SessionID string `json:"sessionId"`
+	Data      string `json:"data"`
+	Seq       uint64 `json:"seq,omitempty"`
+}
+
+// OutputGap precedes a replay that could not go back as far as asked: Seq is
+// the oldest chunk the agent still holds.
+type OutputGap struct {
+	SessionID string `json:"sessionId"`
+	Seq       uint64 `json:"seq"`
+}
+
+type Heartbeat struct{}
+
+// Sessions is the session inventory, sent in answer to "listSessions" and
+// whenever it changes.
+type Sessions struct {
+	Reply
+	Sessions      []SessionInfo `json:"sessions"`
+	TmuxAvailable bool          `json:"tmuxAvailable,omitempty"`
+}
+
+type SessionOpened struct {
+	Reply
+	SessionID string `json:"sessionId"`
+}
+
+type SessionClosed struct {
+	Reply
+	Event
+	SessionID string `json:"sessionId"`
+}
+
+// SessionExited reports that a session's PTY ended; the tmux session may
+// still exist.
+type SessionExited struct {
+	Event
+	SessionID string `json:"sessionId"`
+}
+
+type DockerInfoReply struct {
+	Reply
+	Containers []DockerContainer `json:"containers"`
+}
+
+type SystemInfoReply struct {
+	Reply
+	SystemInfo *SystemInfo `json:"systemInfo,omitempty"`
+}
+
+type NetworkInfoReply struct {
+	Reply
+	NetworkInfo *NetworkInfo `json:"networkInfo,omitempty"`
+}
+
+type ProcessesReply struct {
+	Reply
+	Processes []ProcessInfo `json:"processes"`
+	Truncated bool          `json:"truncated,omitempty"`
+}
+
+type SignalProcessReply struct {
+	Reply
+	PID    int    `json:"pid"`
+	Signal string `json:"signal"`
+}
+
+type SystemdUnitsReply struct {
+	Reply
+	Units []UnitInfo `json:"units"`
+}
+
+type UnitStatusReply struct {
+	Reply
+	Unit       string      `json:"unit"`
+	UnitStatus *UnitStatus `json:"unitStatus,omitempty"`
+}
+
+type UnitActionReply struct {
+	Reply
+	Unit   string `json:"unit"`
+	Action string `json:"action"`
+}
+
+// Logs is a page of log records, in answer to "queryLogs" and from a follow.
+type Logs struct {
+	Reply
+	Logs *LogPage `json:"logs"`
+}
+
+// PowerStatus reports a power action's progress: scheduled, cancelled,
+// shuttingDown, completed or failed.
+type PowerStatus struct {
+	Reply
+	Action string `json:"action"`
+	State  string `json:"state"`
+	At     int64  `json:"at,omitempty"`
+}
+
+// UpdateStatus reports a self-update's progress: started, installed or failed,
+// or rolledBack when the new version never connected and the previous one was
+// restored. The new binary's first handshake reports completed, with its own
+// version, or mismatch when some other version came up. An automatic update
+// the agent's policy holds back is reported as deferred, with the reason;
+// automatic updates carry no request ID.
+type UpdateStatus struct {
+	Reply
+	Event
+	State   string `json:"state"`
+	Version string `json:"version,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+func (AgentHello) MessageType() string         { return "hello" }
+func (Output) MessageType() string             { return "output" }
+func (OutputGap) MessageType() string          { return "outputGap" }
+func (Heartbeat) MessageType() string          { return "heartbeat" }
+func (Sessions) MessageType() string           { return "sessions" }
+func (SessionOpened) MessageType() string      { return "sessionOpened" }
+func (SessionClosed) MessageType() string      { return "sessionClosed" }
+func (SessionExited) MessageType() string      { return "sessionExited" }
+func (DockerInfoReply) MessageType() string    { return "dockerInfo" }
+func (SystemInfoReply) MessageType() string    { return "systemInfo" }
+func (NetworkInfoReply) MessageType() string   { return "networkInfo" }
+func (ProcessesReply) MessageType() string     { return "processes" }
+func (SignalProcessReply) MessageType() string { return "signalProcess" }
+func (SystemdUnitsReply) MessageType() string  { return "systemdUnits" }
+func (UnitStatusReply) MessageType() string    { return "unitStatus" }
+func (UnitActionReply) MessageType() string    { return "unitAction" }
+func (Logs) MessageType() string               { return "logs" }
+func (PowerStatus) MessageType() string        { return "powerStatus" }
+func (UpdateStatus) MessageType() string       { return "updateStatus" }
+
+// Failure is a failed answer to a request whose type has no reply of its own,
+// such as a keystroke for a session that is gone or a type the agent does not
+// know. Type is the request's type.
+type Failure struct {
+	Type string `json:"-"`
+	Reply
+}
+
+func (f Failure) MessageType() string { return f.Type }
@@ -0,0 +1,84 @@
+// Package protocol is the wire protocol between a Spectre agent and its
+// control server.
+//
+// Every message is a JSON object with a "type" field naming it. There are two
+// ways to handle them here:
+//
+//   - The envelopes, ControlMessage (server to agent) and AgentMessage (agent
+//     to server), hold the fields of every message type at once. The agent
+//     reads and writes these; they are cheap to switch on.
+//   - The typed messages in messages.go hold only what one type carries, and
+//     Encode and Decode move them on and off the wire with validation. They
+//     are what tools and test harnesses should use.
+//
+// Both produce the same JSON, so either side may use either form.
+package protocol
+
+import "fmt"
+
+// Version is the newest protocol this package speaks. LegacyVersion is what a
+// peer that predates negotiation speaks: it sends a bare hello.
+const (
+	LegacyVersion = 1
+	Version       = 2
+)
+
+// Optional features, as named in the hello negotiation. Anything not behind a
+// feature — sessions, keystrokes, system and network info — is always on.
+const (
+	FeatureTmux         = "tmux"
+	FeatureDocker       = "docker"
+	FeatureProcesses    = "processes"
+	FeatureSystemd      = "systemd"
+	FeatureLogs         = "logs"
+	FeaturePower        = "power"
+	FeatureUpdate       = "update"
+	FeatureOutputReplay = "outputReplay"
+	FeatureEvents       = "events"
+)
+
+// Features maps each server-to-agent message type that belongs to an optional
+// feature to that feature.
+var Features = map[string]string{
+	"dockerInfo":    FeatureDocker,
+	"processes":     FeatureProcesses,
+	"signalProcess": FeatureProcesses,
+	"systemdUnits":  FeatureSystemd,
+	"unitStatus":    FeatureSystemd,
+	"unitAction":    FeatureSystemd,
+	"queryLogs":     FeatureLogs,
+	"stopLogs":      FeatureLogs,
+	"power":         FeaturePower,
+	"update":        FeatureUpdate,
+	"replay":        FeatureOutputReplay,
+	"ackOutput":     FeatureOutputReplay,
+	"ackEvent":      FeatureEvents,
+}
+
+// Error codes a failed reply carries alongside its message.
+const (
+	// CodeUnknownType: the agent has no handler for the request's type.
+	CodeUnknownType = "unknownType"
+	// CodeNotEnabled: the request needs a feature the hello did not enable.
+	CodeNotEnabled = "notEnabled"
+	// CodeBadRequest: a required field is missing or malformed.
+	CodeBadRequest = "badRequest"
+	// CodeNotFound: the session or other object addressed does not exist.
+	CodeNotFound = "notFound"
+	// CodeFailed: the request was understood but could not be carried out.
+	CodeFailed = "failed"
+	// CodeUnverified: an update was refused because the release's checksum
+	// or signature did not verify.
+	CodeUnverified = "unverified"
+)
+
+// Error is a failed reply, as an error.
+type Error struct {
+	Type    string
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s failed (%s): %s", e.Type, e.Code, e.Message)
+}
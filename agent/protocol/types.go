@@ -0,0 +1,243 @@
+package protocol
+
+// DockerContainer is one running container. The name predates support for
+// engines other than Docker and is kept because the wire format uses it.
+type DockerContainer struct {
+	Name  string   `json:"name"`
+	Ports []string `json:"ports"`
+	// Runtime is the engine that reported it: docker, podman or containerd.
+	Runtime string `json:"runtime,omitempty"`
+}
+
+type SystemInfo struct {
+	OS             string `json:"os"`
+	Version        string `json:"version"`
+	CPU            string `json:"cpu"`
+	Arch           string `json:"arch"`
+	Cores          int    `json:"cores"`
+	MemoryBytes    uint64 `json:"memoryBytes"`
+	DiskTotalBytes uint64 `json:"diskTotalBytes"`
+	DiskFreeBytes  uint64 `json:"diskFreeBytes"`
+	TmuxAvailable  bool   `json:"tmuxAvailable"`
+}
+
+type NetworkInfo struct {
+	IPv4 []string `json:"ipv4"`
+	IPv6 []string `json:"ipv6"`
+}
+
+// SessionInfo describes one terminal session as the agent sees it.
+//
+// ID is the tmux session name, which is also what the control protocol uses to
+// address the session. Sessions the agent created are named "spectre-<uuid>";
+// sessions the user started themselves (over SSH, say) keep their own names and
+// are reported with Managed false.
+type SessionInfo struct {
+	ID string `json:"id"`
+	// CreatedAt is a Unix timestamp from tmux, absent for raw shells.
+	CreatedAt int64 `json:"createdAt,omitempty"`
+	// Attached reports whether any tmux client is currently viewing it.
+	Attached bool `json:"attached"`
+	Windows  int  `json:"windows,omitempty"`
+	// Managed marks sessions Spectre created, as opposed to pre-existing ones.
+	Managed bool `json:"managed"`
+	// Live marks sessions this agent process currently holds a PTY for.
+	Live bool `json:"live"`
+	// Seq is the last output sequence number sent for the session. A server
+	// that holds less than this after a reconnect asks for a "replay".
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+// ControlMessage is the envelope for every server-to-agent message.
+type ControlMessage struct {
+	Type string `json:"type"`
+	// RequestID, when set, is echoed on everything sent in answer.
+	RequestID string `json:"requestId,omitempty"`
+	// DeviceKey is set only on an "enrolled" message, when the server issues
+	// this machine its long-lived credential.
+	DeviceKey string `json:"deviceKey,omitempty"`
+	Data      string `json:"data,omitempty"`
+	// SessionID differentiates simultaneous PTY sessions.
+	SessionID string `json:"sessionId,omitempty"`
+	// Cols and Rows carry the browser terminal's geometry. Without them the PTY
+	// keeps whatever size it was opened at, so full-screen programs and line
+	// wrapping are laid out for a window the user is not looking at.
+	Cols uint16 `json:"cols,omitempty"`
+	Rows uint16 `json:"rows,omitempty"`
+	// Version pins the release an "update" message should install. Empty means
+	// whatever GitHub currently calls latest.
+	Version string `json:"version,omitempty"`
+	// PID and Signal address a "signalProcess" request.
+	PID    int    `json:"pid,omitempty"`
+	Signal string `json:"signal,omitempty"`
+	// Unit and Action address "unitStatus" and "unitAction" requests. Lines
+	// caps how much of the unit's journal comes back with its status.
+	Unit   string `json:"unit,omitempty"`
+	Action string `json:"action,omitempty"`
+	Lines  int    `json:"lines,omitempty"`
+	// Query describes a "queryLogs" request; FollowID names the follow a
+	// "stopLogs" ends.
+	Query    *LogQuery `json:"query,omitempty"`
+	FollowID string    `json:"followId,omitempty"`
+	// Delay and Message go with a "power" request: seconds to wait, and a
+	// note shown to anyone logged in.
+	Delay   int    `json:"delay,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Seq is the last output sequence number the server holds for a
+	// session, on "replay" and "ackOutput".
+	Seq uint64 `json:"seq,omitempty"`
+	// EventID names the event an "ackEvent" acknowledges.
+	EventID string `json:"eventId,omitempty"`
+	// ProtocolVersion and Features are the server's half of the hello
+	// negotiation: the version it settled on, and the features to enable.
+	// Both are absent from servers that predate negotiation.
+	ProtocolVersion int      `json:"protocolVersion,omitempty"`
+	Features        []string `json:"features,omitempty"`
+}
+
+// AgentMessage is the envelope for every agent-to-server message.
+type AgentMessage struct {
+	Type         string            `json:"type"`
+	AgentID      string            `json:"agentId,omitempty"`
+	AgentVersion string            `json:"agentVersion,omitempty"`
+	Fingerprint  map[string]any    `json:"fingerprint,omitempty"`
+	Data         string            `json:"data,omitempty"`
+	SessionID    string            `json:"sessionId,omitempty"`
+	Containers   []DockerContainer `json:"containers,omitempty"`
+	SystemInfo   *SystemInfo       `json:"systemInfo,omitempty"`
+	NetworkInfo  *NetworkInfo      `json:"networkInfo,omitempty"`
+	Sessions     []SessionInfo     `json:"sessions,omitempty"`
+	Processes    []ProcessInfo     `json:"processes,omitempty"`
+	Units        []UnitInfo        `json:"units,omitempty"`
+	UnitStatus   *UnitStatus       `json:"unitStatus,omitempty"`
+	Logs         *LogPage          `json:"logs,omitempty"`
+	// Truncated says a "processes" reply holds only the busiest and biggest
+	// processes, the whole table being too big for one message.
+	Truncated bool `json:"truncated,omitempty"`
+	// Seq numbers "output" chunks per session, starting at 1. Redraws sent
+	// on attach are unnumbered. On "outputGap" it is the oldest chunk still
+	// held, everything before it having been discarded.
+	Seq uint64 `json:"seq,omitempty"`
+	// TmuxAvailable tells the UI whether sessions can outlive a disconnect on
+	// this host. Sent alongside a session list.
+	TmuxAvailable bool   `json:"tmuxAvailable,omitempty"`
+	Error         string `json:"error,omitempty"`
+	// Code classifies Error; see the Code constants.
+	Code string `json:"code,omitempty"`
+	// State reports progress of a self-update (started, installed,
+	// completed, mismatch, failed, rolledBack, deferred) or of a power action
+	// (scheduled, cancelled, shuttingDown, completed, failed).
+	State string `json:"state,omitempty"`
+	// Version is the release an update targeted.
+	Version string `json:"version,omitempty"`
+	// Reason says why an automatic update was deferred.
+	Reason string `json:"reason,omitempty"`
+	// PID and Signal echo what a "signalProcess" reply acted on.
+	PID    int    `json:"pid,omitempty"`
+	Signal string `json:"signal,omitempty"`
+	// Unit and Action echo what a "unitAction" reply acted on.
+	Unit   string `json:"unit,omitempty"`
+	Action string `json:"action,omitempty"`
+	// At is a Unix timestamp: when a scheduled power action will happen, or
+	// when a completed one was requested.
+	At int64 `json:"at,omitempty"`
+	// ProtocolVersion and Capabilities go with "hello": the newest protocol
+	// this agent speaks, and the features it can offer on this host.
+	ProtocolVersion int      `json:"protocolVersion,omitempty"`
+	Capabilities    []string `json:"capabilities,omitempty"`
+	// RequestID echoes the request this answers; empty on unprompted messages.
+	RequestID string `json:"requestId,omitempty"`
+	// EventID is set on messages sent through the agent's event queue, which
+	// may arrive more than once; the server acts on each id only once.
+	EventID string `json:"eventId,omitempty"`
+}
+
+// ProcessInfo is one row of the process table.
+type ProcessInfo struct {
+	PID     int    `json:"pid"`
+	PPID    int    `json:"ppid"`
+	User    string `json:"user"`
+	Command string `json:"command"`
+	// CPUPercent is measured over a short sampling window, the way top shows
+	// it, rather than averaged over the process's whole life as ps does.
+	CPUPercent float64 `json:"cpuPercent"`
+	RSSBytes   uint64  `json:"rssBytes"`
+	// StartTime is a Unix timestamp.
+	StartTime int64 `json:"startTime"`
+	// State is the single-letter kernel state: R, S, D, Z, T and so on.
+	State string `json:"state"`
+}
+
+// UnitInfo is one line of the unit list.
+type UnitInfo struct {
+	Name        string `json:"name"`
+	Load        string `json:"load"`
+	Active      string `json:"active"`
+	Sub         string `json:"sub"`
+	Description string `json:"description"`
+}
+
+// UnitStatus is the detail view of a single unit.
+type UnitStatus struct {
+	UnitInfo
+	// UnitFileState is enabled, disabled, static, masked and so on.
+	UnitFileState string `json:"unitFileState,omitempty"`
+	MainPID       int    `json:"mainPid,omitempty"`
+	// Since is when the unit last entered its current active state.
+	Since string `json:"since,omitempty"`
+	// Journal holds its most recent log lines, oldest first.
+	Journal []string `json:"journal,omitempty"`
+}
+
+// LogQuery describes a "queryLogs" request.
+type LogQuery struct {
+	// Source is "journal" (the default) or "file".
+	Source string `json:"source,omitempty"`
+	// Path is the log file to read when Source is "file".
+	Path string `json:"path,omitempty"`
+	// Unit and Priority filter the journal. Priority is a syslog level, by
+	// number or name, and matches that level and everything more severe.
+	Unit     string `json:"unit,omitempty"`
+	Priority string `json:"priority,omitempty"`
+	// Since and Until bound the journal by time, as RFC 3339 timestamps.
+	Since string `json:"since,omitempty"`
+	Until string `json:"until,omitempty"`
+	// Grep is a regular expression the message must match.
+	Grep string `json:"grep,omitempty"`
+	// Cursor continues a journal query after the last page's final record.
+	Cursor string `json:"cursor,omitempty"`
+	// Offset continues a file query from a byte offset. Absent means the
+	// tail of the file.
+	Offset *int64 `json:"offset,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+	// Follow keeps streaming new records after the first page, until a
+	// "stopLogs" with the same FollowID arrives or the connection drops.
+	Follow   bool   `json:"follow,omitempty"`
+	FollowID string `json:"followId,omitempty"`
+}
+
+// LogRecord is one journal entry or log file line.
+type LogRecord struct {
+	// Time is a Unix timestamp in milliseconds; zero for file lines, which
+	// carry no reliable time of their own.
+	Time int64  `json:"time,omitempty"`
+	Unit string `json:"unit,omitempty"`
+	// Priority is the syslog level of a journal entry, 0 (emerg) included;
+	// nil for file lines, which have none.
+	Priority *int   `json:"priority,omitempty"`
+	Message  string `json:"message"`
+	// Cursor and Offset locate the record for the next page.
+	Cursor string `json:"cursor,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+}
+
+// LogPage is a "queryLogs" reply.
+type LogPage struct {
+	Records []LogRecord `json:"records"`
+	// Cursor or Offset is where the next page starts.
+	Cursor string `json:"cursor,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+	// HasMore reports that the query stopped at its limit, not at the end.
+	HasMore  bool   `json:"hasMore,omitempty"`
+	FollowID string `json:"followId,omitempty"`
+}
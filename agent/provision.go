@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+)
+
+// Zero-touch enrollment.
+//
+// A golden image or a cloud-init run cannot answer an approval code, and an
+// auth key baked into a unit file outlives its purpose. Instead, whoever builds
+// the machine drops a provisioning file where the agent looks on first start:
+//
+//	{"host": "wss://spectre.example.com", "authKey": "sk_...", "labels": {"env": "prod"}}
+//
+// The agent enrolls with it, keeps the host and labels next to the device key,
+// and destroys the file, so the auth key exists on disk only until it has been
+// used. From then on it runs as any enrolled agent does. A machine that is
+// already enrolled never reads the file's key; it only removes it.
+
+// Where a provisioning file is looked for, in order. The seed directories are
+// cloud-init's NoCloud datasource, which an image or seed volume can populate
+// without any other cloud-init configuration; cloud-init's write_files can
+// equally put the file at the first path. A var so tests can use their own.
+var provisioningPaths = []string{
+	"/etc/spectre-agent/provision.json",
+	"/var/lib/cloud/seed/nocloud/spectre-agent.json",
+	"/var/lib/cloud/seed/nocloud-net/spectre-agent.json",
+}
+
+// provisioning is a provisioning file's contents.
+type provisioning struct {
+	Host    string            `json:"host"`
+	AuthKey string            `json:"authKey"`
+	Labels  map[string]string `json:"labels,omitempty"`
+
+	path string
+}
+
+// findProvisioning returns the first provisioning file present, nil when there
+// is none. A file that is there but unusable is an error rather than skipped:
+// quietly falling through would leave a machine waiting for approval that
+// nobody knows to give. One this account may not read is the exception: it is
+// meant for a root install, and `up --user` or a manual run by somebody else
+// must not fail on it.
+func findProvisioning() (*provisioning, error) {
+	for _, path := range provisioningPaths {
+		st, err := os.Lstat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if errors.Is(err, fs.ErrPermission) {
+			log.Printf("skipping provisioning file %s: %v", path, err)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("provisioning file %s: %w", path, err)
+		}
+		// Not a symlink or anything else: the file gets overwritten and
+		// removed once used, and that must not land somewhere else.
+		if !st.Mode().IsRegular() {
+			return nil, fmt.Errorf("provisioning file %s is not a regular file", path)
+		}
+		if st.Mode().Perm()&0o004 != 0 {
+			log.Printf("warning: provisioning file %s is readable by every local user; make it 0600", path)
+		}
+
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrPermission) {
+			log.Printf("skipping provisioning file %s: %v", path, err)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("provisioning file %s: %w", path, err)
+		}
+		var p provisioning
+		if err := json.Unmarshal(data, &p); err != nil {
+			return nil, fmt.Errorf("provisioning file %s: %w", path, err)
+		}
+		p.Host, p.AuthKey = strings.TrimSpace(p.Host), strings.TrimSpace(p.AuthKey)
+		if p.AuthKey == "" {
+			return nil, fmt.Errorf("provisioning file %s has no authKey", path)
+		}
+		p.path = path
+		return &p, nil
+	}
+	return nil, nil
+}
+
+// provisioningFor is the provisioning file to enroll with, if any. An auth key
+// given outright wins, and the file is then not even read: whatever is wrong
+// with it is no reason to refuse a start or an install that does not need it.
+func provisioningFor(authKey string) (*provisioning, error) {
+	if authKey != "" {
+		return nil, nil
+	}
+	return findProvisioning()
+}
+
+// enrollFromProvisioning enrolls this machine with the file's auth key against
+// host, records the host and labels with the device key, and destroys the
+// file. The file survives a failed enrollment, so the next start tries again:
+// at first boot the network is often not up yet.
+func enrollFromProvisioning(info *DeviceInfo, p *provisioning, host string) error {
+	log.Printf("enrolling with the auth key from %s", p.path)
+	key, err := enrollWithAuthKey(host, p.AuthKey, info.DeviceID)
+	if err != nil {
+		return fmt.Errorf("enrollment from %s failed: %w", p.path, err)
+	}
+	info.DeviceKey = key
+	info.Host = host
+	info.Labels = p.Labels
+	if err := saveDeviceInfo(*info); err != nil {
+		return fmt.Errorf("save device key: %w", err)
+	}
+	log.Printf("enrolled; removing %s", p.path)
+	p.destroy()
+	return nil
+}
+
+// destroy overwrites the file before removing it, so the auth key is not left
+// in freed blocks. On copy-on-write filesystems and flash the old blocks may
+// survive regardless; a single-use or short-lived auth key is what actually
+// limits the exposure.
+func (p *provisioning) destroy() {
+	if err := shred(p.path); err != nil {
+		log.Printf("warning: could not overwrite %s: %v", p.path, err)
+	}
+	if err := os.Remove(p.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("warning: could not remove %s: %v; delete it by hand, it holds an auth key", p.path, err)
+	}
+}
+
+func shred(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(make([]byte, st.Size()), 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
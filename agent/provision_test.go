@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// registrationServer enrolls any agent presenting authKey, and refuses the rest.
+func registrationServer(t *testing.T, authKey string) string {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/agents/register" || r.Header.Get("Authorization") != "Bearer "+authKey {
+			http.Error(w, "invalid auth key", http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var hello AgentMessage
+		if conn.ReadJSON(&hello) != nil {
+			return
+		}
+		_ = conn.WriteJSON(ControlMessage{Type: "enrolled", DeviceKey: "dk_" + hello.AgentID})
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func writeProvisioningFile(t *testing.T, p provisioning) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "provision.json")
+	data, _ := json.Marshal(p)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	old := provisioningPaths
+	provisioningPaths = []string{filepath.Join(t.TempDir(), "absent.json"), path}
+	t.Cleanup(func() { provisioningPaths = old })
+	return path
+}
+
+// The auth key is on disk only until it has been used: a successful enrollment
+// keeps the host and labels with the device key and destroys the file.
+func TestProvisioningEnrollsAndDestroysTheFile(t *testing.T) {
+	t.Setenv("SPECTRE_AGENT_HOME", t.TempDir())
+	host := registrationServer(t, "sk_golden")
+	path := writeProvisioningFile(t, provisioning{Host: host, AuthKey: "sk_golden", Labels: map[string]string{"env": "prod"}})
+
+	info, err := ensureDeviceInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := findProvisioning()
+	if err != nil || p == nil || p.path != path {
+		t.Fatalf("findProvisioning = %+v, %v", p, err)
+	}
+	if err := enrollFromProvisioning(&info, p, p.Host); err != nil {
+		t.Fatalf("enrollFromProvisioning: %v", err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("provisioning file still there: %v", err)
+	}
+	saved, _, found := loadDeviceInfo()
+	if !found || saved.DeviceKey != "dk_"+info.DeviceID || saved.Host != host || saved.Labels["env"] != "prod" {
+		t.Fatalf("saved device info = %+v", saved)
+	}
+}
+
+// At first boot the network is often not up yet. A failed enrollment must keep
+// the file, so the restarted agent can try again.
+func TestProvisioningFileSurvivesAFailedEnrollment(t *testing.T) {
+	t.Setenv("SPECTRE_AGENT_HOME", t.TempDir())
+	host := registrationServer(t, "sk_other")
+	path := writeProvisioningFile(t, provisioning{Host: host, AuthKey: "sk_revoked"})
+
+	info, _ := ensureDeviceInfo()
+	p, _ := findProvisioning()
+	if err := enrollFromProvisioning(&info, p, p.Host); err == nil {
+		t.Fatal("enrolled with a refused auth key")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("provisioning file gone after a failed enrollment: %v", err)
+	}
+	if saved, _, _ := loadDeviceInfo(); saved.DeviceKey != "" {
+		t.Fatalf("device key stored: %+v", saved)
+	}
+}
+
+// A file that is there but unusable is reported, not skipped, and one that is
+// not a regular file is never read or overwritten.
+func TestFindProvisioningRejectsUnusableFiles(t *testing.T) {
+	path := writeProvisioningFile(t, provisioning{Host: "wss://example.com"})
+	if _, err := findProvisioning(); err == nil || !strings.Contains(err.Error(), "no authKey") {
+		t.Fatalf("a file without an auth key: %v", err)
+	}
+
+	target := filepath.Join(t.TempDir(), "elsewhere.json")
+	if err := os.WriteFile(target, []byte(`{"authKey":"sk_x"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := findProvisioning(); err == nil || !strings.Contains(err.Error(), "not a regular file") {
+		t.Fatalf("a symlink: %v", err)
+	}
+
+	provisioningPaths = []string{filepath.Join(t.TempDir(), "absent.json")}
+	if p, err := findProvisioning(); p != nil || err != nil {
+		t.Fatalf("no file: %+v, %v", p, err)
+	}
+}
+
+// An auth key given outright makes the file irrelevant, even a broken one.
+func TestAuthKeyBypassesProvisioning(t *testing.T) {
+	writeProvisioningFile(t, provisioning{Host: "wss://example.com"})
+	if _, err := provisioningFor(""); err == nil {
+		t.Fatal("a file without an auth key was accepted")
+	}
+	if p, err := provisioningFor("sk_given"); p != nil || err != nil {
+		t.Fatalf("with --authkey: %+v, %v", p, err)
+	}
+}
+
+// A file this account may not read is for somebody else's install, such as
+// root's, and is passed over for the next path.
+func TestFindProvisioningSkipsUnreadableFiles(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root reads everything")
+	}
+	path := writeProvisioningFile(t, provisioning{AuthKey: "sk_root"})
+	if err := os.Chmod(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := findProvisioning(); p != nil || err != nil {
+		t.Fatalf("an unreadable file: %+v, %v", p, err)
+	}
+}
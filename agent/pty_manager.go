@@ -71,11 +71,13 @@ func (m *ptyManager) inventory() []SessionInfo {
 	sessions := listTmuxSessions()
 
 	live := make(map[string]bool)
+	seqs := make(map[string]uint64)
 	m.mu.RLock()
 	for id, s := range m.sessions {
 		if s.current() != nil {
 			live[id] = true
 		}
+		seqs[id] = s.output.lastSeq()
 	}
 	m.mu.RUnlock()
 
@@ -83,6 +85,7 @@ func (m *ptyManager) inventory() []SessionInfo {
 	for i := range sessions {
 		seen[sessions[i].ID] = true
 		sessions[i].Live = live[sessions[i].ID]
+		sessions[i].Seq = seqs[sessions[i].ID]
 	}
 
 	// Raw shells exist only here; without tmux they are the whole inventory.
@@ -92,6 +95,7 @@ func (m *ptyManager) inventory() []SessionInfo {
 				ID:      id,
 				Managed: isManagedSessionName(id),
 				Live:    true,
+				Seq:     seqs[id],
 			})
 		}
 	}
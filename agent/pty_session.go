@@ -21,6 +21,9 @@ type ptySession struct {
 	// dropping back to the default until the next resize arrives.
 	cols uint16
 	rows uint16
+	// output numbers and keeps recent output for replay after a reconnect.
+	// It outlives reset, so sequence numbers never repeat within a session.
+	output outputLog
 }
 
 func newPtySession(sessionID string) *ptySession {
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sidhantpanda/spectre/agent/protocol"
+)
+
+// Replies and failures.
+//
+// A request from the server may carry a requestId, and everything sent in
+// answer to it echoes that id back: the reply itself, any progress reports,
+// and the pages of a log follow. With two browser tabs asking the same agent
+// for the same thing, that is the only way to tell the answers apart.
+//
+// Failures all have one shape: the reply's usual type, with error saying what
+// went wrong and code saying what kind of wrong it was. That includes requests
+// this agent does not understand, which used to be dropped without a word.
+
+// reply answers the request with the given id. A reply with an error and no
+// code is a plain failure.
+func (c *safeConn) reply(requestID string, msg AgentMessage) error {
+	return c.writeJSON(addressed(requestID, msg))
+}
+
+// addressed is msg as an answer to the request with the given id.
+func addressed(requestID string, msg AgentMessage) AgentMessage {
+	msg.RequestID = requestID
+	if msg.Error != "" && msg.Code == "" {
+		msg.Code = protocol.CodeFailed
+	}
+	return msg
+}
+
+// refuse answers a request that was not carried out at all.
+func (c *safeConn) refuse(req ControlMessage, code, format string, args ...any) error {
+	return c.reply(req.RequestID, AgentMessage{
+		Type:      req.Type,
+		SessionID: req.SessionID,
+		Code:      code,
+		Error:     fmt.Sprintf(format, args...),
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/sidhantpanda/spectre/agent/protocol"
+)
+
+// replyRecorder is a control connection whose server side hands back
+// whatever the agent sends.
+func replyRecorder(t *testing.T) (*safeConn, <-chan AgentMessage) {
+	t.Helper()
+	replies := make(chan AgentMessage, 16)
+	conn := newSafeConn(dialTestServer(t, func(server *websocket.Conn) {
+		for {
+			var msg AgentMessage
+			if err := server.ReadJSON(&msg); err != nil {
+				return
+			}
+			replies <- msg
+		}
+	}))
+	conn.protocol = negotiated{protocol: protocol.Version, features: map[string]bool{}}
+	return conn, replies
+}
+
+func nextReply(t *testing.T, replies <-chan AgentMessage) AgentMessage {
+	t.Helper()
+	select {
+	case msg := <-replies:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("no reply")
+		return AgentMessage{}
+	}
+}
+
+func TestRepliesEchoTheRequestID(t *testing.T) {
+	conn, replies := replyRecorder(t)
+	if err := handleControlMessage(conn, newAgentControl(), ControlMessage{Type: "networkInfo", RequestID: "r1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := nextReply(t, replies); got.Type != "networkInfo" || got.RequestID != "r1" || got.Error != "" {
+		t.Fatalf("unexpected reply %+v", got)
+	}
+}
+
+func TestFailedRequestsAreAnswered(t *testing.T) {
+	cases := []struct {
+		req  ControlMessage
+		code string
+	}{
+		{ControlMessage{Type: "frobnicate", RequestID: "r2"}, protocol.CodeUnknownType},
+		{ControlMessage{Type: "reset", RequestID: "r3", SessionID: "s"}, protocol.CodeUnknownType},
+		{ControlMessage{Type: "processes", RequestID: "r4"}, protocol.CodeNotEnabled},
+		{ControlMessage{Type: "keystroke", RequestID: "r5", SessionID: "gone", Data: "ls"}, protocol.CodeNotFound},
+		{ControlMessage{Type: "killSession", RequestID: "r6"}, protocol.CodeBadRequest},
+	}
+	conn, replies := replyRecorder(t)
+	for _, c := range cases {
+		if err := handleControlMessage(conn, newAgentControl(), c.req, nil); err != nil {
+			t.Fatalf("%s: a failed request must not end the connection: %v", c.req.Type, err)
+		}
+		got := nextReply(t, replies)
+		if got.Type != c.req.Type || got.RequestID != c.req.RequestID || got.Code != c.code || got.Error == "" {
+			t.Errorf("%s: got %+v, want a %s error echoing %s", c.req.Type, got, c.code, c.req.RequestID)
+		}
+	}
+}
+
+func TestReplyMarksPlainFailures(t *testing.T) {
+	conn, replies := replyRecorder(t)
+	if err := conn.reply("r7", AgentMessage{Type: "dockerInfo", Error: "docker is not running"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := nextReply(t, replies); got.Code != protocol.CodeFailed {
+		t.Fatalf("code = %q, want %q", got.Code, protocol.CodeFailed)
+	}
+}
@@ -3,46 +3,104 @@ package main
 import (
 	"context"
 	"fmt"
+	"log"
 	"os"
 	"os/signal"
 	"syscall"
 )
 
-func runAgent(host, authKey string) error {
-	if host == "" {
-		return fmt.Errorf("--host is required (e.g. --host wss://spectre.example.com)")
-	}
-
+func runAgent(host, authKey, updateSource string, policy updatePolicy) error {
 	deviceInfo, err := ensureDeviceInfo()
 	if err != nil {
 		return fmt.Errorf("failed to load device id: %w", err)
 	}
 
+	// First start of a provisioned machine: the file supplies what the
+	// command line does not.
+	var provision *provisioning
+	if deviceInfo.DeviceKey == "" {
+		if provision, err = provisioningFor(authKey); err != nil {
+			return err
+		}
+	}
+	switch {
+	case host != "":
+	case provision != nil && provision.Host != "":
+		host = provision.Host
+	default:
+		host = deviceInfo.Host
+	}
+	if host == "" {
+		return fmt.Errorf("--host is required (e.g. --host wss://spectre.example.com)")
+	}
+	updateSource = updateSourceSpec(updateSource)
+	if err := checkUpdateSource(updateSource); err != nil {
+		return err
+	}
+	setAgentUpdateSource(updateSource, host)
+
 	instance := AgentInstanceInfo{
-		PID:     os.Getpid(),
-		AgentID: deviceInfo.DeviceID,
-		Host:    host,
+		PID:          os.Getpid(),
+		AgentID:      deviceInfo.DeviceID,
+		Host:         host,
+		UpdateSource: updateSource,
+	}
+	if exe, err := currentExecutablePath(); err == nil {
+		instance.Binary = exe
 	}
 
-	acquired, running, err := ensureSingleInstance(instance)
+	lock, running, err := ensureSingleInstance(instance)
 	if err != nil {
 		return fmt.Errorf("failed to check agent instance: %w", err)
 	}
-	if !acquired && running != nil {
-		return fmt.Errorf("spectre-agent is already running (pid %d)", running.PID)
+	if lock == nil {
+		if running != nil {
+			return fmt.Errorf("spectre-agent is already running (pid %d)", running.PID)
+		}
+		return fmt.Errorf("spectre-agent is already running")
 	}
 	defer func() {
-		if err := releaseSingleton(instance.PID); err != nil {
+		if err := lock.release(); err != nil {
 			fmt.Fprintf(os.Stderr, "warning: failed to release agent lock: %v\n", err)
 		}
 	}()
 
+	// Under the lock, so two agents starting at once do not both spend the
+	// auth key.
+	if provision != nil {
+		if err := enrollFromProvisioning(&deviceInfo, provision, host); err != nil {
+			return err
+		}
+	} else if deviceInfo.DeviceKey != "" {
+		// Already enrolled; a provisioning file left behind only holds a
+		// secret nobody needs any more.
+		if p, _ := findProvisioning(); p != nil {
+			log.Printf("already enrolled; removing %s unused", p.path)
+			p.destroy()
+		}
+	}
+
+	// Before connecting, so a new binary that cannot connect is still caught.
+	armUpdateGuard(getAgentVersion())
+
 	fingerprint := collectFingerprint()
+	if len(deviceInfo.Labels) > 0 {
+		fingerprint["labels"] = deviceInfo.Labels
+	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	go connectToControlServer(host, authKey, &deviceInfo, fingerprint)
+	ctl := newAgentControl()
+	ctl.updater = newAutoUpdater(ctl, policy)
+	if stopAdmin, err := serveAdminSocket(ctl); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: admin socket unavailable: %v\n", err)
+	} else {
+		defer stopAdmin()
+	}
+
+	go connectToControlServer(ctl, host, authKey, &deviceInfo, fingerprint)
+	go ctl.updater.run(ctx)
 
 	<-ctx.Done()
 	return nil
@@ -1,20 +1,59 @@
 package main
 
 import (
+	"fmt"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// Liveness of the control connection.
+//
+// A write only proves the kernel accepted the bytes. After a NAT mapping
+// expires or a laptop sleeps, the socket stays "open" and writes keep
+// succeeding into the void for many minutes, while reads simply block. So the
+// agent pings, and every read carries a deadline: if neither a message nor a
+// pong arrives within pongWait, the read fails and the agent reconnects.
+//
+// Vars rather than constants so tests need not wait out real timeouts.
+var (
+	pingInterval = 15 * time.Second
+	pongWait     = 40 * time.Second
+	// handshakeWait bounds the hello exchange, which happens before pings
+	// start.
+	handshakeWait = 30 * time.Second
+	writeWait     = 10 * time.Second
+)
+
 // safeConn wraps a websocket.Conn with a mutex to prevent concurrent writes.
 // gorilla/websocket does not support concurrent writers.
 type safeConn struct {
 	mu   sync.Mutex
 	conn *websocket.Conn
+	// onPong, when set, is told each new round-trip time.
+	onPong func(time.Duration)
+	// protocol is what the handshake negotiated. It is set before any
+	// goroutine starts and never changes after.
+	protocol negotiated
 }
 
+// newSafeConn wraps conn and arms its read deadline. The pong handler is
+// installed here, before anything reads, because gorilla does not allow it to
+// change while a read is in progress.
 func newSafeConn(conn *websocket.Conn) *safeConn {
-	return &safeConn{conn: conn}
+	c := &safeConn{conn: conn}
+	_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(payload string) error {
+		if sent, err := strconv.ParseInt(payload, 10, 64); err == nil {
+			if c.onPong != nil {
+				c.onPong(time.Since(time.Unix(0, sent)))
+			}
+		}
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	return c
 }
 
 func (c *safeConn) writeJSON(v interface{}) error {
@@ -23,10 +62,36 @@ func (c *safeConn) writeJSON(v interface{}) error {
 	return c.conn.WriteJSON(v)
 }
 
+// readJSON reads the next message. Any inbound message is proof of life, so
+// each one pushes the deadline out again.
 func (c *safeConn) readJSON(v interface{}) error {
-	return c.conn.ReadJSON(v)
+	if err := c.conn.ReadJSON(v); err != nil {
+		return err
+	}
+	return c.conn.SetReadDeadline(time.Now().Add(pongWait))
 }
 
 func (c *safeConn) close() error {
 	return c.conn.Close()
 }
+
+// keepAlive pings until a ping cannot be sent.
+//
+// Each ping carries its send time, so the pong that echoes it back measures
+// the round trip without any bookkeeping. Pongs are handled inside the read
+// loop's ReadJSON, which is why a dead peer surfaces there as a timeout.
+//
+// The interval is an argument, read by the caller, because the goroutine can
+// outlive its connection by up to one tick.
+func (c *safeConn) keepAlive(interval time.Duration, errCh chan<- error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		payload := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+		// WriteControl may run alongside WriteJSON; it needs no lock.
+		if err := c.conn.WriteControl(websocket.PingMessage, payload, time.Now().Add(writeWait)); err != nil {
+			endConnection(errCh, fmt.Errorf("ping failed: %w", err))
+			return
+		}
+	}
+}
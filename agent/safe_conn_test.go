@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialTestServer connects to a websocket server whose behaviour after the
+// upgrade is up to serve.
+func dialTestServer(t *testing.T, serve func(*websocket.Conn)) *websocket.Conn {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(conn)
+	}))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func shortenKeepAlive(t *testing.T) {
+	t.Helper()
+	oldPing, oldPong := pingInterval, pongWait
+	pingInterval, pongWait = 20*time.Millisecond, 200*time.Millisecond
+	t.Cleanup(func() { pingInterval, pongWait = oldPing, oldPong })
+}
+
+// A peer that has silently gone away — the socket still "open", nothing
+// coming back — must fail the read instead of blocking it forever.
+func TestKeepAliveDetectsASilentPeer(t *testing.T) {
+	shortenKeepAlive(t)
+	release := make(chan struct{})
+	defer close(release)
+	// Never reading means never answering a ping.
+	conn := newSafeConn(dialTestServer(t, func(*websocket.Conn) { <-release }))
+
+	errCh := make(chan error, 2)
+	go conn.keepAlive(pingInterval, errCh)
+
+	done := make(chan error, 1)
+	go func() {
+		var msg ControlMessage
+		done <- conn.readJSON(&msg)
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("read returned without a message or an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read is still blocked on a dead peer")
+	}
+}
+
+func TestKeepAliveMeasuresRoundTrip(t *testing.T) {
+	shortenKeepAlive(t)
+	// Reading is enough for gorilla to answer pings.
+	raw := dialTestServer(t, func(c *websocket.Conn) {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+	conn := newSafeConn(raw)
+	measured := make(chan time.Duration, 16)
+	conn.onPong = func(rtt time.Duration) { measured <- rtt }
+
+	errCh := make(chan error, 2)
+	go conn.keepAlive(pingInterval, errCh)
+	go func() {
+		var msg ControlMessage
+		_ = conn.readJSON(&msg) // pongs are processed inside the read
+	}()
+
+	select {
+	case rtt := <-measured:
+		if rtt <= 0 || rtt > 5*time.Second {
+			t.Fatalf("implausible round trip %v", rtt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no round trip was measured")
+	}
+}
+
+// Once one goroutine has ended the connection nobody reads errCh again; the
+// others must give up rather than block on it forever.
+func TestKeepAliveDoesNotBlockOnceTheConnectionHasEnded(t *testing.T) {
+	shortenKeepAlive(t)
+	conn := newSafeConn(dialTestServer(t, func(*websocket.Conn) {}))
+	_ = conn.close()
+
+	errCh := make(chan error, 1)
+	errCh <- errors.New("read loop: connection closed")
+	done := make(chan struct{})
+	go func() {
+		conn.keepAlive(pingInterval, errCh)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("keepAlive is stuck sending a second error")
+	}
+}
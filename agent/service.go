@@ -5,15 +5,116 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 )
 
 const (
 	systemdUnitPath  = "/etc/systemd/system/spectre-agent.service"
 	launchdPlistPath = "/Library/LaunchDaemons/com.spectre.agent.plist"
 	launchdLabel     = "com.spectre.agent"
+
+	// serviceName is what every init system knows the agent as.
+	serviceName = "spectre-agent"
 )
 
-func serviceUp(host, authKey string) error {
+// Service managers.
+//
+// systemd and launchd cover most hosts, but not Alpine (OpenRC), Void (runit),
+// Devuan (SysV or OpenRC) or the many embedded images that boot with s6 or a
+// classic init. Each backend installs the agent the same way: enrolled
+// beforehand, running as the service account with SPECTRE_AGENT_HOME set, and
+// restarted whenever it exits, which is how an update takes effect. The host's
+// init system is detected rather than asked for.
+type serviceManager interface {
+	// name is how status and errors refer to it.
+	name() string
+	// detect reports whether this is the init system the host runs. It must
+	// not need root.
+	detect() bool
+	install(exe string, args []string) error
+	uninstall() error
+	// installed reports whether the agent's service file is in place.
+	installed() bool
+	// state is the service's run state as the manager words it, such as
+	// "active" or "stopped".
+	state() string
+	// logHint is the command that follows the service's log.
+	logHint() string
+}
+
+// In detection order: on a host with several installed, the first that is
+// actually running wins. A var so tests can substitute fakes.
+var serviceManagers = []serviceManager{
+	systemdService{},
+	openrcService{},
+	supervisedService{runitSupervisor},
+	supervisedService{s6Supervisor},
+	sysvService{},
+	launchdService{},
+	// Never detected; only `up --user` installs it.
+	userSystemdService{},
+}
+
+// detectServiceManager is the host's init system.
+func detectServiceManager() (serviceManager, error) {
+	for _, m := range serviceManagers {
+		if m.detect() {
+			return m, nil
+		}
+	}
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("service management is not supported on %s", runtime.GOOS)
+	}
+	return nil, fmt.Errorf("no supported init system found (looked for systemd, OpenRC, runit, s6 and SysV init)")
+}
+
+// installedServiceManager is whichever manager has the agent installed, nil
+// when none does. It is asked of the detected one first.
+func installedServiceManager() serviceManager {
+	if m, err := detectServiceManager(); err == nil && m.installed() {
+		return m
+	}
+	for _, m := range serviceManagers {
+		if m.installed() {
+			return m
+		}
+	}
+	return nil
+}
+
+func serviceUp(host, authKey, updateSource, updateToken string, policy updatePolicy, hardening hardeningLevel, userMode bool) error {
+	// A provisioning file stands in for --host and --authkey, so cloud-init
+	// can run a bare `spectre-agent up`.
+	provision, err := provisioningFor(authKey)
+	if err != nil {
+		return err
+	}
+	if host == "" && provision != nil {
+		host = provision.Host
+	}
+	if host == "" {
+		return fmt.Errorf("--host is required (e.g. --host wss://spectre.example.com)")
+	}
+
+	updateSource = updateSourceSpec(updateSource)
+	if err := checkUpdateSource(updateSource); err != nil {
+		return err
+	}
+	if userMode {
+		return userServiceUp(host, authKey, updateSource, updateToken, policy, provision)
+	}
+
+	// Before enrolling: a host with no init system to install into should
+	// not come away enrolled regardless.
+	manager, err := detectServiceManager()
+	if err != nil {
+		return err
+	}
+	if m, ok := manager.(systemdService); ok {
+		m.hardening = hardening
+		manager = m
+	}
+
 	exe, err := os.Executable()
 	if err != nil {
 		return fmt.Errorf("resolve executable: %w", err)
@@ -32,9 +133,16 @@ func serviceUp(host, authKey string) error {
 	// Enrollment happens once, here, before the service is installed. The
 	// device key is written to the device info file, so the auth key never
 	// needs to appear in the unit file or in `ps` output.
-	if err := enrollForService(host, authKey); err != nil {
+	if err := enrollForService(host, authKey, provision); err != nil {
+		return err
+	}
+	if err := storeUpdateToken(updateToken); err != nil {
 		return err
 	}
+	args := buildExecArgs(host, updateSource, policy)
+	if err := saveServiceSettings(args); err != nil {
+		return fmt.Errorf("save service settings: %w", err)
+	}
 
 	// The file was just written by root; the service runs as the invoking user.
 	if err := handServiceHomeToServiceAccount(); err != nil {
@@ -49,30 +157,13 @@ func serviceUp(host, authKey string) error {
 		return err
 	}
 
-	serviceArgs := buildExecArgs(host)
-
-	var installErr error
-	switch runtime.GOOS {
-	case "linux":
-		installErr = installSystemdService(exe, serviceArgs)
-	case "darwin":
-		installErr = installLaunchdService(exe, serviceArgs)
-	default:
-		return fmt.Errorf("service management is not supported on %s", runtime.GOOS)
-	}
-
-	if installErr != nil {
-		return installErr
+	if err := manager.install(exe, args); err != nil {
+		return err
 	}
 
-	fmt.Println("\nspectre-agent service installed and started.")
+	fmt.Printf("\nspectre-agent service installed and started (%s).\n", manager.name())
 	fmt.Println("  Check status:  spectre-agent status")
-	switch runtime.GOOS {
-	case "linux":
-		fmt.Println("  View logs:     journalctl -u spectre-agent -f")
-	case "darwin":
-		fmt.Println("  View logs:     tail -f /var/log/spectre-agent.log")
-	}
+	fmt.Println("  View logs:     " + manager.logHint())
 	fmt.Println("  Stop service:  sudo spectre-agent down")
 	return nil
 }
@@ -87,21 +178,30 @@ func downNeedsRoot(err error) error {
 	return fmt.Errorf("%w\n\nRemoving the system service needs root. Re-run with:\n    sudo spectre-agent down", err)
 }
 
-func serviceDown(purge bool) error {
-	switch runtime.GOOS {
-	case "linux":
-		if err := uninstallSystemdService(); err != nil {
-			return downNeedsRoot(err)
+func serviceDown(purge, userMode bool) error {
+	var manager serviceManager
+	if userMode {
+		manager = userSystemdService{}
+	} else {
+		manager = installedServiceManager()
+	}
+	if manager == nil {
+		// Nothing installed; still tidy up after the detected one, as before.
+		var err error
+		if manager, err = detectServiceManager(); err != nil {
+			return err
 		}
-	case "darwin":
-		if err := uninstallLaunchdService(); err != nil {
-			return downNeedsRoot(err)
+	}
+	if err := manager.uninstall(); err != nil {
+		if _, ok := manager.(userSystemdService); ok {
+			return err
 		}
-	default:
-		return fmt.Errorf("service management is not supported on %s", runtime.GOOS)
+		return downNeedsRoot(err)
 	}
 
-	_ = os.Remove(lockFilePath())
+	// Left behind by agents from before the lock moved into the state
+	// directory.
+	_ = os.Remove(legacyLockFilePath())
 
 	if purge {
 		purgeDataDirs()
@@ -113,3 +213,53 @@ func serviceDown(purge bool) error {
 	}
 	return nil
 }
+
+// initRoot prefixes the paths init-system detection looks at. A var so tests
+// can stage a host's layout.
+var initRoot = "/"
+
+func initPath(p string) string { return filepath.Join(initRoot, p) }
+
+// pid1Name is the command name of the host's init process.
+func pid1Name() string {
+	data, _ := os.ReadFile(initPath("/proc/1/comm"))
+	return strings.TrimSpace(string(data))
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// servicePATH is the PATH every service runs with; some init systems hand
+// their daemons next to nothing, and the agent shells out to tmux and friends.
+const servicePATH = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/bin"
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func quoteAll(words []string) []string {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = shellQuote(w)
+	}
+	return quoted
+}
+
+// shellCommand is exe and args as one line of shell, each word quoted.
+func shellCommand(exe string, args []string) string {
+	return strings.Join(quoteAll(append([]string{exe}, args...)), " ")
+}
+
+// scriptEnvironment is the environment lines shared by the init scripts.
+func scriptEnvironment() string {
+	return "export PATH=" + servicePATH + "\n" +
+		"export SPECTRE_AGENT_HOME=" + shellQuote(serviceAgentHome()) + "\n"
+}
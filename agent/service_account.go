@@ -8,8 +8,14 @@ import (
 	"strings"
 )
 
-func buildExecArgs(host string) []string {
-	return []string{"run", fmt.Sprintf("--host=%s", host)}
+func buildExecArgs(host, updateSource string, policy updatePolicy) []string {
+	args := []string{"run", fmt.Sprintf("--host=%s", host)}
+	// In the arguments rather than the environment, so it shows in `ps` and
+	// survives an edit to the unit's Environment lines.
+	if updateSource != "" && updateSource != updateSourceGitHub {
+		args = append(args, fmt.Sprintf("--update-source=%s", updateSource))
+	}
+	return append(args, policy.args()...)
 }
 
 func resolveServiceAccount() (string, string) {
@@ -50,13 +50,10 @@ func resolveServiceBinary(exe string) (string, error) {
 		return exe, nil // the service runs as root; it can rewrite anything
 	}
 
-	staged := serviceBinaryPath()
-	if exe == staged {
-		return exe, nil // already relocated by an earlier `up`
-	}
-	if dirWritableBy(filepath.Dir(exe), uid, gid) {
-		return exe, nil // it can already replace itself where it stands
+	if serviceCanReplace(exe, uid, gid) {
+		return exe, nil
 	}
+	staged := serviceBinaryPath()
 
 	if err := copyExecutable(exe, staged); err != nil {
 		return "", err
@@ -87,9 +84,24 @@ func resolveServiceBinary(exe string) (string, error) {
 	return staged, nil
 }
 
+// serviceCanReplace reports whether the service account can update exe where
+// it stands: either an earlier `up` already relocated it, or its directory is
+// writable to the account.
+func serviceCanReplace(exe string, uid, gid int) bool {
+	return exe == serviceBinaryPath() || dirWritableBy(filepath.Dir(exe), uid, gid)
+}
+
 // dirWritableBy reports whether uid/gid could create or rename a file in dir.
 func dirWritableBy(dir string, uid, gid int) bool {
-	info, err := os.Stat(dir)
+	return accessibleBy(dir, uid, gid, 0o2)
+}
+
+// accessibleBy reports whether uid/gid has the access in want — a mask of 4
+// (read), 2 (write) and 1 (execute/search) — to path, going by its permission
+// bits the way the kernel does: owner bits for the owner, group bits for the
+// group, the rest for everyone else.
+func accessibleBy(path string, uid, gid int, want os.FileMode) bool {
+	info, err := os.Stat(path)
 	if err != nil {
 		return false
 	}
@@ -100,11 +112,11 @@ func dirWritableBy(dir string, uid, gid int) bool {
 	mode := info.Mode().Perm()
 	switch {
 	case int(stat.Uid) == uid:
-		return mode&0o200 != 0
+		return (mode>>6)&want == want
 	case int(stat.Gid) == gid:
-		return mode&0o020 != 0
+		return (mode>>3)&want == want
 	default:
-		return mode&0o002 != 0
+		return mode&want == want
 	}
 }
 
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Sandboxing for the systemd unit.
+//
+// The agent is a remote shell, so most of what would confine it confines the
+// terminals it opens too: NoNewPrivileges stops sudo, ProtectSystem stops a
+// package install, PrivateTmp hides the rest of the machine's /tmp. Hence
+// levels, picked at `up` time:
+//
+//   - none: the unit as it was before, for anything the others get in the way of.
+//   - shell: only what a terminal is unlikely to notice. sudo, package
+//     installs and the machine's /tmp all keep working. The default.
+//   - strict: the full sandbox, for machines where the dashboard is for
+//     looking rather than administering. A terminal's shell cannot gain
+//     privileges and can write only to the agent's own directories and a
+//     private /tmp.
+type hardeningLevel string
+
+const (
+	hardeningNone   hardeningLevel = "none"
+	hardeningShell  hardeningLevel = "shell"
+	hardeningStrict hardeningLevel = "strict"
+
+	defaultHardening = hardeningShell
+)
+
+const hardeningFlagDoc = `How tightly the systemd unit sandboxes the agent: "none", "shell" (keeps sudo working in terminals) or "strict"`
+
+func parseHardeningLevel(s string) (hardeningLevel, error) {
+	switch level := hardeningLevel(strings.TrimSpace(s)); level {
+	case "":
+		return defaultHardening, nil
+	case hardeningNone, hardeningShell, hardeningStrict:
+		return level, nil
+	}
+	return "", fmt.Errorf("unknown hardening level %q (want none, shell or strict)", s)
+}
+
+// The agent needs IP for the server, Unix sockets for tmux and D-Bus, and
+// netlink to read its addresses for the dashboard.
+const serviceAddressFamilies = "AF_UNIX AF_INET AF_INET6 AF_NETLINK"
+
+// hardeningDirectives are the [Service] lines for a level. writable lists the
+// directories the agent must still be able to write: its state directory, and
+// the one its binary is replaced in.
+func hardeningDirectives(level hardeningLevel, writable []string) []string {
+	switch level {
+	case hardeningShell:
+		return []string{
+			// AF_PACKET too, so tcpdump and DHCP clients in a terminal work.
+			"RestrictAddressFamilies=" + serviceAddressFamilies + " AF_PACKET",
+			"LockPersonality=yes",
+			"RestrictRealtime=yes",
+		}
+	case hardeningStrict:
+		lines := []string{
+			"NoNewPrivileges=yes",
+			"ProtectSystem=strict",
+			// Hidden outright, unless something the agent writes lives
+			// there; then read-only with that one path let through.
+			"ProtectHome=" + protectHomeMode(writable),
+			"PrivateTmp=yes",
+			"RestrictAddressFamilies=" + serviceAddressFamilies,
+			// Empty: no capabilities at all, even for a service run as root.
+			// Rebooting goes through systemd over D-Bus, which needs none.
+			"CapabilityBoundingSet=",
+			"AmbientCapabilities=",
+			"ProtectKernelTunables=yes",
+			"ProtectKernelModules=yes",
+			"ProtectKernelLogs=yes",
+			"ProtectControlGroups=yes",
+			"ProtectClock=yes",
+			"RestrictNamespaces=yes",
+			"RestrictSUIDSGID=yes",
+			"LockPersonality=yes",
+			"RestrictRealtime=yes",
+			"SystemCallArchitectures=native",
+		}
+		if len(writable) > 0 {
+			lines = append(lines, "ReadWritePaths="+strings.Join(quoteUnitPaths(writable), " "))
+		}
+		return lines
+	}
+	return nil
+}
+
+// homeDirs are the trees ProtectHome covers.
+var homeDirs = []string{"/home", "/root", "/run/user"}
+
+func protectHomeMode(writable []string) string {
+	for _, dir := range writable {
+		for _, home := range homeDirs {
+			if dir == home || strings.HasPrefix(dir, home+"/") {
+				return "read-only"
+			}
+		}
+	}
+	return "yes"
+}
+
+// writableServicePaths are what a strict unit lets the agent write: its state
+// directory, and the directory its binary sits in, since an update lands by
+// rename(2) there. /var/lib/spectre-agent is StateDirectory= already.
+func writableServicePaths(exe, home string) []string {
+	var paths []string
+	for _, dir := range []string{filepath.Clean(home), filepath.Dir(exe)} {
+		if dir == "/var/lib/spectre-agent" || strings.HasPrefix(dir, "/var/lib/spectre-agent/") {
+			continue
+		}
+		if !slices.Contains(paths, dir) {
+			paths = append(paths, dir)
+		}
+	}
+	return paths
+}
+
+// quoteUnitPaths quotes paths with spaces, as systemd's path lists allow.
+func quoteUnitPaths(paths []string) []string {
+	quoted := make([]string, len(paths))
+	for i, p := range paths {
+		if strings.ContainsAny(p, " \t") {
+			p = `"` + p + `"`
+		}
+		quoted[i] = p
+	}
+	return quoted
+}
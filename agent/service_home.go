@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"slices"
 	"strconv"
 )
 
@@ -24,10 +25,15 @@ func purgeDataDirs() {
 		dirs = append(dirs, filepath.Dir(p))
 	}
 
+	// The system service's directory needs root; this account's own
+	// `up --user` directory does not.
 	sysDir := "/var/lib/spectre-agent"
-	if _, err := os.Stat(sysDir); err == nil {
+	if _, err := os.Stat(sysDir); err == nil && os.Geteuid() == 0 {
 		dirs = append(dirs, sysDir)
 	}
+	if userDir := userServiceHome(); isDir(userDir) && !slices.Contains(dirs, userDir) {
+		dirs = append(dirs, userDir)
+	}
 
 	for _, d := range dirs {
 		if err := os.RemoveAll(d); err != nil {
@@ -52,11 +58,21 @@ func serviceAgentHome() string {
 	return defaultServiceAgentHome
 }
 
+// serviceHomes are the state directories an installed service may be using:
+// the one this process would install into, the system default, and this
+// account's own from `up --user`.
+func serviceHomes() []string {
+	return []string{serviceAgentHome(), defaultServiceAgentHome, userServiceHome()}
+}
+
 // prepareServiceHome points enrollment at the service's state directory, and
 // carries over a device key from a previous non-service enrollment so an
 // already-enrolled machine is not enrolled all over again.
 func prepareServiceHome() error {
-	home := serviceAgentHome()
+	return prepareServiceHomeAt(serviceAgentHome())
+}
+
+func prepareServiceHomeAt(home string) error {
 	if os.Getenv("SPECTRE_AGENT_HOME") == home {
 		return nil // already resolved to the same place; nothing to move
 	}
@@ -110,7 +126,7 @@ func handServiceHomeToServiceAccount() error {
 		return nil
 	}
 	dir := filepath.Dir(path)
-	for _, target := range []string{filepath.Dir(dir), dir, path} {
+	for _, target := range []string{filepath.Dir(dir), dir, path, filepath.Join(dir, serviceSettingsFile)} {
 		if _, err := os.Stat(target); err != nil {
 			continue
 		}
@@ -143,17 +159,29 @@ func serviceAccountIDs() (int, int, bool) {
 
 // enrollForService makes sure this machine holds a device key before the
 // service is installed, so the service itself starts with no secret on its
-// command line. An already-enrolled machine is left alone.
-func enrollForService(host, authKey string) error {
+// command line. An already-enrolled machine is left alone. With provision
+// set, its auth key is used and the file destroyed.
+func enrollForService(host, authKey string, provision *provisioning) error {
 	info, err := ensureDeviceInfo()
 	if err != nil {
 		return fmt.Errorf("read device info: %w", err)
 	}
 	if info.DeviceKey != "" {
 		fmt.Println("This machine is already enrolled.")
+		if provision != nil {
+			provision.destroy()
+		}
 		return nil
 	}
 
+	if provision != nil {
+		fmt.Printf("Enrolling with the auth key from %s...\n", provision.path)
+		if err := enrollFromProvisioning(&info, provision, host); err != nil {
+			return err
+		}
+		fmt.Println("Enrolled. Device key stored; provisioning file removed.")
+		return nil
+	}
 	if authKey != "" {
 		fmt.Println("Enrolling with control server...")
 		key, err := enrollWithAuthKey(host, authKey, info.DeviceID)
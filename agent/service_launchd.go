@@ -4,9 +4,35 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"os/exec"
+	"runtime"
 	"strings"
 )
 
+type launchdService struct{}
+
+func (launchdService) name() string { return "launchd" }
+
+func (launchdService) detect() bool { return runtime.GOOS == "darwin" }
+
+func (launchdService) install(exe string, args []string) error {
+	return installLaunchdService(exe, args)
+}
+
+func (launchdService) uninstall() error { return uninstallLaunchdService() }
+
+func (launchdService) installed() bool { return fileExists(launchdPlistPath) }
+
+// state is whether launchd has the job loaded; printing it needs no root.
+func (launchdService) state() string {
+	if exec.Command("launchctl", "print", "system/"+launchdLabel).Run() != nil {
+		return "not loaded"
+	}
+	return "loaded"
+}
+
+func (launchdService) logHint() string { return "tail -f /var/log/spectre-agent.log" }
+
 func installLaunchdService(exe string, args []string) error {
 	userName, _ := resolveServiceAccount()
 	var userLine string
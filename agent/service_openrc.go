@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	// Both script-based init systems keep their scripts here; the first
+	// line tells an OpenRC script from a SysV one.
+	initScriptPath = "/etc/init.d/spectre-agent"
+	openrcShebang  = "#!/sbin/openrc-run"
+	initLogPath    = "/var/log/spectre-agent.log"
+)
+
+// openrcService is the init system of Alpine and Gentoo, and an option on
+// Devuan. supervise-daemon keeps the agent running, much as systemd's
+// Restart=always does.
+type openrcService struct{}
+
+func (openrcService) name() string { return "OpenRC" }
+
+// detect looks for the directory OpenRC keeps its state in, which exists
+// only once it has booted the machine.
+func (openrcService) detect() bool {
+	return runtime.GOOS == "linux" && isDir(initPath("/run/openrc"))
+}
+
+func (openrcService) install(exe string, args []string) error {
+	if err := os.WriteFile(initScriptPath, []byte(openrcScript(exe, args)), 0o755); err != nil {
+		return fmt.Errorf("write init script: %w", err)
+	}
+	if err := runCommand("rc-update", "add", serviceName, "default"); err != nil {
+		return err
+	}
+	// restart starts a stopped service too, and picks up a rewritten script.
+	if err := runCommand("rc-service", serviceName, "restart"); err != nil {
+		return err
+	}
+	_ = runCommand("rc-service", serviceName, "status")
+	return nil
+}
+
+func (openrcService) uninstall() error {
+	_ = runCommand("rc-service", serviceName, "stop")
+	_ = runCommand("rc-update", "del", serviceName, "default")
+	if err := os.Remove(initScriptPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove init script: %w", err)
+	}
+	return nil
+}
+
+func (openrcService) installed() bool { return initScriptIsOpenRC() == 1 }
+
+func (openrcService) state() string {
+	if exec.Command("rc-service", serviceName, "status").Run() != nil {
+		return "stopped"
+	}
+	return "started"
+}
+
+func (openrcService) logHint() string { return "tail -f " + initLogPath }
+
+func openrcScript(exe string, args []string) string {
+	userName, groupName := resolveServiceAccount()
+	var sb strings.Builder
+	sb.WriteString(openrcShebang + "\n")
+	sb.WriteString("# Written by `spectre-agent up`, which rewrites it on every install.\n\n")
+	sb.WriteString("description=\"Spectre agent\"\n")
+	sb.WriteString("supervisor=supervise-daemon\n")
+	sb.WriteString("command=" + shellQuote(exe) + "\n")
+	// OpenRC evals command_args, so the quoting inside survives.
+	sb.WriteString("command_args=\"" + shellEscaper.Replace(strings.Join(quoteAll(args), " ")) + "\"\n")
+	owner := ""
+	if userName != "" {
+		owner = userName
+		if groupName != "" {
+			owner += ":" + groupName
+		}
+		sb.WriteString("command_user=" + shellQuote(owner) + "\n")
+	}
+	sb.WriteString("directory=" + shellQuote(filepath.Dir(exe)) + "\n")
+	sb.WriteString("output_log=" + initLogPath + "\n")
+	sb.WriteString("error_log=" + initLogPath + "\n")
+	// The agent exits to pick up an update and relies on being started
+	// again, however often that happens.
+	sb.WriteString("respawn_delay=5\n")
+	sb.WriteString("respawn_max=0\n\n")
+	sb.WriteString(scriptEnvironment())
+	sb.WriteString("\ndepend() {\n\tneed net\n\tafter firewall\n}\n")
+	if owner != "" {
+		sb.WriteString("\nstart_pre() {\n")
+		sb.WriteString("\tcheckpath --file --owner " + shellQuote(owner) + " --mode 0640 " + initLogPath + "\n")
+		sb.WriteString("}\n")
+	}
+	return sb.String()
+}
+
+// shellEscaper escapes what is special inside a double-quoted shell string.
+var shellEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+
+// initScriptIsOpenRC reads the installed init script's first line: 1 for an
+// OpenRC script, 0 for any other, -1 when there is none.
+func initScriptIsOpenRC() int {
+	f, err := os.Open(initScriptPath)
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+	line, _ := bufio.NewReader(f).ReadString('\n')
+	if strings.TrimSpace(line) == openrcShebang {
+		return 1
+	}
+	return 0
+}
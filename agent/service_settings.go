@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// The service's settings, kept where the running agent can find them again.
+//
+// The unit, init script or plist starts the agent with `run` flags. `up`
+// also writes that command line to settings.json in the state directory, and
+// `admin reload` re-reads it there, so a host, update source or update policy
+// changed in it takes effect on the next connection without the agent having
+// to know which init system started it, or to be restarted. A restart goes
+// back to the flags the service was installed with; `up` changes both.
+
+const serviceSettingsFile = "settings.json"
+
+type storedServiceSettings struct {
+	// Args is the command line the service runs, "run" first.
+	Args []string `json:"args"`
+}
+
+// runSettings are what a reload can change.
+type runSettings struct {
+	host, updateSource string
+	policy             updatePolicy
+}
+
+func saveServiceSettings(args []string) error {
+	return writeStateJSON(serviceSettingsFile, storedServiceSettings{Args: args})
+}
+
+// loadServiceSettings reads settings.json back. An agent not started by `up`
+// has none, which is os.ErrNotExist.
+func loadServiceSettings() (runSettings, error) {
+	path, err := agentStatePath(serviceSettingsFile)
+	if err != nil {
+		return runSettings{}, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return runSettings{}, err
+	}
+	var stored storedServiceSettings
+	if !readStateJSON(serviceSettingsFile, &stored) {
+		return runSettings{}, fmt.Errorf("%s is not valid JSON", path)
+	}
+	settings, err := parseRunArgs(stored.Args)
+	if err != nil {
+		return runSettings{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return settings, nil
+}
+
+// parseRunArgs reads settings from a `run` command line, with the flags `run`
+// itself has.
+func parseRunArgs(args []string) (runSettings, error) {
+	if len(args) == 0 || args[0] != "run" {
+		return runSettings{}, errors.New(`args must start with "run"`)
+	}
+	var settings runSettings
+	var authKey string
+	var policy updatePolicyFlags
+	cmd := &cobra.Command{Use: "run"}
+	cmd.Flags().StringVar(&settings.host, "host", "", hostFlagDoc)
+	cmd.Flags().StringVar(&authKey, "authkey", "", authKeyFlagDoc)
+	cmd.Flags().StringVar(&settings.updateSource, "update-source", "", updateSourceFlagDoc)
+	addUpdatePolicyFlags(cmd, &policy)
+	if err := cmd.ParseFlags(args[1:]); err != nil {
+		return runSettings{}, err
+	}
+	if extra := cmd.Flags().Args(); len(extra) > 0 {
+		return runSettings{}, fmt.Errorf("unexpected arguments: %s", strings.Join(extra, " "))
+	}
+	if settings.host == "" {
+		return runSettings{}, errors.New("--host is missing")
+	}
+	settings.updateSource = updateSourceSpec(settings.updateSource)
+	if err := checkUpdateSource(settings.updateSource); err != nil {
+		return runSettings{}, err
+	}
+	var err error
+	if settings.policy, err = policy.policy(); err != nil {
+		return runSettings{}, err
+	}
+	return settings, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// runit and s6.
+//
+// Both supervise a directory per service: a run script that execs the daemon,
+// restarted whenever it exits, and a log/run script that takes its output.
+// The directory is kept in one place and enabled by linking it into the
+// directory the supervisor scans, so removing the link is how it is disabled.
+// The two differ only in their tools and where things live.
+
+// supervisor is one supervision suite.
+type supervisor struct {
+	name string
+	// pid1 is the init process's name when the suite boots the machine.
+	pid1 string
+	// serviceDir is where the agent's service directory is written.
+	serviceDir string
+	// scanDirs are the supervisor's scan directories, most specific first;
+	// the first that exists gets the link.
+	scanDirs []string
+	// runAs is the command prefix that drops to the service account.
+	runAs func(userName string) string
+	// logger is the command log/run execs, given the log directory.
+	logger string
+	// control, up, down and status drive the supervised service, each given
+	// its path in the scan directory.
+	control, up, down, status []string
+	// rescan, when set, tells the supervisor its scan directory changed.
+	rescan []string
+}
+
+const supervisedLogDir = "/var/log/spectre-agent"
+
+var (
+	runitSupervisor = supervisor{
+		name:       "runit",
+		pid1:       "runit",
+		serviceDir: "/etc/sv/spectre-agent",
+		// Void, then the conventional default, then Artix.
+		scanDirs: []string{"/var/service", "/etc/service", "/etc/runit/runsvdir/default"},
+		runAs: func(userName string) string {
+			return "chpst -u " + shellQuote(userName) + " "
+		},
+		logger:  "svlogd -tt",
+		control: []string{"sv"},
+		up:      []string{"sv", "up"},
+		down:    []string{"sv", "down"},
+		status:  []string{"sv", "status"},
+	}
+	s6Supervisor = supervisor{
+		name:       "s6",
+		pid1:       "s6-svscan",
+		serviceDir: "/etc/s6/sv/spectre-agent",
+		scanDirs:   []string{"/run/service", "/service", "/etc/service"},
+		runAs: func(userName string) string {
+			return "s6-setuidgid " + shellQuote(userName) + " "
+		},
+		logger:  "s6-log t",
+		control: []string{"s6-svc"},
+		up:      []string{"s6-svc", "-u"},
+		down:    []string{"s6-svc", "-d"},
+		status:  []string{"s6-svstat"},
+		rescan:  []string{"s6-svscanctl", "-a"},
+	}
+)
+
+// supervisedService installs the agent under runit or s6.
+type supervisedService struct{ s supervisor }
+
+func (m supervisedService) name() string { return m.s.name }
+
+func (m supervisedService) detect() bool {
+	return runtime.GOOS == "linux" && pid1Name() == m.s.pid1 && hasCommand(m.s.control[0])
+}
+
+func (m supervisedService) install(exe string, args []string) error {
+	scanDir := m.scanDir()
+	if scanDir == "" {
+		return fmt.Errorf("no %s scan directory found (looked in %s)", m.s.name, strings.Join(m.s.scanDirs, ", "))
+	}
+	if err := os.MkdirAll(filepath.Join(m.s.serviceDir, "log"), 0o755); err != nil {
+		return fmt.Errorf("create service directory: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(m.s.serviceDir, "run"), []byte(m.runScript(exe, args)), 0o755); err != nil {
+		return fmt.Errorf("write run script: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(m.s.serviceDir, "log", "run"), []byte(m.logScript()), 0o755); err != nil {
+		return fmt.Errorf("write log script: %w", err)
+	}
+
+	link := filepath.Join(scanDir, serviceName)
+	if target, err := os.Readlink(link); err != nil || target != m.s.serviceDir {
+		_ = os.Remove(link)
+		if err := os.Symlink(m.s.serviceDir, link); err != nil {
+			return fmt.Errorf("enable service: %w", err)
+		}
+	}
+	if m.s.rescan != nil {
+		_ = runCommand(m.s.rescan[0], append(m.s.rescan[1:], scanDir)...)
+	}
+
+	// The supervisor picks the link up on its next scan, every few seconds,
+	// and starts the service by itself. Wait for it so status has something
+	// to say, and so a rewritten run script is what is running.
+	if !waitForPath(filepath.Join(link, "supervise"), 15*time.Second) {
+		return fmt.Errorf("%s did not pick up %s; is its supervisor running on %s?", m.s.name, link, scanDir)
+	}
+	_ = runCommand(m.s.down[0], append(m.s.down[1:], link)...)
+	if err := runCommand(m.s.up[0], append(m.s.up[1:], link)...); err != nil {
+		return err
+	}
+	_ = runCommand(m.s.status[0], append(m.s.status[1:], link)...)
+	return nil
+}
+
+func (m supervisedService) uninstall() error {
+	for _, scanDir := range m.s.scanDirs {
+		link := filepath.Join(scanDir, serviceName)
+		if _, err := os.Lstat(link); err != nil {
+			continue
+		}
+		_ = runCommand(m.s.down[0], append(m.s.down[1:], link)...)
+		if err := os.Remove(link); err != nil {
+			return fmt.Errorf("disable service: %w", err)
+		}
+		if m.s.rescan != nil {
+			_ = runCommand(m.s.rescan[0], append(m.s.rescan[1:], scanDir)...)
+		}
+	}
+	if err := os.RemoveAll(m.s.serviceDir); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove service directory: %w", err)
+	}
+	return nil
+}
+
+func (m supervisedService) installed() bool {
+	return fileExists(filepath.Join(m.s.serviceDir, "run"))
+}
+
+// state is the first word the status tool prints: "run" or "down" from sv,
+// "up" or "down" from s6-svstat.
+func (m supervisedService) state() string {
+	scanDir := m.scanDir()
+	if scanDir == "" {
+		return "not enabled"
+	}
+	args := append(append([]string{}, m.s.status[1:]...), filepath.Join(scanDir, serviceName))
+	out, err := exec.Command(m.s.status[0], args...).Output()
+	if err != nil {
+		return "not supervised"
+	}
+	word, _, _ := strings.Cut(strings.TrimSpace(string(out)), " ")
+	return strings.TrimSuffix(word, ":")
+}
+
+func (m supervisedService) logHint() string {
+	return "tail -f " + supervisedLogDir + "/current"
+}
+
+func (m supervisedService) scanDir() string {
+	for _, dir := range m.s.scanDirs {
+		if isDir(dir) {
+			return dir
+		}
+	}
+	return ""
+}
+
+func (m supervisedService) runScript(exe string, args []string) string {
+	userName, _ := resolveServiceAccount()
+	var sb strings.Builder
+	sb.WriteString("#!/bin/sh\n")
+	sb.WriteString("# Written by `spectre-agent up`, which rewrites it on every install.\n")
+	sb.WriteString("exec 2>&1\n")
+	sb.WriteString(scriptEnvironment())
+	sb.WriteString("cd " + shellQuote(filepath.Dir(exe)) + " || exit 1\n")
+	sb.WriteString("exec ")
+	if userName != "" {
+		sb.WriteString(m.s.runAs(userName))
+	}
+	sb.WriteString(shellCommand(exe, args) + "\n")
+	return sb.String()
+}
+
+func (m supervisedService) logScript() string {
+	return "#!/bin/sh\n" +
+		"mkdir -p " + supervisedLogDir + "\n" +
+		"exec " + m.s.logger + " " + supervisedLogDir + "\n"
+}
+
+// waitForPath polls for path to appear.
+func waitForPath(path string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
@@ -4,12 +4,45 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
 )
 
-func installSystemdService(exe string, args []string) error {
-	if err := os.WriteFile(systemdUnitPath, []byte(systemdUnit(exe, args)), 0644); err != nil {
+// systemdService is the default on nearly every mainstream distribution.
+type systemdService struct {
+	// hardening is the sandbox `up` asked for; empty is the default.
+	hardening hardeningLevel
+}
+
+func (systemdService) name() string { return "systemd" }
+
+// detect is sd_booted(3): the directory exists only when systemd is PID 1.
+func (systemdService) detect() bool {
+	return runtime.GOOS == "linux" && isDir(initPath("/run/systemd/system"))
+}
+
+func (m systemdService) install(exe string, args []string) error {
+	return installSystemdService(newSystemdUnitConfig(exe, args, m.hardening))
+}
+
+func (systemdService) uninstall() error { return uninstallSystemdService() }
+
+func (systemdService) installed() bool { return fileExists(systemdUnitPath) }
+
+func (systemdService) state() string {
+	out, err := exec.Command("systemctl", "is-active", "spectre-agent.service").Output()
+	if err != nil {
+		return "inactive"
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func (systemdService) logHint() string { return "journalctl -u spectre-agent -f" }
+
+func installSystemdService(unit systemdUnitConfig) error {
+	if err := os.WriteFile(systemdUnitPath, []byte(unit.render()), 0644); err != nil {
 		return fmt.Errorf("write unit: %w", err)
 	}
 
@@ -25,28 +58,66 @@ func installSystemdService(exe string, args []string) error {
 	return nil
 }
 
-func systemdUnit(exe string, args []string) string {
+// systemdUnitConfig is everything the unit is written from. `status` reads it
+// back out of the installed unit to tell whether this binary would write the
+// same thing.
+type systemdUnitConfig struct {
+	exe         string
+	args        []string
+	user, group string
+	home        string
+	hardening   hardeningLevel
+}
+
+// hardeningMarker records the level in the unit, where systemd ignores it.
+const hardeningMarker = "# Hardening: "
+
+func newSystemdUnitConfig(exe string, args []string, level hardeningLevel) systemdUnitConfig {
+	if level == "" {
+		level = defaultHardening
+	}
 	userName, groupName := resolveServiceAccount()
+	return systemdUnitConfig{
+		exe:       exe,
+		args:      args,
+		user:      userName,
+		group:     groupName,
+		home:      serviceAgentHome(),
+		hardening: level,
+	}
+}
+
+func systemdUnit(exe string, args []string, level hardeningLevel) string {
+	return newSystemdUnitConfig(exe, args, level).render()
+}
+
+func (c systemdUnitConfig) render() string {
 	var sb strings.Builder
+	sb.WriteString("# Written by `spectre-agent up`, which rewrites it on every install.\n")
+	sb.WriteString(hardeningMarker + string(c.hardening) + "\n")
 	sb.WriteString("[Unit]\n")
 	sb.WriteString("Description=Spectre agent\n")
 	sb.WriteString("After=network.target\n\n")
 
 	sb.WriteString("[Service]\n")
 	sb.WriteString("Type=simple\n")
-	sb.WriteString("Environment=PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/bin\n")
-	sb.WriteString("Environment=SPECTRE_AGENT_HOME=" + serviceAgentHome() + "\n")
+	sb.WriteString("Environment=PATH=" + servicePATH + "\n")
+	sb.WriteString("Environment=SPECTRE_AGENT_HOME=" + c.home + "\n")
 	sb.WriteString("StateDirectory=spectre-agent\n")
-	if userName != "" {
-		sb.WriteString("User=" + userName + "\n")
+	if c.user != "" {
+		sb.WriteString("User=" + c.user + "\n")
 	}
-	if groupName != "" {
-		sb.WriteString("Group=" + groupName + "\n")
+	if c.group != "" {
+		sb.WriteString("Group=" + c.group + "\n")
 	}
-	sb.WriteString(fmt.Sprintf("ExecStart=%s %s\n", exe, strings.Join(args, " ")))
-	sb.WriteString(fmt.Sprintf("WorkingDirectory=%s\n", filepath.Dir(exe)))
+	sb.WriteString(fmt.Sprintf("ExecStart=%s %s\n", c.exe, strings.Join(c.args, " ")))
+	sb.WriteString(fmt.Sprintf("WorkingDirectory=%s\n", filepath.Dir(c.exe)))
 	sb.WriteString("Restart=always\n")
-	sb.WriteString("RestartSec=5\n\n")
+	sb.WriteString("RestartSec=5\n")
+	for _, line := range hardeningDirectives(c.hardening, writableServicePaths(c.exe, c.home)) {
+		sb.WriteString(line + "\n")
+	}
+	sb.WriteString("\n")
 
 	sb.WriteString("[Install]\n")
 	sb.WriteString("WantedBy=multi-user.target\n")
@@ -54,6 +125,113 @@ func systemdUnit(exe string, args []string) string {
 	return sb.String()
 }
 
+// parseSystemdUnit recovers the config an installed unit was written from. A
+// unit from before hardening levels has no marker, and had no sandbox.
+func parseSystemdUnit(unit string) (systemdUnitConfig, error) {
+	c := systemdUnitConfig{hardening: hardeningNone}
+	for _, line := range strings.Split(unit, "\n") {
+		line = strings.TrimSpace(line)
+		if level, ok := strings.CutPrefix(line, hardeningMarker); ok {
+			c.hardening = hardeningLevel(level)
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "ExecStart":
+			fields := strings.Fields(value)
+			if len(fields) > 0 {
+				c.exe, c.args = fields[0], fields[1:]
+			}
+		case "User":
+			c.user = value
+		case "Group":
+			c.group = value
+		case "Environment":
+			if home, ok := strings.CutPrefix(value, "SPECTRE_AGENT_HOME="); ok {
+				c.home = home
+			}
+		}
+	}
+	if c.exe == "" {
+		return c, fmt.Errorf("no ExecStart line")
+	}
+	return c, nil
+}
+
+// systemdUnitDrift compares the installed unit with the one this binary would
+// write in its place, for the same binary, account, state directory and
+// hardening level. Each difference is a line prefixed "-" for one only the
+// installed unit has, or "+" for one only the new one would. None means it is
+// current.
+//
+// An agent that updates itself keeps running under the unit an older version
+// wrote, so sandboxing added since never reaches it until `up` is run again;
+// this is how that shows.
+func systemdUnitDrift() ([]string, systemdUnitConfig, error) {
+	data, err := os.ReadFile(systemdUnitPath)
+	if err != nil {
+		return nil, systemdUnitConfig{}, err
+	}
+	installed := string(data)
+	config, err := parseSystemdUnit(installed)
+	if err != nil {
+		return nil, config, fmt.Errorf("read %s: %w", systemdUnitPath, err)
+	}
+	return lineDiff(installed, config.render()), config, nil
+}
+
+// upCommand is the `up` that rewrites the unit with the settings it already
+// has. The hardening level is spelled out: left to its default, following the
+// advice would quietly move a none or strict install to shell.
+func (c systemdUnitConfig) upCommand() string {
+	parts := []string{"sudo"}
+	if c.home != "" && c.home != defaultServiceAgentHome {
+		parts = append(parts, "SPECTRE_AGENT_HOME="+shellQuote(c.home))
+	}
+	parts = append(parts, "spectre-agent", "up")
+	// args[0] is the "run" subcommand; the rest are up's flags too.
+	if len(c.args) > 1 {
+		parts = append(parts, c.args[1:]...)
+	}
+	return strings.Join(append(parts, "--hardening", string(c.hardening)), " ")
+}
+
+// lineDiff lists the lines only one side has. Order within each side is kept;
+// moves are not reported.
+func lineDiff(installed, want string) []string {
+	count := func(s string) map[string]int {
+		m := map[string]int{}
+		for _, line := range strings.Split(s, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				m[line]++
+			}
+		}
+		return m
+	}
+	inInstalled, inWant := count(installed), count(want)
+	var diff []string
+	for _, side := range []struct {
+		text   string
+		prefix string
+		other  map[string]int
+	}{{installed, "- ", inWant}, {want, "+ ", inInstalled}} {
+		for _, line := range strings.Split(side.text, "\n") {
+			if line = strings.TrimSpace(line); line == "" {
+				continue
+			}
+			if side.other[line] > 0 {
+				side.other[line]--
+				continue
+			}
+			diff = append(diff, side.prefix+line)
+		}
+	}
+	return diff
+}
+
 func uninstallSystemdService() error {
 	_ = runCommand("systemctl", "disable", "--now", "spectre-agent.service")
 	if err := os.Remove(systemdUnitPath); err != nil && !errors.Is(err, os.ErrNotExist) {
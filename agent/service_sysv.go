@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const sysvPidFile = "/var/run/spectre-agent.pid"
+
+// sysvService is a classic /etc/init.d script, for Devuan, older Debian and
+// RHEL derivatives, and embedded images with no service manager to speak of.
+//
+// SysV init starts a daemon and forgets it; nothing starts it again when it
+// exits. The agent exits to pick up an update, so the script runs it under a
+// small loop that does, in its own process group so stopping the service
+// takes the loop and the agent down together.
+type sysvService struct{}
+
+func (sysvService) name() string { return "SysV init" }
+
+// detect is the fallback on Linux: init scripts, and a tool to enable them at
+// boot. Every service manager above it in the list keeps /etc/init.d around
+// too, which is why it comes last.
+func (sysvService) detect() bool {
+	return runtime.GOOS == "linux" && isDir(initPath("/etc/init.d")) &&
+		(hasCommand("update-rc.d") || hasCommand("chkconfig"))
+}
+
+func (sysvService) install(exe string, args []string) error {
+	if userName, _ := resolveServiceAccount(); userName != "" && !hasCommand("runuser") {
+		return fmt.Errorf("the init script drops to %s with runuser, which is not installed", userName)
+	}
+	if err := os.WriteFile(initScriptPath, []byte(sysvScript(exe, args)), 0o755); err != nil {
+		return fmt.Errorf("write init script: %w", err)
+	}
+	if hasCommand("update-rc.d") {
+		if err := runCommand("update-rc.d", serviceName, "defaults"); err != nil {
+			return err
+		}
+	} else if err := runCommand("chkconfig", "--add", serviceName); err != nil {
+		return err
+	}
+	if err := runCommand(initScriptPath, "restart"); err != nil {
+		return err
+	}
+	_ = runCommand(initScriptPath, "status")
+	return nil
+}
+
+func (sysvService) uninstall() error {
+	if fileExists(initScriptPath) {
+		_ = runCommand(initScriptPath, "stop")
+	}
+	if hasCommand("update-rc.d") {
+		_ = runCommand("update-rc.d", "-f", serviceName, "remove")
+	} else if hasCommand("chkconfig") {
+		_ = runCommand("chkconfig", "--del", serviceName)
+	}
+	if err := os.Remove(initScriptPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove init script: %w", err)
+	}
+	_ = os.Remove(sysvPidFile)
+	return nil
+}
+
+func (sysvService) installed() bool { return initScriptIsOpenRC() == 0 }
+
+func (sysvService) state() string {
+	if exec.Command(initScriptPath, "status").Run() != nil {
+		return "stopped"
+	}
+	return "running"
+}
+
+func (sysvService) logHint() string { return "tail -f " + initLogPath }
+
+func sysvScript(exe string, args []string) string {
+	userName, _ := resolveServiceAccount()
+	command := shellCommand(exe, args)
+	if userName != "" {
+		command = "runuser -u " + shellQuote(userName) + " -- " + command
+	}
+
+	var sb strings.Builder
+	sb.WriteString(`#!/bin/sh
+### BEGIN INIT INFO
+# Provides:          spectre-agent
+# Required-Start:    $network $remote_fs
+# Required-Stop:     $network $remote_fs
+# Default-Start:     2 3 4 5
+# Default-Stop:      0 1 6
+# Short-Description: Spectre agent
+### END INIT INFO
+# chkconfig: 2345 90 10
+# description: Spectre agent
+#
+# Written by ` + "`spectre-agent up`" + `, which rewrites it on every install.
+
+PIDFILE=` + sysvPidFile + `
+LOGFILE=` + initLogPath + `
+`)
+	sb.WriteString(scriptEnvironment())
+	sb.WriteString(`
+# Runs the agent, and runs it again whenever it exits.
+supervise() {
+	cd ` + shellQuote(filepath.Dir(exe)) + ` || exit 1
+	while :; do
+		` + command + `
+		sleep 5
+	done
+}
+
+running() {
+	[ -f "$PIDFILE" ] && kill -0 "$(cat "$PIDFILE")" 2>/dev/null
+}
+
+start() {
+	running && return 0
+	setsid ` + initScriptPath + ` supervise >>"$LOGFILE" 2>&1 </dev/null &
+	echo $! >"$PIDFILE"
+}
+
+stop() {
+	if running; then
+		kill -TERM -"$(cat "$PIDFILE")" 2>/dev/null
+	fi
+	rm -f "$PIDFILE"
+}
+
+case "$1" in
+	start) start ;;
+	stop) stop ;;
+	restart|force-reload) stop; sleep 1; start ;;
+	status)
+		if running; then echo "spectre-agent is running"; else echo "spectre-agent is stopped"; exit 3; fi ;;
+	supervise) supervise ;;
+	*) echo "Usage: $0 {start|stop|restart|status}" >&2; exit 1 ;;
+esac
+`)
+	return sb.String()
+}
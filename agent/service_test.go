@@ -3,7 +3,9 @@ package main
 import (
 	"encoding/json"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
 )
@@ -28,7 +30,7 @@ func TestEnrollmentAndServiceAgreeOnTheDeviceKeyPath(t *testing.T) {
 		t.Fatalf("enrollment writes to %s, outside the service home %s", enrolled, home)
 	}
 
-	unit := systemdUnit("/usr/local/bin/spectre-agent", buildExecArgs("wss://example.com"))
+	unit := systemdUnit("/usr/local/bin/spectre-agent", buildExecArgs("wss://example.com", "", updatePolicy{}), defaultHardening)
 	if !strings.Contains(unit, "Environment=SPECTRE_AGENT_HOME="+home+"\n") {
 		t.Fatalf("unit does not point the service at %s:\n%s", home, unit)
 	}
@@ -129,3 +131,248 @@ func TestLoadDeviceInfoFindsTheServiceHome(t *testing.T) {
 		t.Fatalf("expected the service's identity, got %+v (found=%v)", info, found)
 	}
 }
+
+func TestDetectServiceManager(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("init system detection is for Linux")
+	}
+	for _, tc := range []struct {
+		name     string
+		dirs     []string
+		pid1     string
+		commands []string
+		want     string
+	}{
+		{"systemd", []string{"run/systemd/system", "etc/init.d"}, "systemd", []string{"update-rc.d"}, "systemd"},
+		{"alpine", []string{"run/openrc", "etc/init.d"}, "init", nil, "OpenRC"},
+		{"void", []string{"etc/sv"}, "runit", []string{"sv"}, "runit"},
+		{"s6", nil, "s6-svscan", []string{"s6-svc"}, "s6"},
+		{"devuan", []string{"etc/init.d"}, "init", []string{"update-rc.d"}, "SysV init"},
+		{"rhel6", []string{"etc/init.d"}, "init", []string{"chkconfig"}, "SysV init"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root, bin := t.TempDir(), t.TempDir()
+			for _, dir := range append(tc.dirs, "proc/1") {
+				if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(filepath.Join(root, "proc/1/comm"), []byte(tc.pid1+"\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range tc.commands {
+				if err := os.WriteFile(filepath.Join(bin, c), []byte("#!/bin/sh\n"), 0o755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Setenv("PATH", bin)
+			old := initRoot
+			initRoot = root
+			defer func() { initRoot = old }()
+
+			m, err := detectServiceManager()
+			if err != nil || m.name() != tc.want {
+				t.Fatalf("detected %v, %v; want %s", m, err, tc.want)
+			}
+		})
+	}
+
+	old := initRoot
+	initRoot = t.TempDir()
+	defer func() { initRoot = old }()
+	if _, err := detectServiceManager(); err == nil || !strings.Contains(err.Error(), "no supported init system") {
+		t.Fatalf("a bare host: %v", err)
+	}
+}
+
+// Every script must parse, run the agent as the service account with its
+// state directory, and restart it after it exits to take an update.
+func TestInitScriptsRunTheAgentAsTheServiceAccount(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no shell to check the scripts with")
+	}
+	t.Setenv("SUDO_USER", "nobody")
+	t.Setenv("SPECTRE_AGENT_HOME", "/var/lib/spectre agent")
+	exe := "/var/lib/spectre-agent/bin/spectre-agent"
+	args := buildExecArgs("wss://example.com", "server", updatePolicy{})
+
+	for name, tc := range map[string]struct {
+		script string
+		want   []string
+	}{
+		"openrc": {openrcScript(exe, args), []string{
+			"supervisor=supervise-daemon", "respawn_max=0", "command_user='nobody", "command_args=",
+		}},
+		"runit": {supervisedService{runitSupervisor}.runScript(exe, args), []string{"exec chpst -u 'nobody' '" + exe + "' 'run'"}},
+		"s6":    {supervisedService{s6Supervisor}.runScript(exe, args), []string{"exec s6-setuidgid 'nobody' '" + exe + "'"}},
+		"sysv":  {sysvScript(exe, args), []string{"runuser -u 'nobody' -- '" + exe + "' 'run' '--host=wss://example.com' '--update-source=server'", "while :; do"}},
+	} {
+		for _, want := range append(tc.want, "export SPECTRE_AGENT_HOME='/var/lib/spectre agent'") {
+			if !strings.Contains(tc.script, want) {
+				t.Errorf("%s script lacks %q:\n%s", name, want, tc.script)
+			}
+		}
+		if out, err := exec.Command("sh", "-n", "-c", tc.script).CombinedOutput(); err != nil {
+			t.Errorf("%s script does not parse: %v\n%s", name, err, out)
+		}
+	}
+}
+
+// A user unit runs as whoever owns it, so it must not name an account, and has
+// to hang off default.target: multi-user.target does not exist in a user
+// manager, and a unit wanted by it never starts.
+func TestUserUnitRunsUnderTheAccountsOwnManager(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("XDG_STATE_HOME", "relative/is/ignored")
+
+	if got, want := userServiceHome(), filepath.Join(home, ".local/state/spectre-agent"); got != want {
+		t.Fatalf("userServiceHome = %s, want %s", got, want)
+	}
+	if got, want := userUnitPath(), filepath.Join(home, ".config/systemd/user/spectre-agent.service"); got != want {
+		t.Fatalf("userUnitPath = %s, want %s", got, want)
+	}
+
+	t.Setenv("SPECTRE_AGENT_HOME", userServiceHome())
+	unit := systemdUserUnit("/home/me/bin/spectre-agent", buildExecArgs("wss://example.com", "github", updatePolicy{}))
+	for _, want := range []string{
+		"Environment=SPECTRE_AGENT_HOME=" + userServiceHome(), "Restart=always", "WantedBy=default.target",
+	} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("unit lacks %q:\n%s", want, unit)
+		}
+	}
+	for _, unwanted := range []string{"User=", "Group=", "StateDirectory=", "multi-user.target"} {
+		if strings.Contains(unit, unwanted) {
+			t.Errorf("unit has %q:\n%s", unwanted, unit)
+		}
+	}
+
+	if (userSystemdService{}).installed() {
+		t.Fatal("installed before the unit was written")
+	}
+	if err := os.MkdirAll(filepath.Dir(userUnitPath()), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(userUnitPath(), []byte(unit), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !(userSystemdService{}).installed() {
+		t.Fatal("not installed once the unit was written")
+	}
+}
+
+// `status` and `update` look for a running agent in every state directory a
+// service may use, the per-user one included.
+func TestLoadDeviceInfoFindsAUserInstall(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_STATE_HOME", "")
+	t.Setenv("SPECTRE_AGENT_HOME", userServiceHome())
+	if err := saveDeviceInfo(DeviceInfo{DeviceID: "device-user", DeviceKey: "dk_user"}); err != nil {
+		t.Fatalf("saveDeviceInfo: %v", err)
+	}
+
+	t.Setenv("SPECTRE_AGENT_HOME", "")
+	info, _, found := loadDeviceInfo()
+	if !found || info.DeviceID != "device-user" {
+		t.Fatalf("expected the user install's identity, got %+v (found=%v)", info, found)
+	}
+}
+
+// Each level has to keep what the agent itself needs: its state directory and
+// the directory its binary is replaced in stay writable, and a shell-level
+// unit leaves sudo alone.
+func TestSystemdUnitHardeningLevels(t *testing.T) {
+	t.Setenv("SUDO_USER", "nobody")
+	t.Setenv("SPECTRE_AGENT_HOME", "/home/ops/spectre")
+	exe := "/usr/local/bin/spectre-agent"
+	args := buildExecArgs("wss://example.com", "", updatePolicy{})
+
+	for _, tc := range []struct {
+		level        hardeningLevel
+		want, reject []string
+	}{
+		{hardeningNone, nil, []string{"NoNewPrivileges", "RestrictAddressFamilies", "ProtectSystem"}},
+		{hardeningShell, []string{"RestrictAddressFamilies=AF_UNIX AF_INET AF_INET6 AF_NETLINK AF_PACKET"}, []string{"NoNewPrivileges", "ProtectSystem", "PrivateTmp", "CapabilityBoundingSet"}},
+		{hardeningStrict, []string{
+			"NoNewPrivileges=yes", "ProtectSystem=strict", "PrivateTmp=yes", "CapabilityBoundingSet=\n",
+			// The state directory is under /home, so it cannot be hidden.
+			"ProtectHome=read-only", "ReadWritePaths=/home/ops/spectre /usr/local/bin",
+		}, nil},
+	} {
+		unit := systemdUnit(exe, args, tc.level)
+		if !strings.Contains(unit, hardeningMarker+string(tc.level)+"\n") {
+			t.Errorf("%s: unit does not record its level:\n%s", tc.level, unit)
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(unit, want) {
+				t.Errorf("%s: unit lacks %q:\n%s", tc.level, want, unit)
+			}
+		}
+		for _, reject := range tc.reject {
+			if strings.Contains(unit, reject) {
+				t.Errorf("%s: unit has %q:\n%s", tc.level, reject, unit)
+			}
+		}
+	}
+
+	t.Setenv("SPECTRE_AGENT_HOME", defaultServiceAgentHome)
+	unit := systemdUnit(defaultServiceAgentHome+"/bin/spectre-agent", args, hardeningStrict)
+	if !strings.Contains(unit, "ProtectHome=yes") || strings.Contains(unit, "ReadWritePaths") {
+		t.Errorf("StateDirectory already covers the default home:\n%s", unit)
+	}
+
+	if _, err := parseHardeningLevel("paranoid"); err == nil {
+		t.Error("an unknown level was accepted")
+	}
+}
+
+// `status` regenerates the installed unit from its own settings. A current
+// unit shows no drift; one an older version wrote shows what changed.
+func TestSystemdUnitDrift(t *testing.T) {
+	t.Setenv("SUDO_USER", "nobody")
+	t.Setenv("SPECTRE_AGENT_HOME", "/var/lib/spectre-agent")
+	args := buildExecArgs("wss://example.com", "server", updatePolicy{})
+
+	// Rendered as somebody else, as `status` would be run.
+	installed := systemdUnit("/usr/local/bin/spectre-agent", args, hardeningStrict)
+	t.Setenv("SUDO_USER", "")
+	t.Setenv("SPECTRE_AGENT_HOME", t.TempDir())
+
+	config, err := parseSystemdUnit(installed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drift := lineDiff(installed, config.render()); len(drift) != 0 {
+		t.Fatalf("a current unit drifted: %q", drift)
+	}
+
+	// A unit from before hardening: no marker, no sandbox.
+	old := strings.Join(strings.Split(systemdUnit("/usr/local/bin/spectre-agent", args, hardeningNone), "\n")[2:], "\n")
+	config, err = parseSystemdUnit(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drift := lineDiff(old, config.render())
+	want := []string{"+ # Written by `spectre-agent up`, which rewrites it on every install.", "+ # Hardening: none"}
+	if strings.Join(drift, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("drift = %q, want %q", drift, want)
+	}
+
+	// The advice keeps the level: `up` on its own would fall back to shell.
+	// It keeps a state directory other than the default, too.
+	want = []string{"sudo", "SPECTRE_AGENT_HOME=" + shellQuote(config.home), "spectre-agent", "up", "--host=wss://example.com", "--update-source=server", "--hardening", "none"}
+	if got, want := config.upCommand(), strings.Join(want, " "); got != want {
+		t.Fatalf("upCommand = %q, want %q", got, want)
+	}
+
+	edited := strings.Replace(installed, "ProtectSystem=strict", "ProtectSystem=full", 1)
+	config, _ = parseSystemdUnit(edited)
+	if drift := lineDiff(edited, config.render()); strings.Join(drift, ",") != "- ProtectSystem=full,+ ProtectSystem=strict" {
+		t.Fatalf("a hand-edited unit: %q", drift)
+	}
+	if cmd := config.upCommand(); !strings.HasSuffix(cmd, " --hardening strict") {
+		t.Fatalf("upCommand = %q, want the strict level kept", cmd)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// A per-user install.
+//
+// `up --user` is for machines where the agent cannot have root: a shared
+// server, a lab login. It installs a systemd user unit for the account running
+// it, keeps its state under ~/.local/state/spectre-agent rather than /var/lib,
+// and asks logind to keep the account's service manager running when nobody
+// is logged in ("lingering"), so the agent starts at boot and survives logout.
+// Where lingering is refused, the agent runs only while the user has a
+// session, and `up` says so.
+//
+// Everything else is as for a system install: enrolled once beforehand,
+// restarted by systemd whenever it exits, and updated by replacing a binary
+// the account owns.
+
+// userServiceUp is `up --user`.
+func userServiceUp(host, authKey, updateSource, updateToken string, policy updatePolicy, provision *provisioning) error {
+	if os.Geteuid() == 0 {
+		return fmt.Errorf("--user installs the agent for the account running it; run it without sudo, or drop --user for a system install")
+	}
+	if runtime.GOOS != "linux" || !(systemdService{}).detect() || !hasCommand("systemctl") {
+		return fmt.Errorf("--user needs systemd, which this machine does not run")
+	}
+
+	exe, err := currentExecutablePath()
+	if err != nil {
+		return err
+	}
+
+	home := os.Getenv("SPECTRE_AGENT_HOME")
+	if home == "" {
+		home = userServiceHome()
+	}
+	if err := prepareServiceHomeAt(home); err != nil {
+		return err
+	}
+	if err := enrollForService(host, authKey, provision); err != nil {
+		return err
+	}
+	if err := storeUpdateToken(updateToken); err != nil {
+		return err
+	}
+	args := buildExecArgs(host, updateSource, policy)
+	if err := saveServiceSettings(args); err != nil {
+		return fmt.Errorf("save service settings: %w", err)
+	}
+	// Everything was written by the account the service runs as, so unlike
+	// a system install there is nothing to hand over.
+	exe, err = userInstallBinary(exe)
+	if err != nil {
+		return err
+	}
+
+	manager := userSystemdService{}
+	if err := manager.install(exe, args); err != nil {
+		return err
+	}
+
+	fmt.Printf("\nspectre-agent service installed and started (%s).\n", manager.name())
+	fmt.Println("  Check status:  spectre-agent status")
+	fmt.Println("  View logs:     " + manager.logHint())
+	fmt.Println("  Stop service:  spectre-agent down --user")
+	return nil
+}
+
+type userSystemdService struct{}
+
+func (userSystemdService) name() string { return "systemd --user" }
+
+// detect is never true: a user install is asked for, not chosen for the host.
+func (userSystemdService) detect() bool { return false }
+
+func (userSystemdService) install(exe string, args []string) error {
+	path := userUnitPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("create %s: %w", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, []byte(systemdUserUnit(exe, args)), 0o644); err != nil {
+		return fmt.Errorf("write unit: %w", err)
+	}
+	if err := runCommand("systemctl", "--user", "daemon-reload"); err != nil {
+		return err
+	}
+	if err := runCommand("systemctl", "--user", "enable", "--now", "spectre-agent.service"); err != nil {
+		return err
+	}
+	// Also restarts an agent a previous `up --user` left running on an
+	// older unit; enable --now leaves a running service alone.
+	_ = runCommand("systemctl", "--user", "restart", "spectre-agent.service")
+
+	if err := enableLingering(); err != nil {
+		fmt.Printf("\nwarning: could not enable lingering for this account: %v\n", err)
+		fmt.Println("         The agent will run only while you are logged in. An administrator can")
+		fmt.Printf("         allow it to run at boot with: sudo loginctl enable-linger %s\n", currentUserName())
+	}
+	_ = runCommand("systemctl", "--user", "status", "--no-pager", "spectre-agent.service")
+	return nil
+}
+
+func (userSystemdService) uninstall() error {
+	_ = runCommand("systemctl", "--user", "disable", "--now", "spectre-agent.service")
+	if err := os.Remove(userUnitPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove unit: %w", err)
+	}
+	_ = runCommand("systemctl", "--user", "daemon-reload")
+	// Lingering is left as it was: other user services may depend on it.
+	return nil
+}
+
+func (userSystemdService) installed() bool { return fileExists(userUnitPath()) }
+
+func (userSystemdService) state() string {
+	out, err := exec.Command("systemctl", "--user", "is-active", "spectre-agent.service").Output()
+	if err != nil {
+		return "inactive"
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func (userSystemdService) logHint() string { return "journalctl --user -u spectre-agent -f" }
+
+func systemdUserUnit(exe string, args []string) string {
+	var sb strings.Builder
+	sb.WriteString("[Unit]\n")
+	sb.WriteString("Description=Spectre agent\n")
+	sb.WriteString("After=network-online.target\n\n")
+
+	sb.WriteString("[Service]\n")
+	sb.WriteString("Type=simple\n")
+	sb.WriteString("Environment=PATH=" + servicePATH + "\n")
+	sb.WriteString("Environment=SPECTRE_AGENT_HOME=" + serviceAgentHome() + "\n")
+	sb.WriteString(fmt.Sprintf("ExecStart=%s %s\n", exe, strings.Join(args, " ")))
+	sb.WriteString(fmt.Sprintf("WorkingDirectory=%s\n", filepath.Dir(exe)))
+	sb.WriteString("Restart=always\n")
+	sb.WriteString("RestartSec=5\n\n")
+
+	sb.WriteString("[Install]\n")
+	sb.WriteString("WantedBy=default.target\n")
+	return sb.String()
+}
+
+// userUnitPath is where systemd looks for the account's own units.
+func userUnitPath() string {
+	return filepath.Join(xdgDir("XDG_CONFIG_HOME", ".config"), "systemd", "user", "spectre-agent.service")
+}
+
+// userServiceHome is the state directory of a user install.
+func userServiceHome() string {
+	return filepath.Join(xdgDir("XDG_STATE_HOME", filepath.Join(".local", "state")), "spectre-agent")
+}
+
+// xdgDir is an XDG base directory: the variable when it is set to an absolute
+// path, as the spec requires, and its default under the home directory
+// otherwise.
+func xdgDir(env, fallback string) string {
+	if dir := os.Getenv(env); filepath.IsAbs(dir) {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), fallback)
+	}
+	return filepath.Join(home, fallback)
+}
+
+// enableLingering keeps this account's systemd instance running without a
+// login session. Already enabled is fine; otherwise logind may allow it
+// outright or via polkit, or refuse.
+func enableLingering() error {
+	name := currentUserName()
+	if fileExists(filepath.Join("/var/lib/systemd/linger", name)) {
+		return nil
+	}
+	return runCommand("loginctl", "enable-linger", name)
+}
+
+// currentUserName is the account this process runs as. Not $USER, which su
+// and some remote shells leave pointing at someone else.
+func currentUserName() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// userInstallBinary is the binary a user install runs: this one, when the
+// account can replace it, and otherwise a copy in the install's state
+// directory. Unlike a system install, nothing is left behind at the original
+// path, which belongs to root.
+func userInstallBinary(exe string) (string, error) {
+	if checkWritableDir(filepath.Dir(exe)) == nil {
+		return exe, nil
+	}
+	staged := serviceBinaryPath()
+	if exe == staged {
+		return exe, nil
+	}
+	if err := copyExecutable(exe, staged); err != nil {
+		return "", err
+	}
+	fmt.Printf("%s is read-only to you, so the service runs a copy at %s, which it can update.\n", exe, staged)
+	return staged, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// agentStatePath locates a file in the agent's state directory, next to the
+// device key. Anything the agent must remember across restarts lives here.
+func agentStatePath(name string) (string, error) {
+	home := os.Getenv("SPECTRE_AGENT_HOME")
+	if home == "" {
+		var err error
+		home, err = os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(home, ".spectre-agent", name), nil
+}
+
+// writeStateJSON stores v in the state directory, write-then-rename so a crash
+// never leaves a half-written file for the next start to trip over.
+func writeStateJSON(name string, v any) error {
+	path, err := agentStatePath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// readStateJSON loads a file written by writeStateJSON, reporting false when
+// there is none or it cannot be parsed.
+func readStateJSON(name string, v any) bool {
+	path, err := agentStatePath(name)
+	if err != nil {
+		return false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
+
+// removeStateFile deletes a state file; one that is already gone is fine.
+func removeStateFile(name string) error {
+	path, err := agentStatePath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -1,25 +1,28 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"runtime"
 	"strings"
+	"time"
 )
 
 func showStatus() error {
 	fmt.Printf("spectre-agent %s\n\n", getAgentVersion())
 
-	running, info := checkRunning()
-	if running && info != nil {
+	info, running, err := readRunningInstance()
+	switch {
+	case running:
 		fmt.Printf("  Status:    running (pid %d)\n", info.PID)
 		fmt.Printf("  Agent ID:  %s\n", info.AgentID)
 		if info.Host != "" {
 			fmt.Printf("  Server:    %s\n", info.Host)
 		}
-	} else {
+	case err != nil:
+		fmt.Println("  Status:    unknown (permission denied; run as the service's account or with sudo)")
+	default:
 		fmt.Println("  Status:    not running")
 	}
 
@@ -39,40 +42,153 @@ func showStatus() error {
 		}
 	}
 
+	if running && info != nil && found {
+		printConnectionState(filepath.Dir(infoPath), info.PID)
+	}
+	if running {
+		printLiveStatus()
+	}
+
 	if svcStatus := serviceStatus(); svcStatus != "" {
 		fmt.Printf("  Service:   %s\n", svcStatus)
 	}
+	printUnitDrift()
+
+	if found {
+		printConnectionHistory(filepath.Dir(infoPath))
+	}
 	return nil
 }
 
+// checkRunning is readRunningInstance for callers that only act on an agent
+// they found.
 func checkRunning() (bool, *AgentInstanceInfo) {
-	info, err := readExistingInstance(lockFilePath())
-	if err != nil {
-		return false, nil
+	info, ok, _ := readRunningInstance()
+	return ok, info
+}
+
+// serviceStatus names the init system the agent is installed under and what
+// it says of the service. Empty where no init system is supported.
+func serviceStatus() string {
+	if m := installedServiceManager(); m != nil {
+		return fmt.Sprintf("installed (%s, %s)", m.name(), m.state())
 	}
-	if processRunning(info.PID) {
-		return true, info
+	if _, err := detectServiceManager(); err != nil {
+		return ""
 	}
-	return false, nil
+	return "not installed"
 }
 
-func serviceStatus() string {
-	switch runtime.GOOS {
-	case "linux":
-		if _, err := os.Stat(systemdUnitPath); err != nil {
-			return "not installed"
+// printUnitDrift says when the installed systemd unit is not what this version
+// would write, which is the case after an update that changed the unit.
+func printUnitDrift() {
+	if _, ok := installedServiceManager().(systemdService); !ok {
+		return
+	}
+	drift, config, err := systemdUnitDrift()
+	switch {
+	case err != nil:
+		fmt.Printf("  Unit:      cannot compare (%v)\n", err)
+	case len(drift) == 0:
+		fmt.Println("  Unit:      up to date")
+	default:
+		fmt.Println("  Unit:      differs from what this version writes")
+		for _, line := range drift {
+			fmt.Printf("             %s\n", line)
+		}
+		fmt.Println("             Rewrite it, keeping its settings, with:")
+		fmt.Printf("               %s\n", config.upCommand())
+	}
+}
+
+// printConnectionState reports what the running agent last recorded about its
+// link to the server. A record from some other process is stale and ignored.
+func printConnectionState(stateDir string, pid int) {
+	data, err := os.ReadFile(filepath.Join(stateDir, connectionStateFile))
+	if err != nil {
+		return
+	}
+	var state connectionState
+	if json.Unmarshal(data, &state) != nil || state.PID != pid {
+		return
+	}
+	since := time.Unix(state.Since, 0).Format(time.RFC3339)
+	if !state.Connected {
+		fmt.Printf("  Connected: no (since %s)\n", since)
+		if state.LastError != "" {
+			fmt.Printf("  Error:     %s\n", state.LastError)
 		}
-		out, err := exec.Command("systemctl", "is-active", "spectre-agent.service").Output()
-		if err != nil {
-			return "installed (inactive)"
+		return
+	}
+	fmt.Printf("  Connected: yes (since %s)\n", since)
+}
+
+// printLiveStatus adds what only the running agent knows, asked over the
+// admin socket. Without access to the socket — `status` run as another user —
+// the lines are simply left out.
+func printLiveStatus() {
+	resp, err := queryAdmin(adminRequest{Command: "status"})
+	if err != nil || resp.Status == nil {
+		return
+	}
+	live := resp.Status
+	if live.Connection.Connected && live.Connection.RTTMillis > 0 {
+		fmt.Printf("  Latency:   %.1f ms\n", live.Connection.RTTMillis)
+	}
+	fmt.Printf("  Sessions:  %d\n", len(live.Sessions))
+	for _, s := range live.Sessions {
+		state := "detached"
+		if s.Attached {
+			state = "attached"
 		}
-		return "installed (" + strings.TrimSpace(string(out)) + ")"
-	case "darwin":
-		if _, err := os.Stat(launchdPlistPath); err != nil {
-			return "not installed"
+		fmt.Printf("    %s  %s\n", s.ID, state)
+	}
+	if live.Update != "" {
+		fmt.Printf("  Updating:  to %s\n", live.Update)
+	}
+	if len(live.RecentErrors) > 0 {
+		fmt.Println("\n  Recent errors:")
+		for _, e := range live.RecentErrors {
+			fmt.Printf("    %s  %s: %s\n", time.Unix(e.Time, 0).Format("2006-01-02 15:04:05"), e.Context, e.Error)
 		}
-		return "installed"
-	default:
-		return ""
 	}
 }
+
+// statusHistoryLines is how much of the connection history `status` shows.
+const statusHistoryLines = 5
+
+func printConnectionHistory(stateDir string) {
+	data, err := os.ReadFile(filepath.Join(stateDir, connectionHistoryFile))
+	if err != nil {
+		return
+	}
+	var history []connectionEvent
+	if json.Unmarshal(data, &history) != nil || len(history) == 0 {
+		return
+	}
+	if len(history) > statusHistoryLines {
+		history = history[len(history)-statusHistoryLines:]
+	}
+	fmt.Println("\n  Recent connections:")
+	for _, e := range history {
+		fmt.Printf("    %s  %s\n", time.Unix(e.Time, 0).Format("2006-01-02 15:04:05"), describeConnectionEvent(e))
+	}
+}
+
+func describeConnectionEvent(e connectionEvent) string {
+	var b strings.Builder
+	b.WriteString(e.Event)
+	if e.Event == "disconnected" && e.Seconds > 0 {
+		b.WriteString(" after " + (time.Duration(e.Seconds) * time.Second).String())
+	}
+	if e.Count > 1 {
+		fmt.Fprintf(&b, " (%d times)", e.Count)
+	}
+	if e.Server != "" && e.Event == "connected" {
+		b.WriteString(" to " + e.Server)
+	}
+	if e.Reason != "" {
+		b.WriteString(": " + e.Reason)
+	}
+	return b.String()
+}
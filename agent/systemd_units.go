@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Managing the host's other systemd services.
+//
+// Everything goes through systemctl and journalctl rather than D-Bus: they
+// are present wherever systemd is, need no extra dependency, and apply the
+// same polkit rules an operator at the shell would hit. The agent runs as an
+// ordinary account, so starting or stopping a system unit succeeds only where
+// polkit (or running as root) allows it — which is the point.
+
+const (
+	unitQueryTimeout  = 5 * time.Second
+	unitActionTimeout = 2 * time.Minute
+	defaultUnitLines  = 50
+	maxUnitLines      = 1000
+)
+
+var unitActions = map[string]bool{
+	"start": true, "stop": true, "restart": true, "enable": true, "disable": true,
+}
+
+// Unit names as systemd allows them. Checked before anything reaches a
+// command line, so a name can never be read as a flag.
+var unitNamePattern = regexp.MustCompile(`^[A-Za-z0-9:_.@\\-]+$`)
+
+// normalizeUnitName validates a unit name and defaults its type to service,
+// as systemctl itself does.
+func normalizeUnitName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || strings.HasPrefix(name, "-") || !unitNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid unit name %q", name)
+	}
+	if !strings.Contains(name, ".") {
+		name += ".service"
+	}
+	return name, nil
+}
+
+func requireSystemd() error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("systemd is not available on %s", runtime.GOOS)
+	}
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		return fmt.Errorf("systemctl not found; this host does not run systemd")
+	}
+	return nil
+}
+
+// runSystemctl runs a systemctl-family command and returns its stdout, or an
+// error carrying whatever it printed to stderr.
+func runSystemctl(timeout time.Duration, name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		detail := strings.TrimSpace(stderr.String())
+		if detail == "" {
+			detail = err.Error()
+		}
+		return stdout.String(), fmt.Errorf("%s %s: %s", name, strings.Join(args, " "), detail)
+	}
+	return stdout.String(), nil
+}
+
+func listSystemdUnits() ([]UnitInfo, error) {
+	if err := requireSystemd(); err != nil {
+		return nil, err
+	}
+	out, err := runSystemctl(unitQueryTimeout, "systemctl",
+		"list-units", "--type=service", "--all", "--no-legend", "--plain", "--no-pager")
+	if err != nil {
+		return nil, err
+	}
+	return parseUnitList(out), nil
+}
+
+// parseUnitList reads `systemctl list-units --no-legend --plain`, whose
+// columns are UNIT LOAD ACTIVE SUB DESCRIPTION, the last free text.
+func parseUnitList(out string) []UnitInfo {
+	units := make([]UnitInfo, 0)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		// Older systemd marks failed units with a leading "●" even in plain mode.
+		if len(fields) > 0 && fields[0] == "●" {
+			fields = fields[1:]
+		}
+		if len(fields) < 4 {
+			continue
+		}
+		units = append(units, UnitInfo{
+			Name:        fields[0],
+			Load:        fields[1],
+			Active:      fields[2],
+			Sub:         fields[3],
+			Description: strings.Join(fields[4:], " "),
+		})
+	}
+	return units
+}
+
+func systemdUnitStatus(name string, lines int) (UnitStatus, error) {
+	if err := requireSystemd(); err != nil {
+		return UnitStatus{}, err
+	}
+	unit, err := normalizeUnitName(name)
+	if err != nil {
+		return UnitStatus{}, err
+	}
+
+	out, err := runSystemctl(unitQueryTimeout, "systemctl", "show", "--no-pager",
+		"--property=Id,Description,LoadState,ActiveState,SubState,UnitFileState,MainPID,ActiveEnterTimestamp",
+		"--", unit)
+	if err != nil {
+		return UnitStatus{}, err
+	}
+	status := parseUnitShow(out)
+
+	if lines <= 0 {
+		lines = defaultUnitLines
+	}
+	if lines > maxUnitLines {
+		lines = maxUnitLines
+	}
+	// The journal is a nice-to-have here: an account outside systemd-journal
+	// simply sees no lines rather than no status at all.
+	if journal, err := runSystemctl(unitQueryTimeout, "journalctl", "--no-pager", "-o", "short-iso",
+		"-n", strconv.Itoa(lines), "-u", unit); err == nil {
+		for _, line := range strings.Split(strings.TrimRight(journal, "\n"), "\n") {
+			if line != "" {
+				status.Journal = append(status.Journal, line)
+			}
+		}
+	}
+	return status, nil
+}
+
+// parseUnitShow reads the key=value pairs `systemctl show` prints.
+func parseUnitShow(out string) UnitStatus {
+	var status UnitStatus
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "Id":
+			status.Name = value
+		case "Description":
+			status.Description = value
+		case "LoadState":
+			status.Load = value
+		case "ActiveState":
+			status.Active = value
+		case "SubState":
+			status.Sub = value
+		case "UnitFileState":
+			status.UnitFileState = value
+		case "MainPID":
+			status.MainPID, _ = strconv.Atoi(value)
+		case "ActiveEnterTimestamp":
+			status.Since = value
+		}
+	}
+	return status
+}
+
+// runUnitAction starts, stops, restarts, enables or disables a unit.
+//
+// --no-ask-password makes a missing privilege fail at once; without it
+// systemctl would wait for a polkit agent that nobody is there to answer.
+func runUnitAction(name, action string) error {
+	if err := requireSystemd(); err != nil {
+		return err
+	}
+	unit, err := normalizeUnitName(name)
+	if err != nil {
+		return err
+	}
+	if !unitActions[action] {
+		return fmt.Errorf("unsupported unit action %q (use start, stop, restart, enable or disable)", action)
+	}
+	if unit == "spectre-agent.service" && (action == "stop" || action == "disable") {
+		return fmt.Errorf("refusing to %s the agent's own service from the dashboard; use 'spectre-agent down' on the machine", action)
+	}
+	if _, err := runSystemctl(unitActionTimeout, "systemctl", "--no-ask-password", action, "--", unit); err != nil {
+		return err
+	}
+	log.Printf("%s %s at the control server's request", action, unit)
+	return nil
+}
+
+// handleUnitAction services a "unitAction" message. A restart can take as long
+// as the unit's stop timeout, so it runs off the read loop, the same way an
+// update does, and replies when it is finished.
+func handleUnitAction(conn *safeConn, requestID, unit, action string) {
+	go func() {
+		payload := AgentMessage{Type: "unitAction", Unit: unit, Action: action}
+		if err := runUnitAction(unit, action); err != nil {
+			payload.Error = err.Error()
+		}
+		_ = conn.reply(requestID, payload)
+	}()
+}
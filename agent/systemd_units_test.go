@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestParseUnitList(t *testing.T) {
+	out := "cron.service loaded active running Regular background program processing daemon\n" +
+		"● nginx.service loaded failed failed A high performance web server\n" +
+		"\n" +
+		"short line\n"
+
+	units := parseUnitList(out)
+	if len(units) != 2 {
+		t.Fatalf("expected 2 units, got %+v", units)
+	}
+	if units[0].Name != "cron.service" || units[0].Sub != "running" ||
+		units[0].Description != "Regular background program processing daemon" {
+		t.Errorf("unexpected first unit %+v", units[0])
+	}
+	// The failed-unit marker is not part of the name.
+	if units[1].Name != "nginx.service" || units[1].Active != "failed" {
+		t.Errorf("unexpected second unit %+v", units[1])
+	}
+}
+
+func TestParseUnitShow(t *testing.T) {
+	out := "Id=nginx.service\nDescription=A web server\nLoadState=loaded\nActiveState=active\n" +
+		"SubState=running\nUnitFileState=enabled\nMainPID=812\nActiveEnterTimestamp=Mon 2026-10-12 09:00:01 UTC\n"
+
+	status := parseUnitShow(out)
+	if status.Name != "nginx.service" || status.Active != "active" || status.Sub != "running" {
+		t.Errorf("unexpected state %+v", status)
+	}
+	if status.UnitFileState != "enabled" || status.MainPID != 812 {
+		t.Errorf("unexpected unit file state or pid %+v", status)
+	}
+	if status.Since != "Mon 2026-10-12 09:00:01 UTC" {
+		t.Errorf("since = %q", status.Since)
+	}
+}
+
+// Unit names reach a systemctl command line; nothing may be read as a flag.
+func TestNormalizeUnitName(t *testing.T) {
+	cases := map[string]string{
+		"nginx":              "nginx.service",
+		"nginx.service":      "nginx.service",
+		"getty@tty1.service": "getty@tty1.service",
+		"backup.timer":       "backup.timer",
+	}
+	for in, want := range cases {
+		if got, err := normalizeUnitName(in); err != nil || got != want {
+			t.Errorf("normalizeUnitName(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	for _, bad := range []string{"", "--now", "-H", "a b", "x;reboot", "../etc"} {
+		if _, err := normalizeUnitName(bad); err == nil {
+			t.Errorf("normalizeUnitName(%q) should be rejected", bad)
+		}
+	}
+}
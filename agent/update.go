@@ -13,15 +13,20 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/sidhantpanda/spectre/agent/protocol"
 )
 
-// Self-update: fetch the latest release from GitHub and swap this binary for
-// it, in place.
+// Self-update: fetch the latest release from GitHub, the control server or a
+// mirror (update_source.go), verify it against the release signing key
+// (update_verify.go), and swap this binary for it, in place.
 //
 // Enrollment is deliberately untouched. The device key lives in the agent's
 // state directory (SPECTRE_AGENT_HOME, or /var/lib/spectre-agent for the
@@ -41,8 +46,12 @@ const (
 )
 
 type updateOptions struct {
-	// Release to install. Empty means whatever GitHub calls latest.
+	// Release to install. Empty means whatever the source calls latest.
 	tag string
+	// source is where to fetch it, as updateSourceSpec reads it; host is the
+	// control server, for the "server" source.
+	source string
+	host   string
 	// Report what would happen and exit without touching anything.
 	checkOnly bool
 	// Reinstall even when the running version already matches.
@@ -52,6 +61,13 @@ type updateOptions struct {
 	// from inside that service would both duplicate the exit and require root,
 	// which the service account has not got.
 	skipRestart bool
+	// binary is the file to replace, when it is not this process's own.
+	binary string
+	// guard keeps the old binary and records the update as pending, so the new
+	// one is rolled back if it never connects (update_rollback.go). requestID
+	// is the request the rollback report answers.
+	guard     bool
+	requestID string
 }
 
 // Injectable for tests; the real ones talk to github.com and to the init
@@ -66,18 +82,23 @@ var (
 // downloads onto the same binary.
 var updateInProgress atomic.Bool
 
+// updateTarget is the version an in-flight update asked for, for the admin
+// socket's status; empty means the latest.
+var updateTarget atomic.Value
+
 // handleRemoteUpdate services an "update" message from the control server.
 //
 // The work happens on its own goroutine: a download plus a service restart
 // takes far too long to block the socket read loop, which would stall
 // keystrokes and heartbeats and get this machine swept as stale.
 //
-// The "installed" report is best-effort. A successful update restarts the
-// service, which kills this process — often before the message is flushed. The
-// dashboard's real confirmation is the machine reconnecting on a new version.
-func handleRemoteUpdate(conn *safeConn, version string) {
+// Every report goes through the event queue (event_queue.go). A successful
+// update restarts the service, which kills this process, often before the
+// "installed" report is on the wire; the new binary sends it after its first
+// handshake, followed by its own "completed".
+func handleRemoteUpdate(conn *safeConn, requestID, version string) {
 	if !updateInProgress.CompareAndSwap(false, true) {
-		_ = conn.writeJSON(AgentMessage{
+		_ = conn.sendEvent(requestID, AgentMessage{
 			Type: "updateStatus", State: "failed", Version: version,
 			Error: "an update is already in progress",
 		})
@@ -86,31 +107,58 @@ func handleRemoteUpdate(conn *safeConn, version string) {
 
 	go func() {
 		defer updateInProgress.Store(false)
-
 		log.Printf("control server requested an update%s", versionSuffix(version))
-		_ = conn.writeJSON(AgentMessage{Type: "updateStatus", State: "started", Version: version})
-
-		if err := runUpdate(updateOptions{tag: version, skipRestart: true}); err != nil {
-			log.Printf("update failed: %v", err)
-			_ = conn.writeJSON(AgentMessage{
-				Type: "updateStatus", State: "failed", Version: version, Error: err.Error(),
-			})
-			return
-		}
-		_ = conn.writeJSON(AgentMessage{Type: "updateStatus", State: "installed", Version: version})
-
-		// Exiting is how the new binary gets picked up. Both supervisors are
-		// configured to restart us (systemd Restart=always, launchd KeepAlive),
-		// and exiting needs no privileges — asking systemctl or launchctl to
-		// restart the service does, which a non-root service account has not
-		// got. Give the message above a moment to reach the wire first.
-		log.Printf("update installed; exiting so the service manager restarts on the new binary")
-		time.Sleep(500 * time.Millisecond)
-		_ = conn.close()
-		os.Exit(0)
+		// Somebody asked: a release the policy skips since it was rolled
+		// back is theirs to retry, and the policy's again from now on.
+		_ = removeStateFile(rolledBackFile)
+		installUpdate(conn, requestID, version)
 	}()
 }
 
+// installUpdate is an update the service runs on itself, whether the control
+// server asked for it or the update policy (update_policy.go) decided on it.
+// It reports each step to the server and, once the new binary is in place,
+// exits onto it. The caller holds updateInProgress.
+func installUpdate(conn *safeConn, requestID, version string) {
+	updateTarget.Store(version)
+
+	_ = conn.sendEvent(requestID, AgentMessage{Type: "updateStatus", State: "started", Version: version})
+
+	source, host := agentUpdateSource()
+	opts := updateOptions{
+		tag: version, source: source, host: host,
+		skipRestart: true, guard: true, requestID: requestID,
+	}
+	if err := runUpdate(opts); err != nil {
+		log.Printf("update failed: %v", err)
+		recordAgentError("update", err)
+		failure := AgentMessage{Type: "updateStatus", State: "failed", Version: version, Error: err.Error()}
+		if errors.Is(err, errUpdateUnverified) {
+			failure.Code = protocol.CodeUnverified
+		}
+		_ = conn.sendEvent(requestID, failure)
+		return
+	}
+	_ = conn.sendEvent(requestID, AgentMessage{Type: "updateStatus", State: "installed", Version: version})
+	restartOnNewBinary(conn)
+}
+
+// restartOnNewBinary gets the new binary running. A var so a test can install
+// an update without exiting.
+//
+// Exiting is how the new binary gets picked up. Every service manager is
+// configured to restart us (systemd Restart=always, launchd KeepAlive, the
+// supervisors behind the others), and exiting needs no privileges — asking
+// the service manager to restart the service does, which a non-root service
+// account has not got. Give the
+// "installed" report a moment to reach the wire first.
+var restartOnNewBinary = func(conn *safeConn) {
+	log.Printf("update installed; exiting so the service manager restarts on the new binary")
+	time.Sleep(500 * time.Millisecond)
+	_ = conn.close()
+	os.Exit(0)
+}
+
 func versionSuffix(version string) string {
 	if version == "" {
 		return " to the latest release"
@@ -119,6 +167,9 @@ func versionSuffix(version string) string {
 }
 
 func runUpdate(opts updateOptions) error {
+	if opts.binary != "" {
+		return updateBinaryAt(opts.binary, opts)
+	}
 	exe, err := currentExecutablePath()
 	if err != nil {
 		return err
@@ -129,14 +180,18 @@ func runUpdate(opts updateOptions) error {
 // updateBinaryAt is runUpdate with the install location already resolved, so
 // the whole flow can be exercised against a binary that is not this process.
 func updateBinaryAt(exe string, opts updateOptions) error {
-	var err error
 	current := getAgentVersion()
 	fmt.Printf("spectre-agent %s (%s/%s)\n", current, runtime.GOOS, runtime.GOARCH)
 
+	source, err := resolveUpdateSource(updateSourceSpec(opts.source), opts.host)
+	if err != nil {
+		return err
+	}
+
 	target := opts.tag
 	if target == "" {
-		fmt.Println("Checking GitHub for the latest release...")
-		target, err = latestReleaseTag()
+		fmt.Printf("Checking %s for the latest release...\n", source.name)
+		target, err = latestReleaseTag(source, channelStable)
 		if err != nil {
 			return err
 		}
@@ -160,7 +215,16 @@ func updateBinaryAt(exe string, opts updateOptions) error {
 	}
 
 	asset := agentAssetName(runtime.GOOS, runtime.GOARCH)
-	url := fmt.Sprintf("%s/%s/releases/download/%s/%s", updateReleaseBase, updateRepo, target, asset)
+
+	fmt.Println("Checking the release signature...")
+	sums, err := fetchVerifiedChecksums(source, target)
+	if err != nil {
+		return err
+	}
+	digest, ok := sums[asset]
+	if !ok {
+		return unverified("%s is not listed in the signed %s", asset, checksumsAsset)
+	}
 
 	workDir, err := os.MkdirTemp(filepath.Dir(exe), ".spectre-agent-update-")
 	if err != nil {
@@ -169,7 +233,7 @@ func updateBinaryAt(exe string, opts updateOptions) error {
 	defer os.RemoveAll(workDir)
 
 	fmt.Printf("Downloading %s...\n", asset)
-	staged, err := downloadAgentBinary(url, workDir)
+	staged, err := downloadAgentBinary(source, source.releaseDir(target)+"/"+asset, workDir, digest)
 	if err != nil {
 		return err
 	}
@@ -180,7 +244,29 @@ func updateBinaryAt(exe string, opts updateOptions) error {
 		return fmt.Errorf("downloaded binary does not run on this machine: %w", err)
 	}
 
+	// Kept however the update was started, so a bad release can always be
+	// undone by hand; only a guarded update undoes it by itself.
+	previous := previousBinaryPath(exe)
+	if err := copyExecutable(exe, previous); err != nil {
+		return fmt.Errorf("keep the current binary: %w", err)
+	}
+	if opts.guard {
+		if err := writeStateJSON(pendingUpdateFile, pendingUpdate{
+			RequestID: opts.requestID,
+			From:      current,
+			To:        target,
+			Binary:    exe,
+			Previous:  previous,
+			StartedAt: time.Now().Unix(),
+		}); err != nil {
+			return fmt.Errorf("record the pending update: %w", err)
+		}
+	}
+
 	if err := replaceExecutable(exe, staged); err != nil {
+		if opts.guard {
+			_ = removeStateFile(pendingUpdateFile)
+		}
 		return err
 	}
 	fmt.Printf("Installed %s to %s\n", target, exe)
@@ -227,51 +313,180 @@ func sameVersion(a, b string) bool {
 	return norm(a) == norm(b)
 }
 
-// latestReleaseTag asks GitHub which release is current. /releases/latest
-// already excludes drafts and prereleases, so there is nothing to filter.
-func latestReleaseTag() (string, error) {
-	url := fmt.Sprintf("%s/repos/%s/releases/latest", updateAPIBase, updateRepo)
+// releaseVersion is a tag parsed as semver: v1.2.3, v1.2.3-beta.1, and the
+// `git describe` form of a local build, v1.2.3-4-gabc1234, which is ahead of
+// v1.2.3 rather than a prerelease of it.
+type releaseVersion struct {
+	core  [3]int
+	pre   []string
+	ahead bool
+}
+
+var describeSuffix = regexp.MustCompile(`-[0-9]+-g[0-9a-f]+(-dirty)?$`)
+
+func parseReleaseVersion(tag string) (releaseVersion, bool) {
+	var v releaseVersion
+	s := strings.TrimPrefix(strings.TrimSpace(tag), "v")
+	s, _, _ = strings.Cut(s, "+")
+	if loc := describeSuffix.FindStringIndex(s); loc != nil {
+		v.ahead, s = true, s[:loc[0]]
+	}
+	core, pre, hasPre := strings.Cut(s, "-")
+	parts := strings.Split(core, ".")
+	if len(parts) != 3 {
+		return releaseVersion{}, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return releaseVersion{}, false
+		}
+		v.core[i] = n
+	}
+	if hasPre {
+		if pre == "" {
+			return releaseVersion{}, false
+		}
+		v.pre = strings.Split(pre, ".")
+	}
+	return v, true
+}
+
+// compareVersions orders two release tags by semver precedence: negative when
+// a is older, positive when it is newer. ok is false when either is not a
+// release version, a dev build for one, and so cannot be ordered.
+func compareVersions(a, b string) (cmp int, ok bool) {
+	va, okA := parseReleaseVersion(a)
+	vb, okB := parseReleaseVersion(b)
+	if !okA || !okB {
+		return 0, false
+	}
+	for i := range va.core {
+		if c := va.core[i] - vb.core[i]; c != 0 {
+			return c, true
+		}
+	}
+	// A prerelease comes before its release.
+	switch {
+	case len(va.pre) == 0 && len(vb.pre) > 0:
+		return 1, true
+	case len(va.pre) > 0 && len(vb.pre) == 0:
+		return -1, true
+	}
+	for i := 0; i < len(va.pre) && i < len(vb.pre); i++ {
+		if c := comparePrerelease(va.pre[i], vb.pre[i]); c != 0 {
+			return c, true
+		}
+	}
+	if c := len(va.pre) - len(vb.pre); c != 0 {
+		return c, true
+	}
+	switch {
+	case va.ahead && !vb.ahead:
+		return 1, true
+	case !va.ahead && vb.ahead:
+		return -1, true
+	}
+	return 0, true
+}
+
+// comparePrerelease orders one dot-separated prerelease identifier: numbers
+// numerically and below words, words lexically.
+func comparePrerelease(a, b string) int {
+	na, errA := strconv.Atoi(a)
+	nb, errB := strconv.Atoi(b)
+	switch {
+	case errA == nil && errB == nil:
+		return na - nb
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// newReleaseRequest is a GET against an update source, carrying its
+// credential when it has one. net/http drops the Authorization header on a
+// redirect to another host, so the credential never follows a source off to
+// a CDN.
+func newReleaseRequest(source releaseSource, url string) (*http.Request, error) {
 	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "spectre-agent/"+getAgentVersion())
+	if source.credential != "" {
+		req.Header.Set("Authorization", "Bearer "+source.credential)
+	}
+	return req, nil
+}
+
+// latestReleaseTag asks the source which release is current on a channel.
+// GitHub's /releases/latest already excludes drafts and prereleases, and a
+// mirror names one release, so only GitHub's full list, which the beta
+// channel reads, needs filtering.
+func latestReleaseTag(source releaseSource, channel string) (string, error) {
+	url := source.latestURL
+	if channel == channelBeta {
+		url = source.betaURL
+	}
+	req, err := newReleaseRequest(source, url)
 	if err != nil {
 		return "", err
 	}
 	req.Header.Set("Accept", "application/vnd.github+json")
-	req.Header.Set("User-Agent", "spectre-agent/"+getAgentVersion())
 
 	client := &http.Client{Timeout: 30 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("reach GitHub: %w", err)
+		return "", fmt.Errorf("reach %s: %w", source.name, err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests {
-		return "", fmt.Errorf("GitHub rate-limited this machine (HTTP %d); try again later or pass --tag", resp.StatusCode)
-	}
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("GitHub returned HTTP %d looking up the latest release", resp.StatusCode)
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized ||
+		(resp.StatusCode == http.StatusForbidden && source.credential != ""):
+		return "", fmt.Errorf("%s refused %s (HTTP %d)", source.name, source.credentialName(), resp.StatusCode)
+	case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests:
+		return "", fmt.Errorf("%s rate-limited this machine (HTTP %d); try again later or pass --tag", source.name, resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("%s returned HTTP %d looking up the latest release", source.name, resp.StatusCode)
 	}
 
-	var release struct {
+	type release struct {
 		TagName string `json:"tag_name"`
+		Draft   bool   `json:"draft"`
 	}
-	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&release); err != nil {
-		return "", fmt.Errorf("parse GitHub response: %w", err)
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("read the response from %s: %w", source.name, err)
+	}
+	// A list, newest first, or a single release.
+	var releases []release
+	if err := json.Unmarshal(body, &releases); err != nil {
+		var one release
+		if err := json.Unmarshal(body, &one); err != nil {
+			return "", fmt.Errorf("parse the response from %s: %w", source.name, err)
+		}
+		releases = []release{one}
 	}
-	if release.TagName == "" {
-		return "", errors.New("GitHub reported no latest release for this repository")
+	for _, r := range releases {
+		if r.TagName != "" && !r.Draft {
+			return r.TagName, nil
+		}
 	}
-	return release.TagName, nil
+	return "", fmt.Errorf("%s reported no %s release", source.name, channel)
 }
 
-// downloadAgentBinary fetches the release tarball and unpacks the agent out of
-// it into destDir, returning the path to the extracted binary.
-func downloadAgentBinary(url, destDir string) (string, error) {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+// downloadAgentBinary fetches the release tarball, checks it against its
+// signed digest, and only then unpacks the agent out of it into destDir,
+// returning the path to the extracted binary.
+func downloadAgentBinary(source releaseSource, url, destDir, digest string) (string, error) {
+	req, err := newReleaseRequest(source, url)
 	if err != nil {
 		return "", err
 	}
-	req.Header.Set("User-Agent", "spectre-agent/"+getAgentVersion())
 
 	client := &http.Client{Timeout: updateHTTPTimeout}
 	resp, err := client.Do(req)
@@ -288,7 +503,29 @@ func downloadAgentBinary(url, destDir string) (string, error) {
 		return "", fmt.Errorf("download %s: HTTP %d", url, resp.StatusCode)
 	}
 
-	return extractAgentBinary(resp.Body, destDir)
+	archive := filepath.Join(destDir, filepath.Base(url))
+	out, err := os.OpenFile(archive, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return "", fmt.Errorf("write %s: %w", archive, err)
+	}
+	// Bounded so a hostile server cannot fill the disk.
+	_, err = io.Copy(out, io.LimitReader(resp.Body, 512<<20))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("download %s: %w", url, err)
+	}
+	if err := verifyFileSHA256(archive, digest); err != nil {
+		return "", fmt.Errorf("%s: %w", filepath.Base(url), err)
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return extractAgentBinary(f, destDir)
 }
 
 // extractAgentBinary pulls the spectre-agent executable out of a .tar.gz.
@@ -388,16 +625,7 @@ func checkWritableDir(dir string) error {
 // serviceInstalled reports whether an init system is managing this agent, and
 // will therefore start it again when it exits.
 func serviceInstalled() bool {
-	switch runtime.GOOS {
-	case "linux":
-		_, err := os.Stat(systemdUnitPath)
-		return err == nil
-	case "darwin":
-		_, err := os.Stat(launchdPlistPath)
-		return err == nil
-	default:
-		return false
-	}
+	return installedServiceManager() != nil
 }
 
 // handOverToNewBinary gets the running agent onto the binary just installed.
@@ -405,7 +633,7 @@ func serviceInstalled() bool {
 // It signals the agent rather than asking the service manager to restart it:
 // `systemctl restart` needs root, but the CLI and the service run as the same
 // account, so a plain SIGTERM does not. The agent shuts down cleanly on it, and
-// systemd's Restart=always (or launchd's KeepAlive) starts the new binary.
+// the service manager starts the new binary, as it does after any exit.
 // That is what lets `spectre-agent update` work without sudo.
 func handOverToNewBinary() {
 	running, info := checkRunning()
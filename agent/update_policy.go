@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Automatic updates.
+//
+// Off unless an interval is set. The agent then checks its update source on
+// that interval and installs what its channel calls current: the newest
+// stable release, the newest release including betas, or one pinned
+// version. A maintenance window limits installs to certain hours of the
+// local day, and --update-when-idle holds them back while a terminal session
+// is live. The check itself happens any time; only the install waits.
+//
+// Every decision not to install an available update is reported to the
+// control server as updateStatus "deferred", with the reason, once per
+// version and reason rather than on every check. An install is reported
+// exactly as one the dashboard asked for: started, then installed or failed.
+// Neither carries a requestId, which is how the server tells them apart.
+//
+// The policy governs only what the agent does by itself. An update asked for
+// from the dashboard or with `spectre-agent update` is a person's decision
+// and happens at once.
+
+const (
+	channelStable = "stable"
+	channelBeta   = "beta"
+	channelPinned = "pinned"
+
+	// minUpdateInterval keeps a fleet from burning through GitHub's
+	// unauthenticated rate limit, which is per IP and shared with everything
+	// else behind the same NAT.
+	minUpdateInterval = 15 * time.Minute
+)
+
+// How long after startup the first check waits, and how soon a check that
+// could not finish, or an install held back by live sessions, is retried.
+// Vars so tests can shorten them.
+var (
+	autoUpdateFirstCheck = time.Minute
+	autoUpdateRetry      = 5 * time.Minute
+)
+
+type updatePolicy struct {
+	channel string
+	// pin is the version the pinned channel holds.
+	pin string
+	// interval between checks; zero turns automatic updates off.
+	interval time.Duration
+	window   maintenanceWindow
+	// whenIdle holds installs back while any session is live.
+	whenIdle bool
+}
+
+// updatePolicyFlags are the flags behind an updatePolicy, shared by every
+// command that runs the agent.
+type updatePolicyFlags struct {
+	channel, pin, window string
+	interval             time.Duration
+	whenIdle             bool
+}
+
+func addUpdatePolicyFlags(cmd *cobra.Command, f *updatePolicyFlags) {
+	cmd.Flags().StringVar(&f.channel, "update-channel", channelStable, `Release channel for automatic updates: "stable", "beta" or "pinned"`)
+	cmd.Flags().StringVar(&f.pin, "update-pin", "", "Version the pinned channel holds, e.g. v1.2.3. Implies --update-channel pinned")
+	cmd.Flags().DurationVar(&f.interval, "update-interval", 0, "Check for updates this often and install them, e.g. 6h. 0 turns automatic updates off")
+	cmd.Flags().StringVar(&f.window, "update-window", "", "Install automatic updates only between these local times, e.g. 02:00-05:00")
+	cmd.Flags().BoolVar(&f.whenIdle, "update-when-idle", false, "Never install an automatic update while a terminal session is live")
+}
+
+// policy validates the flags.
+func (f updatePolicyFlags) policy() (updatePolicy, error) {
+	p := updatePolicy{channel: f.channel, pin: strings.TrimSpace(f.pin), interval: f.interval, whenIdle: f.whenIdle}
+	if p.pin != "" {
+		if p.channel != channelStable && p.channel != channelPinned {
+			return p, fmt.Errorf("--update-pin holds one version, so it cannot go with --update-channel %s", p.channel)
+		}
+		p.channel = channelPinned
+	}
+	switch p.channel {
+	case channelStable, channelBeta:
+	case channelPinned:
+		if p.pin == "" {
+			return p, fmt.Errorf("--update-channel pinned needs --update-pin with the version to hold")
+		}
+	default:
+		return p, fmt.Errorf("unknown update channel %q: use %q, %q or %q", p.channel, channelStable, channelBeta, channelPinned)
+	}
+	if p.interval < 0 || (p.interval > 0 && p.interval < minUpdateInterval) {
+		return p, fmt.Errorf("--update-interval must be 0 or at least %s", minUpdateInterval)
+	}
+	var err error
+	if p.window, err = parseMaintenanceWindow(f.window); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// args are the flags that reproduce the policy, for the service's command
+// line. Defaults are left out.
+func (p updatePolicy) args() []string {
+	var args []string
+	switch p.channel {
+	case channelBeta:
+		args = append(args, "--update-channel=beta")
+	case channelPinned:
+		args = append(args, "--update-pin="+p.pin)
+	}
+	if p.interval > 0 {
+		args = append(args, "--update-interval="+p.interval.String())
+	}
+	if p.window.set {
+		args = append(args, "--update-window="+p.window.String())
+	}
+	if p.whenIdle {
+		args = append(args, "--update-when-idle")
+	}
+	return args
+}
+
+// maintenanceWindow is a span of the local day, in minutes after midnight.
+// One that ends before it starts runs across midnight. The zero value, unset,
+// is the whole day.
+type maintenanceWindow struct {
+	start, end int
+	set        bool
+}
+
+func parseMaintenanceWindow(s string) (maintenanceWindow, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return maintenanceWindow{}, nil
+	}
+	from, to, ok := strings.Cut(s, "-")
+	start, err1 := parseClock(from)
+	end, err2 := parseClock(to)
+	if !ok || err1 != nil || err2 != nil || start == end {
+		return maintenanceWindow{}, fmt.Errorf("invalid --update-window %q: want HH:MM-HH:MM in local time, e.g. 02:00-05:00", s)
+	}
+	return maintenanceWindow{start: start, end: end, set: true}, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w maintenanceWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.start/60, w.start%60, w.end/60, w.end%60)
+}
+
+// contains reports whether t falls inside the window.
+func (w maintenanceWindow) contains(t time.Time) bool {
+	if !w.set {
+		return true
+	}
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
+
+// nextOpen is when the window next opens after t.
+func (w maintenanceWindow) nextOpen(t time.Time) time.Time {
+	open := time.Date(t.Year(), t.Month(), t.Day(), w.start/60, w.start%60, 0, 0, t.Location())
+	if !open.After(t) {
+		open = open.AddDate(0, 0, 1)
+	}
+	return open
+}
+
+// autoUpdateDecision is what one check decided about an available update.
+type autoUpdateDecision struct {
+	install bool
+	// reason says why not, when it does not install.
+	reason string
+	// retry is when to look again, zero meaning the policy's interval.
+	retry time.Duration
+}
+
+// decideAutoUpdate applies the policy to an available update. current and
+// target differ by the time it is called.
+func decideAutoUpdate(p updatePolicy, now time.Time, liveSessions int) autoUpdateDecision {
+	if !p.window.contains(now) {
+		open := p.window.nextOpen(now)
+		return autoUpdateDecision{
+			reason: fmt.Sprintf("outside the maintenance window %s; next opens %s", p.window, open.Format("Mon 15:04")),
+			retry:  open.Sub(now),
+		}
+	}
+	if p.whenIdle && liveSessions > 0 {
+		return autoUpdateDecision{
+			reason: fmt.Sprintf("%d terminal session(s) are live", liveSessions),
+			retry:  autoUpdateRetry,
+		}
+	}
+	return autoUpdateDecision{install: true}
+}
+
+// autoUpdater runs the policy for the life of the agent. With no interval
+// it only waits, in case a reload turns automatic updates on.
+type autoUpdater struct {
+	ctl    *agentControl
+	policy updatePolicy
+	// reported is the last deferral sent, so an unchanged one is not
+	// repeated on every check.
+	reported string
+	// reloaded hands run a new policy. Only run touches policy.
+	reloaded chan updatePolicy
+}
+
+func newAutoUpdater(ctl *agentControl, policy updatePolicy) *autoUpdater {
+	return &autoUpdater{ctl: ctl, policy: policy, reloaded: make(chan updatePolicy, 1)}
+}
+
+// setPolicy replaces the policy, starting its schedule over. A policy not
+// yet taken up is superseded.
+func (u *autoUpdater) setPolicy(p updatePolicy) {
+	select {
+	case <-u.reloaded:
+	default:
+	}
+	u.reloaded <- p
+}
+
+func (u *autoUpdater) run(ctx context.Context) {
+	if u.policy.interval > 0 {
+		u.logPolicy()
+	}
+	wait := autoUpdateFirstCheck
+	for {
+		timer := time.NewTimer(wait)
+		due := timer.C
+		if u.policy.interval <= 0 {
+			due = nil
+		}
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case u.policy = <-u.reloaded:
+			timer.Stop()
+			u.reported = ""
+			u.logPolicy()
+			wait = autoUpdateFirstCheck
+			continue
+		case <-due:
+		}
+		wait = u.check()
+		if wait <= 0 {
+			wait = u.policy.interval
+		}
+	}
+}
+
+func (u *autoUpdater) logPolicy() {
+	if u.policy.interval <= 0 {
+		log.Printf("automatic updates: off")
+		return
+	}
+	log.Printf("automatic updates: %s channel, every %s%s", u.policy.describeChannel(), u.policy.interval, u.policy.describeLimits())
+}
+
+// check looks for an update once and acts on it. It returns how long to wait
+// before the next check, zero meaning the policy's interval.
+func (u *autoUpdater) check() time.Duration {
+	// Reports need the connection, and a release from the control server
+	// needs it up anyway.
+	conn := u.ctl.currentConn()
+	if conn == nil {
+		return autoUpdateRetry
+	}
+
+	current := getAgentVersion()
+	target := u.policy.pin
+	if u.policy.channel != channelPinned {
+		spec, host := agentUpdateSource()
+		source, err := resolveUpdateSource(updateSourceSpec(spec), host)
+		if err == nil {
+			target, err = latestReleaseTag(source, u.policy.channel)
+		}
+		if err != nil {
+			log.Printf("automatic update check failed: %v", err)
+			recordAgentError("auto-update", err)
+			return autoUpdateRetry
+		}
+	}
+	if sameVersion(current, target) {
+		return 0
+	}
+	// A pin is held whichever way it lies. A channel only moves forward: a
+	// stable machine running a beta, or a local build, is ahead of "latest".
+	if u.policy.channel != channelPinned {
+		cmp, ok := compareVersions(target, current)
+		if !ok {
+			u.deferUpdate(conn, target, fmt.Sprintf("%s cannot be ordered against %s; a local build is only replaced by hand", current, target))
+			return 0
+		}
+		if cmp <= 0 {
+			return 0
+		}
+	}
+	if reason, ok := rolledBack(target); ok {
+		u.deferUpdate(conn, target, fmt.Sprintf("rolled back on this machine (%s); skipped until a newer release, or an update asked for from the dashboard", reason))
+		return 0
+	}
+
+	decision := decideAutoUpdate(u.policy, time.Now(), len(u.ctl.sessions.activeSessions()))
+	if !decision.install {
+		u.deferUpdate(conn, target, decision.reason)
+		return decision.retry
+	}
+
+	if !updateInProgress.CompareAndSwap(false, true) {
+		return autoUpdateRetry
+	}
+	defer updateInProgress.Store(false)
+	u.reported = ""
+	log.Printf("installing %s from the %s channel", target, u.policy.channel)
+	installUpdate(conn, "", target)
+	// Still here: the install failed and was reported. Try again on the
+	// next interval rather than hammering a broken release.
+	return 0
+}
+
+// deferUpdate reports that target is not being installed yet, unless the
+// same deferral was the last one reported.
+func (u *autoUpdater) deferUpdate(conn *safeConn, target, reason string) {
+	if report := target + ": " + reason; report != u.reported {
+		log.Printf("update to %s deferred: %s", target, reason)
+		// Queued if the link is down, so it counts as reported.
+		_ = conn.sendEvent("", AgentMessage{Type: "updateStatus", State: "deferred", Version: target, Reason: reason})
+		u.reported = report
+	}
+}
+
+func (p updatePolicy) describeChannel() string {
+	if p.channel == channelPinned {
+		return "pinned to " + p.pin
+	}
+	return p.channel
+}
+
+func (p updatePolicy) describeLimits() string {
+	var limits []string
+	if p.window.set {
+		limits = append(limits, "installing between "+p.window.String())
+	}
+	if p.whenIdle {
+		limits = append(limits, "never while a session is live")
+	}
+	if len(limits) == 0 {
+		return ""
+	}
+	return ", " + strings.Join(limits, ", ")
+}
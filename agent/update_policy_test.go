@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindow(t *testing.T) {
+	at := func(clock string) time.Time {
+		c, _ := time.Parse("15:04", clock)
+		return time.Date(2026, 3, 14, c.Hour(), c.Minute(), 0, 0, time.Local)
+	}
+
+	night, err := parseMaintenanceWindow("23:00-02:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for clock, want := range map[string]bool{"22:59": false, "23:00": true, "01:30": true, "02:00": false, "12:00": false} {
+		if got := night.contains(at(clock)); got != want {
+			t.Errorf("23:00-02:00 contains %s = %v, want %v", clock, got, want)
+		}
+	}
+	if open := night.nextOpen(at("12:00")); !open.Equal(at("23:00")) {
+		t.Errorf("next open after noon = %v", open)
+	}
+	if open := night.nextOpen(at("23:30")); !open.Equal(at("23:00").AddDate(0, 0, 1)) {
+		t.Errorf("next open after 23:30 = %v, want tomorrow's", open)
+	}
+
+	if !(maintenanceWindow{}).contains(at("12:00")) {
+		t.Error("no window should mean any time")
+	}
+	for _, bad := range []string{"2-5", "02:00", "02:00-02:00", "25:00-03:00"} {
+		if _, err := parseMaintenanceWindow(bad); err == nil {
+			t.Errorf("parseMaintenanceWindow(%q) accepted", bad)
+		}
+	}
+}
+
+func TestUpdatePolicyFlags(t *testing.T) {
+	p, err := updatePolicyFlags{channel: channelStable, pin: "v1.2.3", interval: time.Hour, window: "02:00-05:00", whenIdle: true}.policy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.channel != channelPinned {
+		t.Fatalf("a pin left the channel at %s", p.channel)
+	}
+	want := "--update-pin=v1.2.3 --update-interval=1h0m0s --update-window=02:00-05:00 --update-when-idle"
+	if got := strings.Join(p.args(), " "); got != want {
+		t.Fatalf("args = %s, want %s", got, want)
+	}
+
+	for name, f := range map[string]updatePolicyFlags{
+		"unknown channel":  {channel: "nightly"},
+		"pinned, no pin":   {channel: channelPinned},
+		"beta with a pin":  {channel: channelBeta, pin: "v1.2.3"},
+		"interval too low": {channel: channelStable, interval: time.Minute},
+	} {
+		if _, err := f.policy(); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	if args := (updatePolicy{channel: channelStable}).args(); len(args) != 0 {
+		t.Errorf("the default policy was spelled out: %v", args)
+	}
+}
+
+func TestDecideAutoUpdate(t *testing.T) {
+	noon := time.Date(2026, 3, 14, 12, 0, 0, 0, time.Local)
+	night, _ := parseMaintenanceWindow("02:00-05:00")
+
+	if d := decideAutoUpdate(updatePolicy{}, noon, 3); !d.install {
+		t.Errorf("no limits: %+v", d)
+	}
+	d := decideAutoUpdate(updatePolicy{window: night}, noon, 0)
+	if d.install || !strings.Contains(d.reason, "maintenance window") || d.retry != 14*time.Hour {
+		t.Errorf("outside the window: %+v", d)
+	}
+	d = decideAutoUpdate(updatePolicy{whenIdle: true}, noon, 2)
+	if d.install || !strings.Contains(d.reason, "2 terminal session(s)") {
+		t.Errorf("sessions live: %+v", d)
+	}
+	if d := decideAutoUpdate(updatePolicy{whenIdle: true}, noon, 0); !d.install {
+		t.Errorf("idle: %+v", d)
+	}
+}
+
+func TestLatestReleaseTagOnTheBetaChannel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/releases") {
+			t.Errorf("beta read %s, want the release list", r.URL.Path)
+		}
+		fmt.Fprint(w, `[{"tag_name":"v2.0.0","draft":true},{"tag_name":"v2.0.0-beta.1","prerelease":true},{"tag_name":"v1.9.0"}]`)
+	}))
+	defer srv.Close()
+	old := updateAPIBase
+	updateAPIBase = srv.URL
+	defer func() { updateAPIBase = old }()
+
+	source, _ := resolveUpdateSource(updateSourceGitHub, "")
+	tag, err := latestReleaseTag(source, channelBeta)
+	if err != nil || tag != "v2.0.0-beta.1" {
+		t.Fatalf("latestReleaseTag = %q, %v; want the newest release that is not a draft", tag, err)
+	}
+}
+
+// withAgentVersion makes this process report version for the test.
+func withAgentVersion(t *testing.T, version string) {
+	t.Helper()
+	old := getAgentVersion()
+	agentVersion = version
+	t.Cleanup(func() { agentVersion = old })
+}
+
+// autoUpdaterAgainst is an updater whose update source is a mirror offering
+// v9.9.9, connected to a recorder. The agent runs v1.0.0.
+func autoUpdaterAgainst(t *testing.T, policy updatePolicy) (*autoUpdater, <-chan AgentMessage) {
+	t.Helper()
+	withAgentVersion(t, "v1.0.0")
+	enrolledInstall(t)
+	srv := serveMirror(t, "", "v9.9.9", "", nil)
+	oldSource, oldHost := agentUpdateSource()
+	oldKey := releasePublicKey
+	setAgentUpdateSource(srv.URL, "")
+	releasePublicKey = ""
+	t.Cleanup(func() {
+		setAgentUpdateSource(oldSource, oldHost)
+		releasePublicKey = oldKey
+	})
+
+	conn, replies := replyRecorder(t)
+	ctl := newAgentControl()
+	ctl.setConn(conn)
+	return newAutoUpdater(ctl, policy), replies
+}
+
+func TestAutoUpdateOutsideTheWindowIsDeferredAndReportedOnce(t *testing.T) {
+	// A window that is certainly closed now: it opens in two hours.
+	start := (time.Now().Hour()*60 + time.Now().Minute() + 120) % (24 * 60)
+	closed := maintenanceWindow{start: start, end: (start + 60) % (24 * 60), set: true}
+	u, replies := autoUpdaterAgainst(t, updatePolicy{channel: channelStable, interval: time.Hour, window: closed})
+
+	if retry := u.check(); retry <= time.Hour || retry > 2*time.Hour {
+		t.Errorf("retry in %s, want when the window opens", retry)
+	}
+	msg := nextReply(t, replies)
+	if msg.Type != "updateStatus" || msg.State != "deferred" || msg.Version != "v9.9.9" ||
+		msg.RequestID != "" || !strings.Contains(msg.Reason, "maintenance window") {
+		t.Fatalf("report = %+v", msg)
+	}
+
+	u.check()
+	select {
+	case msg := <-replies:
+		t.Fatalf("the same deferral was reported again: %+v", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// An install the policy allows goes the way a dashboard update does. This
+// build has no signing key, so it stops at verification, before touching the
+// binary, and reports the failure.
+func TestAutoUpdateReportsTheInstallOutcome(t *testing.T) {
+	u, replies := autoUpdaterAgainst(t, updatePolicy{channel: channelStable, interval: time.Hour})
+
+	if retry := u.check(); retry != 0 {
+		t.Errorf("retry in %s after a failed install, want the next interval", retry)
+	}
+	started, failed := nextReply(t, replies), nextReply(t, replies)
+	if started.State != "started" || started.Version != "v9.9.9" || started.RequestID != "" {
+		t.Fatalf("first report = %+v", started)
+	}
+	if failed.State != "failed" || failed.Error == "" {
+		t.Fatalf("second report = %+v", failed)
+	}
+	if updateInProgress.Load() {
+		t.Fatal("the update slot was not released")
+	}
+}
+
+func TestAutoUpdateStaysOnItsPin(t *testing.T) {
+	u, replies := autoUpdaterAgainst(t, updatePolicy{channel: channelPinned, pin: "v1.0.0", interval: time.Hour})
+
+	u.check()
+	select {
+	case msg := <-replies:
+		t.Fatalf("a machine on its pinned version did something: %+v", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// A release that was rolled back here is not installed again by the policy,
+// until somebody asks for it.
+func TestAutoUpdateSkipsARolledBackRelease(t *testing.T) {
+	u, replies := autoUpdaterAgainst(t, updatePolicy{channel: channelStable, interval: time.Hour})
+	if err := writeStateJSON(rolledBackFile, rolledBackRelease{Version: "v9.9.9", Reason: "v9.9.9 did not connect within 5m0s"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if retry := u.check(); retry != 0 {
+		t.Errorf("retry in %s, want the next interval", retry)
+	}
+	msg := nextReply(t, replies)
+	if msg.State != "deferred" || msg.Version != "v9.9.9" || !strings.Contains(msg.Reason, "rolled back") {
+		t.Fatalf("report = %+v", msg)
+	}
+	u.check()
+	select {
+	case msg := <-replies:
+		t.Fatalf("the skipped release was reported again: %+v", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// An update asked for from the dashboard is attempted, and hands the
+	// release back to the policy.
+	handleRemoteUpdate(u.ctl.currentConn(), "u1", "v9.9.9")
+	if msg := nextReply(t, replies); msg.State != "started" || msg.RequestID != "u1" {
+		t.Fatalf("report = %+v", msg)
+	}
+	nextReply(t, replies)
+	for updateInProgress.Load() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := rolledBack("v9.9.9"); ok {
+		t.Fatal("still skipped after an update was asked for")
+	}
+	u.check()
+	if msg := nextReply(t, replies); msg.State != "started" || msg.RequestID != "" {
+		t.Fatalf("report = %+v", msg)
+	}
+	nextReply(t, replies)
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"v1.2.3", "1.2.3", 0},
+		{"v1.2.10", "v1.2.9", 1},
+		{"v2.0.0", "v10.0.0", -1},
+		{"v2.0.0-beta.1", "v2.0.0", -1},
+		{"v2.0.0-beta.2", "v2.0.0-beta.10", -1},
+		{"v2.0.0-beta.1", "v2.0.0-alpha.9", 1},
+		{"v2.0.0-rc.1", "v2.0.0-rc.1.1", -1},
+		{"v1.2.3-4-gabc1234", "v1.2.3", 1},
+		{"v1.2.3-4-gabc1234-dirty", "v1.2.4", -1},
+		{"v2.0.0-beta.1-2-gabc1234", "v2.0.0-beta.1", 1},
+	} {
+		cmp, ok := compareVersions(tc.a, tc.b)
+		if !ok || (cmp > 0) != (tc.want > 0) || (cmp < 0) != (tc.want < 0) {
+			t.Errorf("compareVersions(%q, %q) = %d, %v; want the sign of %d", tc.a, tc.b, cmp, ok, tc.want)
+		}
+	}
+	for _, bad := range []string{"dev-1700000000", "", "v1.2", "latest"} {
+		if _, ok := compareVersions(bad, "v1.0.0"); ok {
+			t.Errorf("%q was ordered", bad)
+		}
+	}
+}
+
+// A channel only moves forward. A stable machine running a newer beta, or a
+// local build, is left alone rather than taken back to the latest release.
+func TestAutoUpdateNeverDowngrades(t *testing.T) {
+	u, replies := autoUpdaterAgainst(t, updatePolicy{channel: channelStable, interval: time.Hour})
+
+	withAgentVersion(t, "v10.0.0-beta.1")
+	u.check()
+	assertNoMoreEvents(t, replies)
+
+	withAgentVersion(t, "v9.9.9-3-gabc1234")
+	u.check()
+	assertNoMoreEvents(t, replies)
+
+	withAgentVersion(t, "dev-1700000000")
+	u.check()
+	if msg := nextReply(t, replies); msg.State != "deferred" || !strings.Contains(msg.Reason, "local build") {
+		t.Fatalf("report = %+v", msg)
+	}
+	assertNoMoreEvents(t, replies)
+
+	// A pin is held either way: a machine ahead of it goes back to it.
+	u.policy = updatePolicy{channel: channelPinned, pin: "v9.9.9", interval: time.Hour}
+	withAgentVersion(t, "v10.0.0")
+	u.check()
+	if msg := nextReply(t, replies); msg.State != "started" || msg.Version != "v9.9.9" {
+		t.Fatalf("report = %+v", msg)
+	}
+	nextReply(t, replies)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Automatic rollback of a remote update.
+//
+// Before a remote update swaps the binary it copies the old one alongside, to
+// <binary>.previous, and records the update as pending in the state
+// directory. The new binary, when it starts, finds the record and has until
+// the grace period runs out — counted from the install — to complete a
+// control handshake. A handshake confirms the update and clears the record.
+// Failing that, or starting too many times without getting there (a crash
+// loop under Restart=always), it puts the previous binary back and exits, so
+// the service manager starts the old version again. The old version finds
+// the record marked rolled back and reports it on its first handshake.
+//
+// Either way the record is how the server hears how the update ended: the
+// "installed" report goes out just before the old process exits, so it says
+// nothing about whether the new one ever ran. The binary that completes the
+// first handshake after the update reports "completed" with its version, or
+// "mismatch" if it is neither the version installed nor the one it replaced,
+// or "rolledBack". The record is cleared only once that report is sent.
+//
+// A binary that dies before it gets as far as reading the record cannot roll
+// itself back; the smoke test before install is what catches those.
+//
+// A rolled-back release is remembered after its record is gone, so the update
+// policy (update_policy.go) does not install it again on its next check and
+// put the machine through the same failure every interval. It is skipped until
+// a newer release appears, or somebody asks for an update from the dashboard.
+//
+// Only updates the service runs on itself are guarded. The new binary has to
+// be started with the same state directory as the process that installed it,
+// which is only certain when they are the same service.
+
+const (
+	pendingUpdateFile = "update-pending.json"
+	rolledBackFile    = "update-rolled-back.json"
+	// maxUpdateStarts is how many starts a new binary gets to connect before
+	// it is judged to be crash-looping.
+	maxUpdateStarts = 3
+)
+
+// How long a new binary has to connect. Long enough for a slow network to
+// come up after the restart, short enough that a broken release does not
+// leave a machine dark for long. A var so tests can shorten it.
+var updateGracePeriod = 5 * time.Minute
+
+// exitAfterRollback hands over to the restored binary. A seam: a test must
+// not exit.
+var exitAfterRollback = func() { os.Exit(1) }
+
+type pendingUpdate struct {
+	// RequestID is the "update" request's, echoed on the rollback report.
+	RequestID string `json:"requestId,omitempty"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	// Binary is the path the update replaced; Previous is the old binary,
+	// kept beside it.
+	Binary    string `json:"binary"`
+	Previous  string `json:"previous"`
+	StartedAt int64  `json:"startedAt"`
+	// Starts counts how often the new binary has started without connecting.
+	Starts int `json:"starts,omitempty"`
+	// RolledBack is set once the previous binary is back, with Reason saying
+	// why, until the old version reports it.
+	RolledBack bool   `json:"rolledBack,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+var (
+	updateGuardMu sync.Mutex
+	// updateGuardTimer is the running grace period, nil when none is.
+	updateGuardTimer *time.Timer
+)
+
+// rolledBackRelease is the last release that was rolled back.
+type rolledBackRelease struct {
+	Version string `json:"version"`
+	Reason  string `json:"reason"`
+}
+
+func rememberRollback(pending pendingUpdate) {
+	if err := writeStateJSON(rolledBackFile, rolledBackRelease{Version: pending.To, Reason: pending.Reason}); err != nil {
+		log.Printf("warning: could not record %s as rolled back: %v", pending.To, err)
+	}
+}
+
+// rolledBack reports whether version is the release last rolled back here,
+// and why it was.
+func rolledBack(version string) (string, bool) {
+	var release rolledBackRelease
+	if !readStateJSON(rolledBackFile, &release) || !sameVersion(release.Version, version) {
+		return "", false
+	}
+	return release.Reason, true
+}
+
+// previousBinaryPath is where the binary an update replaces is kept.
+func previousBinaryPath(exe string) string {
+	return exe + ".previous"
+}
+
+// armUpdateGuard runs at startup. When this process is the new binary of a
+// pending update, it counts the start and starts the grace period.
+func armUpdateGuard(version string) {
+	var pending pendingUpdate
+	if !readStateJSON(pendingUpdateFile, &pending) || pending.RolledBack {
+		return
+	}
+	if !sameVersion(version, pending.To) {
+		if sameVersion(version, pending.From) {
+			// Back on the old version without this code having done it: the
+			// binary was restored by hand.
+			pending.RolledBack = true
+			pending.Reason = "the previous version was restored before the update connected"
+			_ = writeStateJSON(pendingUpdateFile, pending)
+		}
+		return
+	}
+
+	pending.Starts++
+	if pending.Starts > maxUpdateStarts {
+		rollBackUpdate(pending, fmt.Sprintf("%s started %d times without connecting", pending.To, pending.Starts-1))
+		return
+	}
+	if err := writeStateJSON(pendingUpdateFile, pending); err != nil {
+		log.Printf("warning: could not record the pending update: %v", err)
+	}
+
+	remaining := time.Until(time.Unix(pending.StartedAt, 0).Add(updateGracePeriod))
+	log.Printf("running %s on probation: it must reach the control server within %s or %s is restored",
+		pending.To, remaining.Round(time.Second), pending.From)
+	updateGuardMu.Lock()
+	updateGuardTimer = time.AfterFunc(max(remaining, 0), func() {
+		updateGuardMu.Lock()
+		fired := updateGuardTimer != nil
+		updateGuardTimer = nil
+		updateGuardMu.Unlock()
+		if fired {
+			rollBackUpdate(pending, fmt.Sprintf("%s did not connect within %s", pending.To, updateGracePeriod))
+		}
+	})
+	updateGuardMu.Unlock()
+}
+
+// rollBackUpdate restores the previous binary and exits onto it.
+func rollBackUpdate(pending pendingUpdate, reason string) {
+	log.Printf("update failed: %s; restoring %s", reason, pending.From)
+	if err := replaceExecutable(pending.Binary, pending.Previous); err != nil {
+		log.Printf("rollback failed: %v", err)
+		recordAgentError("rollback", err)
+		return
+	}
+	pending.RolledBack = true
+	pending.Reason = reason
+	if err := writeStateJSON(pendingUpdateFile, pending); err != nil {
+		log.Printf("warning: could not record the rollback: %v", err)
+	}
+	rememberRollback(pending)
+	exitAfterRollback()
+}
+
+// confirmPendingUpdate runs after every handshake and reports how a pending
+// update ended: confirmed by the new binary, rolled back, or overtaken by some
+// other version.
+func confirmPendingUpdate(conn *safeConn, version string) {
+	var pending pendingUpdate
+	if !readStateJSON(pendingUpdateFile, &pending) {
+		return
+	}
+
+	// Reports go through the event queue, which keeps them until the server
+	// has them, so the record can go as soon as one is queued.
+	if pending.RolledBack {
+		// Again, for a binary restored by hand, which rollBackUpdate never saw.
+		rememberRollback(pending)
+		_ = conn.sendEvent(pending.RequestID, AgentMessage{
+			Type: "updateStatus", State: "rolledBack", Version: pending.To, Error: pending.Reason,
+		})
+		log.Printf("reported the rollback from %s", pending.To)
+		_ = removeStateFile(pendingUpdateFile)
+		return
+	}
+	if sameVersion(version, pending.From) {
+		// The process that installed the update, reconnecting in the moment
+		// before it exits.
+		return
+	}
+
+	report := AgentMessage{Type: "updateStatus", State: "completed", Version: version}
+	if sameVersion(version, pending.To) {
+		updateGuardMu.Lock()
+		if updateGuardTimer != nil {
+			updateGuardTimer.Stop()
+			updateGuardTimer = nil
+		}
+		updateGuardMu.Unlock()
+	} else {
+		report.State = "mismatch"
+		report.Error = fmt.Sprintf("the update installed %s, but %s is running", pending.To, version)
+	}
+	_ = conn.sendEvent(pending.RequestID, report)
+	if report.State == "completed" {
+		log.Printf("update to %s confirmed", pending.To)
+	} else {
+		log.Printf("update to %s was overtaken: %s is running", pending.To, version)
+	}
+	_ = removeStateFile(pendingUpdateFile)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seedPendingUpdate installs "new" over a binary whose previous version,
+// "old", is kept alongside, as a guarded update leaves things.
+func seedPendingUpdate(t *testing.T, pending pendingUpdate) (string, <-chan struct{}) {
+	t.Helper()
+	t.Setenv("SPECTRE_AGENT_HOME", t.TempDir())
+	exe := filepath.Join(t.TempDir(), "spectre-agent")
+	if err := os.WriteFile(exe, []byte("new"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(previousBinaryPath(exe), []byte("old"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	pending.Binary, pending.Previous = exe, previousBinaryPath(exe)
+	if pending.StartedAt == 0 {
+		pending.StartedAt = time.Now().Unix()
+	}
+	if err := writeStateJSON(pendingUpdateFile, pending); err != nil {
+		t.Fatal(err)
+	}
+
+	exited := make(chan struct{}, 1)
+	oldExit, oldGrace := exitAfterRollback, updateGracePeriod
+	exitAfterRollback = func() { exited <- struct{}{} }
+	t.Cleanup(func() {
+		exitAfterRollback, updateGracePeriod = oldExit, oldGrace
+		updateGuardMu.Lock()
+		if updateGuardTimer != nil {
+			updateGuardTimer.Stop()
+			updateGuardTimer = nil
+		}
+		updateGuardMu.Unlock()
+	})
+	return exe, exited
+}
+
+func assertRolledBack(t *testing.T, exe string) {
+	t.Helper()
+	if body, _ := os.ReadFile(exe); string(body) != "old" {
+		t.Fatalf("binary holds %q, want the previous one back", body)
+	}
+	var pending pendingUpdate
+	if !readStateJSON(pendingUpdateFile, &pending) || !pending.RolledBack || pending.Reason == "" {
+		t.Fatalf("pending update = %+v, want it marked rolled back with a reason", pending)
+	}
+	if _, ok := rolledBack(pending.To); !ok {
+		t.Fatalf("%s is not remembered as rolled back", pending.To)
+	}
+}
+
+func TestUpdateRollsBackWhenTheNewBinaryNeverConnects(t *testing.T) {
+	exe, exited := seedPendingUpdate(t, pendingUpdate{From: "v1.0.0", To: "v2.0.0"})
+	updateGracePeriod = 50 * time.Millisecond
+
+	armUpdateGuard("v2.0.0")
+	select {
+	case <-exited:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the grace period ran out without a rollback")
+	}
+	assertRolledBack(t, exe)
+}
+
+func TestUpdateRollsBackACrashLoop(t *testing.T) {
+	exe, exited := seedPendingUpdate(t, pendingUpdate{From: "v1.0.0", To: "v2.0.0", Starts: maxUpdateStarts})
+
+	armUpdateGuard("v2.0.0")
+	select {
+	case <-exited:
+	default:
+		t.Fatal("a binary past its start limit was not rolled back")
+	}
+	assertRolledBack(t, exe)
+}
+
+func TestHandshakeConfirmsTheUpdate(t *testing.T) {
+	exe, exited := seedPendingUpdate(t, pendingUpdate{RequestID: "u1", From: "v1.0.0", To: "v2.0.0"})
+	updateGracePeriod = 200 * time.Millisecond
+	conn, replies := replyRecorder(t)
+
+	armUpdateGuard("v2.0.0")
+	confirmPendingUpdate(conn, "v2.0.0")
+
+	msg := nextReply(t, replies)
+	if msg.Type != "updateStatus" || msg.State != "completed" || msg.Version != "v2.0.0" || msg.RequestID != "u1" {
+		t.Fatalf("report = %+v", msg)
+	}
+	select {
+	case <-exited:
+		t.Fatal("rolled back a confirmed update")
+	case <-time.After(400 * time.Millisecond):
+	}
+	if body, _ := os.ReadFile(exe); string(body) != "new" {
+		t.Fatalf("binary holds %q", body)
+	}
+	var pending pendingUpdate
+	if readStateJSON(pendingUpdateFile, &pending) {
+		t.Fatalf("pending update left behind: %+v", pending)
+	}
+}
+
+func TestRestoredBinaryReportsTheRollback(t *testing.T) {
+	seedPendingUpdate(t, pendingUpdate{
+		RequestID: "u1", From: "v1.0.0", To: "v2.0.0",
+		RolledBack: true, Reason: "v2.0.0 did not connect within 5m0s",
+	})
+	conn, replies := replyRecorder(t)
+
+	armUpdateGuard("v1.0.0")
+	confirmPendingUpdate(conn, "v1.0.0")
+
+	msg := nextReply(t, replies)
+	if msg.Type != "updateStatus" || msg.State != "rolledBack" || msg.RequestID != "u1" || msg.Version != "v2.0.0" || msg.Error == "" {
+		t.Fatalf("report = %+v", msg)
+	}
+	var pending pendingUpdate
+	if readStateJSON(pendingUpdateFile, &pending) {
+		t.Fatal("the rollback would be reported again on the next handshake")
+	}
+}
+
+func TestAnotherVersionReportsAMismatch(t *testing.T) {
+	seedPendingUpdate(t, pendingUpdate{RequestID: "u1", From: "v1.0.0", To: "v2.0.0"})
+	conn, replies := replyRecorder(t)
+
+	armUpdateGuard("v3.0.0")
+	confirmPendingUpdate(conn, "v3.0.0")
+
+	msg := nextReply(t, replies)
+	if msg.State != "mismatch" || msg.Version != "v3.0.0" || !strings.Contains(msg.Error, "v2.0.0") {
+		t.Fatalf("report = %+v", msg)
+	}
+	var pending pendingUpdate
+	if readStateJSON(pendingUpdateFile, &pending) {
+		t.Fatal("the mismatch would be reported again on the next handshake")
+	}
+}
+
+// The process that installed the update can reconnect before it exits. That
+// is not the update's outcome, and must not be reported as one.
+func TestTheInstallingProcessReportsNothing(t *testing.T) {
+	seedPendingUpdate(t, pendingUpdate{From: "v1.0.0", To: "v2.0.0"})
+	conn, replies := replyRecorder(t)
+
+	confirmPendingUpdate(conn, "v1.0.0")
+
+	select {
+	case msg := <-replies:
+		t.Fatalf("reported %+v", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+	var pending pendingUpdate
+	if !readStateJSON(pendingUpdateFile, &pending) {
+		t.Fatal("the pending update was cleared before the new binary ran")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Where updates come from.
+//
+// By default releases come from GitHub. A machine on a network that cannot
+// reach github.com fetches them from its control server instead ("server"),
+// or from any mirror URL laid out the same way:
+//
+//	<base>/latest           {"tag_name": "v1.2.3"}
+//	<base>/beta             the same for the beta channel; optional
+//	<base>/<tag>/<asset>    each release asset, SHA256SUMS and its signature included
+//
+// The control server is sent the device key as a bearer token, the credential
+// the control connection already uses, so it can keep downloads to enrolled
+// machines. A mirror never is: the device key opens a shell on this machine,
+// and a mirror may be run by anyone. One that wants to keep its downloads to
+// its own machines is sent an update token instead, given to `up` with
+// --update-token (or $SPECTRE_UPDATE_TOKEN) and kept with the device key.
+// Neither source is trusted: a release from either is verified against the
+// built-in signing key exactly as one from GitHub is, so a mirror can withhold
+// an update but cannot change what gets installed.
+
+const (
+	updateSourceGitHub = "github"
+	updateSourceServer = "server"
+	// serverReleasesPath is where the control server publishes releases.
+	serverReleasesPath = "/api/agent-releases"
+
+	updateSourceFlagDoc = `Where to fetch updates: "github", "server" (the control server) or a mirror URL (default $SPECTRE_UPDATE_SOURCE, else github)`
+	updateTokenFlagDoc  = `Bearer token for a mirror update source that asks for one (or $SPECTRE_UPDATE_TOKEN); kept with the device key, never sent to the control server or GitHub`
+)
+
+// agentUpdateSettings are the running agent's update source and control
+// server, for updates. Set by runAgent, and again by a reload.
+var agentUpdateSettings struct {
+	sync.Mutex
+	source, host string
+}
+
+func setAgentUpdateSource(source, host string) {
+	agentUpdateSettings.Lock()
+	defer agentUpdateSettings.Unlock()
+	agentUpdateSettings.source, agentUpdateSettings.host = source, host
+}
+
+func agentUpdateSource() (source, host string) {
+	agentUpdateSettings.Lock()
+	defer agentUpdateSettings.Unlock()
+	return agentUpdateSettings.source, agentUpdateSettings.host
+}
+
+// releaseSource is a resolved update source.
+type releaseSource struct {
+	// name is how messages refer to it.
+	name string
+	// latestURL answers with the current release's tag_name; betaURL with
+	// the newest, prereleases included.
+	latestURL string
+	betaURL   string
+	// downloadBase is the parent of each release's asset directory.
+	downloadBase string
+	// credential, when set, is sent as a bearer token: the device key for
+	// the control server, an update token for a mirror.
+	credential string
+	isServer   bool
+}
+
+// credentialName is how an error refers to what the source was sent.
+func (s releaseSource) credentialName() string {
+	switch {
+	case s.credential == "":
+		return "this machine, which sent no update token"
+	case s.isServer:
+		return "this machine's device key"
+	}
+	return "this machine's update token"
+}
+
+// releaseDir is the URL a release's assets are served under.
+func (s releaseSource) releaseDir(tag string) string {
+	return s.downloadBase + "/" + tag
+}
+
+// updateSourceSpec is the source an agent was configured with, the flag
+// winning over the environment.
+func updateSourceSpec(flag string) string {
+	if spec := strings.TrimSpace(flag); spec != "" {
+		return spec
+	}
+	if spec := strings.TrimSpace(os.Getenv("SPECTRE_UPDATE_SOURCE")); spec != "" {
+		return spec
+	}
+	return updateSourceGitHub
+}
+
+// checkUpdateSource rejects a source that could never resolve, so a typo
+// fails at `up` rather than at the first update.
+func checkUpdateSource(spec string) error {
+	switch spec {
+	case updateSourceGitHub, updateSourceServer:
+		return nil
+	}
+	_, err := mirrorBase(spec)
+	return err
+}
+
+// resolveUpdateSource turns a source as configured into URLs. host is the
+// control server, needed for "server".
+func resolveUpdateSource(spec, host string) (releaseSource, error) {
+	switch spec {
+	case "", updateSourceGitHub:
+		return releaseSource{
+			name:         "GitHub",
+			latestURL:    fmt.Sprintf("%s/repos/%s/releases/latest", updateAPIBase, updateRepo),
+			betaURL:      fmt.Sprintf("%s/repos/%s/releases?per_page=20", updateAPIBase, updateRepo),
+			downloadBase: fmt.Sprintf("%s/%s/releases/download", updateReleaseBase, updateRepo),
+		}, nil
+
+	case updateSourceServer:
+		if host == "" {
+			return releaseSource{}, fmt.Errorf("updating from the control server needs its address, and no running agent here to take it from")
+		}
+		base, err := normalizeServerURL(host, "http", serverReleasesPath)
+		if err != nil {
+			return releaseSource{}, err
+		}
+		info, _, _ := loadDeviceInfo()
+		if info.DeviceKey == "" {
+			return releaseSource{}, fmt.Errorf("this machine is not enrolled, so it has no device key to fetch updates from the control server with")
+		}
+		return releaseSource{
+			name: "the control server", latestURL: base + "/latest", betaURL: base + "/beta",
+			downloadBase: base, credential: info.DeviceKey, isServer: true,
+		}, nil
+	}
+
+	base, err := mirrorBase(spec)
+	if err != nil {
+		return releaseSource{}, err
+	}
+	u, _ := url.Parse(base)
+	return releaseSource{
+		name: u.Host, latestURL: base + "/latest", betaURL: base + "/beta",
+		downloadBase: base, credential: updateToken(),
+	}, nil
+}
+
+// updateToken is what a mirror is sent, if anything: $SPECTRE_UPDATE_TOKEN,
+// else the token `up` stored.
+func updateToken() string {
+	if token := strings.TrimSpace(os.Getenv("SPECTRE_UPDATE_TOKEN")); token != "" {
+		return token
+	}
+	info, _, _ := loadDeviceInfo()
+	return info.UpdateToken
+}
+
+// storeUpdateToken keeps a mirror's update token with the device key, where
+// the service finds it: in the unit it would be readable by every local user.
+func storeUpdateToken(token string) error {
+	if token = strings.TrimSpace(token); token == "" {
+		return nil
+	}
+	info, err := ensureDeviceInfo()
+	if err != nil {
+		return fmt.Errorf("read device info: %w", err)
+	}
+	info.UpdateToken = token
+	if err := saveDeviceInfo(info); err != nil {
+		return fmt.Errorf("store update token: %w", err)
+	}
+	return nil
+}
+
+// mirrorBase validates a mirror URL. It may be sent an update token, so
+// plaintext is refused off this machine just as it is for the control server.
+func mirrorBase(spec string) (string, error) {
+	u, err := url.Parse(spec)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return "", fmt.Errorf("unknown update source %q: use %q, %q or a mirror URL", spec, updateSourceGitHub, updateSourceServer)
+	}
+	if u.Scheme == "http" && !isLoopback(spec) {
+		return "", fmt.Errorf("refusing plaintext mirror %s: use https", u.Host)
+	}
+	u.RawQuery, u.Fragment = "", ""
+	return strings.TrimRight(u.String(), "/"), nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// serveMirror serves one release in the mirror layout under prefix, only to
+// callers presenting credential as a bearer token, or, when it is empty, no
+// Authorization header at all.
+func serveMirror(t *testing.T, prefix, tag, credential string, assets map[string][]byte) *httptest.Server {
+	t.Helper()
+	want := ""
+	if credential != "" {
+		want = "Bearer " + credential
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != want {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		path, ok := strings.CutPrefix(r.URL.Path, prefix+"/")
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if path == "latest" {
+			fmt.Fprintf(w, `{"tag_name":%q}`, tag)
+			return
+		}
+		body, ok := assets[strings.TrimPrefix(path, tag+"/")]
+		if !ok || !strings.HasPrefix(path, tag+"/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// enrolledInstall is an enrolled machine with a binary to update.
+func enrolledInstall(t *testing.T) string {
+	t.Helper()
+	stubServiceRestart(t)
+	t.Setenv("SPECTRE_AGENT_HOME", t.TempDir())
+	if err := saveDeviceInfo(DeviceInfo{DeviceID: "device-1", DeviceKey: "dk_mirror"}); err != nil {
+		t.Fatal(err)
+	}
+	installed := filepath.Join(t.TempDir(), "spectre-agent")
+	if err := os.WriteFile(installed, []byte("original"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return installed
+}
+
+func TestUpdateFromTheControlServerOrAMirror(t *testing.T) {
+	asset := agentAssetName(runtime.GOOS, runtime.GOARCH)
+	archive := tarGz(t, map[string]string{"spectre-agent": "#!/bin/sh\nexit 0\n"})
+
+	// The device key goes to the control server only. A mirror gets nothing,
+	// or the update token when one was given.
+	for _, tc := range []struct {
+		name, prefix, token, credential string
+		opts                            func(srv *httptest.Server) updateOptions
+	}{
+		{"server", serverReleasesPath, "ut_mirror", "dk_mirror", func(srv *httptest.Server) updateOptions {
+			return updateOptions{source: updateSourceServer, host: srv.URL}
+		}},
+		{"mirror", "/spectre", "", "", func(srv *httptest.Server) updateOptions {
+			return updateOptions{source: srv.URL + "/spectre/"}
+		}},
+		{"mirror with a token", "/spectre", "ut_mirror", "ut_mirror", func(srv *httptest.Server) updateOptions {
+			return updateOptions{source: srv.URL + "/spectre/"}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			installed := enrolledInstall(t)
+			if err := storeUpdateToken(tc.token); err != nil {
+				t.Fatal(err)
+			}
+			s := newTestSigner(t)
+			sums := manifest(map[string][]byte{asset: archive})
+			srv := serveMirror(t, tc.prefix, "v9.9.9", tc.credential, map[string][]byte{
+				asset: archive, checksumsAsset: sums, signatureAsset: s.sign(sums, "release: v9.9.9"),
+			})
+
+			if err := updateBinaryAt(installed, tc.opts(srv)); err != nil {
+				t.Fatalf("update: %v", err)
+			}
+			if body, _ := os.ReadFile(installed); !strings.Contains(string(body), "exit 0") {
+				t.Fatalf("binary holds %q, want the release", body)
+			}
+		})
+	}
+}
+
+// A mirror is only a transport: it must not be able to swap the binary.
+func TestUpdateRefusesATamperedMirror(t *testing.T) {
+	asset := agentAssetName(runtime.GOOS, runtime.GOARCH)
+	good := tarGz(t, map[string]string{"spectre-agent": "#!/bin/sh\nexit 0\n"})
+	evil := tarGz(t, map[string]string{"spectre-agent": "#!/bin/sh\necho owned\n"})
+
+	installed := enrolledInstall(t)
+	s := newTestSigner(t)
+	sums := manifest(map[string][]byte{asset: good})
+	srv := serveMirror(t, "", "v9.9.9", "", map[string][]byte{
+		asset: evil, checksumsAsset: sums, signatureAsset: s.sign(sums, "release: v9.9.9"),
+	})
+
+	err := updateBinaryAt(installed, updateOptions{source: srv.URL})
+	if !errors.Is(err, errUpdateUnverified) {
+		t.Fatalf("err = %v, want errUpdateUnverified", err)
+	}
+	if body, _ := os.ReadFile(installed); string(body) != "original" {
+		t.Fatalf("binary replaced with %q", body)
+	}
+}
+
+func TestUpdateFromTheServerReportsARefusedDeviceKey(t *testing.T) {
+	installed := enrolledInstall(t)
+	srv := serveMirror(t, serverReleasesPath, "v9.9.9", "dk_someone_else", nil)
+
+	err := updateBinaryAt(installed, updateOptions{source: updateSourceServer, host: srv.URL})
+	if err == nil || !strings.Contains(err.Error(), "refused this machine's device key") {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestCheckUpdateSource(t *testing.T) {
+	for _, ok := range []string{"github", "server", "https://mirror.example.com/spectre", "http://127.0.0.1:8080"} {
+		if err := checkUpdateSource(ok); err != nil {
+			t.Errorf("checkUpdateSource(%q) = %v", ok, err)
+		}
+	}
+	for _, bad := range []string{"gihtub", "ftp://mirror.example.com", "http://mirror.example.com"} {
+		if err := checkUpdateSource(bad); err == nil {
+			t.Errorf("checkUpdateSource(%q) accepted", bad)
+		}
+	}
+}
+
+func TestServiceKeepsTheUpdateSource(t *testing.T) {
+	args := strings.Join(buildExecArgs("wss://example.com", "server", updatePolicy{}), " ")
+	if !strings.Contains(args, "--update-source=server") {
+		t.Fatalf("args = %s", args)
+	}
+	if args := buildExecArgs("wss://example.com", updateSourceGitHub, updatePolicy{}); len(args) != 2 {
+		t.Fatalf("the default source was spelled out: %v", args)
+	}
+}
@@ -170,7 +170,8 @@ func TestLatestReleaseTag(t *testing.T) {
 	updateAPIBase = srv.URL
 	defer func() { updateAPIBase = old }()
 
-	tag, err := latestReleaseTag()
+	source, _ := resolveUpdateSource(updateSourceGitHub, "")
+	tag, err := latestReleaseTag(source, channelStable)
 	if err != nil {
 		t.Fatalf("latestReleaseTag: %v", err)
 	}
@@ -189,7 +190,8 @@ func TestLatestReleaseTagReportsRateLimiting(t *testing.T) {
 	updateAPIBase = srv.URL
 	defer func() { updateAPIBase = old }()
 
-	_, err := latestReleaseTag()
+	source, _ := resolveUpdateSource(updateSourceGitHub, "")
+	_, err := latestReleaseTag(source, channelStable)
 	if err == nil || !strings.Contains(err.Error(), "rate-limited") {
 		t.Fatalf("want a rate-limit error, got %v", err)
 	}
@@ -201,7 +203,7 @@ func TestDownloadAgentBinaryReportsMissingPlatformBuild(t *testing.T) {
 	}))
 	defer srv.Close()
 
-	_, err := downloadAgentBinary(srv.URL+"/missing.tar.gz", t.TempDir())
+	_, err := downloadAgentBinary(releaseSource{}, srv.URL+"/missing.tar.gz", t.TempDir(), "")
 	if err == nil || !strings.Contains(err.Error(), runtime.GOARCH) {
 		t.Fatalf("want an error naming this platform, got %v", err)
 	}
@@ -265,23 +267,15 @@ func TestUpdateReplacesTheBinaryAndLeavesEnrollmentAlone(t *testing.T) {
 	}
 
 	newBinary := "#!/bin/sh\nexit 0\n# v9.9.9\n"
+	asset := agentAssetName(runtime.GOOS, runtime.GOARCH)
 	archive := tarGz(t, map[string]string{"spectre-agent-" + runtime.GOOS + "-" + runtime.GOARCH: newBinary})
-
-	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		switch {
-		case strings.HasSuffix(r.URL.Path, "/releases/latest"):
-			fmt.Fprint(w, `{"tag_name":"v9.9.9"}`)
-		case strings.HasSuffix(r.URL.Path, agentAssetName(runtime.GOOS, runtime.GOARCH)):
-			w.Write(archive)
-		default:
-			w.WriteHeader(http.StatusNotFound)
-		}
-	}))
-	defer srv.Close()
-
-	oldAPI, oldRelease := updateAPIBase, updateReleaseBase
-	updateAPIBase, updateReleaseBase = srv.URL, srv.URL
-	defer func() { updateAPIBase, updateReleaseBase = oldAPI, oldRelease }()
+	signer := newTestSigner(t)
+	sums := manifest(map[string][]byte{asset: archive})
+	serveRelease(t, "v9.9.9", map[string][]byte{
+		asset:          archive,
+		checksumsAsset: sums,
+		signatureAsset: signer.sign(sums, "release: v9.9.9"),
+	})
 
 	if err := updateBinaryAt(installed, updateOptions{}); err != nil {
 		t.Fatalf("updateBinaryAt: %v", err)
@@ -304,6 +298,11 @@ func TestUpdateReplacesTheBinaryAndLeavesEnrollmentAlone(t *testing.T) {
 		t.Fatalf("device info changed: %q", after)
 	}
 
+	// The old binary is kept beside the new one, for a rollback.
+	if previous, _ := os.ReadFile(previousBinaryPath(installed)); string(previous) != "#!/bin/sh\nexit 0\n" {
+		t.Fatalf("previous binary holds %q", previous)
+	}
+
 	// No staging directories left behind next to the binary.
 	entries, _ := os.ReadDir(installDir)
 	for _, e := range entries {
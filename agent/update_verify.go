@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Release verification.
+//
+// Every release carries SHA256SUMS, a checksum for each asset, and
+// SHA256SUMS.minisig, a detached minisign signature over it made with the
+// project's release key. An update downloads both, checks the signature
+// against the public key built into this binary, and then checks the asset it
+// downloaded against its line in the manifest. Anything that does not verify
+// is refused before it is unpacked, so neither the release page nor anything
+// on the network path can hand an agent a binary the key did not sign.
+//
+// The signature is minisign's legacy Ed25519 form (minisign -S -l), which the
+// standard library can check on its own. Its trusted comment names the
+// release, so a validly signed manifest from an older release cannot be
+// replayed as a newer one.
+
+const (
+	checksumsAsset = "SHA256SUMS"
+	signatureAsset = "SHA256SUMS.minisig"
+	// Generous for a manifest of a handful of lines.
+	maxManifestSize = 64 << 10
+)
+
+// releasePublicKey is the minisign public key releases are signed with, set
+// at build time:
+//
+//	go build -ldflags "-X main.releasePublicKey=RWQ..."
+//
+// A build without one cannot verify anything, and so refuses every update.
+var releasePublicKey string
+
+// errUpdateUnverified marks a release that failed verification, as opposed to
+// one that could not be fetched.
+var errUpdateUnverified = errors.New("release failed verification")
+
+func unverified(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", errUpdateUnverified, fmt.Sprintf(format, args...))
+}
+
+type minisignKey struct {
+	id  [8]byte
+	key ed25519.PublicKey
+}
+
+// parseMinisignPublicKey accepts a public key as minisign prints it, with or
+// without its comment line.
+func parseMinisignPublicKey(text string) (minisignKey, error) {
+	var k minisignKey
+	line := lastLine(text)
+	raw, err := base64.StdEncoding.DecodeString(line)
+	if err != nil || len(raw) != 2+8+ed25519.PublicKeySize || string(raw[:2]) != "Ed" {
+		return k, errors.New("malformed minisign public key")
+	}
+	copy(k.id[:], raw[2:10])
+	k.key = ed25519.PublicKey(raw[10:])
+	return k, nil
+}
+
+func lastLine(text string) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// verifyMinisign checks sig, a .minisig file, over message, and returns its
+// trusted comment.
+func verifyMinisign(key minisignKey, message, sig []byte) (string, error) {
+	lines := strings.Split(strings.TrimSpace(string(sig)), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return "", errors.New("malformed signature file")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(raw) != 2+8+ed25519.SignatureSize {
+		return "", errors.New("malformed signature")
+	}
+	switch string(raw[:2]) {
+	case "Ed":
+	case "ED":
+		return "", errors.New("prehashed signature; releases must be signed with minisign -l")
+	default:
+		return "", errors.New("unknown signature algorithm")
+	}
+	if !bytes.Equal(raw[2:10], key.id[:]) {
+		return "", errors.New("signed with a different key")
+	}
+	signature := raw[10:]
+	if !ed25519.Verify(key.key, message, signature) {
+		return "", errors.New("signature does not match")
+	}
+
+	// The trusted comment has a signature of its own, over the first one and
+	// the comment together; without it the comment could be anything.
+	comment := strings.TrimPrefix(strings.TrimRight(lines[2], "\r"), "trusted comment: ")
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return "", errors.New("malformed trusted comment signature")
+	}
+	if !ed25519.Verify(key.key, append(append([]byte{}, signature...), comment...), global) {
+		return "", errors.New("trusted comment signature does not match")
+	}
+	return comment, nil
+}
+
+// parseChecksums reads a sha256sum-style manifest into asset name → hex digest.
+func parseChecksums(data []byte) map[string]string {
+	sums := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		// sha256sum marks binary mode with a leading '*'.
+		sums[strings.TrimPrefix(fields[1], "*")] = strings.ToLower(fields[0])
+	}
+	return sums
+}
+
+// fetchVerifiedChecksums downloads a release's manifest and signature from
+// source and returns the manifest's checksums once the signature holds.
+func fetchVerifiedChecksums(source releaseSource, tag string) (map[string]string, error) {
+	if releasePublicKey == "" {
+		return nil, unverified("this build has no release signing key, so it cannot verify updates; install a release build")
+	}
+	key, err := parseMinisignPublicKey(releasePublicKey)
+	if err != nil {
+		return nil, unverified("built-in release key: %v", err)
+	}
+
+	base := source.releaseDir(tag)
+	manifest, err := fetchSmallAsset(source, base+"/"+checksumsAsset)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := fetchSmallAsset(source, base+"/"+signatureAsset)
+	if err != nil {
+		return nil, err
+	}
+	comment, err := verifyMinisign(key, manifest, sig)
+	if err != nil {
+		return nil, unverified("%s: %v", checksumsAsset, err)
+	}
+	if comment != "release: "+tag {
+		return nil, unverified("%s is signed for %q, not release %s", checksumsAsset, comment, tag)
+	}
+	return parseChecksums(manifest), nil
+}
+
+// fetchSmallAsset downloads a release asset that is not a binary. A release
+// without one is unsigned, which is a verification failure in its own right.
+func fetchSmallAsset(source releaseSource, url string) ([]byte, error) {
+	req, err := newReleaseRequest(source, url)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("download %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, unverified("the release is unsigned (no %s)", url[strings.LastIndexByte(url, '/')+1:])
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download %s: HTTP %d", url, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+}
+
+// verifyFileSHA256 checks the file at path against a hex digest.
+func verifyFileSHA256(path, want string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return unverified("checksum mismatch: got %s, the signed manifest says %s", got, want)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// testSigner stands in for the release key: it installs its public key as the
+// built-in one for the length of the test.
+type testSigner struct {
+	id  [8]byte
+	key ed25519.PrivateKey
+}
+
+func newTestSigner(t *testing.T) *testSigner {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSigner{key: priv}
+	copy(s.id[:], "testkey1")
+
+	raw := append(append([]byte("Ed"), s.id[:]...), pub...)
+	old := releasePublicKey
+	releasePublicKey = "untrusted comment: test key\n" + base64.StdEncoding.EncodeToString(raw)
+	t.Cleanup(func() { releasePublicKey = old })
+	return s
+}
+
+// sign produces a .minisig file as `minisign -S -l -t comment` would.
+func (s *testSigner) sign(message []byte, comment string) []byte {
+	sig := ed25519.Sign(s.key, message)
+	global := ed25519.Sign(s.key, append(append([]byte{}, sig...), comment...))
+	return []byte(fmt.Sprintf("untrusted comment: signature\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), s.id[:]...), sig...)),
+		comment,
+		base64.StdEncoding.EncodeToString(global)))
+}
+
+// manifest builds a SHA256SUMS for the given assets.
+func manifest(assets map[string][]byte) []byte {
+	var b strings.Builder
+	for name, body := range assets {
+		sum := sha256.Sum256(body)
+		fmt.Fprintf(&b, "%s  %s\n", hex.EncodeToString(sum[:]), name)
+	}
+	return []byte(b.String())
+}
+
+func TestVerifyMinisign(t *testing.T) {
+	s := newTestSigner(t)
+	key, err := parseMinisignPublicKey(releasePublicKey)
+	if err != nil {
+		t.Fatalf("parse key: %v", err)
+	}
+	msg := []byte("abc  spectre-agent-linux-amd64.tar.gz\n")
+	sig := s.sign(msg, "release: v1.2.3")
+
+	comment, err := verifyMinisign(key, msg, sig)
+	if err != nil || comment != "release: v1.2.3" {
+		t.Fatalf("verifyMinisign = %q, %v", comment, err)
+	}
+	if _, err := verifyMinisign(key, []byte("tampered"), sig); err == nil {
+		t.Error("a tampered message verified")
+	}
+	forged := strings.Replace(string(sig), "release: v1.2.3", "release: v9.9.9", 1)
+	if _, err := verifyMinisign(key, msg, []byte(forged)); err == nil {
+		t.Error("an edited trusted comment verified")
+	}
+	other := newTestSigner(t)
+	if _, err := verifyMinisign(key, msg, other.sign(msg, "release: v1.2.3")); err == nil {
+		t.Error("a signature from another key verified")
+	}
+}
+
+func TestParseChecksums(t *testing.T) {
+	sums := parseChecksums([]byte("AAAA  a.tar.gz\nbbbb *b.tar.gz\n\nnot a line\n"))
+	if sums["a.tar.gz"] != "aaaa" || sums["b.tar.gz"] != "bbbb" || len(sums) != 2 {
+		t.Fatalf("sums = %v", sums)
+	}
+}
+
+// serveRelease serves the assets of one release the way GitHub lays them out.
+func serveRelease(t *testing.T, tag string, assets map[string][]byte) *httptest.Server {
+	t.Helper()
+	prefix := "/" + updateRepo + "/releases/download/" + tag + "/"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/releases/latest") {
+			fmt.Fprintf(w, `{"tag_name":%q}`, tag)
+			return
+		}
+		body, ok := assets[strings.TrimPrefix(r.URL.Path, prefix)]
+		if !ok || !strings.HasPrefix(r.URL.Path, prefix) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+
+	oldAPI, oldRelease := updateAPIBase, updateReleaseBase
+	updateAPIBase, updateReleaseBase = srv.URL, srv.URL
+	t.Cleanup(func() { updateAPIBase, updateReleaseBase = oldAPI, oldRelease })
+	return srv
+}
+
+// Each way a release can fail verification must leave the installed binary
+// alone and say why.
+func TestUpdateRefusesUnverifiedReleases(t *testing.T) {
+	asset := agentAssetName(runtime.GOOS, runtime.GOARCH)
+	good := tarGz(t, map[string]string{"spectre-agent": "#!/bin/sh\nexit 0\n"})
+	evil := tarGz(t, map[string]string{"spectre-agent": "#!/bin/sh\necho owned\n"})
+
+	cases := []struct {
+		name   string
+		assets func(s *testSigner) map[string][]byte
+		want   string
+	}{
+		{"unsigned", func(*testSigner) map[string][]byte {
+			return map[string][]byte{asset: good, checksumsAsset: manifest(map[string][]byte{asset: good})}
+		}, "unsigned"},
+		{"tampered archive", func(s *testSigner) map[string][]byte {
+			sums := manifest(map[string][]byte{asset: good})
+			return map[string][]byte{asset: evil, checksumsAsset: sums, signatureAsset: s.sign(sums, "release: v9.9.9")}
+		}, "checksum mismatch"},
+		{"tampered manifest", func(s *testSigner) map[string][]byte {
+			sums := manifest(map[string][]byte{asset: good})
+			return map[string][]byte{asset: evil, checksumsAsset: manifest(map[string][]byte{asset: evil}), signatureAsset: s.sign(sums, "release: v9.9.9")}
+		}, "signature does not match"},
+		{"replayed older release", func(s *testSigner) map[string][]byte {
+			sums := manifest(map[string][]byte{asset: good})
+			return map[string][]byte{asset: good, checksumsAsset: sums, signatureAsset: s.sign(sums, "release: v1.0.0")}
+		}, "not release v9.9.9"},
+		{"asset missing from manifest", func(s *testSigner) map[string][]byte {
+			sums := manifest(map[string][]byte{"other.tar.gz": good})
+			return map[string][]byte{asset: good, checksumsAsset: sums, signatureAsset: s.sign(sums, "release: v9.9.9")}
+		}, "not listed"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			stubServiceRestart(t)
+			s := newTestSigner(t)
+			serveRelease(t, "v9.9.9", tc.assets(s))
+			installed := filepath.Join(t.TempDir(), "spectre-agent")
+			if err := os.WriteFile(installed, []byte("original"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+
+			err := updateBinaryAt(installed, updateOptions{})
+			if !errors.Is(err, errUpdateUnverified) || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("err = %v, want an unverified error mentioning %q", err, tc.want)
+			}
+			if body, _ := os.ReadFile(installed); string(body) != "original" {
+				t.Fatalf("binary replaced with %q", body)
+			}
+		})
+	}
+}
+
+func TestUpdateRefusesWithoutABuiltInKey(t *testing.T) {
+	old := releasePublicKey
+	releasePublicKey = ""
+	defer func() { releasePublicKey = old }()
+
+	if _, err := fetchVerifiedChecksums(releaseSource{downloadBase: "http://127.0.0.1:1"}, "v1.0.0"); !errors.Is(err, errUpdateUnverified) {
+		t.Fatalf("err = %v, want errUpdateUnverified", err)
+	}
+}
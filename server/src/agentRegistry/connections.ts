@@ -1,6 +1,7 @@
 import WebSocket from "ws";
 import { listAgentRecords } from "../deviceStore";
 import { type ControlMessage } from "../types";
+import { resetOutputReplayForTest } from "./outputReplay";
 
 /**
  * Live connection tracking.
@@ -16,6 +17,8 @@ export type LiveConnection = {
   deviceStoreId: string;
   connectionId: string;
   identity: string;
+  /** Negotiated in the hello; undefined for agents that predate negotiation. */
+  features?: string[];
 };
 
 // Keyed by credential id (deviceStoreId) so a same-key reconnect replaces its
@@ -23,6 +26,26 @@ export type LiveConnection = {
 export const connections: Map<string, LiveConnection> = new Map();
 export const identityToStoreId: Map<string, string> = new Map();
 
+/**
+ * Event ids recently seen from each device. The agent re-sends a queued event
+ * on every connection until it is acknowledged, so one can arrive twice when
+ * an ack is lost with the link. Kept per device, not per socket, because the
+ * repeat comes on the next connection; in memory only, since a repeat after a
+ * server restart costs no more than a duplicate log line.
+ */
+const seenEvents: Map<string, string[]> = new Map();
+const MAX_SEEN_EVENTS = 512;
+
+/** Records an agent event id, reporting whether it is new. */
+export function firstSightOfEvent(deviceStoreId: string, eventId: string) {
+  const seen = seenEvents.get(deviceStoreId) ?? [];
+  if (seen.includes(eventId)) return false;
+  seen.push(eventId);
+  if (seen.length > MAX_SEEN_EVENTS) seen.shift();
+  seenEvents.set(deviceStoreId, seen);
+  return true;
+}
+
 export function pushToAgent(agentId: string, message: ControlMessage) {
   const conn = connections.get(agentId);
   if (!conn || conn.socket.readyState !== WebSocket.OPEN) {
@@ -31,6 +54,15 @@ export function pushToAgent(agentId: string, message: ControlMessage) {
   conn.socket.send(JSON.stringify(message));
 }
 
+/**
+ * Whether a connected agent serves a feature. Agents that did not negotiate
+ * are assumed to, as they always have been.
+ */
+export function agentSupports(agentId: string, feature: string) {
+  const features = connections.get(agentId)?.features;
+  return features === undefined || features.includes(feature);
+}
+
 /** Drops every live connection belonging to a device (used on revoke). */
 export function disconnectDevice(deviceStoreId: string) {
   for (const conn of connections.values()) {
@@ -73,4 +105,6 @@ export function resetAgentsForTest() {
   }
   connections.clear();
   identityToStoreId.clear();
+  seenEvents.clear();
+  resetOutputReplayForTest();
 }
@@ -46,6 +46,18 @@ export function emitUpdateFailure(agentId: string, error: string) {
   for (const listener of updateFailureListeners) listener(agentId, error);
 }
 
+const updateCompletedListeners: Set<(agentId: string, version: string) => void> = new Set();
+
+export function onAgentUpdateCompleted(listener: (agentId: string, version: string) => void) {
+  updateCompletedListeners.add(listener);
+  return () => updateCompletedListeners.delete(listener);
+}
+
+/** A machine's new binary came up and reported in after an update. */
+export function emitUpdateCompleted(agentId: string, version: string) {
+  for (const listener of updateCompletedListeners) listener(agentId, version);
+}
+
 /** Emits the canonical (deduped) record for whichever device this row belongs to. */
 export function emitDeviceUpdate(deviceStoreId: string) {
   const record = canonicalAgentRecordFor(deviceStoreId);
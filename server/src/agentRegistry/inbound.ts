@@ -2,9 +2,11 @@ import WebSocket, { type RawData } from "ws";
 import { markDeviceSeen, recordDeviceConnected, recordDeviceDisconnected, updateDeviceRuntime } from "../deviceStore";
 import { type AgentMessage, type ControlMessage } from "../types";
 import { summarizeOutput } from "../utils/output";
-import { connections, identityToStoreId } from "./connections";
-import { emitDeviceUpdate, emitOutput, emitUpdateFailure } from "./events";
+import { connections, firstSightOfEvent, identityToStoreId } from "./connections";
+import { emitDeviceUpdate, emitOutput, emitUpdateCompleted, emitUpdateFailure } from "./events";
 import { requestDockerInfo, requestNetworkInfo, requestSystemInfo } from "./info";
+import { forgetOutput, heldOutput, reconcileOutput, recordOutput, recordOutputGap, sessionsToReplay } from "./outputReplay";
+import { negotiateHello } from "./protocol";
 
 const MAX_AGENT_MESSAGE_BYTES = 256 * 1024;
 const DEBUG_TERMINAL = process.env.SPECTRE_DEBUG_TERMINAL === "1";
@@ -34,6 +36,15 @@ export function registerInboundAgent(socket: WebSocket, address: string, deviceS
       return;
     }
 
+    // Events from the agent's durable queue: acknowledge every copy, so the
+    // agent can let it go, but act on each only once.
+    if ("eventId" in payload && payload.eventId) {
+      if (connections.get(deviceStoreId)?.features?.includes("events")) {
+        socket.send(JSON.stringify({ type: "ackEvent", eventId: payload.eventId } satisfies ControlMessage));
+      }
+      if (!firstSightOfEvent(deviceStoreId, payload.eventId)) return;
+    }
+
     switch (payload.type) {
       case "hello": {
         const { connectionId: cid, identity } = recordDeviceConnected(deviceStoreId, {
@@ -57,10 +68,17 @@ export function registerInboundAgent(socket: WebSocket, address: string, deviceS
           sameKeyGhost.socket.close(4004, "superseded by newer connection");
         }
 
-        connections.set(deviceStoreId, { socket, deviceStoreId, connectionId: cid, identity });
+        const reply = negotiateHello(payload);
+        connections.set(deviceStoreId, { socket, deviceStoreId, connectionId: cid, identity, features: reply.features });
         identityToStoreId.set(identity, deviceStoreId);
 
-        socket.send(JSON.stringify({ type: "hello" } satisfies ControlMessage));
+        socket.send(JSON.stringify(reply satisfies ControlMessage));
+        // Whatever the last link dropped is still buffered on the agent.
+        if (reply.features?.includes("outputReplay")) {
+          for (const [sessionId, seq] of sessionsToReplay(deviceStoreId)) {
+            socket.send(JSON.stringify({ type: "replay", sessionId, seq } satisfies ControlMessage));
+          }
+        }
         emitDeviceUpdate(deviceStoreId);
         requestDockerInfo(deviceStoreId);
         requestSystemInfo(deviceStoreId);
@@ -68,6 +86,15 @@ export function registerInboundAgent(socket: WebSocket, address: string, deviceS
         return;
       }
       case "output": {
+        // Numbered output is relayed once, then acknowledged so the agent can
+        // let it go. Redraws are unnumbered and always relayed.
+        if (payload.seq && payload.sessionId) {
+          if (!recordOutput(deviceStoreId, payload.sessionId, payload.seq)) return;
+          if (connections.get(deviceStoreId)?.features?.includes("outputReplay")) {
+            const seq = heldOutput(deviceStoreId, payload.sessionId);
+            socket.send(JSON.stringify({ type: "ackOutput", sessionId: payload.sessionId, seq } satisfies ControlMessage));
+          }
+        }
         emitOutput(deviceStoreId, payload);
         if (DEBUG_TERMINAL) {
           const summary = summarizeOutput(payload.data);
@@ -75,15 +102,26 @@ export function registerInboundAgent(socket: WebSocket, address: string, deviceS
         }
         return;
       }
+      case "outputGap":
+        console.warn(`[agent ${deviceStoreId}] output of ${payload.sessionId} before ${payload.seq} was lost`);
+        recordOutputGap(deviceStoreId, payload.sessionId, payload.seq);
+        return;
       case "heartbeat":
         markDeviceSeen(deviceStoreId);
         return;
-      // Session lifecycle is relayed straight through to the UI; the server
-      // keeps no session state of its own, because tmux on the agent's host is
-      // the only thing that actually knows which sessions exist.
+      // Session lifecycle is relayed straight through to the UI; beyond how far
+      // each session's output has been relayed, the server keeps no session
+      // state of its own, because tmux on the agent's host is the only thing
+      // that actually knows which sessions exist.
       case "sessions":
-      case "sessionOpened":
+        reconcileOutput(deviceStoreId, payload.sessions ?? []);
+        emitOutput(deviceStoreId, payload);
+        return;
       case "sessionClosed":
+        forgetOutput(deviceStoreId, payload.sessionId);
+        emitOutput(deviceStoreId, payload);
+        return;
+      case "sessionOpened":
       case "sessionExited":
         emitOutput(deviceStoreId, payload);
         return;
@@ -100,12 +138,25 @@ export function registerInboundAgent(socket: WebSocket, address: string, deviceS
         emitDeviceUpdate(deviceStoreId);
         return;
       case "updateStatus":
-        // Logged, not stored: a successful update ends with the agent
-        // restarting and re-announcing its version, which is what the
-        // dashboard actually reflects. A failure is only useful in the log.
-        if (payload.state === "failed") {
+        // Logged, not stored. The outcome comes from the new binary itself,
+        // on its first handshake: "completed", or "mismatch" when the version
+        // that came up is not the one installed.
+        if (payload.state === "completed") {
+          console.log(`[update] ${deviceStoreId} completed, now on ${payload.version ?? "an unknown version"}`);
+          emitUpdateCompleted(deviceStoreId, payload.version ?? "");
+        } else if (payload.state === "failed" || payload.state === "mismatch") {
           console.warn(`[update] ${deviceStoreId} failed to update: ${payload.error ?? "unknown error"}`);
           emitUpdateFailure(deviceStoreId, payload.error ?? "update failed");
+        } else if (payload.state === "rolledBack") {
+          // Sent by the previous version once it is back: the new one was
+          // installed but never connected, and the agent restored the old.
+          const reason = `rolled back from ${payload.version ?? "the update"}: ${payload.error ?? "it did not connect"}`;
+          console.warn(`[update] ${deviceStoreId} ${reason}`);
+          emitUpdateFailure(deviceStoreId, reason);
+        } else if (payload.state === "deferred") {
+          // The machine's own update policy (channel, maintenance window,
+          // idle-only) is holding back an automatic update. Not a failure.
+          console.log(`[update] ${deviceStoreId} deferred ${payload.version ?? "an update"}: ${payload.reason ?? "by policy"}`);
         } else {
           console.log(`[update] ${deviceStoreId} ${payload.state}${payload.version ? ` ${payload.version}` : ""}`);
         }
@@ -1,6 +1,9 @@
-import { connections, pushToAgent } from "./connections";
+import { agentSupports, connections, pushToAgent } from "./connections";
 
 function requestInfo(agentId: string, type: "dockerInfo" | "systemInfo" | "networkInfo") {
+  // Container listing is optional; an agent that did not enable it would only
+  // answer with an error.
+  if (type === "dockerInfo" && !agentSupports(agentId, "docker")) return;
   try {
     pushToAgent(agentId, { type });
   } catch (err) {
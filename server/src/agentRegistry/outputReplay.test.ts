@@ -0,0 +1,51 @@
+import { beforeEach, describe, expect, it } from "vitest";
+import {
+  heldOutput,
+  reconcileOutput,
+  recordOutput,
+  recordOutputGap,
+  resetOutputReplayForTest,
+  sessionsToReplay,
+} from "./outputReplay";
+
+beforeEach(resetOutputReplayForTest);
+
+describe("output replay", () => {
+  it("relays each chunk once and holds up to the last one with nothing missing", () => {
+    expect(recordOutput("d1", "s1", 1)).toBe(true);
+    expect(recordOutput("d1", "s1", 2)).toBe(true);
+    expect(recordOutput("d1", "s1", 2)).toBe(false);
+    expect(sessionsToReplay("d1")).toEqual([["s1", 2]]);
+  });
+
+  it("does not hold past live output that overtook a replay", () => {
+    recordOutput("d1", "s1", 1);
+    expect(recordOutput("d1", "s1", 4)).toBe(true);
+    expect(heldOutput("d1", "s1")).toBe(1);
+
+    expect(recordOutput("d1", "s1", 2)).toBe(true);
+    expect(recordOutput("d1", "s1", 3)).toBe(true);
+    expect(recordOutput("d1", "s1", 4)).toBe(false);
+    expect(heldOutput("d1", "s1")).toBe(4);
+  });
+
+  it("carries on past output the agent had already discarded", () => {
+    recordOutput("d1", "s1", 1);
+    recordOutput("d1", "s1", 9);
+    recordOutputGap("d1", "s1", 7);
+    expect(heldOutput("d1", "s1")).toBe(6);
+    recordOutput("d1", "s1", 7);
+    recordOutput("d1", "s1", 8);
+    expect(heldOutput("d1", "s1")).toBe(9);
+  });
+
+  it("forgets sessions that are gone, or numbered over by a restarted agent", () => {
+    recordOutput("d1", "s1", 5);
+    recordOutput("d1", "s2", 5);
+    recordOutput("d1", "s3", 5);
+    reconcileOutput("d1", [{ id: "s1", seq: 8 }, { id: "s2", seq: 1 }]);
+    expect(sessionsToReplay("d1")).toEqual([["s1", 5]]);
+
+    expect(recordOutput("d1", "s2", 2)).toBe(true);
+  });
+});
@@ -0,0 +1,91 @@
+/**
+ * Session output replay.
+ *
+ * The agent numbers each session's output and keeps what the server has not
+ * acknowledged. The server remembers how far it has relayed each session,
+ * acknowledges as it goes, and after a reconnect asks for everything since,
+ * so output the link dropped still reaches the browser. Kept per device
+ * rather than per socket because the replay is asked for on the next
+ * connection; in memory only, since after a server restart the browsers
+ * reattach and get a fresh redraw anyway.
+ *
+ * Live output can overtake a replay on a fresh connection, so a session
+ * tracks the last chunk relayed with nothing missing before it, plus any
+ * relayed beyond that. Only the former is acknowledged or asked to be
+ * replayed from; the latter stop a replayed copy being relayed twice.
+ */
+type SessionOutput = { held: number; ahead: Set<number> };
+
+const sessionsByDevice: Map<string, Map<string, SessionOutput>> = new Map();
+
+function advance(output: SessionOutput) {
+  while (output.ahead.delete(output.held + 1)) output.held++;
+}
+
+/**
+ * Records a numbered chunk about to be relayed, reporting whether it is new.
+ * Numbering for a session first seen mid-stream, such as after a server
+ * restart, starts at whatever arrives.
+ */
+export function recordOutput(deviceStoreId: string, sessionId: string, seq: number) {
+  const sessions = sessionsByDevice.get(deviceStoreId) ?? new Map<string, SessionOutput>();
+  sessionsByDevice.set(deviceStoreId, sessions);
+  const output = sessions.get(sessionId);
+  if (!output) {
+    sessions.set(sessionId, { held: seq, ahead: new Set() });
+    return true;
+  }
+  if (seq <= output.held || output.ahead.has(seq)) return false;
+  output.ahead.add(seq);
+  advance(output);
+  return true;
+}
+
+/**
+ * The agent had already discarded output before `seq`; nothing earlier will
+ * come, so the session carries on from there.
+ */
+export function recordOutputGap(deviceStoreId: string, sessionId: string, seq: number) {
+  const output = sessionsByDevice.get(deviceStoreId)?.get(sessionId);
+  if (!output || output.held >= seq - 1) return;
+  output.held = seq - 1;
+  for (const ahead of output.ahead) {
+    if (ahead <= output.held) output.ahead.delete(ahead);
+  }
+  advance(output);
+}
+
+/** The last chunk of a session relayed with nothing missing before it; 0 when none. */
+export function heldOutput(deviceStoreId: string, sessionId: string) {
+  return sessionsByDevice.get(deviceStoreId)?.get(sessionId)?.held ?? 0;
+}
+
+/** The sessions to ask a reconnecting agent to replay, with the last chunk held for each. */
+export function sessionsToReplay(deviceStoreId: string): [sessionId: string, seq: number][] {
+  return [...(sessionsByDevice.get(deviceStoreId) ?? [])].map(([sessionId, output]) => [sessionId, output.held]);
+}
+
+/** Forgets a session that closed. */
+export function forgetOutput(deviceStoreId: string, sessionId: string) {
+  sessionsByDevice.get(deviceStoreId)?.delete(sessionId);
+}
+
+/**
+ * Reconciles with the agent's session list: sessions missing from it are
+ * gone, and one numbered lower than what is held belongs to a restarted
+ * agent whose numbering started over.
+ */
+export function reconcileOutput(deviceStoreId: string, listed: { id: string; seq?: number }[]) {
+  const sessions = sessionsByDevice.get(deviceStoreId);
+  if (!sessions) return;
+  const lastSeqs = new Map(listed.map((session) => [session.id, session.seq ?? 0]));
+  for (const [sessionId, output] of sessions) {
+    const lastSeq = lastSeqs.get(sessionId);
+    if (lastSeq === undefined || lastSeq < output.held) sessions.delete(sessionId);
+  }
+}
+
+/** Test seam: forgets every session. */
+export function resetOutputReplayForTest() {
+  sessionsByDevice.clear();
+}
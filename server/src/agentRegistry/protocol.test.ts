@@ -0,0 +1,19 @@
+import { describe, expect, it } from "vitest";
+import { negotiateHello, PROTOCOL_VERSION } from "./protocol";
+
+const base = { type: "hello" as const, agentId: "a1", fingerprint: { hostname: "h", macAddresses: [], nics: [] } };
+
+describe("negotiateHello", () => {
+  it("answers agents that predate negotiation with a bare hello", () => {
+    expect(negotiateHello(base)).toEqual({ type: "hello" });
+  });
+
+  it("enables only offered features the server drives", () => {
+    const reply = negotiateHello({ ...base, protocolVersion: 2, capabilities: ["docker", "events", "outputReplay", "systemd", "tmux"] });
+    expect(reply).toEqual({ type: "hello", protocolVersion: 2, features: ["tmux", "docker", "outputReplay", "events"] });
+  });
+
+  it("settles on the older of the two protocol versions", () => {
+    expect(negotiateHello({ ...base, protocolVersion: PROTOCOL_VERSION + 1 }).protocolVersion).toBe(PROTOCOL_VERSION);
+  });
+});
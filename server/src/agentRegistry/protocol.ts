@@ -0,0 +1,27 @@
+import { type AgentMessage, type ControlMessage } from "../types";
+
+/**
+ * Hello negotiation.
+ *
+ * An agent offers the features it can serve on its host; the server switches
+ * on the ones it actually drives and the agent refuses everything else for
+ * the life of the connection. Agents that predate negotiation send no version
+ * and get the bare hello they expect.
+ */
+export const PROTOCOL_VERSION = 2;
+
+/** Features this server uses. Offered features missing here stay off. */
+export const SERVER_FEATURES = ["tmux", "docker", "update", "outputReplay", "events"] as const;
+
+type AgentHello = Extract<AgentMessage, { type: "hello" }>;
+type ServerHello = Extract<ControlMessage, { type: "hello" }>;
+
+export function negotiateHello(hello: AgentHello): ServerHello {
+  if (hello.protocolVersion === undefined) return { type: "hello" };
+  const offered = new Set(hello.capabilities ?? []);
+  return {
+    type: "hello",
+    protocolVersion: Math.min(PROTOCOL_VERSION, hello.protocolVersion),
+    features: SERVER_FEATURES.filter((feature) => offered.has(feature)),
+  };
+}
@@ -8,6 +8,10 @@
  * the machine list.
  */
 
+import fs from "fs";
+import path from "path";
+import { AGENT_RELEASES_DIR } from "./config";
+
 const RELEASE_URL = "https://api.github.com/repos/sidhantpanda/spectre/releases/latest";
 // Short enough that a release you just cut shows up in the dashboard while
 // you are still looking at it. 12 requests an hour sits well inside GitHub's
@@ -40,8 +44,44 @@ export function updateAvailableFor(agentVersion: string | undefined, latest = la
   return norm(agentVersion) !== norm(latest);
 }
 
-/** Fetches the latest release tag, at most one request at a time. */
+/**
+ * The tag this server's own release directory calls current on a channel, or
+ * undefined when it hosts no releases or the file is missing or malformed.
+ * The beta channel falls back to the stable release when it has no file.
+ */
+export function hostedLatestAgentVersion(
+  channel: "latest" | "beta" = "latest",
+  dir = AGENT_RELEASES_DIR,
+): string | undefined {
+  if (!dir) return undefined;
+  if (channel === "beta" && !fs.existsSync(path.join(dir, "beta"))) {
+    return hostedLatestAgentVersion("latest", dir);
+  }
+  try {
+    const tag = fs.readFileSync(path.join(dir, channel), "utf8").trim();
+    return isReleaseTag(tag) ? tag : undefined;
+  } catch {
+    return undefined;
+  }
+}
+
+/** A tag safe to use as a path segment. */
+export function isReleaseTag(tag: string): boolean {
+  return /^v?\d[\w.\-+]*$/.test(tag);
+}
+
+/**
+ * Fetches the latest release tag, at most one request at a time.
+ *
+ * A server that hosts releases offers what it hosts: those are the ones its
+ * machines can actually install, and such a server is often one that cannot
+ * reach GitHub at all.
+ */
 export async function refreshLatestAgentVersion(): Promise<void> {
+  if (AGENT_RELEASES_DIR) {
+    latestVersion = hostedLatestAgentVersion();
+    return;
+  }
   if (inFlight) return inFlight;
 
   inFlight = (async () => {
@@ -9,6 +9,7 @@ import {
 } from "./agentRegistry";
 import { authMiddleware } from "./auth";
 import { API_PREFIX, corsOrigins } from "./config";
+import { agentReleaseRoutes } from "./routes/agentReleaseRoutes";
 import { agentRoutes } from "./routes/agentRoutes";
 import { authKeyRoutes } from "./routes/authKeyRoutes";
 import { deviceRoutes } from "./routes/deviceRoutes";
@@ -59,6 +60,8 @@ export function createApp(
   const api = Router();
 
   api.use(publicRoutes());
+  // Authenticated by device key, not by session.
+  api.use(agentReleaseRoutes());
 
   api.use(authMiddleware);
 
@@ -24,6 +24,11 @@ export const CORS_ORIGIN = process.env.CORS_ORIGIN || "";
 // what a direct/self-hosted setup needs.
 export const PUBLIC_HOST = process.env.SPECTRE_PUBLIC_HOST || "";
 
+// A directory of agent releases this server hands out to its own machines,
+// for networks that cannot reach GitHub: <dir>/<tag>/<asset> for each
+// release, and <dir>/latest holding the current tag. Unset, it hosts none.
+export const AGENT_RELEASES_DIR = process.env.SPECTRE_AGENT_RELEASES_DIR || "";
+
 const MIN_PASSWORD_LENGTH = 12;
 const WEAK_PASSWORDS = new Set(["changeme", "change-me", "password", "admin", "spectre", "letmein", "secret"]);
 
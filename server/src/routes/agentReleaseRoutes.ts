@@ -0,0 +1,60 @@
+import { Router, type NextFunction, type Request, type Response } from "express";
+import path from "path";
+import { hostedLatestAgentVersion, isReleaseTag } from "../agentRelease";
+import { AGENT_RELEASES_DIR } from "../config";
+import { findDeviceByKey, isInitialized as isDeviceStoreInitialized } from "../deviceStore";
+import { agentCredential } from "../websockets/agentSocket";
+
+const ASSET_NAME = /^[\w][\w.\-]*$/;
+
+/**
+ * Agent releases served from SPECTRE_AGENT_RELEASES_DIR, for machines that
+ * cannot reach GitHub. Laid out the way the agent expects of any mirror:
+ *
+ *   GET /agent-releases/latest          {"tag_name": "v1.2.3"}
+ *   GET /agent-releases/beta            the same for the beta channel
+ *   GET /agent-releases/:tag/:asset     the asset, SHA256SUMS and its signature included
+ *
+ * Mounted before authMiddleware: the caller is an agent, which has a device
+ * key rather than an admin session. Nothing here is trusted by the agent —
+ * it verifies every release against the signing key built into it — so the
+ * key check only keeps the downloads to enrolled machines.
+ */
+export function agentReleaseRoutes(): Router {
+  const router = Router();
+
+  router.use("/agent-releases", requireDeviceKey);
+
+  router.get("/agent-releases/:channel(latest|beta)", (req: Request, res: Response) => {
+    const tag = hostedLatestAgentVersion(req.params.channel as "latest" | "beta");
+    if (!tag) {
+      return res.status(404).json({ error: "this server hosts no agent releases" });
+    }
+    res.json({ tag_name: tag });
+  });
+
+  router.get("/agent-releases/:tag/:asset", (req: Request, res: Response) => {
+    const { tag, asset } = req.params;
+    if (!AGENT_RELEASES_DIR || !isReleaseTag(tag) || !ASSET_NAME.test(asset)) {
+      return res.status(404).json({ error: "not found" });
+    }
+    // Both segments are validated above, and sendFile's root refuses
+    // anything that resolves outside the directory regardless.
+    res.sendFile(path.join(tag, asset), { root: path.resolve(AGENT_RELEASES_DIR), dotfiles: "deny" }, (err) => {
+      if (err && !res.headersSent) {
+        res.status(404).json({ error: "not found" });
+      }
+    });
+  });
+
+  return router;
+}
+
+function requireDeviceKey(req: Request, res: Response, next: NextFunction) {
+  const credential = agentCredential(req);
+  if (!isDeviceStoreInitialized() || !credential || !findDeviceByKey(credential)) {
+    res.status(401).json({ error: "unauthorized" });
+    return;
+  }
+  next();
+}
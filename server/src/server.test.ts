@@ -1,5 +1,8 @@
+import fs from "fs";
+import os from "os";
+import path from "path";
 import request from "supertest";
-import { beforeEach, describe, expect, it, vi } from "vitest";
+import { afterEach, beforeEach, describe, expect, it, vi } from "vitest";
 import { type AgentRecord, type ControlMessage } from "./types";
 
 // config.ts reads the environment when it is first imported, so every suite
@@ -228,3 +231,62 @@ describe("CORS", () => {
     expect(res.headers["access-control-allow-origin"]).toBeUndefined();
   });
 });
+
+describe("agent releases", () => {
+  const password = "correct-horse-battery-staple";
+  let dataDir: string;
+  let releasesDir: string;
+
+  beforeEach(() => {
+    dataDir = fs.mkdtempSync(path.join(os.tmpdir(), "spectre-store-"));
+    releasesDir = fs.mkdtempSync(path.join(os.tmpdir(), "spectre-releases-"));
+    fs.mkdirSync(path.join(releasesDir, "v1.5.0"));
+    fs.writeFileSync(path.join(releasesDir, "v1.5.0", "SHA256SUMS"), "abc  spectre-agent-linux-amd64.tar.gz\n");
+    fs.writeFileSync(path.join(releasesDir, "latest"), "v1.5.0\n");
+  });
+
+  afterEach(async () => {
+    (await import("./deviceStore")).resetStoreForTest();
+    fs.rmSync(dataDir, { recursive: true, force: true });
+    fs.rmSync(releasesDir, { recursive: true, force: true });
+  });
+
+  async function releaseApp() {
+    const { createApp } = await loadApp({ ADMIN_PASSWORD: password, SPECTRE_AGENT_RELEASES_DIR: releasesDir });
+    const store = await import("./deviceStore");
+    store.initDeviceStore(dataDir);
+    const enrolled = store.redeemAuthKey(store.createAuthKey().key);
+    return { app: createApp(agentDeps()), deviceKey: enrolled!.deviceKey };
+  }
+
+  it("serves the hosted releases to an enrolled machine", async () => {
+    const { app, deviceKey } = await releaseApp();
+    const auth = { Authorization: `Bearer ${deviceKey}` };
+
+    const latest = await request(app).get("/api/agent-releases/latest").set(auth);
+    expect(latest.status).toBe(200);
+    expect(latest.body).toEqual({ tag_name: "v1.5.0" });
+
+    const sums = await request(app).get("/api/agent-releases/v1.5.0/SHA256SUMS").set(auth);
+    expect(sums.status).toBe(200);
+    expect(sums.text).toContain("spectre-agent-linux-amd64.tar.gz");
+
+    expect((await request(app).get("/api/agent-releases/v1.5.0/missing.tar.gz").set(auth)).status).toBe(404);
+  });
+
+  it("refuses anyone without a device key", async () => {
+    const { app } = await releaseApp();
+    expect((await request(app).get("/api/agent-releases/latest")).status).toBe(401);
+    expect(
+      (await request(app).get("/api/agent-releases/v1.5.0/SHA256SUMS").set("Authorization", "Bearer dk_made-up")).status,
+    ).toBe(401);
+  });
+
+  it("never serves anything outside the release directory", async () => {
+    const { app, deviceKey } = await releaseApp();
+    const res = await request(app)
+      .get("/api/agent-releases/v1.5.0/..%2F..%2Fetc%2Fpasswd")
+      .set("Authorization", `Bearer ${deviceKey}`);
+    expect(res.status).toBe(404);
+  });
+});
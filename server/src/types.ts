@@ -5,6 +5,8 @@ export interface AgentFingerprint {
   machineId?: string;
   macAddresses: string[];
   nics: string[];
+  /** From the provisioning file the machine was enrolled with, if any. */
+  labels?: Record<string, string>;
 }
 
 export interface DockerContainer {
@@ -89,16 +91,29 @@ export interface SessionInfo {
   managed: boolean;
   /** True when the agent process currently holds a PTY for it. */
   live: boolean;
+  /** The last output chunk the agent numbered for it; see "replay". */
+  seq?: number;
 }
 
 /** Server to agent. */
 export type ControlMessage =
-  | { type: "hello" }
+  /**
+   * The handshake reply. To an agent that negotiates, it carries the protocol
+   * version settled on and the features to switch on; anything else the agent
+   * offered stays off for the connection.
+   */
+  | { type: "hello"; protocolVersion?: number; features?: string[] }
   /** Handed to an agent that connected with an auth key; carries its device key. */
   | { type: "enrolled"; deviceKey: string }
   | { type: "keystroke"; data: string; sessionId?: string }
   /** Asks the agent to enumerate every tmux session on its host. */
   | { type: "listSessions" }
+  /** Asks for a session's output after `seq`, the last chunk the server holds. */
+  | { type: "replay"; sessionId: string; seq: number }
+  /** Confirms a session's output up to `seq` arrived, so the agent can let it go. */
+  | { type: "ackOutput"; sessionId: string; seq: number }
+  /** Confirms a queued agent event arrived, so the agent can let it go. */
+  | { type: "ackEvent"; eventId: string }
   /** Opens a new session; the server mints the `spectre-<uuid>` name. */
   | { type: "createSession"; sessionId: string; cols?: number; rows?: number }
   /** Attaches to an existing session, creating it if it has since vanished. */
@@ -125,20 +140,44 @@ export type ControlMessage =
 
 /** Agent to server. */
 export type AgentMessage =
-  | { type: "hello"; agentId: string; fingerprint: AgentFingerprint; agentVersion?: string }
-  | { type: "output"; data: string; sessionId?: string }
+  /**
+   * `protocolVersion` and `capabilities` are absent from agents that predate
+   * negotiation; they speak protocol 1 with every feature they know of.
+   */
+  | {
+      type: "hello";
+      agentId: string;
+      fingerprint: AgentFingerprint;
+      agentVersion?: string;
+      protocolVersion?: number;
+      capabilities?: string[];
+    }
+  /** `seq` numbers a session's output from 1; redraws sent on attach have none. */
+  | { type: "output"; data: string; sessionId?: string; seq?: number }
+  /** Precedes a replay that could not go back as far as asked: output before `seq` is gone. */
+  | { type: "outputGap"; sessionId: string; seq: number }
   | { type: "heartbeat" }
   | { type: "sessions"; sessions?: SessionInfo[]; tmuxAvailable?: boolean }
   | { type: "sessionOpened"; sessionId: string }
-  | { type: "sessionClosed"; sessionId: string }
+  | { type: "sessionClosed"; sessionId: string; eventId?: string }
   /** The PTY ended (shell exited or tmux detached); the session may still exist. */
-  | { type: "sessionExited"; sessionId: string }
+  | { type: "sessionExited"; sessionId: string; eventId?: string }
   | { type: "dockerInfo"; containers?: DockerContainer[]; error?: string }
   | { type: "systemInfo"; systemInfo?: SystemInfo; error?: string }
   | { type: "networkInfo"; networkInfo?: NetworkInfo; error?: string }
   /**
-   * Progress of a self-update. "installed" is followed by the agent restarting,
-   * so the confirmation that it worked is the machine reconnecting on the new
-   * version rather than any further message on this socket.
+   * Progress of a self-update. "installed" is followed by the agent restarting;
+   * the new binary's first handshake then reports "completed" with its own
+   * version, or "mismatch" when some other version came up. "deferred" is an
+   * automatic update the machine's own policy is holding back, for `reason`.
+   * Automatic updates carry no requestId.
    */
-  | { type: "updateStatus"; state: "started" | "installed" | "failed"; version?: string; error?: string };
+  | {
+      type: "updateStatus";
+      state: "started" | "installed" | "completed" | "mismatch" | "failed" | "rolledBack" | "deferred";
+      version?: string;
+      error?: string;
+      reason?: string;
+      requestId?: string;
+      eventId?: string;
+    };
@@ -10,9 +10,9 @@ import { inboundAddress } from "../utils/net";
  *
  * Credentials are never accepted in the query string: URLs end up in access
  * logs, proxy logs and Referer headers, and a device key is a permanent shell
- * credential.
+ * credential. Also how the release routes authenticate an agent's downloads.
  */
-function agentCredential(req: IncomingMessage): string | null {
+export function agentCredential(req: IncomingMessage): string | null {
   const header = req.headers.authorization;
   if (!header?.startsWith("Bearer ")) return null;
   const value = header.slice(7).trim();
@@ -71,6 +71,17 @@ export function broadcastUpdateFailure(agentId: string, error: string) {
   }
 }
 
+/**
+ * Tells every open dashboard that a machine's new binary is up: the update's
+ * end-to-end confirmation, from the new version itself.
+ */
+export function broadcastUpdateCompleted(agentId: string, version: string) {
+  const raw = JSON.stringify({ type: "updateCompleted", agentId, version });
+  for (const socket of agentEventClients) {
+    if (socket.readyState === WebSocket.OPEN) socket.send(raw);
+  }
+}
+
 /**
  * Machines waiting for approval, pushed to every open dashboard.
  *
@@ -1,6 +1,6 @@
 import { type Server as HttpServer } from "http";
 import { WebSocketServer } from "ws";
-import { onAgentOutput, onAgentStatusChange, onAgentUpdateFailure } from "../agentRegistry";
+import { onAgentOutput, onAgentStatusChange, onAgentUpdateCompleted, onAgentUpdateFailure } from "../agentRegistry";
 import { onPendingDevicesChange } from "../deviceStore";
 import { handleAgentEventStream } from "./agentEvents";
 import { handleInboundAgents } from "./agentSocket";
@@ -8,6 +8,7 @@ import {
   broadcastAgentEvent,
   broadcastPendingDevices,
   broadcastToUi,
+  broadcastUpdateCompleted,
   broadcastUpdateFailure,
   MAX_UI_MESSAGE_BYTES,
 } from "./clients";
@@ -30,6 +31,7 @@ export function attachWebSockets(httpServer: HttpServer) {
   onAgentOutput((agentId, payload) => broadcastToUi(agentId, payload));
 
   onAgentUpdateFailure((agentId, error) => broadcastUpdateFailure(agentId, error));
+  onAgentUpdateCompleted((agentId, version) => broadcastUpdateCompleted(agentId, version));
 
   onPendingDevicesChange(() => broadcastPendingDevices());
 
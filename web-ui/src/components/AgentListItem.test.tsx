@@ -121,5 +121,15 @@ describe("AgentListItem", () => {
       expect(await screen.findByText("box")).toBeInTheDocument();
       expect(screen.getByText("Last connected: never")).toBeInTheDocument();
     });
+
+    it("shows the labels a machine was provisioned with", async () => {
+      renderAgent({
+        status: "connected",
+        fingerprint: { ...base.fingerprint, labels: { env: "prod", role: "web" } },
+      });
+
+      expect(await screen.findByText("env=prod")).toBeInTheDocument();
+      expect(screen.getByText("role=web")).toBeInTheDocument();
+    });
   });
 });
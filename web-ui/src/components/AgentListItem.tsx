@@ -97,6 +97,15 @@ export function AgentListItem({ agent, removing, updating, updateError, onOpen,
             )}
           </div>
           <p className="text-sm text-muted-foreground">{summarize(agent)}</p>
+          {agent.fingerprint?.labels && Object.keys(agent.fingerprint.labels).length > 0 && (
+            <div className="mt-1 flex flex-wrap gap-1">
+              {Object.entries(agent.fingerprint.labels).map(([key, value]) => (
+                <Badge key={key} variant="outline" className="text-[11px] font-normal">
+                  {key}={value}
+                </Badge>
+              ))}
+            </div>
+          )}
         </div>
 
         <div className="flex shrink-0 flex-col items-end gap-2 text-right text-xs text-muted-foreground">
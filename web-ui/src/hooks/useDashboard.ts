@@ -106,6 +106,22 @@ export function useDashboard(apiBase: string) {
           });
           setUpdateErrors((prev) => ({ ...prev, [agentId]: error }));
         },
+        // The new binary's own word that it is running, which can arrive
+        // before the list shows its version.
+        onUpdateCompleted: (agentId) => {
+          setUpdating((prev) => {
+            if (!(agentId in prev)) return prev;
+            const next = { ...prev };
+            delete next[agentId];
+            return next;
+          });
+          setUpdateErrors((prev) => {
+            if (!(agentId in prev)) return prev;
+            const next = { ...prev };
+            delete next[agentId];
+            return next;
+          });
+        },
       },
     );
     return () => {
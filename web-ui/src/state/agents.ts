@@ -16,6 +16,8 @@ export type AgentFingerprint = {
   machineId?: string;
   macAddresses: string[];
   nics: string[];
+  /** From the provisioning file the machine was enrolled with, if any. */
+  labels?: Record<string, string>;
 };
 
 export type DockerContainer = {
@@ -161,7 +163,9 @@ export type AgentEvent =
   | { type: "agent"; agent: Agent }
   | { type: "pending"; pending: PendingDevice[] }
   /** A machine could not update itself; it will never report a new version. */
-  | { type: "updateFailed"; agentId: string; error: string };
+  | { type: "updateFailed"; agentId: string; error: string }
+  /** A machine's new binary came up after an update and said so. */
+  | { type: "updateCompleted"; agentId: string; version: string };
 
 export type AgentEventHandlers = {
   onOpen?: () => void;
@@ -171,6 +175,8 @@ export type AgentEventHandlers = {
   onPending?: (pending: PendingDevice[]) => void;
   /** A machine reported that its update failed. */
   onUpdateFailed?: (agentId: string, error: string) => void;
+  /** A machine reported, from its new version, that its update worked. */
+  onUpdateCompleted?: (agentId: string, version: string) => void;
 };
 
 export type AgentEventSubscription = { close: () => void };
@@ -214,6 +220,8 @@ export function subscribeToAgentEvents(
             handlers.onPending?.(payload.pending ?? []);
           } else if (payload.type === "updateFailed") {
             handlers.onUpdateFailed?.(payload.agentId, payload.error);
+          } else if (payload.type === "updateCompleted") {
+            handlers.onUpdateCompleted?.(payload.agentId, payload.version);
           }
         } catch {
           // ignore malformed events